@@ -19,7 +19,9 @@ package asm
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/db47h/ngaro/vm"
 )
@@ -75,6 +77,74 @@ func Assemble(name string, r io.Reader) (img []vm.Cell, err error) {
 	return img, nil
 }
 
+// AssembleFiles compiles the given assembly files as if they were a single
+// source made of the concatenation of all files, in order. Labels and constants
+// defined in a file can be used in subsequent files, and error positions refer
+// to the original file names.
+//
+// Files are read and scanned concurrently, then compiled sequentially, so the
+// output is the same as if the files had been assembled one after the other.
+//
+// The returned error, if not nil, is either an I/O error or an ErrAsm value
+// that will contain up to 10 entries. An error is also returned if no file names
+// are given.
+func AssembleFiles(names ...string) (img []vm.Cell, err error) {
+	p := newParser()
+	img, err = p.ParseFiles(names...)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// DebugInfo holds debugging information generated by AssembleDebug.
+type DebugInfo struct {
+	Regions []vm.Region    // memory regions defined with the .region directive
+	Labels  map[string]int // global label addresses
+}
+
+// AssembleDebug works like Assemble and also returns debugging information
+// about the compiled image. The returned regions can be passed as-is to the
+// vm.Regions option:
+//
+//	img, dbg, err := asm.AssembleDebug("kernel.s", r)
+//	// ...
+//	i, err := vm.New(img, "kernel.img", vm.Regions(dbg.Regions...))
+//
+func AssembleDebug(name string, r io.Reader) (img []vm.Cell, dbg *DebugInfo, err error) {
+	p := newParser()
+	img, err = p.Parse(name, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dbg = &DebugInfo{Regions: p.regions, Labels: make(map[string]int)}
+	for n, l := range p.labels {
+		if !strings.Contains(n, localSep) {
+			dbg.Labels[n] = l.address
+		}
+	}
+	return img, dbg, nil
+}
+
+// Symbols returns a symbol table built from the global labels in d. The
+// returned table can be used to symbolize the VM call stack:
+//
+//	frames := i.CallStack(dbg.Symbols())
+//
+func (d *DebugInfo) Symbols() *vm.SymbolTable {
+	names := make([]string, 0, len(d.Labels))
+	for n := range d.Labels {
+		names = append(names, n)
+	}
+	// make the result deterministic when several labels share an address
+	sort.Strings(names)
+	t := &vm.SymbolTable{}
+	for _, n := range names {
+		t.Add(vm.Cell(d.Labels[n]), n)
+	}
+	return t
+}
+
 // Disassemble writes a disassembly of the cells in the given slice at position
 // pc to the specified io.Writer and returns the position of the next valid
 // opcode and any write error.
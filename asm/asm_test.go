@@ -17,11 +17,16 @@
 package asm_test
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
 )
 
 // check some errors. We're not checking the whole messages, rather that they point at
@@ -133,3 +138,165 @@ testStrings:6:13: string can only be used after a .dat directive`
 		t.Fatalf("\nExpected:\n%s\nGot:\n%s", exp, s)
 	}
 }
+
+func TestAssembleDebug_regions(t *testing.T) {
+	img, dbg, err := asm.AssembleDebug("testRegions", strings.NewReader(`
+		.equ HEAP 8
+		.region kernel 0 HEAP
+		.region heap HEAP 16
+		:start 1 2 + jump start
+		.org 15 .dat 42
+		`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := dbg.Labels["start"]; l != 0 {
+		t.Errorf("Expected label start at 0, got %d", l)
+	}
+	i, err := vm.New(img, "", vm.Regions(dbg.Regions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := i.Region("heap")
+	if !ok || r.Start != 8 || r.End != 16 {
+		t.Fatalf("Bad heap region: %v, %v", r, ok)
+	}
+	if m, err := i.RegionMem("heap"); err != nil || len(m) != 8 || m[7] != 42 {
+		t.Fatalf("Bad heap region memory: %v, %v", m, err)
+	}
+	if _, ok = i.Region("buffers"); ok {
+		t.Fatal("Unexpected region buffers")
+	}
+	if _, err = i.RegionMem("buffers"); err == nil {
+		t.Fatal("Unexpected region buffers memory")
+	}
+	if err = i.ReloadImage(img[:10], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.RegionMem("heap"); err == nil {
+		t.Fatal("Expected error for region out of memory bounds")
+	}
+	if _, err = vm.New(img, "", vm.Regions(vm.Region{Name: "x", Start: 0, End: 17})); err == nil {
+		t.Fatal("Expected error for out of bounds region")
+	}
+
+	_, _, err = asm.AssembleDebug("testRegions", strings.NewReader(`
+		.region a 4 2
+		.region b 0 foo
+		.region c 0 1
+		.region c 0 1
+		`))
+	exp := `testRegions:2:11: Invalid bounds for region a
+testRegions:3:15: Invalid region bound: foo
+testRegions:5:11: Region c already defined`
+	if err == nil || err.Error() != exp {
+		t.Fatalf("\nExpected:\n%s\nGot:\n%v", exp, err)
+	}
+}
+
+func TestAssembleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngaro-asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srcs := []string{
+		".equ N 5\n:start N\n:0 1- dup 0; jump 0+\n",
+		":0 jump 0-\n( comment\n)\n",
+		":next .dat \"abc\" jump start\n",
+	}
+	var names []string
+	for n, src := range srcs {
+		name := filepath.Join(dir, fmt.Sprintf("f%d.s", n))
+		if err = ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	img, err := asm.AssembleFiles(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := asm.Assemble("all", strings.NewReader(strings.Join(srcs, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(img) != fmt.Sprint(exp) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v", exp, img)
+	}
+
+	if err = ioutil.WriteFile(names[1], []byte("\n:0 nowhere"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = asm.AssembleFiles(names...)
+	if err == nil {
+		t.Fatal("Unexpected nil error")
+	}
+	if s, e := err.Error(), names[1]+":2:4: Undefined label nowhere"; s != e {
+		t.Fatalf("\nExpected:\n%s\nGot:\n%s", e, s)
+	}
+
+	if _, err = asm.AssembleFiles(); err == nil {
+		t.Fatal("Unexpected nil error with no files")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "ngaro-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// build a program larger than a chunk, with forward references patched on
+	// disk, and the equivalent assembly source.
+	const n = 20000
+	var src bytes.Buffer
+	w, err := asm.NewWriter(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Op(vm.OpJump)
+	w.Ref("end")
+	src.WriteString("jump end\n")
+	w.Label("incr")
+	w.Emit(vm.OpInc, vm.OpReturn)
+	src.WriteString(":incr 1+ ;\n")
+	for k := 0; k < n; k++ {
+		w.Call("incr")
+		src.WriteString("incr\n")
+	}
+	w.Label("end")
+	w.Lit(0)
+	w.Op(vm.OpLit)
+	w.Ref("incr")
+	src.WriteString(":end 0 lit incr\n")
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := asm.Assemble("writer", &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := vm.Load(f.Name(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img) != len(exp) {
+		t.Fatalf("Expected %d cells, got %d", len(exp), len(img))
+	}
+	for k := range img {
+		if img[k] != exp[k] {
+			t.Fatalf("@%d: expected %d, got %d", k, exp[k], img[k])
+		}
+	}
+
+	w, _ = asm.NewWriter(f, 32)
+	w.Ref("foo")
+	w.Ref("bar")
+	if err = w.Close(); err == nil || err.Error() != "undefined label(s): bar, foo" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
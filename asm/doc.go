@@ -226,4 +226,16 @@
 //	cmp 0		( Wrong: would compile as ".dat -1 lit 0" )
 //	cmp .dat 0	( Correct: will compile as ".dat -1 0" )
 //
+//	.region <identifier> <start> <end>
+//
+// defines a named memory region covering addresses start (inclusive) to end
+// (exclusive). Bounds must be integer values, named constants or character
+// literals. Regions do not affect compilation; they are recorded in the debug
+// information returned by AssembleDebug and can be passed to the VM with the
+// vm.Regions option, then retrieved with Instance.Region. For example:
+//
+//	.equ HEAP 4096
+//	.region kernel 0 HEAP
+//	.region heap HEAP 8192
+//
 package asm
@@ -19,12 +19,16 @@ package asm
 import (
 	"fmt"
 	"io"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"text/scanner"
 	"unicode"
 
 	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
 )
 
 const localSep = "·"
@@ -61,11 +65,69 @@ type label struct {
 	uses      []labelSite // where it's used
 }
 
+// token is a raw token read by the scanner, along with any scanner errors that
+// occurred while reading it.
+type token struct {
+	tok  rune
+	text string
+	pos  scanner.Position
+	errs ErrAsm
+}
+
+// lexer wraps a text/scanner.Scanner configured for our assembly syntax.
+type lexer struct {
+	s    scanner.Scanner
+	errs ErrAsm
+}
+
+func newLexer(name string, r io.Reader) *lexer {
+	l := new(lexer)
+	l.s.Init(r)
+	l.s.Error = func(s *scanner.Scanner, msg string) {
+		pos := s.Position
+		if !pos.IsValid() {
+			pos = s.Pos()
+		}
+		l.errs = append(l.errs, parseError(pos, msg))
+	}
+	l.s.IsIdentRune = isIdentRune
+	l.s.Mode = scanner.ScanIdents
+	l.s.Filename = name
+	l.s.Whitespace &^= 1 << '\n'
+	return l
+}
+
+// next returns the next token.
+func (l *lexer) next() token {
+	t := token{tok: l.s.Scan()}
+	t.text = l.s.TokenText()
+	t.pos = l.s.Position
+	if !t.pos.IsValid() {
+		t.pos = l.s.Pos()
+	}
+	t.errs, l.errs = l.errs, nil
+	return t
+}
+
+// all returns all tokens up to and including EOF.
+func (l *lexer) all() []token {
+	var ts []token
+	for {
+		t := l.next()
+		ts = append(ts, t)
+		if t.tok == scanner.EOF {
+			return ts
+		}
+	}
+}
+
 // parser provides the parsing and compiling.
 type parser struct {
 	i       []vm.Cell
 	pc      int
-	s       scanner.Scanner
+	lex     func() token // token source
+	pos     scanner.Position
+	text    string
 	labels  map[string]*label
 	locCtr  map[int]int
 	consts  map[string]labelSite
@@ -73,6 +135,7 @@ type parser struct {
 	cstPos  scanner.Position
 	errs    ErrAsm
 	opcodes map[string]vm.Cell
+	regions []vm.Region
 }
 
 func newParser() *parser {
@@ -100,13 +163,17 @@ func parseError(pos scanner.Position, msg string) struct {
 	}{pos, msg}
 }
 
-// Error appends an error to the internal error list at the current scanner pos.
+// Error appends an error to the internal error list at the current token pos.
 func (p *parser) error(msg string) {
-	pos := p.s.Position
-	if !pos.IsValid() {
-		pos = p.s.Pos()
-	}
-	p.errs = append(p.errs, parseError(pos, msg))
+	p.errs = append(p.errs, parseError(p.pos, msg))
+}
+
+// next reads the next raw token from the token source.
+func (p *parser) next() rune {
+	t := p.lex()
+	p.pos, p.text = t.pos, t.text
+	p.errs = append(p.errs, t.errs...)
+	return t.tok
 }
 
 // abort returns true if the parser should abort due to too many errors.
@@ -136,7 +203,7 @@ func (p *parser) makeLabelRef(name string) {
 		look    byte
 		n       int
 		lbl     *label
-		pos     = p.s.Position
+		pos     = p.pos
 	)
 
 	// demangle name and check if local
@@ -199,8 +266,8 @@ func isIdentRune(ch rune, i int) bool {
 //
 // This function also converts chars to ints.
 func (p *parser) scan() (tok rune, s string, v int) {
-	tok = p.s.Scan()
-	s = p.s.TokenText()
+	tok = p.next()
+	s = p.text
 
 	if tok == scanner.EOF {
 		return tok, "", 0
@@ -230,13 +297,13 @@ func (p *parser) scan() (tok rune, s string, v int) {
 	// check string
 	if len(s) >= 2 && s[0] == '"' {
 		for s[len(s)-1] != '"' {
-			tok = p.s.Scan()
+			tok = p.next()
 			if tok != scanner.Ident {
 				p.error("Unterminated string " + s)
 				s += "\""
 				break
 			}
-			s += " " + p.s.TokenText()
+			s += " " + p.text
 		}
 		t, err := strconv.Unquote(s)
 		if err != nil {
@@ -253,10 +320,91 @@ func (p *parser) scan() (tok rune, s string, v int) {
 	return tok, s, v
 }
 
+// region parses the arguments of a .region directive.
+func (p *parser) region() {
+	t, name, _ := p.scan()
+	if t != scanner.Ident {
+		p.error("Invalid region identifier: " + p.text)
+		return
+	}
+	pos := p.pos
+	var bounds [2]int
+	for n := range bounds {
+		t, s, v := p.scan()
+		if t != scanner.Int {
+			p.error("Invalid region bound: " + s)
+			return
+		}
+		bounds[n] = v
+	}
+	if bounds[0] < 0 || bounds[1] < bounds[0] {
+		p.errs = append(p.errs, parseError(pos, "Invalid bounds for region "+name))
+		return
+	}
+	for _, r := range p.regions {
+		if r.Name == name {
+			p.errs = append(p.errs, parseError(pos, "Region "+name+" already defined"))
+			return
+		}
+	}
+	p.regions = append(p.regions, vm.Region{Name: name, Start: bounds[0], End: bounds[1]})
+}
+
 // Parse does the parsing and compiling. Returns the compiled VM memory image as
 // a Cell slice and any error that occurred. If not nil, the returned error can
 // safely be cast to an ErrAsm value that will contain up to 10 entries.
 func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
+	p.lex = newLexer(name, r).next
+	return p.parse()
+}
+
+// ParseFiles works like Parse on the concatenation of the given files. Files are
+// read and scanned concurrently, by at most GOMAXPROCS goroutines, then compiled
+// in order.
+func (p *parser) ParseFiles(names ...string) ([]vm.Cell, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no input files")
+	}
+	ts := make([][]token, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for n, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n int, name string) {
+			defer func() { <-sem; wg.Done() }()
+			f, err := os.Open(name)
+			if err != nil {
+				errs[n] = err
+				return
+			}
+			defer f.Close()
+			ts[n] = newLexer(name, f).all()
+		}(n, name)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	var n, t int
+	p.lex = func() token {
+		// skip EOF tokens, except for the last file
+		for ts[n][t].tok == scanner.EOF && n < len(ts)-1 {
+			n, t = n+1, 0
+		}
+		tok := ts[n][t]
+		if t < len(ts[n])-1 {
+			t++
+		}
+		return tok
+	}
+	return p.parse()
+}
+
+func (p *parser) parse() ([]vm.Cell, error) {
 	// state:
 	// 0: accept anything
 	// 1: need integer, const or label argument (lit, loop and jumps)
@@ -266,19 +414,6 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 	// 5: accept integer, const, label or string argument
 	var state int
 
-	p.s.Init(r)
-	p.s.Error = func(s *scanner.Scanner, msg string) {
-		pos := s.Position
-		if !pos.IsValid() {
-			pos = s.Pos()
-		}
-		p.errs = append(p.errs, parseError(pos, msg))
-	}
-	p.s.IsIdentRune = isIdentRune
-	p.s.Mode = scanner.ScanIdents
-	p.s.Filename = name
-	p.s.Whitespace &^= 1 << '\n'
-
 	for tok, s, v := p.scan(); !p.abort() && tok != scanner.EOF; tok, s, v = p.scan() {
 	s: // now we only have ints or idents
 		switch tok {
@@ -342,11 +477,11 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 							p.errs = append(p.errs, parseError(l.pos, "Previous definition of "+n))
 						}
 						l.address = p.pc
-						l.pos = p.s.Position
+						l.pos = p.pos
 					} else {
 						// new label
 						p.labels[n] = &label{
-							labelSite{p.s.Position, p.pc},
+							labelSite{p.pos, p.pc},
 							nil,
 						}
 					}
@@ -374,7 +509,7 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 				case ".equ", ".opcode":
 					t, ts, _ := p.scan()
 					if t != scanner.Ident {
-						p.error("Invalid constant or opcode identifier: " + p.s.TokenText())
+						p.error("Invalid constant or opcode identifier: " + p.text)
 						// just eat up next token and keep parsing
 						p.scan()
 						break s
@@ -388,11 +523,13 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 							p.scan()
 							break s
 						}
-						p.cstPos = p.s.Position
+						p.cstPos = p.pos
 						state = 3
 					} else {
 						state = 4
 					}
+				case ".region":
+					p.region()
 				default:
 					p.error("Unknown dot directive: " + s)
 				}
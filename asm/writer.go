@@ -0,0 +1,204 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// chunkSize is the number of cells buffered by a Writer before they are
+// written out.
+const chunkSize = 16384
+
+// Writer assembles a memory image incrementally and writes it to an
+// io.WriteSeeker in chunks, in the same format as vm.Save. It is meant for code
+// generators producing very large images: only the current chunk, label
+// addresses and unresolved forward references are kept in memory. Forward
+// references to cells that have already been written out are patched in place.
+//
+// Writer methods return the first error encountered, and become no-ops after an
+// error.
+type Writer struct {
+	w       io.WriteSeeker
+	size    int              // bytes per cell
+	buf     []vm.Cell        // current chunk
+	base    int              // address of buf[0]
+	labels  map[string]int   // defined labels
+	pending map[string][]int // unresolved forward references
+	err     error
+}
+
+// NewWriter returns a new Writer writing cells of the given size in bits to w.
+// Supported cell sizes are 32 and 64 bits. A value of 0 means vm.CellBits.
+func NewWriter(w io.WriteSeeker, cellBits int) (*Writer, error) {
+	if cellBits == 0 {
+		cellBits = vm.CellBits
+	}
+	if cellBits != 32 && cellBits != 64 {
+		return nil, errors.Errorf("%d bits cells not supported", cellBits)
+	}
+	return &Writer{
+		w:       w,
+		size:    cellBits / 8,
+		buf:     make([]vm.Cell, 0, chunkSize),
+		labels:  make(map[string]int),
+		pending: make(map[string][]int),
+	}, nil
+}
+
+// Pos returns the address of the next cell to be written.
+func (w *Writer) Pos() int {
+	return w.base + len(w.buf)
+}
+
+// Emit writes the given cells as-is.
+func (w *Writer) Emit(cells ...vm.Cell) error {
+	for _, c := range cells {
+		if w.err != nil {
+			return w.err
+		}
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+		w.buf = append(w.buf, c)
+	}
+	return w.err
+}
+
+// Lit writes a lit instruction with argument v.
+func (w *Writer) Lit(v vm.Cell) error {
+	return w.Emit(vm.OpLit, v)
+}
+
+// Op writes opcode op. If op is an instruction that takes a label argument
+// (lit, loop and jumps), use Ref to write the argument.
+func (w *Writer) Op(op vm.Cell) error {
+	return w.Emit(op)
+}
+
+// Label defines a label at the current address and resolves any pending
+// forward references to it.
+func (w *Writer) Label(name string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if _, ok := w.labels[name]; ok {
+		w.err = errors.Errorf("label %s already defined", name)
+		return w.err
+	}
+	addr := w.Pos()
+	w.labels[name] = addr
+	for _, u := range w.pending[name] {
+		w.patch(u, vm.Cell(addr))
+	}
+	delete(w.pending, name)
+	return w.err
+}
+
+// Ref writes the address of the given label. The label does not need to be
+// defined yet.
+func (w *Writer) Ref(name string) error {
+	if addr, ok := w.labels[name]; ok {
+		return w.Emit(vm.Cell(addr))
+	}
+	w.pending[name] = append(w.pending[name], w.Pos())
+	return w.Emit(0)
+}
+
+// Call writes an implicit call to the given label.
+func (w *Writer) Call(name string) error {
+	return w.Ref(name)
+}
+
+// Close writes any buffered cells and checks that all referenced labels have
+// been defined. It does not close the underlying io.WriteSeeker.
+func (w *Writer) Close() error {
+	w.flush()
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.pending) > 0 {
+		l := make([]string, 0, len(w.pending))
+		for n := range w.pending {
+			l = append(l, n)
+		}
+		sort.Strings(l)
+		w.err = errors.Errorf("undefined label(s): %s", strings.Join(l, ", "))
+	}
+	return w.err
+}
+
+// encode encodes cells into b.
+func (w *Writer) encode(b []byte, cells []vm.Cell) error {
+	for n, c := range cells {
+		if w.size == 4 {
+			if vm.Cell(int32(c)) != c {
+				return errors.Errorf("64 bits value %d at memory location %d too large", c, w.base+n)
+			}
+			binary.LittleEndian.PutUint32(b[n*4:], uint32(c))
+		} else {
+			binary.LittleEndian.PutUint64(b[n*8:], uint64(c))
+		}
+	}
+	return nil
+}
+
+// flush writes out the current chunk.
+func (w *Writer) flush() {
+	if w.err != nil || len(w.buf) == 0 {
+		return
+	}
+	b := make([]byte, len(w.buf)*w.size)
+	if w.err = w.encode(b, w.buf); w.err != nil {
+		return
+	}
+	if _, err := w.w.Write(b); err != nil {
+		w.err = errors.Wrap(err, "write failed")
+		return
+	}
+	w.base += len(w.buf)
+	w.buf = w.buf[:0]
+}
+
+// patch sets the cell at addr to v.
+func (w *Writer) patch(addr int, v vm.Cell) {
+	if addr >= w.base {
+		w.buf[addr-w.base] = v
+		return
+	}
+	b := make([]byte, w.size)
+	if w.err = w.encode(b, []vm.Cell{v}); w.err != nil {
+		return
+	}
+	if _, err := w.w.Seek(int64(addr*w.size), io.SeekStart); err != nil {
+		w.err = errors.Wrap(err, "seek failed")
+		return
+	}
+	if _, err := w.w.Write(b); err != nil {
+		w.err = errors.Wrap(err, "write failed")
+		return
+	}
+	if _, err := w.w.Seek(int64(w.base*w.size), io.SeekStart); err != nil {
+		w.err = errors.Wrap(err, "seek failed")
+	}
+}
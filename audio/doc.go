@@ -0,0 +1,44 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audio provides a vm.Audio backend that plays sounds on the host's
+// sound card.
+//
+// The backend is implemented with oto (https://github.com/ebitengine/oto) which
+// must be enabled with the oto build tag:
+//
+//	go get github.com/ebitengine/oto/v3
+//	go build -tags oto github.com/db47h/ngaro/cmd/retro
+//
+// Without this tag, New always fails with ErrNotSupported. Hosts should then
+// fall back to vm.NewBellAudio:
+//
+//	a, err := audio.New()
+//	if err != nil {
+//		a = vm.NewBellAudio(os.Stderr)
+//	}
+//	i, err := vm.New(mem, imageFile, vm.BindWaitHandler(11, vm.AudioHandler(a)))
+package audio
+
+import "github.com/pkg/errors"
+
+// SampleRate is the output sample rate in Hz. PCM buffers played at other rates
+// are resampled.
+const SampleRate = 44100
+
+// ErrNotSupported is returned by New when the package has been built without
+// audio support.
+var ErrNotSupported = errors.New("audio support not compiled in (build with -tags oto)")
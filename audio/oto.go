@@ -0,0 +1,115 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build oto
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/ebitengine/oto/v3"
+	"github.com/pkg/errors"
+)
+
+// amplitude of square waves
+const amplitude = 8192
+
+var (
+	ctxOnce sync.Once
+	ctx     *oto.Context
+	ctxErr  error
+)
+
+// otoAudio is a vm.Audio backend using oto.
+type otoAudio struct {
+	mu      sync.Mutex
+	players []*oto.Player // players must be kept alive until done
+}
+
+// New returns a new audio backend. All backends share the same audio context,
+// which is created on the first call to New.
+func New() (vm.Audio, error) {
+	ctxOnce.Do(func() {
+		var ready chan struct{}
+		ctx, ready, ctxErr = oto.NewContext(&oto.NewContextOptions{
+			SampleRate:   SampleRate,
+			ChannelCount: 1,
+			Format:       oto.FormatSignedInt16LE,
+		})
+		if ctxErr == nil {
+			<-ready
+		}
+	})
+	if ctxErr != nil {
+		return nil, errors.Wrap(ctxErr, "audio initialization failed")
+	}
+	return new(otoAudio), nil
+}
+
+func (a *otoAudio) Beep(freq int, d time.Duration) error {
+	n := int(int64(d) * SampleRate / int64(time.Second))
+	half := SampleRate / (2 * freq)
+	if half == 0 {
+		half = 1
+	}
+	s := make([]int16, n)
+	for k := range s {
+		if (k/half)&1 == 0 {
+			s[k] = amplitude
+		} else {
+			s[k] = -amplitude
+		}
+	}
+	return a.play(s)
+}
+
+func (a *otoAudio) Play(samples []int16, rate int) error {
+	if rate == SampleRate {
+		return a.play(samples)
+	}
+	// nearest neighbour resampling
+	s := make([]int16, int64(len(samples))*SampleRate/int64(rate))
+	for k := range s {
+		s[k] = samples[int64(k)*int64(rate)/SampleRate]
+	}
+	return a.play(s)
+}
+
+func (a *otoAudio) play(s []int16) error {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, s); err != nil {
+		return err
+	}
+	p := ctx.NewPlayer(&b)
+	p.Play()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	live := a.players[:0]
+	for _, q := range a.players {
+		if q.IsPlaying() {
+			live = append(live, q)
+		} else {
+			q.Close()
+		}
+	}
+	a.players = append(live, p)
+	return nil
+}
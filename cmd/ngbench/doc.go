@@ -0,0 +1,52 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The ngbench command runs a standard set of benchmark programs on the Ngaro VM
+// and compares the results against a baseline in order to catch performance
+// regressions before releases.
+//
+// Usage:
+//
+//	-baseline filename
+//		  baseline file (default "ngbench.json")
+//	-count n
+//		  run each benchmark n times and keep the best result (default 3)
+//	-ibits int
+//		  cell size in bits of the Retro memory image (default GOARCH bits)
+//	-image filename
+//		  Retro memory image used by the retro benchmarks (default "retroImage")
+//	-save
+//		  save the results as the new baseline
+//	-threshold percent
+//		  maximum allowed slowdown in percent (default 10)
+//	-time duration
+//		  minimum run time of each benchmark (default 500ms)
+//
+// Throughput is measured in millions of VM instructions per second (MIPS).
+// Benchmarks that need the Retro memory image are skipped if the image cannot
+// be loaded.
+//
+// With -save, the results are written to the baseline file. Otherwise, they are
+// compared against the baseline, if it exists, and ngbench exits with a
+// non-zero status if any benchmark is slower than its baseline by more than the
+// threshold:
+//
+//	ngbench -save		# on the reference version
+//	ngbench -threshold 5	# on the new version
+//
+// Baselines should only be compared on the same machine with the same Go
+// version, which are recorded in the baseline file.
+package main
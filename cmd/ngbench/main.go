@@ -0,0 +1,236 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// baseline is the format of baseline files.
+type baseline struct {
+	GoVersion string             `json:"go"`
+	GOARCH    string             `json:"goarch"`
+	CellBits  int                `json:"cellBits"`
+	MIPS      map[string]float64 `json:"mips"`
+}
+
+// benchmark is a benchmark program. setup returns a new instance ready to run.
+type benchmark struct {
+	name  string
+	retro bool
+	setup func(opts ...vm.Option) (*vm.Instance, error)
+}
+
+const fibLoop = `
+	35 push 0 1
+	jump 1+
+:0	push
+	dup push
+	+
+	pop swap
+:1	pop
+	loop 0-
+	swap
+	drop
+`
+
+const fibRecursive = `
+	25 fib
+	jump end
+.org 32
+:fib
+	dup 1 >jump 0+ ;
+:0	1- dup fib swap
+	1- fib
+	+ ;
+:end
+`
+
+var benchmarks = []benchmark{
+	{"asm/fib-loop", false, asmSetup(fibLoop)},
+	{"asm/fib-recursive", false, asmSetup(fibRecursive)},
+	{"retro/fib-loop", true, retroSetup(": fib [ 0 1 ] dip 1- [ dup [ + ] dip swap ] times swap drop ; 35 fib bye\n")},
+	{"retro/fib-recursive", true, retroSetup(": fib dup 2 < if; 1- dup fib swap 1- fib + ; 20 fib bye\n")},
+}
+
+// runtime memory size of the Retro image, in cells.
+const retroSize = 100000
+
+var retroImage []vm.Cell
+
+func asmSetup(src string) func(...vm.Option) (*vm.Instance, error) {
+	img, err := asm.Assemble("ngbench", strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	return func(opts ...vm.Option) (*vm.Instance, error) {
+		return vm.New(append([]vm.Cell(nil), img...), "", opts...)
+	}
+}
+
+func retroSetup(input string) func(...vm.Option) (*vm.Instance, error) {
+	return func(opts ...vm.Option) (*vm.Instance, error) {
+		mem := make([]vm.Cell, len(retroImage))
+		copy(mem, retroImage)
+		return vm.New(mem, "", append(opts, vm.Input(strings.NewReader(input)))...)
+	}
+}
+
+// run runs the benchmark b repeatedly for at least d and returns its
+// throughput in MIPS.
+func run(b *benchmark, d time.Duration, opts ...vm.Option) (float64, error) {
+	var (
+		ins     int64
+		elapsed time.Duration
+	)
+	for elapsed < d {
+		i, err := b.setup(opts...)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		err = i.Run()
+		elapsed += time.Since(start)
+		if err != nil && errors.Cause(err) != io.EOF {
+			return 0, err
+		}
+		ins += i.InstructionCount()
+	}
+	return float64(ins) / elapsed.Seconds() / 1e6, nil
+}
+
+func loadBaseline(name string) (*baseline, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to load baseline")
+	}
+	var bl baseline
+	if err = json.Unmarshal(data, &bl); err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid baseline", name)
+	}
+	return &bl, nil
+}
+
+func saveBaseline(name string, bl *baseline) error {
+	data, err := json.MarshalIndent(bl, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to save baseline")
+	}
+	return errors.Wrap(ioutil.WriteFile(name, append(data, '\n'), 0666), "failed to save baseline")
+}
+
+func main() {
+	var (
+		err      error
+		regress  bool
+		blName   = flag.String("baseline", "ngbench.json", "baseline `filename`")
+		count    = flag.Int("count", 3, "run each benchmark `n` times and keep the best result")
+		bits     = flag.Int("ibits", vm.CellBits, "cell size in bits of the Retro memory image")
+		image    = flag.String("image", "retroImage", "Retro memory image `filename` used by the retro benchmarks")
+		save     = flag.Bool("save", false, "save the results as the new baseline")
+		thresh   = flag.Float64("threshold", 10, "maximum allowed slowdown in `percent`")
+		duration = flag.Duration("time", 500*time.Millisecond, "minimum run time of each benchmark")
+	)
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ngbench: %v\n", err)
+			os.Exit(2)
+		}
+		if regress {
+			fmt.Fprintln(os.Stderr, "FAIL: performance regression")
+			os.Exit(1)
+		}
+	}()
+	flag.Parse()
+
+	if retroImage, _, err = vm.Load(*image, retroSize, *bits); err != nil {
+		fmt.Fprintf(os.Stderr, "ngbench: skipping retro benchmarks: %v\n", err)
+		retroImage, err = nil, nil
+	}
+	var ref *baseline
+	if !*save {
+		if ref, err = loadBaseline(*blName); err != nil {
+			return
+		}
+		if ref != nil && (ref.GoVersion != runtime.Version() || ref.GOARCH != runtime.GOARCH || ref.CellBits != vm.CellBits) {
+			fmt.Fprintf(os.Stderr, "ngbench: warning: baseline recorded with %s/%s, %d bits cells\n", ref.GoVersion, ref.GOARCH, ref.CellBits)
+		}
+	}
+
+	bl := &baseline{runtime.Version(), runtime.GOARCH, vm.CellBits, make(map[string]float64)}
+	for n := range benchmarks {
+		b := &benchmarks[n]
+		if b.retro && retroImage == nil {
+			continue
+		}
+		var best float64
+		for c := 0; c < *count; c++ {
+			var mips float64
+			if mips, err = run(b, *duration); err != nil {
+				err = errors.Wrap(err, b.name)
+				return
+			}
+			if mips > best {
+				best = mips
+			}
+		}
+		bl.MIPS[b.name] = best
+	}
+
+	if *save {
+		err = saveBaseline(*blName, bl)
+	}
+	names := make([]string, 0, len(bl.MIPS))
+	for name := range bl.MIPS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mips := bl.MIPS[name]
+		old, ok := 0.0, false
+		if ref != nil {
+			old, ok = ref.MIPS[name]
+		}
+		if !ok {
+			fmt.Printf("%-28s %10.2f MIPS\n", name, mips)
+			continue
+		}
+		delta := (mips - old) / old * 100
+		status := "ok"
+		if delta < -*thresh {
+			status = "REGRESSION"
+			regress = true
+		}
+		fmt.Printf("%-28s %10.2f MIPS %10.2f baseline %+7.2f%% %s\n", name, mips, old, delta, status)
+	}
+}
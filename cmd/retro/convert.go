@@ -0,0 +1,99 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// convert implements the convert sub-command.
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fileName := fs.String("image", "retroImage", "source memory image `filename`")
+	out := fs.String("o", "", "destination memory image `filename`")
+	iformat := fs.String("iformat", "raw", "source image `format`")
+	oformat := fs.String("oformat", "raw", "destination image `format`")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s convert [options] -o filename\n\n"+
+			"Convert a memory image to another file format. Formats are given as:\n\n"+
+			"\tencoding[:bits][:be|:le][:hdr]\n\n"+
+			"where encoding is raw or ihex (Intel HEX) and bits is 8, 16, 32 or 64.\n"+
+			"The hdr suffix adds a self-describing header to the image.\n"+
+			"The default is %v.\n\n", os.Args[0], vm.Format{})
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *out == "" {
+		return errors.New("no destination image file given")
+	}
+	src, err := vm.ParseFormat(*iformat)
+	if err != nil {
+		return err
+	}
+	dst, err := vm.ParseFormat(*oformat)
+	if err != nil {
+		return err
+	}
+	mem, _, err := vm.LoadFormat(*fileName, 0, src)
+	if err != nil {
+		return err
+	}
+	if dst.Header != nil {
+		// keep the entry point and symbols of the source image
+		h, err := vm.LoadHeader(*fileName, src)
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			dst.Header = h
+		}
+	}
+	if mem, err = vm.ConvertImage(mem, src.Bits, dst.Bits, convertOptions); err != nil {
+		return err
+	}
+	return vm.SaveFormat(*out, mem, dst)
+}
+
+// convertOptions adds disassembly context to cell size conversion errors.
+var convertOptions = &vm.ConvertOptions{Disassemble: asm.Disassemble}
+
+// saveImage returns a memory image dump function for vm.SaveMemImage that
+// checks with vm.ConvertImage that all cells fit in the cell size of format f
+// before saving. The image is shrunk first if shrink is true.
+func saveImage(shrink bool, f vm.Format) func(fileName string, mem []vm.Cell) error {
+	return func(fileName string, mem []vm.Cell) error {
+		if shrink {
+			m, err := vm.ShrinkImage(mem)
+			if err != nil {
+				return errors.Wrap(err, "image shrink failed")
+			}
+			mem = m
+		}
+		mem, err := vm.ConvertImage(mem, 0, f.Bits, convertOptions)
+		if err != nil {
+			return err
+		}
+		return vm.SaveFormat(fileName, mem, f)
+	}
+}
@@ -0,0 +1,219 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// number of input lines to keep for diagnostics.
+const inputTailLines = 5
+
+// number of instructions to disassemble before and after the PC.
+const disasmWindow = 4
+
+// loadSymbols loads a symbol map file. Each line of the file contains an
+// address followed by a name, separated by spaces. Empty lines and lines
+// starting with '#' are ignored.
+func loadSymbols(name string) (*vm.SymbolTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load symbol map")
+	}
+	defer f.Close()
+	var syms []vm.Symbol
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		l := strings.Fields(s.Text())
+		if len(l) == 0 || strings.HasPrefix(l[0], "#") {
+			continue
+		}
+		if len(l) != 2 {
+			return nil, errors.Errorf("%s:%d: expected address and name", name, n)
+		}
+		addr, err := strconv.ParseInt(l[0], 0, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid address", name, n)
+		}
+		syms = append(syms, vm.Symbol{Addr: vm.Cell(addr), Name: l[1]})
+	}
+	if err = s.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to load symbol map")
+	}
+	return vm.NewSymbolTable(syms...), nil
+}
+
+// lookup returns the symbolic name of addr as name+offset, using the closest
+// symbol at or below addr. It returns an empty string if there is none.
+func lookup(t *vm.SymbolTable, addr int) string {
+	sym, off, ok := t.Lookup(vm.Cell(addr))
+	if !ok {
+		return ""
+	}
+	if off != 0 {
+		return sym.Name + "+" + strconv.Itoa(int(off))
+	}
+	return sym.Name
+}
+
+// inputTail keeps track of the last lines of input consumed by the VM.
+type inputTail struct {
+	lines []string
+	cur   []byte
+}
+
+// reader returns an io.Reader that records everything read from r.
+func (t *inputTail) reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, t)
+}
+
+func (t *inputTail) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if c != '\n' {
+			t.cur = append(t.cur, c)
+			continue
+		}
+		t.push(string(t.cur))
+		t.cur = t.cur[:0]
+	}
+	return len(b), nil
+}
+
+func (t *inputTail) push(l string) {
+	if len(t.lines) == inputTailLines {
+		copy(t.lines, t.lines[1:])
+		t.lines = t.lines[:inputTailLines-1]
+	}
+	t.lines = append(t.lines, l)
+}
+
+// last returns the last lines of input, including any incomplete line.
+func (t *inputTail) last() []string {
+	l := t.lines
+	if len(t.cur) > 0 {
+		l = append(l[:len(l):len(l)], string(t.cur))
+	}
+	return l
+}
+
+// ANSI color escape sequences.
+const (
+	colorRed   = "\033[1;31m"
+	colorCyan  = "\033[36m"
+	colorBold  = "\033[1m"
+	colorReset = "\033[0m"
+)
+
+// diagnostics formats error reports.
+type diagnostics struct {
+	color   bool
+	symbols *vm.SymbolTable
+	input   *inputTail
+}
+
+func (d *diagnostics) paint(color, s string) string {
+	if !d.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// addr formats an address, symbolized if possible.
+func (d *diagnostics) addr(addr int) string {
+	s := strconv.Itoa(addr)
+	if n := lookup(d.symbols, addr); n != "" {
+		s += " <" + n + ">"
+	}
+	return s
+}
+
+// stack formats a stack, symbolizing values if sym is true.
+func (d *diagnostics) stack(s []vm.Cell, sym bool) string {
+	l := make([]string, len(s))
+	for n, v := range s {
+		if sym {
+			l[n] = d.addr(int(v))
+		} else {
+			l[n] = strconv.FormatInt(int64(v), 10)
+		}
+	}
+	return "[" + strings.Join(l, " ") + "]"
+}
+
+// disassemble writes a disassembly of the instructions around pc.
+func (d *diagnostics) disassemble(w io.Writer, mem []vm.Cell, pc int) {
+	start := pc - disasmWindow
+	if start < 0 {
+		start = 0
+	}
+	var b bytes.Buffer
+	for a, n := start, 0; a < len(mem) && n < 2*disasmWindow+1; n++ {
+		b.Reset()
+		next, _ := asm.Disassemble(mem, a, &b)
+		mark := "  "
+		if a <= pc && pc < next {
+			mark = "=>"
+		}
+		line := fmt.Sprintf("  %s %8d\t%s", mark, a, b.String())
+		if name := lookup(d.symbols, a); name != "" && !strings.Contains(name, "+") {
+			line += "\t" + d.paint(colorCyan, "<"+name+">")
+		}
+		if mark == "=>" {
+			line = d.paint(colorBold, line)
+		}
+		fmt.Fprintln(w, line)
+		a = next
+	}
+}
+
+// report writes an error report for the given instance to w. If verbose is true,
+// the report includes a full stack trace, a disassembly window around the PC,
+// the stacks and the last lines of input.
+func (d *diagnostics) report(w io.Writer, i *vm.Instance, err error, verbose bool) {
+	if !verbose {
+		fmt.Fprintf(w, "\n%s %v\n", d.paint(colorRed, "error:"), err)
+		return
+	}
+	fmt.Fprintf(w, "\n%s %+v\n", d.paint(colorRed, "error:"), err)
+	if i == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", d.paint(colorBold, "pc:"), d.addr(i.PC))
+	if i.PC >= 0 && i.PC < len(i.Mem) {
+		d.disassemble(w, i.Mem, i.PC)
+	}
+	fmt.Fprintf(w, "%s %s\n", d.paint(colorBold, "stack:"), d.stack(i.Data(), false))
+	fmt.Fprintf(w, "%s %s\n", d.paint(colorBold, "rstack:"), d.stack(i.Address(), d.symbols.Len() > 0))
+	if d.input != nil {
+		if l := d.input.last(); len(l) > 0 {
+			fmt.Fprintln(w, d.paint(colorBold, "last input:"))
+			for _, s := range l {
+				fmt.Fprintf(w, "  | %s\n", s)
+			}
+		}
+	}
+}
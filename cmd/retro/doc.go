@@ -21,28 +21,114 @@
 //
 // Usage:
 //
+//	retro [flags] [-- args...]
+//
+// Flags:
+//
+//	-I dir
+//		  add dir to the include search path (can be specified multiple times)
+//	-audio port
+//		  bind the audio device to port
+//	-canvas WxH
+//		  open a WxH canvas window for graphical programs
+//	-clkfreq int
+//		  clock frequency throttling in KHz
+//	-clkport port
+//		  bind the clock control device to port
+//	-clkslp duration
+//		  interval between sleeps when throttling the clock (default 16ms)
 //	-debug
 //		  enable debug diagnostics
 //	-dump
 //		  dump stacks and memory image upon exit, for ngarotest.py
+//	-history filename
+//		  load and save the line editing history in filename (implies -edit)
+//	-ibe
+//		  loaded memory image has big-endian cells
 //	-ibits value
 //		  cell size in bits of loaded memory image (default GOARCH bits)
+//	-edit
+//		  enable line editing in the listener
+//	-exec port
+//		  bind the subprocess device to port
+//	-grace duration
+//		  time allowed to the VM to terminate after a shutdown request (default 5s)
 //	-image filename
 //		  Load memory image from file filename (default "retroImage")
+//	-log
+//		  log VM events (image saves, file errors, etc.) to stderr
+//	-map filename
+//		  load symbol map from filename for debug diagnostics
+//	-mux
+//		  with -telnet, let clients create, attach to and detach from named sessions
+//	-muxdir dir
+//		  with -mux, save live sessions to dir on exit and restore them from there
 //	-noraw
 //		  disable raw terminal IO
 //	-noshrink
 //		  When saving, don't shrink memory image file
 //	-o filename
 //		  filename to use when saving memory image
+//	-obe
+//		  save memory image with big-endian cells
 //	-obits value
 //		  cell size in bits of saved memory image (default GOARCH bits)
+//	-poke addr=value
+//		  store value at address addr in the memory image before running (can be specified multiple times)
+//	-ports
+//		  show live port activity at the bottom of the terminal
+//	-pprof filename
+//		  write a pprof profile of executed words to filename upon exit
+//	-root dir
+//		  confine file access of the VM to dir
+//	-screen
+//		  use a full-screen terminal instead of VT100 escape sequences
+//	-shutdown port
+//		  on SIGTERM, notify the VM on port and let it terminate on its own
 //	-size int
 //		  runtime memory image size in cells (default 100000)
+//	-snapshots n
+//		  keep n previous versions of the memory image when saving
+//	-telnet address
+//		  serve sandboxed sessions over telnet on address instead of the console
+//	-timing
+//		  print execution times per opcode category upon exit
+//	-top
+//		  show live VM statistics at the bottom of the terminal
+//	-transient
+//		  save the memory image to a temporary file unless -o is specified
+//	-utf8
+//		  read and write console characters as UTF-8 encoded code points
 //	-with filename
 //		  Add filename to the input list (can be specified multiple times)
 //
-// -debug: will print a full stacktrace should the VM crash.
+// Arguments following the flags (or a "--" separator) are passed to the
+// running program, which can query them with the VM capabilities device on
+// port 5 (see vm.Args). For example, in Retro:
+//
+//	: argc ( -n ) -25 5 out 0 0 out wait 5 in ;
+//	: arg ( n-$ ) here swap -26 5 out 0 0 out wait 5 in drop here ;
+//
+// -clkfreq, -clkslp: throttle the VM to the given clock frequency. The clock
+// frequency can also be changed at runtime by the running program through the
+// clock control device, which is only available if bound to a port with
+// -clkport (see vm.Clock.WaitHandler). For example, to set the frequency to
+// 1MHz in Retro, with -clkport 9:
+//
+//	: clock! ( n- ) 1 9 out 0 0 out wait 9 in drop ;
+//	1000000 clock!
+//
+// -debug: should the VM crash, print a full stacktrace, a disassembly of the
+// code around the PC, the data and address stacks and the last lines of input
+// consumed by the VM. Errors are colorized when printed to a terminal.
+//
+// -map: load a symbol map used to symbolize addresses in -debug diagnostics.
+// Each line of the file contains an address followed by a name, separated by
+// spaces, like:
+//
+//	# address name
+//	1234 words
+//	1300 interpret
 //
 // -dump: this boolean flag is meant to be used in conjonction with the Retro
 // test suite. It will dunp the stacks and memory image to stdout.
@@ -57,6 +143,11 @@
 // automatically extended to fit the loaded memory image file. Make sure that
 // this value is sufficiently big to have some free cells as temporary storage.
 //
+// -I: files included with the :include word that are not found relative to
+// the current directory are searched for in the given directories, in order,
+// then in the directory of the memory image file. This makes :include work
+// regardless of the directory retro is launched from.
+//
 // -with: After loading the memory image, retro will feed the specified file to
 // the VM as input. If specified multiple times, files will be fed to the VM in
 // order of appearance on the command line.
@@ -78,8 +169,152 @@
 // incompatible with this scheme, or if you want to make a full snapshot of the
 // VM memory, including temp data.
 //
+// -poke: patch the memory image after loading it and before running it. This
+// does not modify the image file on disk. Addresses and values can be given in
+// decimal, hexadecimal (0x prefix) or octal (0 prefix).
+//
+// -pprof: sample the call stack every 64 instructions and write the result to
+// the given file as a pprof profile upon exit. Samples are attributed to the
+// words of the Retro dictionary, or to the symbols loaded with -map if
+// specified. The profile can be viewed with the Go pprof tool:
+//
+//	retro -pprof retro.prof -with program.rx
+//	go tool pprof -top retro.prof
+//
+// Since profiling uses instruction tracing, -pprof cannot be used with -top.
+//
+// -shutdown, -grace: upon receiving a SIGTERM signal, retro stops the VM. If
+// -shutdown is specified, the VM is instead notified by setting the given port
+// to -1 (see vm.ShutdownPort) so that the running program can clean up and
+// exit on its own. Should it not terminate within the -grace period, or should
+// a second SIGTERM be received, the VM is stopped. For example, in Retro, with
+// -shutdown 10:
+//
+//	: shutdown? ( -f ) 10 in -1 = ;
+//
+// -snapshots: when saving the memory image, rename the previous image file to
+// filename.<timestamp> and keep only the n most recent versions. A previous
+// version can be restored with the rollback sub-command:
+//
+//	retro rollback [-image filename] [-l] [n]
+//
+// which restores the n-th previous version (default 1). Use -l to list the
+// available versions.
+//
+// The export sub-command writes a memory image as Go or C source code, so that
+// it can be embedded into other programs:
+//
+//	retro export [-image filename] [-ibits n] [-format go|c] [-name image]
+//		[-package main] [-cbits 32] [-z] [-noshrink] [-o filename]
+//
+// By default, the image is written to stdout as a Go []vm.Cell literal. Only
+// the used part of the image (mem[0:HERE]) is exported unless -noshrink is
+// set. The -z flag compresses the image with vm.CompressImage.
+//
+// The convert sub-command converts a memory image between file formats:
+//
+//	retro convert [-image filename] [-iformat format] [-oformat format] -o filename
+//
+// Formats are given as encoding[:bits][:be|:le], where encoding is either raw
+// (raw binary cells, the native format) or ihex (Intel HEX), and bits is the
+// cell size: 8, 16, 32 or 64 (default GOARCH bits). Cells are little-endian
+// unless :be is specified. For example, to convert a 32 bits image to an Intel
+// HEX file of 16 bits big-endian cells:
+//
+//	retro convert -iformat raw:32 -oformat ihex:16:be -o image.hex
+//
+// Adding :hdr to the output format writes a self-describing header in front of
+// the image, recording its cell size, byte order, entry point and symbol table
+// (see vm.Format). Images with a header are detected automatically when
+// loaded, regardless of -ibits or -iformat, and execution starts at the entry
+// point given in the header.
+//
+// -top: reserve the bottom lines of the terminal to display live VM
+// statistics: instruction rate in MIPS, instruction mix, port activity and
+// stack depths. The display is refreshed twice per second while the VM is
+// running. Note that this enables instruction tracing, which slows down the VM.
+//
+// -timing: upon exit, print the instruction count and execution time of each
+// opcode category (stack, arithmetic, memory, branches and calls, I/O, WAIT and
+// custom opcodes). See vm.TimeInstructions for how times are measured. Like
+// -top, this slows down the VM.
+//
+// -ports: reserve the bottom lines of the terminal to display the last IN, OUT
+// and WAIT instructions and WAIT handler replies, along with the instruction
+// count and PC at which they occurred (see vm.PortRecorder). This helps getting
+// the handshake right when writing programs for custom devices. -ports cannot
+// be used with -top.
+//
+// -transient: unless -o is specified, saving the memory image writes to a new
+// temporary file instead of the loaded image file, so that experiments in the
+// listener cannot clobber it. The location of the saved image is printed upon
+// exit. If the image was never saved, the temporary file is removed.
+//
 // -ibits, -obits: control respectively the cell size in bits of the input and
 // output memory images. These flags are primarily meant to convert memory
 // images between different cell sizes. For more details on 32/64 bits handling
 // and examples, please see https://github.com/db47h/ngaro/blob/master/README.md
+//
+// -canvas: open a window of the given size (for example 640x480) displaying
+// the Ngaro canvas device on port 6, with the mouse device on port 7, so that
+// graphical programs written for Ngaro-JS run unmodified. Text input and output
+// still go through the terminal. This requires retro to be built with the
+// ebiten build tag (see package github.com/db47h/ngaro/display). Closing the
+// window terminates the VM like SIGTERM.
+//
+// -audio: bind the audio device (see vm.AudioHandler) to the given port. Sounds
+// are played on the sound card if retro is built with the oto build tag (see
+// package github.com/db47h/ngaro/audio), otherwise beeps ring the terminal bell.
+//
+// -edit: edit input lines before they are sent to the VM, with cursor keys,
+// kill and yank (see vm.LineEditor for the list of keys). This only works with
+// the terminal in raw mode, and since lines are delivered once complete,
+// programs reading single key presses will not work as expected. Previous lines
+// can be recalled with the Up and Down keys.
+//
+// -history: load the line editing history from the given file at startup, and
+// save it there upon exit. This implies -edit.
+//
+// -exec: bind the subprocess device (see vm.Exec) to the given port, allowing
+// Retro programs to run host commands and talk to them through pipes. This
+// gives programs the same access to the host as the user running retro, so
+// only use it with trusted images.
+//
+// -screen: drive the terminal natively, see package
+// github.com/db47h/ngaro/screen, instead of emitting VT100 escape sequences.
+// This makes programs using port 8 work on Windows consoles and handles window
+// resizes. The mouse device is available on port 7. Ctrl-C stops the VM like
+// SIGTERM. This requires retro to be built with the tcell build tag and cannot
+// be used with -top, -ports or -edit.
+//
+// -root: confine all file accesses of the VM (file operations, includes and
+// image saves) to the given directory, see vm.FileRoot. The image is saved
+// relative to this directory, so -o must be a relative name and -transient
+// cannot be used, except with -snapshots which saves the image outside of the
+// VM's control. The directories given with -I are still searched for include
+// files.
+//
+// -telnet: instead of running a single VM on the console, listen for telnet
+// connections on the given TCP address (for example "localhost:2323") and run
+// a new VM for each of them, see package github.com/db47h/ngaro/telnet. Every
+// session starts from the loaded memory image and is sandboxed (see
+// vm.ProfileSandboxed): file, environment, network and subprocess devices are
+// disabled and memory images cannot be saved. The server stops on SIGINT or
+// SIGTERM. This cannot be used with -screen, -top, -ports, -edit or -canvas;
+// devices enabled by other flags, like -audio or -exec, are not available to
+// sessions.
+//
+// -mux: with -telnet, clients get a command prompt where they can create named
+// sessions, attach to them and detach from them (with Ctrl-A d), see package
+// github.com/db47h/ngaro/mux. Detached sessions are paused and keep running
+// across connections until they exit or the server stops. With -muxdir, the
+// memory images of sessions still running when the server stops are saved to
+// the given directory (keeping the number of previous versions given with
+// -snapshots), and new sessions with the same name start from them. -muxdir
+// implies -mux.
+//
+// -ibe, -obe: load, respectively save, memory images with big-endian cells,
+// for example to exchange images with Ngaro implementations running on
+// big-endian hosts. Images with a self-describing header are always loaded
+// with the byte order given in their header.
 package main
@@ -0,0 +1,84 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// export implements the export sub-command.
+func export(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fileName := fs.String("image", "retroImage", "memory image `filename`")
+	var bits = cellSizeBits(vm.CellBits)
+	fs.Var(&bits, "ibits", "cell size in bits of the memory image")
+	format := fs.String("format", "go", "output `format`: go or c")
+	name := fs.String("name", "image", "variable `name`")
+	pkg := fs.String("package", "main", "Go package `name`")
+	cBits := fs.Int("cbits", 32, "cell size in bits of the C array")
+	compress := fs.Bool("z", false, "compress the image")
+	noShrink := fs.Bool("noshrink", false, "export the whole image instead of mem[0:HERE]")
+	out := fs.String("o", "", "write to `filename` instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [options]\n\nExport the memory image as Go or C source code.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	opts := &vm.ExportOptions{Name: *name, Package: *pkg, Bits: *cBits, Compress: *compress}
+	switch *format {
+	case "go":
+		opts.Format = vm.ExportGo
+	case "c":
+		opts.Format = vm.ExportC
+	default:
+		return errors.Errorf("unknown export format %q", *format)
+	}
+
+	mem, _, err := vm.Load(*fileName, 0, int(bits))
+	if err != nil {
+		return err
+	}
+	if !*noShrink {
+		if mem, err = vm.ShrinkImage(mem); err != nil {
+			return err
+		}
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return errors.Wrap(err, "create failed")
+		}
+		defer func() {
+			if e := w.Close(); err == nil {
+				err = errors.Wrap(e, "close failed")
+			}
+		}()
+	}
+	bw := bufio.NewWriter(w)
+	if err = vm.ExportImage(bw, mem, opts); err != nil {
+		return err
+	}
+	return errors.Wrap(bw.Flush(), "write failed")
+}
@@ -0,0 +1,56 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// eventLogger implements vm.Logger on top of the standard log package. Debug
+// messages are discarded.
+type eventLogger struct {
+	l *log.Logger
+}
+
+func newEventLogger(w io.Writer) *eventLogger {
+	return &eventLogger{log.New(w, "", log.LstdFlags)}
+}
+
+func (l *eventLogger) print(level, msg string, args []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for n := 0; n < len(args); n += 2 {
+		if n+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[n], args[n+1])
+		} else {
+			fmt.Fprintf(&b, " %v", args[n])
+		}
+	}
+	l.l.Print(b.String())
+}
+
+// Debug implements vm.Logger.
+func (l *eventLogger) Debug(msg string, args ...interface{}) {}
+
+// Info implements vm.Logger.
+func (l *eventLogger) Info(msg string, args ...interface{}) { l.print("INFO", msg, args) }
+
+// Error implements vm.Logger.
+func (l *eventLogger) Error(msg string, args ...interface{}) { l.print("ERROR", msg, args) }
@@ -21,11 +21,20 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/db47h/ngaro/audio"
+	"github.com/db47h/ngaro/display"
 	"github.com/db47h/ngaro/lang/retro"
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/screen"
 	"github.com/db47h/ngaro/vm"
 	"github.com/pkg/errors"
 )
@@ -36,6 +45,58 @@ func (f *fileList) String() string     { return "" }
 func (f *fileList) Set(s string) error { *f = append(*f, s); return nil }
 func (f *fileList) Get() interface{}   { return *f }
 
+// pokeList implements a flag.Value that collects addr=value pairs.
+type pokeList [][2]vm.Cell
+
+func (p *pokeList) String() string { return "" }
+func (p *pokeList) Set(s string) error {
+	eq := strings.IndexByte(s, '=')
+	if eq < 0 {
+		return errors.Errorf("invalid poke %q, expected addr=value", s)
+	}
+	addr, err := strconv.ParseInt(s[:eq], 0, vm.CellBits)
+	if err != nil {
+		return errors.Wrap(err, "invalid address")
+	}
+	v, err := strconv.ParseInt(s[eq+1:], 0, vm.CellBits)
+	if err != nil {
+		return errors.Wrap(err, "invalid value")
+	}
+	*p = append(*p, [2]vm.Cell{vm.Cell(addr), vm.Cell(v)})
+	return nil
+}
+func (p *pokeList) Get() interface{} { return *p }
+
+// patch returns a function suitable for vm.PatchImage that applies the pokes.
+func (p pokeList) patch(mem []vm.Cell) error {
+	for _, pk := range p {
+		if pk[0] < 0 || int(pk[0]) >= len(mem) {
+			return errors.Errorf("poke address %d out of range", pk[0])
+		}
+		mem[pk[0]] = pk[1]
+	}
+	return nil
+}
+
+// canvasSize implements a flag.Value for canvas dimensions given as WxH.
+type canvasSize struct{ w, h int }
+
+func (c *canvasSize) String() string {
+	if c.w == 0 {
+		return ""
+	}
+	return strconv.Itoa(c.w) + "x" + strconv.Itoa(c.h)
+}
+func (c *canvasSize) Set(s string) error {
+	var w, h int
+	if n, err := fmt.Sscanf(s, "%dx%d", &w, &h); err != nil || n != 2 || w <= 0 || h <= 0 {
+		return errors.Errorf("invalid canvas size %q, expected WxH", s)
+	}
+	c.w, c.h = w, h
+	return nil
+}
+func (c *canvasSize) Get() interface{} { return *c }
+
 type cellSizeBits int
 
 func (sz *cellSizeBits) String() string { return strconv.Itoa(int(*sz)) }
@@ -62,6 +123,7 @@ var (
 	outFileName string
 	srcCellSz   = cellSizeBits(vm.CellBits)
 	dstCellSz   = srcCellSz
+	diag        = diagnostics{input: new(inputTail)}
 )
 
 // port1Handler is a wrapper input handler that catches CTRL-D and turns it into
@@ -106,34 +168,128 @@ func setupIO() (raw bool, tearDown func()) {
 	return true, tearDown
 }
 
-func newVM(name, saveName string, size, cellSize int, opts ...vm.Option) (*vm.Instance, int, error) {
-	mem, fileCells, err := vm.Load(name, size, cellSize)
+func newVM(name, saveName string, size int, f vm.Format, opts ...vm.Option) (*vm.Instance, int, error) {
+	var mem []vm.Cell
+	var fileCells int
+	var err error
+	if f.BigEndian {
+		mem, fileCells, err = vm.LoadFormat(name, size, f)
+	} else {
+		mem, fileCells, err = vm.Load(name, size, f.Bits)
+	}
 	if err != nil {
 		return nil, fileCells, err
 	}
 	i, err := vm.New(mem, saveName, opts...)
-	return i, fileCells, err
+	if err != nil {
+		return nil, fileCells, err
+	}
+	h, err := vm.LoadHeader(name, vm.Format{})
+	if err != nil || h == nil {
+		return i, fileCells, err
+	}
+	i.PC = int(h.Entry)
+	if diag.symbols.Len() == 0 {
+		diag.symbols = h.Symbols
+	}
+	return i, fileCells, nil
 }
 
-func atExit(i *vm.Instance, err error) {
-	if err == nil {
+// loadHistory loads the line editing history from the named file, if it
+// exists.
+func loadHistory(name string, e *vm.LineEditor) {
+	f, err := os.Open(name)
+	if err != nil {
 		return
 	}
-	if !debug {
-		fmt.Fprintf(os.Stderr, "\n%v\n", err)
-		os.Exit(1)
+	defer f.Close()
+	if err = e.ReadHistory(f); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
-	fmt.Fprintf(os.Stderr, "\n%+v\n", err)
-	if i != nil {
-		if i.PC < len(i.Mem) {
-			fmt.Fprintf(os.Stderr, "PC: %v (%v), Stack: %v, Addr: %v\n", i.PC, i.Mem[i.PC], i.Data(), i.Address())
-		} else {
-			fmt.Fprintf(os.Stderr, "PC: %v, Stack: %v\nAddr:  %v\n", i.PC, i.Data(), i.Address())
+}
+
+// saveHistory writes the line editing history to the named file.
+func saveHistory(name string, e *vm.LineEditor) {
+	f, err := os.Create(name)
+	if err == nil {
+		err = e.WriteHistory(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save history: %v\n", err)
+	}
+}
+
+// number of instructions between profile samples.
+const pprofRate = 64
+
+// writeProfile writes the profile collected by p to the named file. Addresses
+// are symbolized with the symbol map loaded with -map, or from the Retro
+// dictionary.
+func writeProfile(name string, p *vm.Profiler, i *vm.Instance) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to write profile")
+	}
+	syms := diag.symbols
+	if syms.Len() == 0 {
+		syms = retro.Symbols(i.Mem)
+	}
+	if err = p.WriteTo(f, syms); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Wrap(f.Close(), "failed to write profile")
+}
+
+// printTiming prints the instruction timings returned by
+// vm.Instance.InstructionTiming.
+func printTiming(w io.Writer, t []vm.OpTiming) {
+	var total time.Duration
+	for _, c := range t {
+		total += c.Time
+	}
+	fmt.Fprintf(w, "%-8s %14s %14s %7s\n", "category", "instructions", "time", "%time")
+	for c, v := range t {
+		var pct float64
+		if total > 0 {
+			pct = float64(v.Time) * 100 / float64(total)
 		}
+		fmt.Fprintf(w, "%-8v %14d %14v %6.1f%%\n", vm.OpCategory(c), v.Count, v.Time, pct)
+	}
+}
+
+func atExit(i *vm.Instance, err error) {
+	if err == nil {
+		return
 	}
+	diag.report(os.Stderr, i, err, debug)
 	os.Exit(1)
 }
 
+// transientImage returns the name of a new temporary file to be used to save the
+// memory image in transient mode.
+func transientImage(name string) (string, error) {
+	f, err := ioutil.TempFile("", filepath.Base(name)+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create transient image file")
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// transientDone removes the transient image file if it has not been written to,
+// or reports its location.
+func transientDone(name string) {
+	if fi, err := os.Stat(name); err == nil && fi.Size() == 0 {
+		os.Remove(name)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nmemory image saved to %s\n", name)
+}
+
 func main() {
 	// check exit condition
 	var err error
@@ -152,52 +308,244 @@ func main() {
 		atExit(i, err)
 	}()
 
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		err = rollback(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err = export(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		err = convert(os.Args[2:])
+		return
+	}
+
 	var withFiles fileList
+	var incPath fileList
+	var pokes pokeList
+	var canvasSz canvasSize
 
 	fileName := flag.String("image", "retroImage", "Load memory image from file `filename`")
 	flag.Var(&srcCellSz, "ibits", "cell size in bits of loaded memory image")
+	srcBE := flag.Bool("ibe", false, "loaded memory image has big-endian cells")
 	size := flag.Int("size", 100000, "runtime memory image size in cells")
 	flag.BoolVar(&dump, "dump", false, "dump stacks and memory image upon exit, for ngarotest.py")
 	flag.Var(&withFiles, "with", "Add `filename` to the input list (can be specified multiple times)")
+	flag.Var(&incPath, "I", "add `dir` to the include search path (can be specified multiple times)")
 	flag.BoolVar(&noShrink, "noshrink", false, "When saving, don't shrink memory image file")
 	flag.BoolVar(&noRawIO, "noraw", false, "disable raw terminal IO")
 	flag.BoolVar(&debug, "debug", false, "enable debug diagnostics")
 	flag.StringVar(&outFileName, "o", "", "`filename` to use when saving memory image")
 	flag.Var(&dstCellSz, "obits", "cell size in bits of saved memory image")
+	dstBE := flag.Bool("obe", false, "save memory image with big-endian cells")
 	freq := flag.Int64("clkfreq", 0, "clock frequency throttling in KHz")
+	clkPort := flag.Int("clkport", 0, "bind the clock control device to `port`")
 	sleep := flag.Duration("clkslp", 16*time.Millisecond, "interval between sleeps when throttling the clock")
 	execStats := flag.Bool("stats", false, "print performance statistics upon exit")
+	timing := flag.Bool("timing", false, "print execution times per opcode category upon exit")
+	flag.Var(&pokes, "poke", "store `addr=value` in the memory image before running (can be specified multiple times)")
+	snapshots := flag.Int("snapshots", 0, "keep `n` previous versions of the memory image when saving")
+	showTop := flag.Bool("top", false, "show live VM statistics at the bottom of the terminal")
+	showPorts := flag.Bool("ports", false, "show live port activity at the bottom of the terminal")
+	symMap := flag.String("map", "", "load symbol map from `filename` for debug diagnostics")
+	transient := flag.Bool("transient", false, "save the memory image to a temporary file unless -o is specified")
+	pprof := flag.String("pprof", "", "write a pprof profile of executed words to `filename` upon exit")
+	sdPort := flag.Int("shutdown", 0, "on SIGTERM, notify the VM on `port` and let it terminate on its own")
+	grace := flag.Duration("grace", 5*time.Second, "time allowed to the VM to terminate after a shutdown request")
+	logEvents := flag.Bool("log", false, "log VM events (image saves, file errors, etc.) to stderr")
+	flag.Var(&canvasSz, "canvas", "open a `WxH` canvas window for graphical programs")
+	audioPort := flag.Int("audio", 0, "bind the audio device to `port`")
+	root := flag.String("root", "", "confine file access of the VM to `dir`")
+	execPort := flag.Int("exec", 0, "bind the subprocess device to `port`")
+	fullScreen := flag.Bool("screen", false, "use a full-screen terminal instead of VT100 escape sequences")
+	useUTF8 := flag.Bool("utf8", false, "read and write console characters as UTF-8 encoded code points")
+	lineEdit := flag.Bool("edit", false, "enable line editing in the listener")
+	histFile := flag.String("history", "", "load and save the line editing history in `filename` (implies -edit)")
+	telnetAddr := flag.String("telnet", "", "serve sandboxed sessions over telnet on `address` instead of the console")
+	muxSessions := flag.Bool("mux", false, "with -telnet, let clients create, attach to and detach from named sessions")
+	muxDir := flag.String("muxdir", "", "with -mux, save live sessions to `dir` on exit and restore them from there")
 
 	flag.Parse()
 
-	// try to switch the output terminal to raw mode.
-	rawtty, ioTearDownFn := setupIO()
-	if ioTearDownFn != nil {
-		defer ioTearDownFn()
+	if *pprof != "" && *showTop {
+		err = errors.New("-pprof and -top cannot be used together")
+		return
+	}
+	if *showTop && *showPorts {
+		err = errors.New("-top and -ports cannot be used together")
+		return
+	}
+	if canvasSz.w != 0 && !display.Supported {
+		err = display.ErrNotSupported
+		return
+	}
+	if *fullScreen && !screen.Supported {
+		err = screen.ErrNotSupported
+		return
+	}
+	if *histFile != "" {
+		*lineEdit = true
+	}
+	if *fullScreen && (*showTop || *showPorts || *lineEdit) {
+		err = errors.New("-screen cannot be used with -top, -ports or -edit")
+		return
+	}
+
+	diag.color = isTerminal(os.Stderr)
+	if *symMap != "" {
+		if diag.symbols, err = loadSymbols(*symMap); err != nil {
+			return
+		}
+	}
+
+	if *telnetAddr != "" {
+		if *fullScreen || *showTop || *showPorts || *lineEdit || canvasSz.w != 0 {
+			err = errors.New("-telnet cannot be used with -screen, -top, -ports, -edit or -canvas")
+			return
+		}
+		var logger vm.Logger
+		if *logEvents {
+			logger = newEventLogger(os.Stderr)
+		}
+		var tmpl *vm.Instance
+		tmpl, _, err = newVM(*fileName, "", *size, vm.Format{Bits: int(srcCellSz), BigEndian: *srcBE},
+			vm.ProfileSandboxed(),
+			vm.StringCodec(retro.StringCodec),
+			vm.Args(flag.Args()...),
+			vm.UTF8Input(*useUTF8),
+			vm.UTF8Output(*useUTF8),
+			vm.PatchImage(pokes.patch),
+			vm.Log(logger))
+		if err != nil {
+			return
+		}
+		var m *mux.Mux
+		if *muxSessions || *muxDir != "" {
+			m = &mux.Mux{SnapshotDir: *muxDir, SnapshotKeep: *snapshots}
+		}
+		err = serveTelnet(*telnetAddr, tmpl, m, logger)
+		return
+	}
+	if *muxSessions || *muxDir != "" {
+		err = errors.New("-mux and -muxdir require -telnet")
+		return
+	}
+
+	if outFileName == "" {
+		if *transient {
+			if outFileName, err = transientImage(*fileName); err != nil {
+				return
+			}
+			defer transientDone(outFileName)
+		} else {
+			outFileName = *fileName
+		}
+	}
+
+	// the SIGTERM handler is installed once the VM is created, but the
+	// full-screen terminal reports Ctrl-C right away.
+	sig := make(chan os.Signal, 1)
+
+	var scr screen.Terminal
+	var rawtty bool
+	if *fullScreen {
+		scr, err = screen.New(func() {
+			select {
+			case sig <- os.Interrupt:
+			default:
+			}
+		})
+		if err != nil {
+			return
+		}
+		defer scr.Close()
+		output = scr
+	} else {
+		// try to switch the output terminal to raw mode.
+		var ioTearDownFn func()
+		rawtty, ioTearDownFn = setupIO()
+		if ioTearDownFn != nil {
+			defer ioTearDownFn()
+		}
 	}
 
 	// default options
 	var opts = []vm.Option{
-		vm.SaveMemImage(retro.ShrinkSave(!noShrink, int(dstCellSz))),
+		vm.SaveMemImage(saveImage(!noShrink, vm.Format{Bits: int(dstCellSz), BigEndian: *dstBE})),
 		vm.Output(output),
+		vm.StringCodec(retro.StringCodec),
+		vm.Args(flag.Args()...),
+		vm.UTF8Input(*useUTF8),
+		vm.UTF8Output(*useUTF8),
 	}
 
-	if *freq > 0 {
-		opts = append(opts, vm.Ticker(vm.ClockLimiter(time.Second/time.Duration(*freq)/1000, *sleep)))
+	// search included files in the -I directories, then in the directory of
+	// the memory image.
+	opts = append(opts, vm.IncludePath(append(incPath, filepath.Dir(*fileName))...))
+
+	if *root != "" {
+		opts = append(opts, vm.FileRoot(*root))
+	}
+
+	if len(pokes) > 0 {
+		opts = append(opts, vm.PatchImage(pokes.patch))
+	}
+
+	if *snapshots > 0 {
+		opts = append(opts, vm.OnSave((&vm.Snapshots{Path: outFileName, Keep: *snapshots}).SaveHook))
+	}
+
+	// the clock can only be throttled with -clkfreq or by the program through
+	// the clock control device.
+	var ticker func(*vm.Instance)
+	var ticks int64
+	if *freq > 0 || *clkPort != 0 {
+		clock := vm.NewClock(*freq*1000, *sleep)
+		ticker, ticks = clock.Ticker()
+		if *clkPort != 0 {
+			opts = append(opts, vm.BindWaitHandler(vm.Cell(*clkPort), clock.WaitHandler))
+		}
+	}
+	if *showTop {
+		t := newTop(stdout, stdout.Flush, consoleSize(os.Stdout))
+		defer t.close()
+		opts = append(opts, t.options(ticker, ticks)...)
+	} else if *showPorts {
+		p := newPorts(stdout, stdout.Flush, consoleSize(os.Stdout))
+		defer p.close()
+		opts = append(opts, p.options(ticker, ticks)...)
+	} else if ticker != nil {
+		opts = append(opts, vm.Ticker(ticker, ticks))
 	}
 
-	if rawtty {
+	if scr != nil {
+		// the full-screen terminal is in raw mode too.
+		opts = append(opts,
+			vm.Input(vm.NewAsyncReader(diag.input.reader(scr.Input()))),
+			vm.BindWaitHandler(1, port1Handler),
+			vm.BindWaitHandler(2, port2Handler(output)))
+	} else if rawtty {
 		// with the terminal in raw mode, we need to manually handle CTRL-D and
 		// backspace, so we'll intercept WAITs on ports 1 and 2.
 		// we could also do it with wrappers around Stdin/Stdout
+		var in io.Reader = vm.NewAsyncReader(diag.input.reader(rawInput(os.Stdin)))
+		if *lineEdit {
+			e := vm.NewLineEditor(in, output)
+			if *histFile != "" {
+				loadHistory(*histFile, e)
+				defer saveHistory(*histFile, e)
+			}
+			in = e
+		}
 		opts = append(opts,
-			vm.Input(os.Stdin),
+			vm.Input(in),
 			vm.BindWaitHandler(1, port1Handler),
 			vm.BindWaitHandler(2, port2Handler(output)))
 	} else {
 		// If not raw tty, buffer stdin, but do not check further if the i/o is
 		// a terminal or not. The standard VT100 behavior is sufficient here.
-		opts = append(opts, vm.Input(bufio.NewReader(os.Stdin)))
+		opts = append(opts, vm.Input(diag.input.reader(bufio.NewReader(os.Stdin))))
 	}
 
 	// append -with files to input stack in reverse order so that they load
@@ -208,23 +556,80 @@ func main() {
 		if err != nil {
 			return
 		}
-		opts = append(opts, vm.Input(bufio.NewReader(f)))
+		opts = append(opts, vm.Input(diag.input.reader(bufio.NewReader(f))))
 	}
 
-	if outFileName == "" {
-		outFileName = *fileName
+	if *sdPort != 0 {
+		opts = append(opts, vm.ShutdownPort(vm.Cell(*sdPort), *grace))
+	}
+
+	if *timing {
+		opts = append(opts, vm.TimeInstructions(true))
+	}
+
+	if *logEvents {
+		opts = append(opts, vm.Log(newEventLogger(os.Stderr)))
 	}
-	i, fileCells, err = newVM(*fileName, outFileName, *size, int(srcCellSz), opts...)
+
+	var canvas *vm.Canvas
+	var mouse *vm.Mouse
+	if canvasSz.w != 0 {
+		canvas, mouse = vm.NewCanvas(canvasSz.w, canvasSz.h), new(vm.Mouse)
+		opts = append(opts, vm.BindCanvas(canvas), vm.BindMouse(mouse))
+	}
+
+	if *audioPort != 0 {
+		a, aerr := audio.New()
+		if aerr != nil {
+			a = vm.NewBellAudio(os.Stderr)
+		}
+		opts = append(opts, vm.BindWaitHandler(vm.Cell(*audioPort), vm.AudioHandler(a)))
+	}
+
+	if *execPort != 0 {
+		e := vm.NewExec(vm.AllowAnyCommand)
+		defer e.Close()
+		opts = append(opts, vm.BindWaitHandler(vm.Cell(*execPort), e.WaitHandler))
+	}
+
+	var prof *vm.Profiler
+	if *pprof != "" {
+		prof = vm.NewProfiler(pprofRate)
+		opts = append(opts, vm.Profile(prof))
+	}
+
+	i, fileCells, err = newVM(*fileName, outFileName, *size, vm.Format{Bits: int(srcCellSz), BigEndian: *srcBE}, opts...)
 	if err != nil {
 		return
 	}
+	signal.Notify(sig, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func(i *vm.Instance) {
+		for range sig {
+			i.RequestStop()
+		}
+	}(i)
+
 	start := time.Now()
-	if err = i.Run(); errors.Cause(err) == io.EOF {
+	if canvas != nil {
+		err = display.Run("retro - "+filepath.Base(*fileName), i, canvas, mouse)
+	} else {
+		err = i.Run()
+	}
+	if errors.Cause(err) == io.EOF || errors.Cause(err) == vm.ErrStopped {
 		err = nil
 	}
+	if prof != nil {
+		if perr := writeProfile(*pprof, prof, i); err == nil {
+			err = perr
+		}
+	}
 	if *execStats {
 		delta := time.Since(start)
 		fmt.Fprintf(os.Stderr, "Executed %d instructions in %v (%.3f MHz).\n", i.InstructionCount(), delta,
 			float64(i.InstructionCount())/float64(delta)*float64(time.Second)/1e6)
 	}
+	if *timing {
+		printTiming(os.Stderr, i.InstructionTiming())
+	}
 }
@@ -0,0 +1,100 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/db47h/ngaro/vm"
+)
+
+const portLines = 8 // height of the port activity pane
+
+// ports implements a live display of the last port events of the VM in the
+// bottom lines of the terminal. Like top, it is refreshed from a vm.Ticker.
+type ports struct {
+	w      io.Writer
+	flush  func() error
+	size   func() (int, int)
+	rec    *vm.PortRecorder
+	last   time.Time
+	height int // terminal height at last refresh
+	next   func(*vm.Instance)
+}
+
+func newPorts(w io.Writer, flush func() error, size func() (int, int)) *ports {
+	return &ports{
+		w:     w,
+		flush: flush,
+		size:  size,
+		rec:   vm.NewPortRecorder(portLines - 1),
+	}
+}
+
+// options returns the VM options needed to run the display. next is an
+// optional ticker function to chain, and ticks its tick interval.
+func (p *ports) options(next func(*vm.Instance), ticks int64) []vm.Option {
+	p.next = next
+	if next == nil || ticks > topTicks {
+		ticks = topTicks
+	}
+	return []vm.Option{vm.RecordPorts(p.rec), vm.Ticker(p.tick, ticks)}
+}
+
+func (p *ports) tick(i *vm.Instance) {
+	if p.next != nil {
+		p.next(i)
+	}
+	if now := time.Now(); now.Sub(p.last) >= topInterval {
+		p.last = now
+		p.draw()
+	}
+}
+
+// draw refreshes the port activity pane.
+func (p *ports) draw() {
+	_, h := p.size()
+	if h <= portLines+1 {
+		return
+	}
+	if h != p.height {
+		// restrict scrolling to the upper part of the screen
+		fmt.Fprintf(p.w, "\0337\033[1;%dr\0338", h-portLines)
+		p.height = h
+	}
+	ev := p.rec.Events()
+	fmt.Fprint(p.w, "\0337")
+	fmt.Fprintf(p.w, "\033[%d;1H\033[2K\033[7m %-79s\033[0m", h-portLines+1, "ngaro ports    insn count    pc  op    port value")
+	for n := 0; n < portLines-1; n++ {
+		fmt.Fprintf(p.w, "\033[%d;1H\033[2K", h-portLines+n+2)
+		if n < len(ev) {
+			fmt.Fprintf(p.w, " %v", ev[n])
+		}
+	}
+	fmt.Fprint(p.w, "\0338")
+	p.flush()
+}
+
+// close restores the terminal scrolling region.
+func (p *ports) close() {
+	if p.height > 0 {
+		fmt.Fprintf(p.w, "\0337\033[r\0338")
+		p.flush()
+	}
+}
@@ -0,0 +1,59 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// rollback implements the rollback sub-command.
+func rollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	fileName := fs.String("image", "retroImage", "memory image `filename`")
+	list := fs.Bool("l", false, "list available versions")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s rollback [options] [n]\n\nRestore the n-th previous version of the memory image (default 1).\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	s := &vm.Snapshots{Path: *fileName}
+	if *list {
+		l, err := s.Versions()
+		if err != nil {
+			return err
+		}
+		for n, v := range l {
+			fmt.Printf("%d\t%s\n", n+1, v)
+		}
+		return nil
+	}
+	n := 1
+	if fs.NArg() > 0 {
+		var err error
+		if n, err = strconv.Atoi(fs.Arg(0)); err != nil {
+			return errors.Wrap(err, "invalid version number")
+		}
+	}
+	return s.Rollback(n)
+}
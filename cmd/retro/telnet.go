@@ -0,0 +1,86 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/telnet"
+	"github.com/db47h/ngaro/vm"
+)
+
+// serveTelnet serves sessions over telnet on addr until SIGINT or SIGTERM.
+// Each session runs a clone of tmpl. If m is not nil, connections are served by
+// m, and m is closed before returning.
+func serveTelnet(addr string, tmpl *vm.Instance, m *mux.Mux, logger vm.Logger) error {
+	var mu sync.Mutex
+	clone := func(in io.Reader, out vm.Terminal) (*vm.Instance, error) {
+		mu.Lock()
+		i := tmpl.Clone()
+		mu.Unlock()
+		err := i.SetOptions(
+			vm.Input(in),
+			vm.Output(out),
+			vm.BindWaitHandler(1, port1Handler),
+			vm.BindWaitHandler(2, port2Handler(out)))
+		return i, err
+	}
+	s := &telnet.Server{
+		NewVM: func(c *telnet.Conn) (*vm.Instance, error) {
+			return clone(c, c.Terminal())
+		},
+		Logger: logger,
+	}
+	if m != nil {
+		m.NewVM = func(ms *mux.Session) (*vm.Instance, error) {
+			i, err := clone(ms, ms.Terminal())
+			if err != nil || ms.Snapshot() == "" {
+				return i, err
+			}
+			mem, _, err := vm.Load(ms.Snapshot(), len(i.Mem), 0)
+			if err != nil {
+				return nil, err
+			}
+			return i, i.ReloadImage(mem, false)
+		}
+		m.Logger = logger
+		s.Mux = m
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		if _, ok := <-sig; ok {
+			s.Close()
+		}
+	}()
+	err := s.ListenAndServe(addr)
+	if err == telnet.ErrServerClosed {
+		err = nil
+	}
+	if m != nil {
+		if e := m.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
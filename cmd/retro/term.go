@@ -19,6 +19,7 @@
 package main
 
 import (
+	"io"
 	"os"
 	"syscall"
 	"unsafe"
@@ -53,6 +54,17 @@ func setRawIO() (func(), error) {
 	}, nil
 }
 
+// rawInput returns the reader to use for console input in raw mode.
+func rawInput(f *os.File) io.Reader {
+	return f
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	var tios syscall.Termios
+	return termios.Tcgetattr(f.Fd(), &tios) == nil
+}
+
 type winsize struct {
 	row, col, xpixel, ypixel uint16
 }
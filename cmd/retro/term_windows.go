@@ -16,14 +16,74 @@
 
 package main
 
-import "github.com/pkg/errors"
+import (
+	"bytes"
+	"io"
+	"os"
 
-// setRawIO() attempts to set stdin to raw IO and returns a function
-// to restore IO settings as they were before
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// setRawIO switches the console to raw IO and returns a function to restore
+// the console modes as they were before. Like on Unix, Ctrl-C is still
+// processed by the system. Virtual terminal processing is enabled on output so
+// that VT100 escape sequences work, and on input so that cursor keys are
+// reported as VT100 sequences.
 func setRawIO() (func(), error) {
-	return nil, errors.New("raw IO not supported")
+	in := windows.Handle(os.Stdin.Fd())
+	out := windows.Handle(os.Stdout.Fd())
+	var inMode, outMode uint32
+	if err := windows.GetConsoleMode(in, &inMode); err != nil {
+		return nil, errors.Wrap(err, "GetConsoleMode failed")
+	}
+	if err := windows.GetConsoleMode(out, &outMode); err != nil {
+		return nil, errors.Wrap(err, "GetConsoleMode failed")
+	}
+	raw := inMode&^(windows.ENABLE_ECHO_INPUT|windows.ENABLE_LINE_INPUT) | windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+	if err := windows.SetConsoleMode(in, raw); err != nil {
+		return nil, errors.Wrap(err, "SetConsoleMode failed")
+	}
+	// older consoles do not support virtual terminal processing, in which case
+	// escape sequences are printed as is.
+	windows.SetConsoleMode(out, outMode|windows.ENABLE_PROCESSED_OUTPUT|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+	return func() {
+		windows.SetConsoleMode(in, inMode)
+		windows.SetConsoleMode(out, outMode)
+	}, nil
+}
+
+// crlfReader translates carriage returns to line feeds, since the Enter key
+// sends a carriage return on a console in raw mode.
+type crlfReader struct {
+	r io.Reader
+}
+
+func (c crlfReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for k := bytes.IndexByte(p[:n], '\r'); k >= 0; k = bytes.IndexByte(p[:n], '\r') {
+		p[k] = '\n'
+	}
+	return n, err
+}
+
+// rawInput returns the reader to use for console input in raw mode.
+func rawInput(f *os.File) io.Reader {
+	return crlfReader{f}
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
 }
 
-func consoleSize() (int, int) {
-	return 0, 0
+func consoleSize(f *os.File) func() (int, int) {
+	return func() (int, int) {
+		var info windows.ConsoleScreenBufferInfo
+		if err := windows.GetConsoleScreenBufferInfo(windows.Handle(f.Fd()), &info); err != nil {
+			return 0, 0
+		}
+		return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1
+	}
 }
@@ -0,0 +1,192 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+)
+
+const (
+	topLines    = 5                      // height of the status pane
+	topInterval = 500 * time.Millisecond // refresh interval
+	topTicks    = 1 << 16                // ticks between refresh checks
+	opCall      = vm.OpWait + 1          // index of implicit calls in top.mix
+	opCustom    = vm.OpWait + 2          // index of custom opcodes in top.mix
+)
+
+// top implements a live status display of the VM in the bottom lines of the
+// terminal: instruction rate, instruction mix, port activity and stack depths.
+//
+// Statistics are collected with a vm.Tracer and the display is refreshed from
+// a vm.Ticker, so everything happens in the VM goroutine.
+type top struct {
+	w      io.Writer
+	flush  func() error
+	size   func() (int, int)
+	mix    [opCustom + 1]int64
+	in     map[vm.Cell]int64
+	out    map[vm.Cell]int64
+	waits  int64
+	depth  int
+	count  int64 // instruction count at last refresh
+	last   time.Time
+	height int // terminal height at last refresh
+	next   func(*vm.Instance)
+}
+
+func newTop(w io.Writer, flush func() error, size func() (int, int)) *top {
+	return &top{
+		w:     w,
+		flush: flush,
+		size:  size,
+		in:    make(map[vm.Cell]int64),
+		out:   make(map[vm.Cell]int64),
+	}
+}
+
+// opNames holds the names of opcodes, indexed like top.mix.
+var opNames = func() []string {
+	var b bytes.Buffer
+	l := make([]string, opCustom+1)
+	for op := vm.OpNop; op <= vm.OpWait; op++ {
+		b.Reset()
+		asm.Disassemble([]vm.Cell{op, 0}, 0, &b)
+		l[op] = strings.Fields(b.String())[0]
+	}
+	l[vm.OpLit], l[opCall], l[opCustom] = "lit", "call", "custom"
+	return l
+}()
+
+// Trace implements vm.Tracer.
+func (t *top) Trace(pc int, op, tos vm.Cell, depth int) {
+	switch {
+	case op < 0:
+		op = opCustom
+	case op > vm.OpWait:
+		op = opCall
+	case op == vm.OpIn:
+		t.in[tos]++
+	case op == vm.OpOut:
+		t.out[tos]++
+	case op == vm.OpWait:
+		t.waits++
+	}
+	t.mix[op]++
+	t.depth = depth
+}
+
+// options returns the VM options needed to run the display. next is an
+// optional ticker function to chain, and ticks its tick interval.
+func (t *top) options(next func(*vm.Instance), ticks int64) []vm.Option {
+	t.next = next
+	if next == nil || ticks > topTicks {
+		ticks = topTicks
+	}
+	return []vm.Option{vm.Trace(t), vm.Ticker(t.tick, ticks)}
+}
+
+func (t *top) tick(i *vm.Instance) {
+	if t.next != nil {
+		t.next(i)
+	}
+	if now := time.Now(); now.Sub(t.last) >= topInterval {
+		t.draw(i, now)
+	}
+}
+
+// counts formats the most used keys of m.
+func counts(m map[vm.Cell]int64, max int) string {
+	type kv struct {
+		k vm.Cell
+		v int64
+	}
+	l := make([]kv, 0, len(m))
+	for k, v := range m {
+		l = append(l, kv{k, v})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].v > l[j].v || l[i].v == l[j].v && l[i].k < l[j].k })
+	var s []string
+	for n := 0; n < len(l) && n < max; n++ {
+		s = append(s, fmt.Sprintf("%d:%d", l[n].k, l[n].v))
+	}
+	return strings.Join(s, " ")
+}
+
+// draw refreshes the status pane.
+func (t *top) draw(i *vm.Instance, now time.Time) {
+	_, h := t.size()
+	if h <= topLines+1 {
+		return
+	}
+	if h != t.height {
+		// restrict scrolling to the upper part of the screen
+		fmt.Fprintf(t.w, "\0337\033[1;%dr\0338", h-topLines)
+		t.height = h
+	}
+	var total int64
+	for _, c := range t.mix {
+		total += c
+	}
+	var mips float64
+	if !t.last.IsZero() {
+		mips = float64(total-t.count) / now.Sub(t.last).Seconds() / 1e6
+	}
+	t.count, t.last = total, now
+
+	ops := make([]int, len(t.mix))
+	for n := range ops {
+		ops[n] = n
+	}
+	sort.Slice(ops, func(a, b int) bool { return t.mix[ops[a]] > t.mix[ops[b]] })
+	var mix []string
+	for _, op := range ops[:8] {
+		if t.mix[op] == 0 || total == 0 {
+			break
+		}
+		mix = append(mix, fmt.Sprintf("%s %.1f%%", opNames[op], float64(t.mix[op])*100/float64(total)))
+	}
+
+	lines := [topLines]string{
+		"\033[7m ngaro top" + strings.Repeat(" ", 70) + "\033[0m",
+		fmt.Sprintf(" %.3f MIPS, %d instructions, stack depth %d, address depth %d", mips, total, t.depth, len(i.Address())),
+		" mix:   " + strings.Join(mix, ", "),
+		" in:    " + counts(t.in, 8),
+		fmt.Sprintf(" out:   %s   wait: %d", counts(t.out, 8), t.waits),
+	}
+	fmt.Fprint(t.w, "\0337")
+	for n, l := range lines {
+		fmt.Fprintf(t.w, "\033[%d;1H\033[2K%s", h-topLines+n+1, l)
+	}
+	fmt.Fprint(t.w, "\0338")
+	t.flush()
+}
+
+// close restores the terminal scrolling region.
+func (t *top) close() {
+	if t.height > 0 {
+		fmt.Fprintf(t.w, "\0337\033[r\0338")
+		t.flush()
+	}
+}
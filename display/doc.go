@@ -0,0 +1,45 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package display shows the canvas of a VM instance in a window and feeds mouse
+// events back to the VM, so that graphical programs written for Ngaro-JS run
+// unmodified.
+//
+// The window is implemented with ebiten (https://ebiten.org) which must be
+// enabled with the ebiten build tag:
+//
+//	go get github.com/hajimehoshi/ebiten/v2
+//	go build -tags ebiten github.com/db47h/ngaro/cmd/retro
+//
+// Without this tag, Run always fails with ErrNotSupported.
+//
+// A typical host creates a vm.Canvas and a vm.Mouse, binds them to the
+// instance, then hands over the main goroutine to Run:
+//
+//	c := vm.NewCanvas(640, 480)
+//	m := new(vm.Mouse)
+//	i, err := vm.New(mem, imageFile, vm.BindCanvas(c), vm.BindMouse(m))
+//	if err != nil {
+//		// handle error
+//	}
+//	err = display.Run("retro", i, c, m)
+package display
+
+import "github.com/pkg/errors"
+
+// ErrNotSupported is returned by Run when the package has been built without
+// window support.
+var ErrNotSupported = errors.New("display support not compiled in (build with -tags ebiten)")
@@ -0,0 +1,88 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build ebiten
+
+package display
+
+import (
+	"github.com/db47h/ngaro/vm"
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Supported is true if the package has been built with window support.
+const Supported = true
+
+// game implements ebiten.Game.
+type game struct {
+	c    *vm.Canvas
+	m    *vm.Mouse
+	done chan struct{}
+}
+
+func (g *game) Update() error {
+	select {
+	case <-g.done:
+		return ebiten.Termination
+	default:
+	}
+	if g.m != nil {
+		g.m.Move(ebiten.CursorPosition())
+		g.m.SetButton(ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft))
+	}
+	return nil
+}
+
+func (g *game) Draw(screen *ebiten.Image) {
+	screen.WritePixels(g.c.Image().Pix)
+}
+
+func (g *game) Layout(_, _ int) (int, int) {
+	r := g.c.Bounds()
+	return r.Dx(), r.Dy()
+}
+
+// Run opens a window titled title that displays the canvas c, and runs the
+// instance i in a new goroutine. The pointer position, in canvas coordinates,
+// and the state of the left mouse button are fed to m, which may be nil. The
+// window can be resized, in which case the canvas is scaled to fit.
+//
+// Run must be called from the main goroutine. It returns when the VM stops,
+// with the error returned by i.Run. If the window is closed first, the VM is
+// asked to terminate with RequestStop, and Run waits for it to stop.
+func Run(title string, i *vm.Instance, c *vm.Canvas, m *vm.Mouse) error {
+	g := &game{c: c, m: m, done: make(chan struct{})}
+	var err error
+	go func() {
+		err = i.Run()
+		close(g.done)
+	}()
+	r := c.Bounds()
+	ebiten.SetWindowSize(r.Dx(), r.Dy())
+	ebiten.SetWindowTitle(title)
+	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
+	werr := ebiten.RunGame(g)
+	select {
+	case <-g.done:
+	default:
+		i.RequestStop()
+		<-g.done
+	}
+	if werr != nil {
+		return werr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The canvas command is an example host for canvas based programs. The VM draws
+// into a frame buffer shared with the host (see vm.SharedSegment) and is
+// synchronized with the host's frame rate by a vm.VSyncTicker. On each frame,
+// the host renders the frame buffer to a PNG file, which stands in for a GUI
+// window.
+//
+// Usage:
+//
+//	canvas [-fps n] [-frames n] [-o dir]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+const (
+	width   = 64
+	height  = 48
+	fbAddr  = 4096 // frame buffer address
+	vsyncPt = 10   // frame ready port
+)
+
+// program fills the frame buffer with a moving gradient, one frame at a time.
+var program = fmt.Sprintf(`
+	.equ fbsize %d
+	.equ fbaddr %d
+	jump start
+.org 32
+:vsync	( -f ) 0 0 out wait %d in dup 0 !jump 1+ drop jump vsync
+:1	;
+:draw	( f-f ) fbsize
+:0	push dup pop dup push + pop dup push fbaddr + 1- ! pop loop 0- ;
+:start	0
+:2	1+ draw vsync drop jump 2-
+`, width*height, fbAddr, vsyncPt)
+
+// render writes the frame buffer to a PNG file.
+func render(fb *vm.Segment, name string) error {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for n := 0; n < fb.Len(); n++ {
+		v := uint8(fb.Load(n))
+		img.Set(n%width, n/width, color.RGBA{v, v * 2, 255 - v, 255})
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func run() error {
+	fps := flag.Int("fps", 30, "frame rate")
+	frames := flag.Int64("frames", 30, "number of frames to render")
+	dir := flag.String("o", ".", "output `directory` for frames")
+	flag.Parse()
+
+	img, err := asm.Assemble("canvas", strings.NewReader(program))
+	if err != nil {
+		return err
+	}
+	fb := vm.NewSegment(width * height)
+	var renderErr error
+	onFrame := func(i *vm.Instance, frame int64) {
+		name := filepath.Join(*dir, fmt.Sprintf("frame%03d.png", frame))
+		if renderErr = render(fb, name); renderErr != nil || frame >= *frames {
+			i.Stop()
+		}
+	}
+	i, err := vm.New(img, "",
+		vm.SharedSegment(fbAddr, fb),
+		vm.Ticker(vm.VSyncTicker(*fps, vsyncPt, vm.NewClock(10e6, 0), onFrame)))
+	if err != nil {
+		return err
+	}
+	if err = i.Run(); errors.Cause(err) != vm.ErrStopped {
+		return err
+	}
+	return renderErr
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,144 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The scripting command is an example host that runs Retro scripts with words
+// implemented in Go. Go functions are registered by name and called from Retro
+// through a WAIT handler bound to port 100: the name of the function is passed
+// as a string on the stack.
+//
+// A prelude defines a Retro word for each Go function, so that scripts can use
+// them like any other word:
+//
+//	"hello" upper puts cr
+//	now putn cr
+//
+// Additional command line arguments are passed to the script and can be
+// retrieved with the argv device on port 5 (see vm.Args).
+//
+// Usage:
+//
+//	scripting [-image filename] [-ibits n] script.rx [-- args...]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/db47h/ngaro/lang/retro"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// goPort is the port the Go functions device is bound to.
+const goPort = 100
+
+// goFuncs are the Go functions callable from Retro. They operate directly on
+// the VM stack.
+var goFuncs = map[string]func(i *vm.Instance) error{
+	// ( -n ) current unix time.
+	"now": func(i *vm.Instance) error {
+		i.Push(vm.Cell(time.Now().Unix()))
+		return nil
+	},
+	// ( $-$ ) convert a string to upper case, in place.
+	"upper": func(i *vm.Instance) error {
+		a := i.Tos()
+		s := retro.StringCodec.Decode(i.Mem, a)
+		retro.StringCodec.Encode(i.Mem, a, bytes.ToUpper(s))
+		return nil
+	},
+}
+
+// goHandler calls the Go function named by the string on top of the stack.
+func goHandler(i *vm.Instance, v, port vm.Cell) error {
+	if v != 1 {
+		return nil
+	}
+	name := string(retro.StringCodec.Decode(i.Mem, i.Pop()))
+	fn := goFuncs[name]
+	if fn == nil {
+		return errors.Errorf("unknown Go function %q", name)
+	}
+	if err := fn(i); err != nil {
+		return errors.Wrapf(err, "Go function %q failed", name)
+	}
+	i.WaitReply(0, port)
+	return nil
+}
+
+// prelude returns Retro code defining a word for each Go function.
+func prelude() string {
+	var names []string
+	for name := range goFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, ": go ( $- ) 1 %d out 0 0 out wait %[1]d in drop ;\n", goPort)
+	for _, name := range names {
+		fmt.Fprintf(&b, ": %s \"%[1]s\" go ;\n", name)
+	}
+	return b.String()
+}
+
+func run() error {
+	fileName := flag.String("image", "retroImage", "load memory image from `filename`")
+	bits := flag.Int("ibits", vm.CellBits, "cell size in bits of the memory image")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		return errors.New("no script specified")
+	}
+	script, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+
+	img, _, err := vm.Load(*fileName, 100000, *bits)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	i, err := vm.New(img, *fileName,
+		vm.StringCodec(retro.StringCodec),
+		vm.Output(vm.NewVT100Terminal(w, w.Flush, nil)),
+		vm.BindWaitHandler(goPort, goHandler),
+		vm.Args(flag.Args()[1:]...),
+		vm.Input(bufio.NewReader(script)),
+		vm.Input(strings.NewReader(prelude())))
+	if err != nil {
+		return err
+	}
+	if err = i.Run(); errors.Cause(err) != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
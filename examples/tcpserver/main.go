@@ -0,0 +1,128 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The tcpserver command is an example host serving Retro sessions over TCP. Each
+// connection gets its own sandboxed VM instance (see vm.ProfileSandboxed),
+// registered in a vm.Registry under the address of the remote peer. On SIGINT
+// or SIGTERM, the server stops accepting connections and asks all running
+// sessions to terminate gracefully (see vm.Instance.RequestStop).
+//
+// Usage:
+//
+//	tcpserver [-addr host:port] [-image filename] [-ibits n] [-size n]
+//
+// Then connect with any line based TCP client, like:
+//
+//	nc localhost 4000
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/db47h/ngaro/lang/retro"
+	"github.com/db47h/ngaro/vm"
+)
+
+// shutdownPort is the port notified of shutdown requests.
+const shutdownPort = 10
+
+// server holds the state shared by all sessions.
+type server struct {
+	img []vm.Cell
+	reg *vm.Registry
+	wg  sync.WaitGroup
+}
+
+// serve runs a session on the given connection.
+func (s *server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	i, err := vm.New(append([]vm.Cell(nil), s.img...), "",
+		vm.ProfileSandboxed(),
+		vm.StringCodec(retro.StringCodec),
+		vm.Input(bufio.NewReader(conn)),
+		vm.Output(vm.NewVT100Terminal(w, w.Flush, nil)),
+		vm.ShutdownPort(shutdownPort, 5*time.Second),
+		vm.Register(s.reg, conn.RemoteAddr().String()))
+	if err != nil {
+		log.Printf("%s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer s.reg.Remove(s.reg.ID(i))
+	log.Printf("%s: session started", conn.RemoteAddr())
+	err = i.Run()
+	w.Flush()
+	log.Printf("%s: session ended: %v", conn.RemoteAddr(), err)
+}
+
+// shutdown requests all sessions to terminate.
+func (s *server) shutdown() {
+	for _, info := range s.reg.List() {
+		if i := s.reg.Lookup(info.ID); i != nil {
+			i.RequestStop()
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:4000", "listen on `address`")
+	fileName := flag.String("image", "retroImage", "load memory image from `filename`")
+	bits := flag.Int("ibits", vm.CellBits, "cell size in bits of the memory image")
+	size := flag.Int("size", 100000, "runtime memory image size in cells")
+	flag.Parse()
+
+	img, _, err := vm.Load(*fileName, *size, *bits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	log.Printf("listening on %s", l.Addr())
+
+	s := &server{img: img, reg: vm.NewRegistry(nil)}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Print("shutting down")
+		l.Close()
+		s.shutdown()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+	s.wg.Wait()
+}
@@ -31,6 +31,9 @@ import (
 //
 // Encode writes the given string at position start in specified slice
 // and terminates it with a '\0' vm.Cell.
+//
+// BytesPerCell returns 1 and EncodedLen returns n+1, since strings are not
+// packed.
 var StringCodec stringCodec
 
 type stringCodec struct{}
@@ -63,20 +66,48 @@ func (stringCodec) Encode(mem []vm.Cell, start vm.Cell, s []byte) {
 	}
 }
 
+func (stringCodec) BytesPerCell() int { return 1 }
+
+func (stringCodec) EncodedLen(n int) int { return n + 1 }
+
 // ShrinkSave returns a closure to pass to vm.SaveMemoryImage that will save
 // only the used part of a Retro memory image (i.e. mem[0:HERE]) if shrink is
 // true. The cellBits parameter specifies the Cell size in bits to use when
-// saving.
+// saving. If the value of HERE is invalid, the whole image is saved.
+//
+// Deprecated: use vm.ShrinkSave, which reports invalid HERE values instead of
+// silently saving the whole image.
 func ShrinkSave(shrink bool, cellBits int) func(fileName string, mem []vm.Cell) error {
 	return func(fileName string, mem []vm.Cell) error {
-		l := vm.Cell(len(mem))
-		here := l
-		if shrink && len(mem) >= 3 {
-			here = mem[3]
-		}
-		if here < 0 || here > l {
-			here = l
+		if shrink {
+			if m, err := vm.ShrinkImage(mem); err == nil {
+				mem = m
+			}
 		}
-		return vm.Save(fileName, mem[:here], cellBits)
+		return vm.Save(fileName, mem, cellBits)
+	}
+}
+
+// Offsets of dictionary header fields.
+const (
+	lastAddr = 2 // address of the pointer to the last dictionary header
+	hdrXT    = 2
+	hdrName  = 4
+)
+
+// Symbols walks the dictionary of a Retro memory image and returns a symbol
+// table that maps the address of each word to its name. The result can be
+// passed to vm.Instance.CallStack.
+//
+// Walking stops at the first invalid header, so an image with a corrupt
+// dictionary yields a partial table.
+func Symbols(mem []vm.Cell) *vm.SymbolTable {
+	t := &vm.SymbolTable{}
+	if len(mem) <= lastAddr {
+		return t
+	}
+	for p, n := mem[lastAddr], 0; p > 0 && p < vm.Cell(len(mem)-hdrName) && n < len(mem); p, n = mem[p], n+1 {
+		t.Add(mem[p+hdrXT], string(StringCodec.Decode(mem, p+hdrName)))
 	}
+	return t
 }
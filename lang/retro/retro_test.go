@@ -106,6 +106,10 @@ func TestShrinkSave(t *testing.T) {
 	if err := saveMemAndCheck(fn, mem, true, 20); err != nil {
 		t.Fatal(err)
 	}
+	// too small to hold HERE
+	if err := saveMemAndCheck(fn, mem[:3], true, 3); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDumpVM(t *testing.T) {
@@ -125,3 +129,33 @@ func TestDumpVM(t *testing.T) {
 		t.Fatalf("Expected:\n%s\ngot: %s", strconv.Quote(exp), strconv.Quote(s))
 	}
 }
+
+func TestSymbols(t *testing.T) {
+	mem, _, err := vm.Load("../../vm/testdata/retroImage", 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := retro.Symbols(mem)
+	if st.Len() == 0 {
+		t.Fatal("Empty symbol table")
+	}
+	for _, name := range []string{"describe", "needs"} {
+		found := false
+		for p := mem[2]; p != 0; p = mem[p] {
+			if string(retro.StringCodec.Decode(mem, p+4)) != name {
+				continue
+			}
+			found = true
+			sym, off, ok := st.Lookup(mem[p+2] + 1)
+			if !ok || sym.Name != name || off != 1 {
+				t.Errorf("Lookup %s: got %s+%d, %v", name, sym.Name, off, ok)
+			}
+		}
+		if !found {
+			t.Errorf("Word %s not found in dictionary", name)
+		}
+	}
+	if st = retro.Symbols(mem[:2]); st.Len() != 0 {
+		t.Errorf("Expected empty symbol table, got %d symbols", st.Len())
+	}
+}
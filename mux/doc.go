@@ -0,0 +1,66 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mux hosts named VM sessions that clients connected over a terminal
+// can create, attach to and detach from, like terminal multiplexers such as
+// tmux or screen.
+//
+// A client connection, for example a telnet connection or an SSH session,
+// starts at a command prompt where the following commands are available:
+//
+//	new NAME     create session NAME and attach to it
+//	attach NAME  attach to session NAME
+//	ls           list sessions
+//	kill NAME    end session NAME
+//	quit         disconnect, leaving sessions running
+//
+// Once attached, the client's input goes to the session's VM and the VM's
+// output to the client. Typing Ctrl-A then d detaches from the session and
+// returns to the prompt; Ctrl-A Ctrl-A sends a Ctrl-A to the VM. The escape key
+// can be changed with the Escape field of Mux.
+//
+// Detached sessions keep their state: their VM is paused and its output is
+// buffered until a client attaches again, possibly from another connection.
+// Sessions are registered in a vm.Registry, so that they can also be managed
+// with the registry's management device. If a snapshot directory is set, the
+// memory image of the sessions still running when the Mux is closed is saved
+// there (see vm.Snapshots), and a new session with the same name can be
+// restored from it.
+//
+// The telnet and sshd packages serve connections with a Mux when one is set
+// in their configuration:
+//
+//	m := &mux.Mux{
+//		NewVM: func(s *mux.Session) (*vm.Instance, error) {
+//			img := append([]vm.Cell(nil), defaultImage...)
+//			if fn := s.Snapshot(); fn != "" {
+//				// resume from the last snapshot
+//				var err error
+//				if img, _, err = vm.Load(fn, 0, 0); err != nil {
+//					return nil, err
+//				}
+//			}
+//			return vm.New(img, "",
+//				vm.ProfileSandboxed(),
+//				vm.Input(s),
+//				vm.Output(s.Terminal()))
+//		},
+//		SnapshotDir: "sessions",
+//	}
+//	defer m.Close()
+//	s := &telnet.Server{Mux: m}
+//	err := s.ListenAndServe("localhost:2323")
+package mux
@@ -0,0 +1,471 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by Serve after a call to Close.
+var ErrClosed = errors.New("mux: closed")
+
+// DefaultEscape is the default escape key: Ctrl-A.
+const DefaultEscape = 'A' - '@'
+
+// Mux hosts named VM sessions. See the package documentation.
+type Mux struct {
+	// NewVM returns the VM instance of a new session. The instance should read
+	// its input from s and write its output to s.Terminal(). If s.Snapshot()
+	// is not empty, the instance should be loaded from this memory image file.
+	// NewVM is called from the goroutine serving the client creating the
+	// session.
+	NewVM func(s *Session) (*vm.Instance, error)
+
+	// Registry, if not nil, is the registry sessions are added to, under
+	// their name. Defaults to a new, private Registry.
+	Registry *vm.Registry
+
+	// SnapshotDir, if not empty, is the directory where Close saves the memory
+	// image of live sessions, with one vm.Snapshots per session.
+	SnapshotDir string
+
+	// SnapshotKeep is the number of previous snapshots kept per session. See
+	// vm.Snapshots.
+	SnapshotKeep int
+
+	// Escape is the key that introduces commands while attached to a
+	// session. Defaults to DefaultEscape.
+	Escape byte
+
+	// Logger, if not nil, is used to report session events.
+	Logger vm.Logger
+
+	mu       sync.Mutex
+	reg      *vm.Registry
+	sessions map[string]*Session
+	closed   bool
+}
+
+// Serve runs the command prompt of a client reading its input from r and
+// writing its output to t, until the client quits or r returns an error. If
+// the client is attached to a session at that time, the session is detached.
+// Serve returns nil if the client quit or r reached EOF.
+func (m *Mux) Serve(r io.Reader, t vm.Terminal) error {
+	c := &client{
+		m:    m,
+		t:    t,
+		in:   make(chan []byte),
+		errc: make(chan error, 1),
+		quit: make(chan struct{}),
+		esc:  m.Escape,
+	}
+	if c.esc == 0 {
+		c.esc = DefaultEscape
+	}
+	go c.read(r)
+	defer close(c.quit)
+	defer c.detach()
+	c.printf("Type help for a list of commands.\n")
+	c.prompt()
+	for {
+		var done chan struct{}
+		if c.s != nil {
+			done = c.s.done
+		}
+		select {
+		case p := <-c.in:
+			if !c.input(p) {
+				return nil
+			}
+		case err := <-c.errc:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-done:
+			s := c.s
+			c.detach()
+			c.printf("\n[session %s exited", s.name)
+			if s.err != nil {
+				c.printf(": %v", s.err)
+			}
+			c.printf("]\n")
+			c.prompt()
+		}
+	}
+}
+
+// Close ends all sessions and, if SnapshotDir is set, saves their memory
+// image. Sessions end as soon as their VM reaches the next control check or
+// tries to read input. Subsequent attempts to create sessions fail with
+// ErrClosed.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	l := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		l = append(l, s)
+	}
+	m.mu.Unlock()
+	var err error
+	for _, s := range l {
+		m.kill(s)
+		if m.SnapshotDir == "" {
+			continue
+		}
+		ss := &vm.Snapshots{Path: m.snapshotPath(s.name), Keep: m.SnapshotKeep}
+		if e := ss.Save(s.i); e != nil && err == nil {
+			err = errors.Wrapf(e, "mux: snapshot of session %s failed", s.name)
+		}
+	}
+	return err
+}
+
+// snapshotPath returns the path of the snapshots of the named session.
+func (m *Mux) snapshotPath(name string) string {
+	return filepath.Join(m.SnapshotDir, name+".img")
+}
+
+// registry returns the registry sessions are added to. m.mu must be held.
+func (m *Mux) registry() *vm.Registry {
+	if m.reg == nil {
+		m.reg = m.Registry
+		if m.reg == nil {
+			m.reg = vm.NewRegistry(nil)
+		}
+		m.sessions = make(map[string]*Session)
+	}
+	return m.reg
+}
+
+// validName returns true if name can be used as a session name. Names are
+// used as file names for snapshots.
+func validName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// create creates a new session and runs its VM in a new goroutine.
+func (m *Mux) create(name string) (*Session, error) {
+	if !validName(name) {
+		return nil, errors.Errorf("invalid session name %q", name)
+	}
+	m.mu.Lock()
+	err := m.checkNew(name)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var snapshot string
+	if m.SnapshotDir != "" {
+		if _, err = os.Stat(m.snapshotPath(name)); err == nil {
+			snapshot = m.snapshotPath(name)
+		}
+	}
+	s := newSession(name, snapshot)
+	s.i, err = m.NewVM(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "session setup failed")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err = m.checkNew(name); err != nil {
+		return nil, err
+	}
+	s.id = m.reg.Add(s.i, name)
+	m.sessions[name] = s
+	go m.run(s)
+	if m.Logger != nil {
+		m.Logger.Info("session started", "name", name)
+	}
+	return s, nil
+}
+
+// checkNew checks that a new session can be created with the given name. m.mu
+// must be held.
+func (m *Mux) checkNew(name string) error {
+	m.registry()
+	if m.closed {
+		return ErrClosed
+	}
+	if m.sessions[name] != nil {
+		return errors.Errorf("session %s already exists", name)
+	}
+	return nil
+}
+
+// run runs the VM of a session.
+func (m *Mux) run(s *Session) {
+	err := s.i.Run()
+	s.term.Flush()
+	m.mu.Lock()
+	m.reg.Remove(s.id)
+	if m.sessions[s.name] == s {
+		delete(m.sessions, s.name)
+	}
+	s.err = err
+	m.mu.Unlock()
+	close(s.done)
+	if m.Logger != nil {
+		m.Logger.Info("session ended", "name", s.name, "err", err)
+	}
+}
+
+// kill ends a session and waits for its VM to return from Run.
+func (m *Mux) kill(s *Session) {
+	s.i.Stop()
+	s.closeInput()
+	s.i.Resume()
+	<-s.done
+}
+
+// lookup returns the named session.
+func (m *Mux) lookup(name string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sessions[name]; s != nil {
+		return s, nil
+	}
+	return nil, errors.Errorf("no session named %s", name)
+}
+
+// client is a client connection.
+type client struct {
+	m    *Mux
+	t    vm.Terminal
+	in   chan []byte
+	errc chan error
+	quit chan struct{}
+
+	s       *Session // attached session
+	esc     byte     // escape key
+	escaped bool     // the escape key has been typed
+	line    []byte   // command line
+}
+
+// read sends the data read from r to c.in and the read error to c.errc.
+func (c *client) read(r io.Reader) {
+	for {
+		p := make([]byte, 256)
+		n, err := r.Read(p)
+		if n > 0 {
+			select {
+			case c.in <- p[:n]:
+			case <-c.quit:
+				return
+			}
+		}
+		if err != nil {
+			c.errc <- err
+			return
+		}
+	}
+}
+
+func (c *client) printf(format string, args ...interface{}) {
+	fmt.Fprintf(c.t, format, args...)
+	c.t.Flush()
+}
+
+func (c *client) prompt() {
+	c.printf("mux> ")
+}
+
+// input processes the client's input. It returns false if the client quit.
+func (c *client) input(p []byte) bool {
+	for len(p) > 0 {
+		if c.s != nil {
+			p = c.forward(p)
+			continue
+		}
+		b := p[0]
+		p = p[1:]
+		switch {
+		case b == '\n':
+			c.printf("\n")
+			l := string(c.line)
+			c.line = c.line[:0]
+			if !c.exec(l) {
+				return false
+			}
+			if c.s == nil {
+				c.prompt()
+			}
+		case b == 4 && len(c.line) == 0: // Ctrl-D
+			c.printf("\n")
+			return false
+		case b == 8 || b == 127:
+			if len(c.line) > 0 {
+				c.line = c.line[:len(c.line)-1]
+				c.printf("\b \b")
+			}
+		case b >= 32 && b < 127:
+			c.line = append(c.line, b)
+			c.printf("%c", b)
+		}
+	}
+	return true
+}
+
+// forward sends p to the attached session until the detach command. It returns
+// any input following the detach command.
+func (c *client) forward(p []byte) []byte {
+	var fwd []byte
+	for n, b := range p {
+		switch {
+		case c.escaped:
+			c.escaped = false
+			switch b {
+			case 'd':
+				c.s.write(fwd)
+				s := c.s
+				c.detach()
+				c.printf("\n[detached from %s]\n", s.name)
+				c.prompt()
+				return p[n+1:]
+			case c.esc:
+				fwd = append(fwd, b)
+			}
+		case b == c.esc:
+			c.escaped = true
+		default:
+			fwd = append(fwd, b)
+		}
+	}
+	c.s.write(fwd)
+	return nil
+}
+
+// exec executes a command line. It returns false if the client quit.
+func (c *client) exec(l string) bool {
+	args := strings.Fields(l)
+	if len(args) == 0 {
+		return true
+	}
+	var err error
+	switch cmd := args[0]; {
+	case cmd == "quit" && len(args) == 1:
+		return false
+	case cmd == "help" && len(args) == 1:
+		c.printf("new NAME     create session NAME and attach to it\n" +
+			"attach NAME  attach to session NAME\n" +
+			"ls           list sessions\n" +
+			"kill NAME    end session NAME\n" +
+			"quit         disconnect, leaving sessions running\n")
+		c.printf("Once attached, type %s d to detach.\n", keyName(c.esc))
+	case cmd == "ls" && len(args) == 1:
+		c.list()
+	case cmd == "new" && len(args) == 2:
+		var s *Session
+		if s, err = c.m.create(args[1]); err == nil {
+			err = c.attach(s)
+		}
+	case cmd == "attach" && len(args) == 2:
+		var s *Session
+		if s, err = c.m.lookup(args[1]); err == nil {
+			err = c.attach(s)
+		}
+	case cmd == "kill" && len(args) == 2:
+		var s *Session
+		if s, err = c.m.lookup(args[1]); err == nil {
+			c.m.kill(s)
+		}
+	default:
+		err = errors.Errorf("invalid command: %s", l)
+	}
+	if err != nil {
+		c.printf("%v\n", err)
+	}
+	return true
+}
+
+// list prints the list of sessions.
+func (c *client) list() {
+	m := c.m
+	m.mu.Lock()
+	l := make([]string, 0, len(m.sessions))
+	for n, s := range m.sessions {
+		st := "detached"
+		if s.c != nil {
+			st = "attached"
+		}
+		l = append(l, n+"\t"+st)
+	}
+	m.mu.Unlock()
+	sort.Strings(l)
+	for _, s := range l {
+		c.printf("%s\n", s)
+	}
+}
+
+// attach attaches the client to s and resumes its VM.
+func (c *client) attach(s *Session) error {
+	m := c.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.c != nil {
+		return errors.Errorf("session %s is attached to another client", s.name)
+	}
+	s.c = c
+	c.s = s
+	c.escaped = false
+	s.term.attach(c.t)
+	m.reg.Resume(s.id)
+	return nil
+}
+
+// detach detaches the client from its session, if any, and pauses its VM.
+func (c *client) detach() {
+	s := c.s
+	if s == nil {
+		return
+	}
+	m := c.m
+	m.mu.Lock()
+	s.c = nil
+	c.s = nil
+	m.reg.Pause(s.id)
+	m.mu.Unlock()
+	s.term.detach()
+}
+
+// keyName returns the name of key k.
+func keyName(k byte) string {
+	if k < 32 {
+		return "Ctrl-" + string(rune(k+'@'))
+	}
+	return string(rune(k))
+}
@@ -0,0 +1,196 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/vm"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// waitFor waits until the output in b contains s.
+func waitFor(t *testing.T, b *syncBuffer, s string) {
+	t.Helper()
+	for n := 0; n < 200; n++ {
+		if strings.Contains(b.String(), s) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %q in output, got %q", s, b.String())
+}
+
+func newMux(t *testing.T) *mux.Mux {
+	img, err := asm.Assemble("Mux", strings.NewReader(`jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:emit 1 2 out 0 0 out wait ;
+		:start getc emit jump start`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mux.Mux{
+		NewVM: func(s *mux.Session) (*vm.Instance, error) {
+			mem := append([]vm.Cell(nil), img...)
+			if fn := s.Snapshot(); fn != "" {
+				var err error
+				if mem, _, err = vm.Load(fn, 0, 0); err != nil {
+					return nil, err
+				}
+			}
+			return vm.New(mem, "", vm.Input(s), vm.Output(s.Terminal()))
+		},
+	}
+}
+
+func TestMux(t *testing.T) {
+	m := newMux(t)
+	m.SnapshotDir, _ = ioutil.TempDir("", "ngaro-mux")
+	defer os.RemoveAll(m.SnapshotDir)
+
+	var out syncBuffer
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- m.Serve(r, vm.NewVT100Terminal(&out, nil, nil)) }()
+
+	w.Write([]byte("new a\nxyz"))
+	waitFor(t, &out, "new a\nxyz")
+	w.Write([]byte("\x01d"))
+	waitFor(t, &out, "xyz\n[detached from a]\nmux> ")
+	w.Write([]byte("new b\nuv\x01\x01"))
+	waitFor(t, &out, "uv\x01")
+	w.Write([]byte("\x01dls\n"))
+	waitFor(t, &out, "uv\x01\n[detached from b]\nmux> ls\na\tdetached\nb\tdetached\nmux> ")
+
+	// attach from a second client while the first one is attached.
+	var out2 syncBuffer
+	r2, w2 := io.Pipe()
+	done2 := make(chan error)
+	go func() { done2 <- m.Serve(r2, vm.NewVT100Terminal(&out2, nil, nil)) }()
+	// output while detached is buffered.
+	w.Write([]byte("attach a\n1\x01d"))
+	waitFor(t, &out, "[detached from a]\nmux> ")
+	w.Write([]byte("attach a\n"))
+	waitFor(t, &out, "attach a\n1")
+	w2.Write([]byte("attach a\n"))
+	waitFor(t, &out2, "session a is attached to another client\n")
+	w2.Write([]byte("kill a\nquit\n"))
+	if err := <-done2; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, &out, "[session a exited")
+
+	w.Write([]byte("bogus\nnew b\nnew ../b\n"))
+	waitFor(t, &out, "invalid command: bogus\n")
+	waitFor(t, &out, "session b already exists\n")
+	waitFor(t, &out, "invalid session name \"../b\"\n")
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(m.SnapshotDir, "b.img")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(m.SnapshotDir, "a.img")); err == nil {
+		t.Fatal("Unexpected snapshot of a killed session")
+	}
+	r, w = io.Pipe()
+	go func() { done <- m.Serve(r, vm.NewVT100Terminal(&out, nil, nil)) }()
+	w.Write([]byte("new c\n"))
+	waitFor(t, &out, mux.ErrClosed.Error())
+	w.Close()
+	<-done
+}
+
+func TestMux_snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngaro-mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newMux(t)
+	m.SnapshotDir = dir
+	var restored string
+	newVM := m.NewVM
+	m.NewVM = func(s *mux.Session) (*vm.Instance, error) {
+		restored = s.Snapshot()
+		return newVM(s)
+	}
+	var out syncBuffer
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- m.Serve(r, vm.NewVT100Terminal(&out, nil, nil)) }()
+	w.Write([]byte("new a\n"))
+	waitFor(t, &out, "new a\n")
+	if restored != "" {
+		t.Fatalf("Unexpected snapshot %q", restored)
+	}
+	w.Close()
+	<-done
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newMux(t)
+	m.SnapshotDir = dir
+	m.NewVM = func(s *mux.Session) (*vm.Instance, error) {
+		restored = s.Snapshot()
+		return newVM(s)
+	}
+	r, w = io.Pipe()
+	go func() { done <- m.Serve(r, vm.NewVT100Terminal(&out, nil, nil)) }()
+	w.Write([]byte("new a\nq"))
+	waitFor(t, &out, "new a\nq")
+	if exp := filepath.Join(dir, "a.img"); restored != exp {
+		t.Fatalf("Expected snapshot %q, got %q", exp, restored)
+	}
+	w.Close()
+	<-done
+	m.Close()
+}
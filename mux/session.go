@@ -0,0 +1,206 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/db47h/ngaro/vm"
+)
+
+// maxBuffered is the maximum number of bytes of output buffered while a
+// session is detached. Any output beyond that is discarded.
+const maxBuffered = 64 << 10
+
+// Session is a named VM session hosted by a Mux.
+//
+// Read returns the input typed by the client attached to the session. It
+// blocks while the session is detached, and returns io.EOF once the session has
+// been killed or the Mux closed. Before blocking, Read flushes the session's
+// Terminal.
+type Session struct {
+	name     string
+	snapshot string
+	term     terminal
+
+	i    *vm.Instance
+	id   vm.Cell
+	c    *client       // attached client, guarded by Mux.mu
+	done chan struct{} // closed when Run returns
+	err  error         // error returned by Run, valid once done is closed
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func newSession(name, snapshot string) *Session {
+	s := &Session{name: name, snapshot: snapshot, done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Name returns the name of the session.
+func (s *Session) Name() string { return s.name }
+
+// Snapshot returns the file name of the last snapshot of a session with the
+// same name, saved when a previous Mux was closed, or an empty string if there
+// is none.
+func (s *Session) Snapshot() string { return s.snapshot }
+
+// Terminal returns the vm.Terminal of the session. Output written while the
+// session is detached is buffered and sent to the next client attaching to it.
+// Cursor movements, colors and screen clears are discarded while detached.
+func (s *Session) Terminal() vm.Terminal { return &s.term }
+
+func (s *Session) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && !s.closed {
+		s.mu.Unlock()
+		s.term.Flush()
+		s.mu.Lock()
+		if len(s.buf) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+	}
+	if len(s.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// write sends p to the session's input.
+func (s *Session) write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.buf = append(s.buf, p...)
+		s.cond.Signal()
+	}
+	s.mu.Unlock()
+}
+
+// closeInput closes the session's input. Read returns io.EOF once pending input
+// has been read.
+func (s *Session) closeInput() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// terminal is the vm.Terminal of a session. It forwards output to the terminal
+// of the attached client, if any.
+type terminal struct {
+	mu  sync.Mutex
+	t   vm.Terminal // client terminal, nil while detached
+	buf bytes.Buffer
+}
+
+// attach sends the buffered output to t, then forwards all output to t.
+func (t *terminal) attach(ct vm.Terminal) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.t = ct
+	ct.Write(t.buf.Bytes())
+	t.buf.Reset()
+	ct.Flush()
+}
+
+// detach starts buffering output.
+func (t *terminal) detach() {
+	t.mu.Lock()
+	if t.t != nil {
+		t.t.Flush()
+		t.t = nil
+	}
+	t.mu.Unlock()
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.t != nil {
+		return t.t.Write(p)
+	}
+	if n := maxBuffered - t.buf.Len(); n < len(p) {
+		t.buf.Write(p[:n])
+	} else {
+		t.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (t *terminal) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.t != nil {
+		return t.t.Flush()
+	}
+	return nil
+}
+
+func (t *terminal) Size() (width int, height int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.t != nil {
+		return t.t.Size()
+	}
+	return 0, 0
+}
+
+func (t *terminal) Clear() {
+	t.mu.Lock()
+	if t.t != nil {
+		t.t.Clear()
+	}
+	t.mu.Unlock()
+}
+
+func (t *terminal) MoveCursor(x, y int) {
+	t.mu.Lock()
+	if t.t != nil {
+		t.t.MoveCursor(x, y)
+	}
+	t.mu.Unlock()
+}
+
+func (t *terminal) FgColor(fg int) {
+	t.mu.Lock()
+	if t.t != nil {
+		t.t.FgColor(fg)
+	}
+	t.mu.Unlock()
+}
+
+func (t *terminal) BgColor(bg int) {
+	t.mu.Lock()
+	if t.t != nil {
+		t.t.BgColor(bg)
+	}
+	t.mu.Unlock()
+}
+
+func (t *terminal) Port8Enabled() bool { return true }
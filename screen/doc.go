@@ -0,0 +1,69 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package screen provides a full-screen vm.Terminal that drives the host
+// terminal natively instead of emitting raw VT100 escape sequences, so that
+// programs using port 8 work on Windows consoles as well as inside terminal
+// multiplexers, with proper handling of window resizes.
+//
+// The terminal is implemented with tcell (https://github.com/gdamore/tcell)
+// which must be enabled with the tcell build tag:
+//
+//	go get github.com/gdamore/tcell/v2
+//	go build -tags tcell github.com/db47h/ngaro/cmd/retro
+//
+// Without this tag, New always fails with ErrNotSupported.
+//
+// Besides output, the terminal provides keyboard input and the mouse device on
+// port 7:
+//
+//	t, err := screen.New(nil)
+//	if err != nil {
+//		// handle error
+//	}
+//	defer t.Close()
+//	i, err := vm.New(mem, imageFile,
+//		vm.Output(t),
+//		vm.Input(vm.NewAsyncReader(t.Input())))
+package screen
+
+import (
+	"io"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// ErrNotSupported is returned by New when the package has been built without
+// tcell support.
+var ErrNotSupported = errors.New("full-screen terminal support not compiled in (build with -tags tcell)")
+
+// Terminal is a full-screen terminal. Mouse events are reported through the
+// vm.MouseProvider interface, with coordinates in character cells.
+type Terminal interface {
+	vm.Terminal
+	vm.MouseProvider
+
+	// Input returns the keyboard input. Keys are encoded in UTF-8, the Enter
+	// key as '\n', control keys as their ASCII code and cursor keys as VT100
+	// escape sequences. Since the terminal does not buffer keys, the input
+	// should be wrapped in a vm.AsyncReader. It reaches EOF when the terminal
+	// is closed.
+	Input() io.Reader
+
+	// Close restores the host terminal to its original state.
+	Close() error
+}
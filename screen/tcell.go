@@ -0,0 +1,276 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build tcell
+
+package screen
+
+import (
+	"io"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/pkg/errors"
+)
+
+// Supported is true if the package has been built with tcell support.
+const Supported = true
+
+type terminal struct {
+	s         tcell.Screen
+	interrupt func()
+	in        *io.PipeReader
+	out       *io.PipeWriter
+
+	mu      sync.Mutex
+	x, y    int
+	style   tcell.Style
+	partial []byte // incomplete UTF-8 sequence at the end of the last write
+	closed  bool
+
+	mx, my  int
+	pressed bool
+}
+
+// New initializes the host terminal and returns a new full-screen Terminal.
+// If interrupt is not nil, it is called when the user presses Ctrl-C, instead
+// of sending the key to the input.
+func New(interrupt func()) (Terminal, error) {
+	s, err := tcell.NewScreen()
+	if err != nil {
+		return nil, errors.Wrap(err, "screen initialization failed")
+	}
+	if err = s.Init(); err != nil {
+		return nil, errors.Wrap(err, "screen initialization failed")
+	}
+	s.EnableMouse()
+	s.Clear()
+	t := &terminal{s: s, interrupt: interrupt, style: tcell.StyleDefault}
+	t.in, t.out = io.Pipe()
+	go t.events()
+	return t, nil
+}
+
+// events handles terminal events until the screen is finalized.
+func (t *terminal) events() {
+	defer t.out.Close()
+	for {
+		switch ev := t.s.PollEvent().(type) {
+		case nil:
+			return
+		case *tcell.EventResize:
+			t.mu.Lock()
+			w, h := t.s.Size()
+			t.x, t.y = clamp(t.x, w), clamp(t.y, h)
+			t.mu.Unlock()
+			t.s.Sync()
+		case *tcell.EventMouse:
+			x, y := ev.Position()
+			t.mu.Lock()
+			t.mx, t.my, t.pressed = x, y, ev.Buttons()&tcell.Button1 != 0
+			t.mu.Unlock()
+		case *tcell.EventKey:
+			if ev.Key() == tcell.KeyCtrlC && t.interrupt != nil {
+				t.interrupt()
+				continue
+			}
+			if b := keyBytes(ev); len(b) > 0 {
+				if _, err := t.out.Write(b); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// keyBytes returns the input bytes for key event ev.
+func keyBytes(ev *tcell.EventKey) []byte {
+	switch k := ev.Key(); k {
+	case tcell.KeyRune:
+		var b [utf8.UTFMax]byte
+		return b[:utf8.EncodeRune(b[:], ev.Rune())]
+	case tcell.KeyEnter:
+		return []byte{'\n'}
+	case tcell.KeyUp:
+		return []byte("\033[A")
+	case tcell.KeyDown:
+		return []byte("\033[B")
+	case tcell.KeyRight:
+		return []byte("\033[C")
+	case tcell.KeyLeft:
+		return []byte("\033[D")
+	case tcell.KeyHome:
+		return []byte("\033[H")
+	case tcell.KeyEnd:
+		return []byte("\033[F")
+	case tcell.KeyDelete:
+		return []byte("\033[3~")
+	default:
+		if k < 256 {
+			return []byte{byte(k)}
+		}
+	}
+	return nil
+}
+
+func clamp(v, max int) int {
+	if v >= max {
+		v = max - 1
+	}
+	if v < 0 {
+		v = 0
+	}
+	return v
+}
+
+func (t *terminal) Input() io.Reader { return t.in }
+
+func (t *terminal) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.s.Fini()
+	}
+	return nil
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, errors.New("write to closed terminal")
+	}
+	n := len(p)
+	if len(t.partial) > 0 {
+		p = append(t.partial, p...)
+		t.partial = nil
+	}
+	for len(p) > 0 {
+		if !utf8.FullRune(p) {
+			t.partial = append([]byte(nil), p...)
+			break
+		}
+		r, sz := utf8.DecodeRune(p)
+		p = p[sz:]
+		t.put(r)
+	}
+	return n, nil
+}
+
+// put writes rune r at the cursor position and advances the cursor.
+func (t *terminal) put(r rune) {
+	w, h := t.s.Size()
+	switch r {
+	case '\n':
+		t.x = 0
+		t.y++
+	case '\r':
+		t.x = 0
+	case '\b':
+		if t.x > 0 {
+			t.x--
+		}
+	case '\t':
+		t.x = (t.x + 8) &^ 7
+	case '\a':
+		t.s.Beep()
+	default:
+		if r < ' ' {
+			return
+		}
+		rw := runewidth.RuneWidth(r)
+		if t.x+rw > w {
+			t.x = 0
+			t.y++
+			t.scroll(w, h)
+		}
+		t.s.SetContent(t.x, t.y, r, nil, t.style)
+		t.x += rw
+		return
+	}
+	if t.x >= w {
+		t.x = w - 1
+	}
+	t.scroll(w, h)
+}
+
+// scroll scrolls the screen up if the cursor is below the last line.
+func (t *terminal) scroll(w, h int) {
+	for ; t.y >= h && h > 0; t.y-- {
+		for y := 1; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r, comb, st, _ := t.s.GetContent(x, y)
+				t.s.SetContent(x, y-1, r, comb, st)
+			}
+		}
+		for x := 0; x < w; x++ {
+			t.s.SetContent(x, h-1, ' ', nil, t.style)
+		}
+	}
+}
+
+func (t *terminal) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.s.ShowCursor(t.x, t.y)
+		t.s.Show()
+	}
+	return nil
+}
+
+func (t *terminal) Size() (width int, height int) {
+	return t.s.Size()
+}
+
+func (t *terminal) Clear() {
+	t.mu.Lock()
+	t.s.Fill(' ', t.style)
+	t.x, t.y = 0, 0
+	t.mu.Unlock()
+}
+
+// MoveCursor moves the cursor to the given 1-based row and column, like the
+// VT100 terminal.
+func (t *terminal) MoveCursor(row, col int) {
+	w, h := t.s.Size()
+	t.mu.Lock()
+	t.x, t.y = clamp(col-1, w), clamp(row-1, h)
+	t.mu.Unlock()
+}
+
+func (t *terminal) FgColor(fg int) {
+	t.mu.Lock()
+	t.style = t.style.Foreground(tcell.PaletteColor(fg & 7))
+	t.mu.Unlock()
+}
+
+func (t *terminal) BgColor(bg int) {
+	t.mu.Lock()
+	t.style = t.style.Background(tcell.PaletteColor(bg & 7))
+	t.mu.Unlock()
+}
+
+func (t *terminal) Port8Enabled() bool { return true }
+
+func (t *terminal) MouseState() (x, y int, pressed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mx, t.my, t.pressed
+}
@@ -0,0 +1,137 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sshd serves VM sessions over SSH, one VM instance per session.
+//
+// Clients authenticate with a password or a public key. Sessions with a
+// pseudo-terminal get the size of the client's window, updated when it is
+// resized, through the Size method of their vm.Terminal. Sessions only run a
+// shell: exec and subsystem requests are refused.
+//
+// The server is implemented with golang.org/x/crypto/ssh which must be enabled
+// with the ssh build tag:
+//
+//	go get golang.org/x/crypto/ssh
+//	go build -tags ssh
+//
+// Without this tag, NewServer always fails with ErrNotSupported.
+//
+// A minimal server accepting the keys of an authorized_keys file:
+//
+//	keys, _ := ioutil.ReadFile("authorized_keys")
+//	hostKey, _ := ioutil.ReadFile("host_key")
+//	s, err := sshd.NewServer(&sshd.Config{
+//		HostKey:        hostKey,
+//		AuthorizedKeys: keys,
+//		NewVM: func(s sshd.Session) (*vm.Instance, error) {
+//			return vm.New(append([]vm.Cell(nil), img...), "",
+//				vm.ProfileSandboxed(),
+//				vm.Input(s),
+//				vm.Output(s.Terminal()))
+//		},
+//	})
+//	if err != nil {
+//		// handle error
+//	}
+//	err = s.ListenAndServe("localhost:2222")
+//
+// The pseudo-terminal of a session is in raw mode: the VM must echo the
+// characters it reads, which Retro images do by default.
+//
+// With a mux.Mux set in the Mux field of the Config, a session can host
+// several named VM sessions that survive the connection, see package mux.
+package sshd
+
+import (
+	"io"
+	"net"
+
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// ErrNotSupported is returned by NewServer when the package has been built
+// without SSH support.
+var ErrNotSupported = errors.New("SSH support not compiled in (build with -tags ssh)")
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Close.
+var ErrServerClosed = errors.New("sshd: server closed")
+
+// Config is the configuration of a Server.
+type Config struct {
+	// HostKey is the PEM encoded private key of the server.
+	HostKey []byte
+
+	// Password, if not nil, is called to authenticate users with a password.
+	Password func(user, password string) bool
+
+	// AuthorizedKeys is a list of public keys, in the format of OpenSSH's
+	// authorized_keys files, that users can authenticate with. Options are
+	// ignored.
+	AuthorizedKeys []byte
+
+	// NewVM returns the VM instance of a new session. The instance should read
+	// its input from s and write its output to s.Terminal(). NewVM is called
+	// from the goroutine serving the session.
+	NewVM func(s Session) (*vm.Instance, error)
+
+	// Mux, if not nil, serves sessions instead of NewVM: each SSH session
+	// can host several named VM sessions, see package mux.
+	Mux *mux.Mux
+
+	// Logger, if not nil, is used to report session events.
+	Logger vm.Logger
+}
+
+// Session is an SSH session. Read returns the data sent by the client, with
+// CR or CR LF converted to '\n'. Write converts '\n' to CR LF. Writes are
+// buffered: buffered data is sent by the Flush method of the Terminal, and
+// before Read blocks waiting for input.
+type Session interface {
+	io.ReadWriter
+
+	// User returns the name of the authenticated user.
+	User() string
+
+	// RemoteAddr returns the address of the client.
+	RemoteAddr() net.Addr
+
+	// Size returns the size of the client's window, or 0, 0 if the session
+	// has no pseudo-terminal.
+	Size() (width int, height int)
+
+	// Terminal returns a VT100 vm.Terminal writing to the session.
+	Terminal() vm.Terminal
+}
+
+// Server is an SSH server.
+type Server interface {
+	// ListenAndServe listens on the TCP network address addr and calls
+	// Serve.
+	ListenAndServe(addr string) error
+
+	// Serve accepts connections on l and serves them in new goroutines. It
+	// always returns a non-nil error and closes l. After Close, the returned
+	// error is ErrServerClosed.
+	Serve(l net.Listener) error
+
+	// Close closes all listeners and connections, and waits for all sessions
+	// to end. Since their input is closed, sessions end as soon as their VM
+	// tries to read input.
+	Close() error
+}
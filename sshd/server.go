@@ -0,0 +1,417 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build ssh
+
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Supported is true if the package has been built with SSH support.
+const Supported = true
+
+type server struct {
+	cfg    ssh.ServerConfig
+	newVM  func(Session) (*vm.Instance, error)
+	mux    *mux.Mux
+	logger vm.Logger
+
+	mu     sync.Mutex
+	ls     map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer returns a new Server with the given configuration. At least one
+// authentication method must be configured.
+func NewServer(c *Config) (Server, error) {
+	if c.NewVM == nil && c.Mux == nil {
+		return nil, errors.New("sshd: no NewVM function or Mux")
+	}
+	key, err := ssh.ParsePrivateKey(c.HostKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "sshd: invalid host key")
+	}
+	s := &server{newVM: c.NewVM, mux: c.Mux, logger: c.Logger}
+	if pw := c.Password; pw != nil {
+		s.cfg.PasswordCallback = func(m ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if pw(m.User(), string(p)) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		}
+	}
+	if len(c.AuthorizedKeys) > 0 {
+		keys, err := parseAuthorizedKeys(c.AuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		s.cfg.PublicKeyCallback = func(m ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if keys[string(k.Marshal())] {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		}
+	}
+	if s.cfg.PasswordCallback == nil && s.cfg.PublicKeyCallback == nil {
+		return nil, errors.New("sshd: no authentication method")
+	}
+	s.cfg.AddHostKey(key)
+	return s, nil
+}
+
+// parseAuthorizedKeys parses the keys of an authorized_keys file. The returned
+// map is indexed by the keys in wire format.
+func parseAuthorizedKeys(b []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, l := range bytes.Split(b, []byte{'\n'}) {
+		l = bytes.TrimSpace(l)
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey(l)
+		if err != nil {
+			return nil, errors.Wrap(err, "sshd: invalid authorized key")
+		}
+		keys[string(k.Marshal())] = true
+	}
+	return keys, nil
+}
+
+func (s *server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "sshd: listen failed")
+	}
+	return s.Serve(l)
+}
+
+func (s *server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return errors.Wrap(err, "sshd: accept failed")
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.ls {
+		if e := l.Close(); err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Wrap(err, "sshd: close failed")
+}
+
+// trackListener adds or removes l from the server's listeners. It returns
+// false if the server is closed.
+func (s *server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.ls, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.ls == nil {
+		s.ls = make(map[net.Listener]struct{})
+	}
+	s.ls[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes c from the server's connections. It returns false
+// if the server is closed.
+func (s *server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		s.wg.Done()
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// serveConn serves the sessions of an SSH connection.
+func (s *server) serveConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(conn, &s.cfg)
+	if err != nil {
+		s.logError("handshake failed", conn.RemoteAddr(), err)
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	var wg sync.WaitGroup
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			s.logError("channel setup failed", conn.RemoteAddr(), err)
+			continue
+		}
+		ss := &session{
+			ch:   ch,
+			r:    bufio.NewReader(ch),
+			bw:   bufio.NewWriter(ch),
+			user: sc.User(),
+			addr: sc.RemoteAddr(),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(ss, creqs)
+		}()
+	}
+	wg.Wait()
+}
+
+// pty-req and window-change request payloads (RFC 4254).
+type ptyRequest struct {
+	Term          string
+	Width, Height uint32
+	PxW, PxH      uint32
+	Modes         string
+}
+
+type windowChange struct {
+	Width, Height uint32
+	PxW, PxH      uint32
+}
+
+// serveSession handles the requests of a session channel, and runs the VM on
+// the first shell request.
+func (s *server) serveSession(ss *session, reqs <-chan *ssh.Request) {
+	defer ss.ch.Close()
+	var done chan struct{}
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var p ptyRequest
+			err := ssh.Unmarshal(req.Payload, &p)
+			if err == nil {
+				ss.setSize(p.Width, p.Height)
+			}
+			req.Reply(err == nil, nil)
+		case "window-change":
+			var p windowChange
+			if ssh.Unmarshal(req.Payload, &p) == nil {
+				ss.setSize(p.Width, p.Height)
+			}
+		case "shell":
+			if done != nil {
+				req.Reply(false, nil)
+				break
+			}
+			req.Reply(true, nil)
+			done = make(chan struct{})
+			go s.run(ss, done)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+// run runs the VM of a session and closes its channel.
+func (s *server) run(ss *session, done chan<- struct{}) {
+	defer close(done)
+	defer ss.ch.Close()
+	var status uint32 = 1
+	defer func() {
+		ss.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	}()
+	if s.mux != nil {
+		if s.logger != nil {
+			s.logger.Info("client connected", "user", ss.user, "addr", ss.addr.String())
+		}
+		err := s.mux.Serve(ss, ss.Terminal())
+		ss.Flush()
+		if err == nil {
+			status = 0
+		}
+		if s.logger != nil {
+			s.logger.Info("client disconnected", "user", ss.user, "addr", ss.addr.String(), "err", err)
+		}
+		return
+	}
+	i, err := s.newVM(ss)
+	if err != nil {
+		s.logError("session setup failed", ss.addr, err)
+		return
+	}
+	if s.logger != nil {
+		s.logger.Info("session started", "user", ss.user, "addr", ss.addr.String())
+	}
+	err = i.Run()
+	ss.Flush()
+	if c := errors.Cause(err); c == nil || c == io.EOF || c == vm.ErrStopped {
+		status = 0
+	}
+	if s.logger != nil {
+		s.logger.Info("session ended", "user", ss.user, "addr", ss.addr.String(), "err", err)
+	}
+}
+
+func (s *server) logError(msg string, addr net.Addr, err error) {
+	if s.logger != nil {
+		s.logger.Error(msg, "addr", addr.String(), "err", err)
+	}
+}
+
+// session implements Session.
+type session struct {
+	ch   ssh.Channel
+	user string
+	addr net.Addr
+
+	r  *bufio.Reader
+	cr bool // last byte read was a CR
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	smu           sync.Mutex
+	width, height int
+}
+
+func (ss *session) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && (n == 0 || ss.r.Buffered() > 0) {
+		if ss.r.Buffered() == 0 {
+			if err := ss.Flush(); err != nil {
+				return n, err
+			}
+		}
+		b, err := ss.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		cr := ss.cr
+		ss.cr = b == '\r'
+		switch {
+		case b == '\r':
+			p[n] = '\n'
+			n++
+		case cr && b == '\n':
+			// second byte of CR LF
+		default:
+			p[n] = b
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (ss *session) Write(p []byte) (int, error) {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	for n, b := range p {
+		var err error
+		if b == '\n' {
+			_, err = ss.bw.Write([]byte{'\r', '\n'})
+		} else {
+			err = ss.bw.WriteByte(b)
+		}
+		if err != nil {
+			return n, errors.Wrap(err, "sshd: write failed")
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends any buffered data to the client.
+func (ss *session) Flush() error {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	return errors.Wrap(ss.bw.Flush(), "sshd: write failed")
+}
+
+func (ss *session) User() string         { return ss.user }
+func (ss *session) RemoteAddr() net.Addr { return ss.addr }
+
+func (ss *session) Size() (width int, height int) {
+	ss.smu.Lock()
+	defer ss.smu.Unlock()
+	return ss.width, ss.height
+}
+
+func (ss *session) setSize(w, h uint32) {
+	ss.smu.Lock()
+	ss.width, ss.height = int(w), int(h)
+	ss.smu.Unlock()
+}
+
+func (ss *session) Terminal() vm.Terminal {
+	return vm.NewVT100Terminal(ss, ss.Flush, ss.Size)
+}
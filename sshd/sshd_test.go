@@ -0,0 +1,207 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build ssh
+
+package sshd_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/sshd"
+	"github.com/db47h/ngaro/vm"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner returns a new ed25519 signer and its PEM encoded private key.
+func newSigner(t *testing.T) (ssh.Signer, []byte) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ssh.MarshalPrivateKey(k, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, pem.EncodeToMemory(b)
+}
+
+// serve starts a server with the given configuration on a loopback address. It
+// returns the server address.
+func serve(t *testing.T, c *sshd.Config) string {
+	// echo the width of the console for each character read.
+	img, err := asm.Assemble("sshd", strings.NewReader(`jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:emit 1 2 out 0 0 out wait ;
+		:start getc drop -11 5 out 0 0 out wait 5 in emit jump start`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c.HostKey = newSigner(t)
+	c.NewVM = func(s sshd.Session) (*vm.Instance, error) {
+		return vm.New(append([]vm.Cell(nil), img...), "",
+			vm.Input(s), vm.Output(s.Terminal()))
+	}
+	s, err := sshd.NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func dial(addr string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// shell starts a shell with an 80x24 pseudo-terminal.
+func shell(t *testing.T, c *ssh.Client) (*ssh.Session, io.WriteCloser, io.Reader) {
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return s, in, out
+}
+
+// width sends a character and returns the console width reported by the VM.
+func width(t *testing.T, in io.Writer, out io.Reader) int {
+	if _, err := in.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(out, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	return int(b[0])
+}
+
+func TestPassword(t *testing.T) {
+	addr := serve(t, &sshd.Config{
+		Password: func(user, password string) bool { return user == "user" && password == "secret" },
+	})
+	if _, err := dial(addr, ssh.Password("wrong")); err == nil {
+		t.Fatal("Unexpected login with a bad password")
+	}
+	c, err := dial(addr, ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, in, out := shell(t, c)
+	if w := width(t, in, out); w != 80 {
+		t.Fatalf("Expected width 80, got %d", w)
+	}
+	in.Close()
+	if err = s.Wait(); err != nil {
+		t.Fatalf("Unexpected exit status: %v", err)
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	key, _ := newSigner(t)
+	other, _ := newSigner(t)
+	addr := serve(t, &sshd.Config{
+		AuthorizedKeys: append([]byte("# comment\n"), ssh.MarshalAuthorizedKey(key.PublicKey())...),
+	})
+	if _, err := dial(addr, ssh.PublicKeys(other)); err == nil {
+		t.Fatal("Unexpected login with an unknown key")
+	}
+	if _, err := dial(addr, ssh.Password("secret")); err == nil {
+		t.Fatal("Unexpected login with a password")
+	}
+	c, err := dial(addr, ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestWindowChange(t *testing.T) {
+	addr := serve(t, &sshd.Config{
+		Password: func(user, password string) bool { return true },
+	})
+	c, err := dial(addr, ssh.Password(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, in, out := shell(t, c)
+	defer s.Close()
+	if w := width(t, in, out); w != 80 {
+		t.Fatalf("Expected width 80, got %d", w)
+	}
+	if err = s.WindowChange(24, 100); err != nil {
+		t.Fatal(err)
+	}
+	// window-change requests have no reply: poll until the VM sees the new size.
+	for n := 0; width(t, in, out) != 100; n++ {
+		if n == 100 {
+			t.Fatal("Window size not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	_, key := newSigner(t)
+	newVM := func(sshd.Session) (*vm.Instance, error) { return nil, nil }
+	if _, err := sshd.NewServer(&sshd.Config{HostKey: key, NewVM: newVM}); err == nil {
+		t.Error("Expected error with no authentication method")
+	}
+	if _, err := sshd.NewServer(&sshd.Config{HostKey: []byte("bogus"), NewVM: newVM, AuthorizedKeys: []byte("")}); err == nil {
+		t.Error("Expected error with an invalid host key")
+	}
+	if _, err := sshd.NewServer(&sshd.Config{HostKey: key, NewVM: newVM, AuthorizedKeys: []byte("bogus")}); err == nil {
+		t.Error("Expected error with invalid authorized keys")
+	}
+}
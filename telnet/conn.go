@@ -0,0 +1,248 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telnet
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// Telnet commands and options.
+const (
+	cmdSE   = 240
+	cmdSB   = 250
+	cmdWill = 251
+	cmdWont = 252
+	cmdDo   = 253
+	cmdDont = 254
+	cmdIAC  = 255
+
+	optEcho = 1
+	optSGA  = 3 // suppress go-ahead
+	optNAWS = 31
+)
+
+// maxSB is the maximum length of the subnegotiation parameters kept by Read.
+// Longer parameters are truncated.
+const maxSB = 16
+
+// Conn is a telnet connection. It implements io.ReadWriter: Read returns the
+// data sent by the client, with telnet commands stripped and end of lines
+// (CR LF or CR NUL) converted to '\n'. Write escapes its input and converts
+// '\n' to CR LF.
+//
+// Writes are buffered. Buffered data is written to the connection by Flush, and
+// before Read blocks waiting for input.
+type Conn struct {
+	net.Conn
+	r  *bufio.Reader
+	cr bool // last byte read was a CR
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	smu           sync.Mutex
+	width, height int
+}
+
+// NewConn returns a new telnet connection on c and starts the negotiation of
+// character mode and window size reports with the client.
+func NewConn(c net.Conn) (*Conn, error) {
+	t := &Conn{Conn: c, r: bufio.NewReader(c), bw: bufio.NewWriter(c)}
+	err := t.command(
+		cmdWill, optEcho,
+		cmdWill, optSGA,
+		cmdDo, optSGA,
+		cmdDo, optNAWS)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// command sends the given telnet commands, each preceded by IAC.
+func (c *Conn) command(cmd ...byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for n := 0; n < len(cmd); n += 2 {
+		c.bw.Write([]byte{cmdIAC, cmd[n], cmd[n+1]})
+	}
+	return errors.Wrap(c.bw.Flush(), "telnet write failed")
+}
+
+// Read reads data sent by the client into p. It blocks until at least one byte
+// is available.
+func (c *Conn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && (n == 0 || c.r.Buffered() > 0) {
+		if c.r.Buffered() == 0 {
+			if err := c.Flush(); err != nil {
+				return n, err
+			}
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		cr := c.cr
+		c.cr = false
+		switch {
+		case b == cmdIAC:
+			b, ok, err := c.readCommand()
+			if err != nil {
+				return n, err
+			}
+			if ok {
+				p[n] = b
+				n++
+			}
+		case b == '\r':
+			c.cr = true
+			p[n] = '\n'
+			n++
+		case cr && (b == '\n' || b == 0):
+			// second byte of an end of line
+		default:
+			p[n] = b
+			n++
+		}
+	}
+	return n, nil
+}
+
+// readCommand reads a telnet command following an IAC. It returns true and the
+// data byte if the command was an escaped IAC.
+func (c *Conn) readCommand() (byte, bool, error) {
+	cmd, err := c.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch cmd {
+	case cmdIAC:
+		return cmdIAC, true, nil
+	case cmdWill, cmdWont, cmdDo, cmdDont:
+		opt, err := c.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, false, c.negotiate(cmd, opt)
+	case cmdSB:
+		return 0, false, c.readSB()
+	}
+	// ignore other commands
+	return 0, false, nil
+}
+
+// negotiate replies to an option negotiation request. The options offered in
+// NewConn are already agreed upon. Other options are refused.
+func (c *Conn) negotiate(cmd, opt byte) error {
+	switch cmd {
+	case cmdWill:
+		if opt != optSGA && opt != optNAWS {
+			return c.command(cmdDont, opt)
+		}
+	case cmdDo:
+		if opt != optEcho && opt != optSGA {
+			return c.command(cmdWont, opt)
+		}
+	}
+	return nil
+}
+
+// readSB reads a subnegotiation, up to IAC SE.
+func (c *Conn) readSB() error {
+	var (
+		buf [maxSB]byte
+		n   int
+		iac bool
+	)
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if iac {
+			iac = false
+			if b == cmdSE {
+				break
+			}
+			if b != cmdIAC {
+				// protocol error, drop the subnegotiation.
+				return nil
+			}
+		} else if b == cmdIAC {
+			iac = true
+			continue
+		}
+		if n < len(buf) {
+			buf[n] = b
+			n++
+		}
+	}
+	if n == 5 && buf[0] == optNAWS {
+		c.smu.Lock()
+		c.width = int(buf[1])<<8 | int(buf[2])
+		c.height = int(buf[3])<<8 | int(buf[4])
+		c.smu.Unlock()
+	}
+	return nil
+}
+
+// Write writes p to the connection.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for n, b := range p {
+		var err error
+		switch b {
+		case '\n':
+			_, err = c.bw.Write([]byte{'\r', '\n'})
+		case cmdIAC:
+			_, err = c.bw.Write([]byte{cmdIAC, cmdIAC})
+		default:
+			err = c.bw.WriteByte(b)
+		}
+		if err != nil {
+			return n, errors.Wrap(err, "telnet write failed")
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered data to the connection.
+func (c *Conn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return errors.Wrap(c.bw.Flush(), "telnet write failed")
+}
+
+// Size returns the size of the client's window as reported with NAWS, or 0, 0
+// if unknown.
+func (c *Conn) Size() (width int, height int) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.width, c.height
+}
+
+// Terminal returns a VT100 vm.Terminal writing to c.
+func (c *Conn) Terminal() vm.Terminal {
+	return vm.NewVT100Terminal(c, c.Flush, c.Size)
+}
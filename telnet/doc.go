@@ -0,0 +1,43 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package telnet serves VM sessions over the telnet protocol, one VM instance
+// per connection.
+//
+// Connections are switched to character mode: the server offers to echo
+// characters and to suppress go-ahead, so that clients send keys as they are
+// typed instead of whole lines, as with a local terminal in raw mode. Clients
+// supporting the NAWS option (RFC 1073) report their window size, which is
+// returned by the Size method of the session's vm.Terminal.
+//
+// A Server only needs a function to create the VM of a session:
+//
+//	s := &telnet.Server{
+//		NewVM: func(c *telnet.Conn) (*vm.Instance, error) {
+//			return vm.New(append([]vm.Cell(nil), img...), "",
+//				vm.ProfileSandboxed(),
+//				vm.Input(c),
+//				vm.Output(c.Terminal()))
+//		},
+//	}
+//	err := s.ListenAndServe("localhost:2323")
+//
+// Since the VM of a session echoes the characters it reads, the client's local
+// echo is disabled. Retro images do this by default.
+//
+// With a mux.Mux set in the Mux field of the Server, a connection can host
+// several named sessions that survive the connection, see package mux.
+package telnet
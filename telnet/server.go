@@ -0,0 +1,193 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telnet
+
+import (
+	"net"
+	"sync"
+
+	"github.com/db47h/ngaro/mux"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Close.
+var ErrServerClosed = errors.New("telnet: server closed")
+
+// Server serves VM sessions over telnet.
+type Server struct {
+	// NewVM returns the VM instance of a new session on c. The instance should
+	// read its input from c and write its output to c.Terminal(). NewVM is
+	// called from the goroutine serving the session.
+	NewVM func(c *Conn) (*vm.Instance, error)
+
+	// Mux, if not nil, serves connections instead of NewVM: each connection
+	// can host several named sessions, see package mux.
+	Mux *mux.Mux
+
+	// Logger, if not nil, is used to report session events.
+	Logger vm.Logger
+
+	mu     sync.Mutex
+	ls     map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenAndServe listens on the TCP network address addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "telnet: listen failed")
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and runs a session for each of them in a new
+// goroutine. It always returns a non-nil error and closes l. After Close, the
+// returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return errors.Wrap(err, "telnet: accept failed")
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close closes all listeners and connections, and waits for all sessions to
+// end. Since their input is closed, sessions end as soon as their VM tries to
+// read input.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.ls {
+		if e := l.Close(); err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Wrap(err, "telnet: close failed")
+}
+
+// trackListener adds or removes l from the server's listeners. It returns
+// false if the server is closed.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.ls, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.ls == nil {
+		s.ls = make(map[net.Listener]struct{})
+	}
+	s.ls[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes c from the server's connections. It returns false
+// if the server is closed.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		s.wg.Done()
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// serve runs a session on conn.
+func (s *Server) serve(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	c, err := NewConn(conn)
+	if err != nil {
+		s.logError("session setup failed", addr, err)
+		return
+	}
+	if s.Mux != nil {
+		if s.Logger != nil {
+			s.Logger.Info("client connected", "addr", addr)
+		}
+		err = s.Mux.Serve(c, c.Terminal())
+		c.Flush()
+		if s.Logger != nil {
+			s.Logger.Info("client disconnected", "addr", addr, "err", err)
+		}
+		return
+	}
+	i, err := s.NewVM(c)
+	if err != nil {
+		s.logError("session setup failed", addr, err)
+		return
+	}
+	if s.Logger != nil {
+		s.Logger.Info("session started", "addr", addr)
+	}
+	err = i.Run()
+	c.Flush()
+	if s.Logger != nil {
+		s.Logger.Info("session ended", "addr", addr, "err", err)
+	}
+}
+
+func (s *Server) logError(msg, addr string, err error) {
+	if s.Logger != nil {
+		s.Logger.Error(msg, "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,80 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telnet_test
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/telnet"
+	"github.com/db47h/ngaro/vm"
+)
+
+func TestServer(t *testing.T) {
+	img, err := asm.Assemble("Server", strings.NewReader(`jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:emit 1 2 out 0 0 out wait ;
+		:start
+			getc emit getc emit getc emit getc emit getc emit
+			-11 5 out 0 0 out wait 5 in emit`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &telnet.Server{
+		NewVM: func(c *telnet.Conn) (*vm.Instance, error) {
+			return vm.New(append([]vm.Cell(nil), img...), "",
+				vm.Input(c), vm.Output(c.Terminal()))
+		},
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Write([]byte("\xff\xfd\x05" + // DO STATUS
+		"\xff\xfb\x1f\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0" + // WILL NAWS 80x24
+		"a\xff\xff\r\nb\r\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\xff\xfb\x01\xff\xfb\x03\xff\xfd\x03\xff\xfd\x1f" + // negotiation
+		"\xff\xfc\x05" + // WONT STATUS
+		"a\xff\xff\r\nb\r\nP"
+	if string(out) != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+
+	s.Close()
+	if err = <-done; err != telnet.ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
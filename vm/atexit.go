@@ -0,0 +1,78 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// OnExit sets a function that is called by Run when the VM exits normally,
+// that is when the program exits with the `bye` word or when the VM reaches
+// the end of its last input stream, after any exit hook registered by the
+// program. This is the place for hosts to save state, close devices or print
+// summaries. A non-nil error returned by fn is returned by Run.
+func OnExit(fn func(i *Instance) error) Option {
+	return func(i *Instance) error {
+		i.exitFn = fn
+		return nil
+	}
+}
+
+// AtExit registers the word at address addr as an exit hook: when the VM
+// exits normally (see OnExit), Run calls the registered words in reverse order
+// of registration before returning. Programs can register exit hooks with the
+// VM capabilities device on port 5 (see Version).
+//
+// Each word is called with an empty address stack and is run to completion,
+// unless an error occurs, in which case the remaining hooks are discarded and
+// Run returns the error.
+func (i *Instance) AtExit(addr Cell) {
+	i.atExit = append(i.atExit, addr)
+}
+
+// exit runs the exit hooks and the function set with OnExit if err denotes a
+// normal exit.
+func (i *Instance) exit(err error) error {
+	if err != nil && errors.Cause(err) != io.EOF {
+		return err
+	}
+	for len(i.atExit) > 0 {
+		n := len(i.atExit) - 1
+		addr := i.atExit[n]
+		i.atExit = i.atExit[:n]
+		if addr < 0 || int(addr) >= len(i.Mem) {
+			i.atExit = nil
+			return i.newRuntimeError(ErrMemOutOfRange, addr)
+		}
+		// return to the end of the memory image
+		i.rsp, i.rtos = 0, 0
+		i.Rpush(Cell(len(i.Mem) - 1))
+		i.PC = int(addr)
+		if e := i.exec(-1); e != nil && errors.Cause(e) != io.EOF {
+			i.atExit = nil
+			return e
+		}
+	}
+	if i.exitFn != nil {
+		if e := i.exitFn(i); e != nil {
+			return e
+		}
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+	"time"
+)
+
+// Audio is the interface implemented by audio backends. See AudioHandler.
+//
+// Beep plays a square wave of the given frequency in Hz for the given
+// duration.
+//
+// Play plays mono PCM samples at the given sample rate in Hz. The samples
+// slice must not be retained after Play returns.
+//
+// Both methods may return before the sound has finished playing.
+type Audio interface {
+	Beep(freq int, d time.Duration) error
+	Play(samples []int16, rate int) error
+}
+
+// bellAudio is an Audio backend using the console bell.
+type bellAudio struct {
+	w io.Writer
+}
+
+// NewBellAudio returns an Audio backend that writes the BEL character to w for
+// every beep or buffer played, which makes most terminals ring their bell. It
+// is a fallback for hosts without a real audio backend.
+func NewBellAudio(w io.Writer) Audio {
+	return bellAudio{w}
+}
+
+func (a bellAudio) Beep(freq int, d time.Duration) error {
+	_, err := a.w.Write([]byte{'\a'})
+	return err
+}
+
+func (a bellAudio) Play(samples []int16, rate int) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	_, err := a.w.Write([]byte{'\a'})
+	return err
+}
+
+// AudioHandler returns a WAIT handler implementing an audio device backed by a.
+// It can be bound to any port with BindWaitHandler. The following requests are
+// supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	fd-f	beep at frequency f Hz for d milliseconds
+//	2	arn-f	play n PCM samples stored at address a at sample rate r Hz
+//
+// Samples are stored one per cell and clamped to the range of 16 bits signed
+// integers. Requests return -1 on success and 0 on failure, for example if the
+// arguments are out of range or if the backend returned an error.
+func AudioHandler(a Audio) WaitHandler {
+	return func(i *Instance, v, port Cell) error {
+		var err error
+		switch v {
+		case 1:
+			d, f := i.Pop(), i.Pop()
+			if f <= 0 || d < 0 {
+				i.WaitReply(0, port)
+				return nil
+			}
+			err = a.Beep(int(f), time.Duration(d)*time.Millisecond)
+		case 2:
+			n, r, addr := i.Pop(), i.Pop(), i.Pop()
+			if n < 0 || r <= 0 || addr < 0 || int64(addr)+int64(n) > int64(len(i.Mem)) {
+				i.WaitReply(0, port)
+				return nil
+			}
+			s := make([]int16, n)
+			for k, c := range i.Mem[addr : addr+n] {
+				switch {
+				case c > 32767:
+					c = 32767
+				case c < -32768:
+					c = -32768
+				}
+				s[k] = int16(c)
+			}
+			err = a.Play(s, int(r))
+		default:
+			return nil
+		}
+		if err != nil {
+			i.logError("audio playback failed", "port", port, "err", err)
+			i.WaitReply(0, port)
+			return nil
+		}
+		i.WaitReply(-1, port)
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+// AuditKind is the kind of an audited access.
+type AuditKind int
+
+// Audited accesses.
+const (
+	AuditFetch      AuditKind = iota // memory fetch outside of the allowed regions
+	AuditStore                       // memory store outside of the allowed regions
+	AuditFileOpen                    // file open, Value is the open mode
+	AuditFileDelete                  // file deletion
+	AuditInclude                     // file include
+	AuditEnv                         // environment variable query
+	AuditDirOpen                     // directory open
+	AuditMkdir                       // directory creation
+	AuditStat                        // file status query
+	AuditRename                      // file rename, recorded for both the old and new names
+	AuditSetEnv                      // environment variable modification
+)
+
+var auditKinds = [...]string{"fetch", "store", "open", "delete", "include", "env", "opendir", "mkdir", "stat", "rename", "setenv"}
+
+func (k AuditKind) String() string {
+	if k < 0 || int(k) >= len(auditKinds) {
+		return "unknown"
+	}
+	return auditKinds[k]
+}
+
+// maxAuditEvents is the maximum number of events kept in the audit log.
+const maxAuditEvents = 1 << 16
+
+// AuditEvent is an entry of the audit log.
+type AuditEvent struct {
+	Kind  AuditKind
+	PC    int    // address of the instruction that triggered the access
+	Addr  Cell   // memory address, for fetches and stores
+	Value Cell   // value stored, or file open mode
+	Name  string // file or environment variable name
+}
+
+// Audit enables the audit mode: every memory fetch or store outside of the
+// allowed regions, as well as every file and environment access, is recorded
+// in the audit log, which can be retrieved with AuditLog after Run returns.
+// This is meant for reviewing what untrusted images do.
+//
+// File and environment accesses are recorded whether they succeed or not, and
+// file names are recorded as requested by the program. Note that like memory
+// regions and watchpoints, the audit mode makes memory accesses slower.
+func Audit(allowed ...Region) Option {
+	return func(i *Instance) error {
+		i.audit = true
+		i.auditOK = append([]Region(nil), allowed...)
+		i.updateMemHook()
+		return nil
+	}
+}
+
+// AuditLog returns the audit log and the number of events that were dropped
+// because the log was full. The log is cleared.
+func (i *Instance) AuditLog() (events []AuditEvent, dropped int) {
+	events, dropped = i.auditLog, i.auditOvf
+	i.auditLog, i.auditOvf = nil, 0
+	return events, dropped
+}
+
+// auditMem records a memory access at addr if it is outside of the allowed
+// regions.
+func (i *Instance) auditMem(kind AuditKind, addr, v Cell) {
+	for _, r := range i.auditOK {
+		if r.Contains(int(addr)) {
+			return
+		}
+	}
+	i.auditEvent(AuditEvent{Kind: kind, PC: i.PC, Addr: addr, Value: v})
+}
+
+// auditName records an access to the named file or environment variable.
+func (i *Instance) auditName(kind AuditKind, name string, v Cell) {
+	if i.audit {
+		i.auditEvent(AuditEvent{Kind: kind, PC: i.PC, Value: v, Name: name})
+	}
+}
+
+func (i *Instance) auditEvent(e AuditEvent) {
+	if len(i.auditLog) >= maxAuditEvents {
+		i.auditOvf++
+		return
+	}
+	i.auditLog = append(i.auditLog, e)
+}
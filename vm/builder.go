@@ -0,0 +1,149 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// ImageBuilder builds memory images programmatically. It is mostly intended
+// for tests, where it is less error prone than hand written []Cell literals:
+//
+//	img, err := vm.NewImageBuilder().
+//		Lit(5).Call("square").Jump(vm.OpJump, "end").
+//		Org(32).Label("square").Ops(vm.OpDup, vm.OpMul, vm.OpReturn).
+//		Label("end").
+//		Build()
+//
+// Labels can be referenced before they are defined. All errors are reported by
+// Build.
+type ImageBuilder struct {
+	mem    []Cell
+	labels map[string]Cell
+	refs   []labelRef
+	err    error
+}
+
+// labelRef is a reference to a label in an image being built.
+type labelRef struct {
+	pos  int
+	name string
+	call bool
+}
+
+// NewImageBuilder returns a new, empty ImageBuilder.
+func NewImageBuilder() *ImageBuilder {
+	return &ImageBuilder{labels: make(map[string]Cell)}
+}
+
+// Ops appends the given opcodes to the image.
+func (b *ImageBuilder) Ops(ops ...Cell) *ImageBuilder {
+	b.mem = append(b.mem, ops...)
+	return b
+}
+
+// Data appends the given cells to the image as raw data.
+func (b *ImageBuilder) Data(v ...Cell) *ImageBuilder {
+	b.mem = append(b.mem, v...)
+	return b
+}
+
+// Lit appends an OpLit instruction that pushes v on the data stack.
+func (b *ImageBuilder) Lit(v Cell) *ImageBuilder {
+	b.mem = append(b.mem, OpLit, v)
+	return b
+}
+
+// Label defines a label at the current position.
+func (b *ImageBuilder) Label(name string) *ImageBuilder {
+	if _, ok := b.labels[name]; ok {
+		b.fail(errors.Errorf("label %s already defined", name))
+	}
+	b.labels[name] = Cell(len(b.mem))
+	return b
+}
+
+// Call appends a call to the given label. Since calls are encoded as the
+// address of the subroutine, the label address must be above OpWait.
+func (b *ImageBuilder) Call(name string) *ImageBuilder {
+	return b.ref(name, true)
+}
+
+// Jump appends the jump instruction op (OpJump, OpLoop or a conditional jump)
+// to the given label.
+func (b *ImageBuilder) Jump(op Cell, name string) *ImageBuilder {
+	switch op {
+	case OpJump, OpLoop, OpGtJump, OpLtJump, OpNeJump, OpEqJump:
+	default:
+		b.fail(errors.Errorf("opcode %d is not a jump", op))
+	}
+	b.mem = append(b.mem, op)
+	return b.ref(name, false)
+}
+
+// Addr appends the address of the given label as a data cell.
+func (b *ImageBuilder) Addr(name string) *ImageBuilder {
+	return b.ref(name, false)
+}
+
+func (b *ImageBuilder) ref(name string, call bool) *ImageBuilder {
+	b.refs = append(b.refs, labelRef{len(b.mem), name, call})
+	b.mem = append(b.mem, 0)
+	return b
+}
+
+// Org pads the image with zeros (OpNop) up to the given address.
+func (b *ImageBuilder) Org(addr int) *ImageBuilder {
+	if addr < len(b.mem) {
+		b.fail(errors.Errorf("org %d: address already used", addr))
+		return b
+	}
+	b.mem = append(b.mem, make([]Cell, addr-len(b.mem))...)
+	return b
+}
+
+// Here returns the current position in the image.
+func (b *ImageBuilder) Here() int {
+	return len(b.mem)
+}
+
+func (b *ImageBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build resolves label references and returns the memory image, or the first
+// error encountered while building it. The builder can be reused after Build,
+// in which case further calls to Build return images that include the cells
+// of previous ones.
+func (b *ImageBuilder) Build() ([]Cell, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	mem := make([]Cell, len(b.mem))
+	copy(mem, b.mem)
+	for _, r := range b.refs {
+		addr, ok := b.labels[r.name]
+		if !ok {
+			return nil, errors.Errorf("undefined label %s", r.name)
+		}
+		if r.call && addr <= OpWait {
+			return nil, errors.Errorf("call to %s: address %d would be decoded as an opcode", r.name, addr)
+		}
+		mem[r.pos] = addr
+	}
+	return mem, nil
+}
@@ -0,0 +1,206 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// CanvasPalette is the palette of colors available to programs drawing on a
+// Canvas. Colors are selected by their index in the palette.
+var CanvasPalette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff}, // black
+	color.RGBA{0x00, 0x00, 0xaa, 0xff}, // dark blue
+	color.RGBA{0x00, 0xaa, 0x00, 0xff}, // dark green
+	color.RGBA{0x00, 0xaa, 0xaa, 0xff}, // dark cyan
+	color.RGBA{0xaa, 0x00, 0x00, 0xff}, // dark red
+	color.RGBA{0xaa, 0x00, 0xaa, 0xff}, // purple
+	color.RGBA{0xaa, 0x55, 0x00, 0xff}, // brown
+	color.RGBA{0x55, 0x55, 0x55, 0xff}, // dark gray
+	color.RGBA{0xaa, 0xaa, 0xaa, 0xff}, // gray
+	color.RGBA{0x55, 0x55, 0xff, 0xff}, // blue
+	color.RGBA{0x55, 0xff, 0x55, 0xff}, // green
+	color.RGBA{0x55, 0xff, 0xff, 0xff}, // cyan
+	color.RGBA{0xff, 0x55, 0x55, 0xff}, // red
+	color.RGBA{0xff, 0x55, 0xff, 0xff}, // magenta
+	color.RGBA{0xff, 0xff, 0x55, 0xff}, // yellow
+	color.RGBA{0xff, 0xff, 0xff, 0xff}, // white
+}
+
+// Canvas implements the Ngaro canvas device by drawing into an image.RGBA.
+//
+// It is attached to an instance with the BindCanvas option, which binds its
+// WaitHandler to port 6 and enables the canvas related queries of the VM
+// capabilities device on port 5:
+//
+//	value	description
+//	-----	-------------------
+//	-2	-1 if a canvas is present, 0 otherwise
+//	-3	canvas width
+//	-4	canvas height
+//
+// All Canvas methods are safe for concurrent use, so that the host can render
+// the canvas while the VM is running.
+type Canvas struct {
+	mu  sync.Mutex
+	img *image.RGBA
+	c   image.Uniform
+}
+
+// NewCanvas returns a new canvas of the given size, filled with black.
+func NewCanvas(width, height int) *Canvas {
+	c := &Canvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+	c.c.C = CanvasPalette[0]
+	draw.Draw(c.img, c.img.Bounds(), &c.c, image.Point{}, draw.Src)
+	c.c.C = CanvasPalette[len(CanvasPalette)-1]
+	return c
+}
+
+// BindCanvas attaches the given canvas to the instance. See Canvas.
+func BindCanvas(c *Canvas) Option {
+	return func(i *Instance) error {
+		i.canvas = c
+		i.bindWait(6, c.WaitHandler)
+		return nil
+	}
+}
+
+// Bounds returns the bounds of the canvas.
+func (c *Canvas) Bounds() image.Rectangle {
+	return c.img.Rect
+}
+
+// Image returns a copy of the canvas contents.
+func (c *Canvas) Image() *image.RGBA {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img := *c.img
+	img.Pix = append([]uint8(nil), c.img.Pix...)
+	return &img
+}
+
+// WritePNG writes the canvas contents to w in PNG format.
+func (c *Canvas) WritePNG(w io.Writer) error {
+	return png.Encode(w, c.Image())
+}
+
+// WriteGIF writes the canvas contents to w in GIF format, using CanvasPalette.
+func (c *Canvas) WriteGIF(w io.Writer) error {
+	img := c.Image()
+	p := image.NewPaletted(img.Rect, CanvasPalette)
+	draw.Draw(p, p.Rect, img, img.Rect.Min, draw.Src)
+	return gif.Encode(w, p, nil)
+}
+
+// WaitHandler implements the canvas device. It can be bound to any port with
+// BindWaitHandler, although programs expect it on port 6, and BindCanvas should
+// be preferred. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	n-	set the drawing color to entry n of CanvasPalette (white by default)
+//	2	xy-	draw a pixel
+//	3	xyhw-	draw a rectangle
+//	4	xyhw-	draw a filled rectangle
+//	5	xyh-	draw a vertical line
+//	6	xyw-	draw a horizontal line
+//	7	xyr-	draw a circle of radius r centered on x, y
+//	8	xyr-	draw a filled circle
+//
+// Requests outside of this range are ignored.
+func (c *Canvas) WaitHandler(i *Instance, v, port Cell) error {
+	if v < 1 || v > 8 {
+		return nil
+	}
+	c.mu.Lock()
+	switch v {
+	case 1:
+		if n := i.Pop(); n >= 0 && int(n) < len(CanvasPalette) {
+			c.c.C = CanvasPalette[n]
+		}
+	case 2:
+		y := int(i.Pop())
+		c.fill(int(i.Pop()), y, 1, 1)
+	case 3, 4:
+		w, h := int(i.Pop()), int(i.Pop())
+		y := int(i.Pop())
+		x := int(i.Pop())
+		if v == 4 {
+			c.fill(x, y, w, h)
+		} else if w != 0 && h != 0 {
+			r := image.Rect(x, y, x+w, y+h)
+			c.fill(r.Min.X, r.Min.Y, r.Dx(), 1)
+			c.fill(r.Min.X, r.Max.Y-1, r.Dx(), 1)
+			c.fill(r.Min.X, r.Min.Y, 1, r.Dy())
+			c.fill(r.Max.X-1, r.Min.Y, 1, r.Dy())
+		}
+	case 5:
+		h := int(i.Pop())
+		y := int(i.Pop())
+		c.fill(int(i.Pop()), y, 1, h)
+	case 6:
+		w := int(i.Pop())
+		y := int(i.Pop())
+		c.fill(int(i.Pop()), y, w, 1)
+	case 7, 8:
+		r := int(i.Pop())
+		y := int(i.Pop())
+		c.circle(int(i.Pop()), y, r, v == 8)
+	}
+	c.mu.Unlock()
+	i.WaitReply(0, port)
+	return nil
+}
+
+// fill fills the rectangle of size w x h at x, y with the current color.
+// Negative sizes extend the rectangle to the left or top.
+func (c *Canvas) fill(x, y, w, h int) {
+	draw.Draw(c.img, image.Rect(x, y, x+w, y+h), &c.c, image.Point{}, draw.Src)
+}
+
+// circle draws a circle with the midpoint circle algorithm.
+func (c *Canvas) circle(cx, cy, r int, filled bool) {
+	if r < 0 {
+		return
+	}
+	x, y, d := r, 0, 1-r
+	for x >= y {
+		if filled {
+			c.fill(cx-x, cy+y, 2*x+1, 1)
+			c.fill(cx-x, cy-y, 2*x+1, 1)
+			c.fill(cx-y, cy+x, 2*y+1, 1)
+			c.fill(cx-y, cy-x, 2*y+1, 1)
+		} else {
+			for _, p := range [...]image.Point{{x, y}, {y, x}, {-y, x}, {-x, y}, {-x, -y}, {-y, -x}, {y, -x}, {x, -y}} {
+				c.fill(cx+p.X, cy+p.Y, 1, 1)
+			}
+		}
+		y++
+		if d < 0 {
+			d += 2*y + 1
+		} else {
+			x--
+			d += 2*(y-x) + 1
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+// Version is the version of the VM implementation, encoded as
+// major*10000 + minor*100 + patch.
+//
+// It is reported to images by the VM capabilities device on port 5 which,
+// besides the standard queries of the Ngaro specification, supports the
+// following queries so that images can adapt to the host at startup instead of
+// probing by trial and error:
+//
+//	value	description
+//	-----	-------------------------------------------------
+//	-18	random number
+//	-19	VM version
+//	-20	enabled host devices, as a bitmask of Device values
+//	-21	maximum memory image size in cells
+//	-22	maximum number of instructions per call to Run
+//	-23	maximum output size in bytes
+//	-24	maximum input size in bytes
+//	-25	number of arguments
+//	-26	argument query
+//	-27	register the word at the address on top of the stack as an exit hook
+//	-28	string buffer size
+//	-29	monotonic clock in milliseconds
+//	-30	monotonic clock in nanoseconds
+//	-31	sleep for the number of milliseconds on top of the stack
+//	-32	date component
+//	-33	set environment variable
+//	-34	environment enumeration
+//
+// Limits are those set with ResourceLimits. A value of 0 means no limit.
+//
+// Arguments are those set with Args. The argument query works like the
+// environment query: with the argument index on top of the stack and the
+// destination address below it, the argument string is written at the
+// destination address, and the query returns the argument length, or -1 if the
+// index is out of range. Writing the argument requires a StringCodec.
+//
+// The string buffer size query takes a length in bytes on top of the stack and
+// returns the number of cells needed to store a string of that length, as
+// reported by the StringCodec's EncodedLen method, or -1 if there is no
+// StringCodec. Programs should use it to allocate buffers for the environment
+// and argument queries.
+//
+// The monotonic clock counts the time elapsed since the instance was created.
+// It is not affected by changes of the system time and should be used to
+// measure durations. On 32 bits builds, the nanosecond clock wraps around
+// every 4.3 seconds, so only differences between close readings are
+// meaningful.
+//
+// The sleep query suspends the VM for at most one hour. It returns early when
+// the VM is requested to stop, pause or yield, or when the deadline set with
+// Deadline expires, so that these requests are not delayed by a sleeping
+// program. The time not slept is returned, in milliseconds, so that programs
+// can sleep again if needed.
+//
+// The date query takes a component number on top of the stack (see DateYear
+// and following constants) and returns the requested component of the current
+// date and time in the time zone set with TimeZone, or -1 for an invalid
+// component number.
+//
+// In deterministic mode (see Deterministic), all time queries use the fake
+// clock, and sleeping advances the fake clock instead of suspending the VM.
+//
+// The set environment variable query takes the address of the variable name on
+// top of the stack and the address of its value below it, and returns -1 on
+// success, 0 on failure. It only succeeds if the VM has a private environment
+// (see Environ). The environment enumeration query works like the argument
+// query and returns the variables as "name=value" strings, sorted by name. It
+// only lists the private environment: without one, it returns -1 for any
+// index.
+//
+// Exit hooks are described in Instance.AtExit.
+const Version = 10000
+
+// Args sets the arguments reported to the running program by the VM
+// capabilities device on port 5 (see Version). Hosts should use it to pass
+// command line parameters to programs.
+func Args(args ...string) Option {
+	return func(i *Instance) error {
+		i.args = append([]string(nil), args...)
+		return nil
+	}
+}
+
+// clampCell converts v to a Cell, clamping it to the range of Cell values.
+func clampCell(v int64) Cell {
+	if c := Cell(v); int64(c) == v {
+		return c
+	}
+	if v < 0 {
+		return Cell(-1) << (CellBits - 1)
+	}
+	return ^(Cell(-1) << (CellBits - 1))
+}
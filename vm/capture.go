@@ -0,0 +1,152 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// CaptureEvent is an entry of a Capture. Terminal output has a non-nil Output
+// and a zero PortEvent. Port events have a nil Output.
+type CaptureEvent struct {
+	Time   time.Time
+	Output []byte
+	PortEvent
+}
+
+func (e CaptureEvent) String() string {
+	ts := e.Time.Format("15:04:05.000000")
+	if e.Output != nil {
+		return fmt.Sprintf("%s output %q", ts, e.Output)
+	}
+	return ts + " " + e.PortEvent.String()
+}
+
+// Capture records the output written to a Terminal and, optionally, the port
+// activity of a VM, with timestamps. It is mainly intended for testing programs
+// running in the VM:
+//
+//	c := new(vm.Capture)
+//	i, err := vm.New(img, "", vm.Output(c.Terminal(nil)), vm.CapturePorts(c, 4))
+//	// ...
+//	if got := c.String(); got != want { ...
+//
+// A Capture can be read from any goroutine while the VM is running. The zero
+// value is an empty Capture ready to use.
+type Capture struct {
+	mu     sync.Mutex
+	events []CaptureEvent
+}
+
+func (c *Capture) add(e CaptureEvent) {
+	c.mu.Lock()
+	c.events = append(c.events, e)
+	c.mu.Unlock()
+}
+
+// Terminal returns a Terminal that records everything written to it in c and
+// forwards all calls to t. Only the text written to the terminal is recorded:
+// calls to Clear, MoveCursor, FgColor and BgColor are passed on to t, but any
+// escape sequences written by t to implement them are not. If t is nil, output
+// is only recorded and the returned Terminal reports a size of 0, 0.
+func (c *Capture) Terminal(t Terminal) Terminal {
+	if t == nil {
+		t = NewVT100Terminal(io.Discard, nil, nil)
+	}
+	return &captureTerminal{t, c}
+}
+
+// Events returns the captured events, oldest first.
+func (c *Capture) Events() []CaptureEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CaptureEvent(nil), c.events...)
+}
+
+// Bytes returns all the captured terminal output.
+func (c *Capture) Bytes() []byte {
+	var b bytes.Buffer
+	c.mu.Lock()
+	for _, e := range c.events {
+		b.Write(e.Output)
+	}
+	c.mu.Unlock()
+	return b.Bytes()
+}
+
+// String returns all the captured terminal output as a string.
+func (c *Capture) String() string {
+	return string(c.Bytes())
+}
+
+// Reset clears the captured events.
+func (c *Capture) Reset() {
+	c.mu.Lock()
+	c.events = nil
+	c.mu.Unlock()
+}
+
+// WriteText writes the captured events to w, one per line, oldest first.
+func (c *Capture) WriteText(w io.Writer) error {
+	for _, e := range c.Events() {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CapturePorts records in c the port activity of the VM on the given ports, or
+// on all ports if none is given. Events are the same as those recorded by a
+// PortRecorder (see RecordPorts).
+func CapturePorts(c *Capture, ports ...Cell) Option {
+	return func(i *Instance) error {
+		i.capture = c
+		i.capPorts = append([]Cell(nil), ports...)
+		return nil
+	}
+}
+
+// capturePort records e in the Capture set with CapturePorts, if any.
+func (i *Instance) capturePort(e PortEvent) {
+	if len(i.capPorts) > 0 {
+		n := 0
+		for ; n < len(i.capPorts) && i.capPorts[n] != e.Port; n++ {
+		}
+		if n == len(i.capPorts) {
+			return
+		}
+	}
+	i.capture.add(CaptureEvent{Time: time.Now(), PortEvent: e})
+}
+
+type captureTerminal struct {
+	Terminal
+	c *Capture
+}
+
+func (t *captureTerminal) Write(p []byte) (int, error) {
+	n, err := t.Terminal.Write(p)
+	if n > 0 {
+		t.c.add(CaptureEvent{Time: time.Now(), Output: append([]byte{}, p[:n]...)})
+	}
+	return n, err
+}
@@ -0,0 +1,125 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clockTicks is the number of VM ticks between two calls to a Clock ticker.
+const clockTicks = 1024
+
+// Clock is a clock frequency limiter whose frequency can be changed while the
+// VM is running, either by the host with SetFrequency, or by the VM itself
+// through its WaitHandler.
+//
+// Like ClockLimiter, its Ticker method returns values that can be fed directly
+// into the Ticker option:
+//
+//	c := vm.NewClock(20e6, 16*time.Millisecond) // 20MHz
+//	i, err := vm.New(mem, "retroImage",
+//		vm.Ticker(c.Ticker()),
+//		vm.BindWaitHandler(9, c.WaitHandler))
+//
+type Clock struct {
+	freq       int64 // Hz, accessed atomically
+	resolution time.Duration
+	cur        int64 // frequency of the current measurement window
+	start      time.Time
+	ticks      int64
+}
+
+// NewClock returns a new Clock running at the given frequency in Hz. A zero or
+// negative frequency means no throttling. resolution sets the maximum real
+// interval between calls to time.Sleep (see ClockLimiter).
+func NewClock(freq int64, resolution time.Duration) *Clock {
+	if resolution <= 0 {
+		resolution = 16 * time.Millisecond
+	}
+	return &Clock{freq: freq, resolution: resolution}
+}
+
+// Frequency returns the clock frequency in Hz.
+func (c *Clock) Frequency() int64 {
+	return atomic.LoadInt64(&c.freq)
+}
+
+// SetFrequency sets the clock frequency in Hz. A zero or negative frequency
+// disables throttling. It can be called from any goroutine.
+func (c *Clock) SetFrequency(freq int64) {
+	atomic.StoreInt64(&c.freq, freq)
+}
+
+// Ticker returns the ticker function and tick interval to use with the Ticker
+// option.
+func (c *Clock) Ticker() (ticker func(i *Instance), ticks int64) {
+	return c.tick, clockTicks
+}
+
+func (c *Clock) tick(i *Instance) {
+	f := atomic.LoadInt64(&c.freq)
+	if f <= 0 || i.detMode {
+		if c.cur != 0 {
+			i.logInfo("clock throttling disabled")
+		}
+		c.cur = 0
+		return
+	}
+	if f != c.cur || c.start.IsZero() {
+		// start a new measurement window
+		if f != c.cur {
+			i.logInfo("clock frequency set", "hz", f)
+		}
+		c.cur, c.start, c.ticks = f, time.Now(), 0
+		return
+	}
+	c.ticks += clockTicks
+	virt := time.Duration(c.ticks * int64(time.Second) / f)
+	if virt < c.resolution {
+		return
+	}
+	end := time.Now()
+	if sleep := virt - end.Sub(c.start); sleep > 0 {
+		time.Sleep(sleep)
+		end = end.Add(sleep)
+	} else {
+		i.logDebug("clock running late", "hz", f, "lag", -sleep)
+	}
+	c.start, c.ticks = end, 0
+}
+
+// WaitHandler implements a clock control device that can be bound to any port
+// with BindWaitHandler. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	n-n	set the clock frequency to n Hz (0 disables throttling). Returns the previous frequency
+//	2	-n	returns the current clock frequency in Hz
+func (c *Clock) WaitHandler(i *Instance, v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		reply = Cell(atomic.SwapInt64(&c.freq, int64(i.Pop())))
+	case 2:
+		reply = Cell(c.Frequency())
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
@@ -0,0 +1,88 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io/fs"
+	"math/rand"
+)
+
+// Clone returns a copy of the instance that can run independently of i, for
+// example in another goroutine. The memory image, I/O ports and queued replies,
+// stacks, tasks (see Tasks), breakpoints, watchpoints and configuration are
+// duplicated.
+//
+// Handlers, the output Terminal, tracers and other values set by Options are
+// shared with i: if they are not safe for concurrent use, replace them in the
+// clone with SetOptions before running both instances concurrently. The input
+// stack and pipe (see WriteInput), open files, journals (see Record and
+// Replay), pending notifications (see Notify) and registry membership are not
+// duplicated: the clone starts with none of them.
+//
+// The monotonic clock of the clone counts from the creation of i. In
+// deterministic mode, the clone gets its own fake clock, starting at the
+// current time of i's clock, and its own random number generator, seeded from
+// i's.
+//
+// Like SetOptions, Clone can be safely called when Run is not executing, while
+// paused with Pause, or from the goroutine running the VM.
+func (i *Instance) Clone() *Instance {
+	c := &Instance{
+		PC:       i.PC,
+		Mem:      append([]Cell(nil), i.Mem...),
+		Ports:    append([]Cell(nil), i.Ports...),
+		tos:      i.tos,
+		sp:       i.sp,
+		rsp:      i.rsp,
+		rtos:     i.rtos,
+		data:     append([]Cell(nil), i.data...),
+		address:  append([]Cell(nil), i.address...),
+		insCount: i.insCount,
+		epoch:    i.epoch,
+		fid:      1,
+		files:    make(map[Cell]fs.File),
+		bp:       append(bitmap(nil), i.bp...),
+		bpPC:     -1,
+		wpPC:     -1,
+		waitPC:   -1,
+		unread:   -1,
+		outBytes: i.outBytes,
+		inBytes:  i.inBytes,
+		atExit:   append([]Cell(nil), i.atExit...),
+		termSel:  i.termSel,
+		sched:    i.sched.clone(),
+		config:   i.config.clone(),
+	}
+	c.ctl.init()
+	c.replies.q = i.replies.clone()
+	if i.watch != nil {
+		c.watch = make(map[Cell]watch, len(i.watch))
+		for k, v := range i.watch {
+			c.watch[k] = v
+		}
+	}
+	c.journal = nil
+	if i.clock != nil {
+		clk := *i.clock
+		c.clock = &clk
+	}
+	c.rng = nil
+	if i.detMode && i.rng != nil {
+		c.rng = rand.New(rand.NewSource(i.rng.Int63()))
+	}
+	return c
+}
@@ -0,0 +1,226 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStopped is the root cause of the error returned by Run when the VM has
+// been stopped with Instance.Stop.
+var ErrStopped = errors.New("vm stopped")
+
+// ErrYield is the root cause of the error returned by Run when the VM has
+// yielded control to the caller after a call to Instance.Yield. Calling Run
+// again resumes execution.
+var ErrYield = errors.New("vm yielded")
+
+// control request flags.
+const (
+	ctlStop int32 = 1 << iota
+	ctlPause
+	ctlYield
+	ctlInspect
+)
+
+// ctlTicks is the default interval, in VM ticks, between two checks of
+// asynchronous control requests. Must be a power of two.
+const ctlTicks = 1024
+
+// control holds the state shared between the Run loop and other goroutines.
+type control struct {
+	flags   int32 // accessed atomically
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running bool              // Run is executing, guarded by mu
+	halted  bool              // Run is waiting for a resume, guarded by mu
+	inspect []*inspectRequest // pending Inspect requests, guarded by mu
+}
+
+func (c *control) init() {
+	c.cond = sync.NewCond(&c.mu)
+}
+
+func (c *control) set(f int32) {
+	c.mu.Lock()
+	c.setLocked(f)
+	c.mu.Unlock()
+}
+
+func (c *control) setLocked(f int32) {
+	for {
+		old := atomic.LoadInt32(&c.flags)
+		if atomic.CompareAndSwapInt32(&c.flags, old, old|f) {
+			break
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// enter marks the VM as running.
+func (c *control) enter() {
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+}
+
+// exit marks the VM as stopped and wakes up any goroutine waiting in Pause.
+func (c *control) exit() {
+	c.mu.Lock()
+	c.running = false
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *control) clear(f int32) {
+	c.mu.Lock()
+	for {
+		old := atomic.LoadInt32(&c.flags)
+		if atomic.CompareAndSwapInt32(&c.flags, old, old&^f) {
+			break
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// Stop requests the VM to stop. It can be called from any goroutine. Run will
+// return an error whose root cause is ErrStopped at the next control check
+// (every 1024 VM ticks at most). Note that a VM blocked in an I/O handler
+// (like waiting for input) will only stop once the handler returns.
+//
+// The stop request, and any pending pause request, are cleared when Run
+// returns ErrStopped.
+func (i *Instance) Stop() {
+	i.ctl.set(ctlStop)
+}
+
+// Yield requests the VM to return from Run at the next control check, with an
+// error whose root cause is ErrYield. Unlike Stop, execution can be resumed by
+// calling Run again. It can be called from any goroutine, and in particular
+// from a ticker function (see Ticker), in which case Run returns right after
+// the ticker function, so that many VMs can be multiplexed on a single
+// goroutine:
+//
+//	vm.Ticker(func(i *vm.Instance) { i.Yield() }, 10000)
+//
+// The yield request is cleared when Run returns ErrYield.
+func (i *Instance) Yield() {
+	i.ctl.set(ctlYield)
+}
+
+// pause requests the VM to pause at the next control check. Unlike Pause, it
+// does not wait for the VM to actually pause, so it can be called from within
+// a handler.
+func (i *Instance) pause() {
+	i.ctl.set(ctlPause)
+}
+
+// Pause pauses the VM and can be called from any goroutine. If the VM is
+// running, Pause blocks until the Run loop has reached the next control check
+// (every 1024 VM ticks at most) and is waiting to be resumed. Once Pause
+// returns, the caller can safely inspect or modify the VM state (stacks,
+// memory, ports) until Resume is called. If the VM is not running, Pause
+// returns immediately and a subsequent call to Run will pause before executing
+// any instruction.
+//
+// A VM blocked in an I/O handler (like waiting for input) will only pause once
+// the handler returns. Pause must not be called from a handler of the same
+// instance since it would deadlock.
+func (i *Instance) Pause() {
+	c := &i.ctl
+	c.mu.Lock()
+	c.setLocked(ctlPause)
+	for c.running && !c.halted {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// Resume resumes a paused VM. It can be called from any goroutine.
+func (i *Instance) Resume() {
+	i.ctl.clear(ctlPause)
+}
+
+// updateCtlMask updates the tick mask for control checks so that they happen at
+// least as often as calls to the ticker function.
+func (i *Instance) updateCtlMask() {
+	if i.tickMask >= 0 && i.tickMask < ctlTicks-1 {
+		i.ctlMask = i.tickMask
+	} else {
+		i.ctlMask = ctlTicks - 1
+	}
+}
+
+// tick is called by Run every ctlMask+1 ticks. It runs the ticker function
+// if due, checks the instruction limit and deadline, and processes asynchronous
+// control requests.
+func (i *Instance) tick() error {
+	if i.wd != nil {
+		atomic.StoreInt64(&i.wd.ins, i.insCount)
+	}
+	if i.tickFn != nil && i.insCount&i.tickMask == 0 {
+		i.tickFn(i)
+	}
+	if err := i.checkInsLimit(); err != nil {
+		return err
+	}
+	if err := i.checkDeadline(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&i.ctl.flags) != 0 {
+		return i.control()
+	}
+	return nil
+}
+
+// control processes pending control requests.
+func (i *Instance) control() error {
+	c := &i.ctl
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		f := atomic.LoadInt32(&c.flags)
+		if f&ctlInspect != 0 {
+			atomic.StoreInt32(&c.flags, f&^ctlInspect)
+			i.serveInspect()
+			continue
+		}
+		if f&ctlStop != 0 {
+			atomic.StoreInt32(&c.flags, f&^(ctlStop|ctlPause))
+			c.halted = false
+			return ErrStopped
+		}
+		if f&ctlYield != 0 {
+			atomic.StoreInt32(&c.flags, f&^ctlYield)
+			c.halted = false
+			return ErrYield
+		}
+		if f&ctlPause == 0 {
+			c.halted = false
+			return nil
+		}
+		if !c.halted {
+			c.halted = true
+			c.cond.Broadcast()
+		}
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,182 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ConvertOptions holds options for ConvertImage. The zero value is ready to
+// use.
+type ConvertOptions struct {
+	// Rewrite, if not nil, is called for every cell of the source image. If it
+	// returns true, the cell value is replaced by v before validation. This
+	// allows rewriting known patterns, like 32 bits masks, that do not
+	// translate as-is between cell sizes.
+	Rewrite func(mem []Cell, addr int) (v Cell, rewrite bool)
+	// Disassemble, if not nil, is used to add disassembly context to errors.
+	// asm.Disassemble can be used here.
+	Disassemble func(mem []Cell, pc int, w io.Writer) (next int, err error)
+	// Context is the number of cells to show before and after an offending
+	// cell in errors. Defaults to 2.
+	Context int
+	// MaxErrors is the maximum number of offending cells to report. Defaults
+	// to 10.
+	MaxErrors int
+}
+
+// BadCell describes a cell that does not fit in the destination cell size.
+type BadCell struct {
+	Addr    int
+	Value   Cell
+	Context string // disassembly or dump of the surrounding cells
+}
+
+// ConvertError is returned by ConvertImage when some cells do not fit in the
+// destination cell size.
+type ConvertError struct {
+	Bits  int       // destination cell size in bits
+	Count int       // total number of offending cells
+	Cells []BadCell // offending cells, at most ConvertOptions.MaxErrors
+}
+
+func (e *ConvertError) Error() string {
+	var b bytes.Buffer
+	b.WriteString(strconv.Itoa(e.Count))
+	b.WriteString(" cell(s) do not fit in ")
+	b.WriteString(strconv.Itoa(e.Bits))
+	b.WriteString(" bits")
+	if len(e.Cells) < e.Count {
+		b.WriteString(", showing the first ")
+		b.WriteString(strconv.Itoa(len(e.Cells)))
+	}
+	for _, c := range e.Cells {
+		b.WriteString("\n@")
+		b.WriteString(strconv.Itoa(c.Addr))
+		b.WriteString(": ")
+		b.WriteString(strconv.FormatInt(int64(c.Value), 10))
+		if c.Context != "" {
+			b.WriteString("\n")
+			b.WriteString(c.Context)
+		}
+	}
+	return b.String()
+}
+
+// fits returns true if v can be represented with the given number of bits.
+func fits(v Cell, bits int) bool {
+	if bits >= CellBits {
+		return true
+	}
+	min := -int64(1) << uint(bits-1)
+	return int64(v) >= min && int64(v) <= -min-1
+}
+
+// convertContext returns the disassembly (or raw dump) of cells around addr.
+func convertContext(mem []Cell, addr int, opts *ConvertOptions) string {
+	start, end := addr-opts.Context, addr+opts.Context+1
+	if start < 0 {
+		start = 0
+	}
+	if end > len(mem) {
+		end = len(mem)
+	}
+	var b, l bytes.Buffer
+	for pc := start; pc < end; {
+		l.Reset()
+		next := pc + 1
+		if opts.Disassemble != nil {
+			if n, _ := opts.Disassemble(mem, pc, &l); n > pc {
+				next = n
+			}
+		} else {
+			l.WriteString(strconv.FormatInt(int64(mem[pc]), 10))
+		}
+		mark := "  "
+		if pc <= addr && addr < next {
+			mark = "=>"
+		}
+		b.WriteString("\t" + mark + " " + strconv.Itoa(pc) + "\t")
+		l.WriteTo(&b)
+		b.WriteByte('\n')
+		pc = next
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// ConvertImage prepares a memory image for conversion from srcBits to dstBits
+// bits per cell. It returns a copy of mem where all cells have been validated
+// to fit in dstBits bits, optionally rewritten by opts.Rewrite. The result can
+// then be saved with Save(fileName, mem, dstBits).
+//
+// Cells are validated only when converting to a smaller cell size. If any cell
+// does not fit, the returned error is a *ConvertError that lists
+// the offending addresses together with disassembly context.
+//
+// Supported cell sizes are 8, 16, 32 and 64 bits. A value of 0 means CellBits.
+func ConvertImage(mem []Cell, srcBits, dstBits int, opts *ConvertOptions) ([]Cell, error) {
+	for _, b := range [...]*int{&srcBits, &dstBits} {
+		switch *b {
+		case 0:
+			*b = CellBits
+		case 8, 16, 32, 64:
+		default:
+			return nil, errors.Errorf("%d bits cells not supported", *b)
+		}
+	}
+	var o ConvertOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Context <= 0 {
+		o.Context = 2
+	}
+	if o.MaxErrors <= 0 {
+		o.MaxErrors = 10
+	}
+	out := make([]Cell, len(mem))
+	copy(out, mem)
+	var (
+		bad   []int
+		count int
+	)
+	for addr := range out {
+		if o.Rewrite != nil {
+			if v, ok := o.Rewrite(out, addr); ok {
+				out[addr] = v
+			}
+		}
+		if dstBits < srcBits && !fits(out[addr], dstBits) {
+			if count++; len(bad) < o.MaxErrors {
+				bad = append(bad, addr)
+			}
+		}
+	}
+	if count == 0 {
+		return out, nil
+	}
+	e := &ConvertError{Bits: dstBits, Count: count}
+	for _, addr := range bad {
+		e.Cells = append(e.Cells, BadCell{addr, out[addr], convertContext(out, addr, &o)})
+	}
+	return nil, e
+}
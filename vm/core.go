@@ -17,6 +17,10 @@
 package vm
 
 import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
 	"github.com/pkg/errors"
 )
 
@@ -97,8 +101,18 @@ func (i *Instance) Drop2() {
 	i.tos = i.data[i.sp+1] // NOTE: this works because i.data[0:2] is always 0
 }
 
-// Push pushes the argument on top of the data stack.
+// Push pushes the argument on top of the data stack. If the data stack is full,
+// it is grown if allowed (see GrowableStacks).
 func (i *Instance) Push(v Cell) {
+	if i.sp >= len(i.data)-1 {
+		i.growData()
+	}
+	i.push(v)
+}
+
+// push is the fast path of Push used by Run: data stack overflows are handled
+// by growing the stack and executing the faulting instruction again.
+func (i *Instance) push(v Cell) {
 	i.sp++
 	i.data[i.sp], i.tos = i.tos, v
 }
@@ -132,12 +146,13 @@ func (i *Instance) Rpop() Cell {
 // Run starts execution of the VM.
 //
 // If an error occurs, the PC will will point to the instruction that triggered
-// the error. The most likely error condition is an "index out of range"
-// runtime.Error which can occur in the following cases:
+// the error. Runtime errors caused by the program being executed have a root
+// cause of type *RuntimeError, which can occur in the following cases:
 //
-//	- address or data stack full
-//	- attempt to address memory outside of the range [0:len(i.Image)]
-//	- use of a port number outside of the range [0:1024] in an I/O operation.
+//	- address or data stack full (ErrReturnStackOverflow, ErrStackOverflow)
+//	- call depth limit set with MaxCallDepth exceeded (ErrCallDepthExceeded)
+//	- attempt to address memory outside of the range [0:len(i.Image)] (ErrMemOutOfRange)
+//	- use of a port number outside of the range [0:1024] in an I/O operation (ErrPortOutOfRange)
 //
 //	A full stack trace should be obtainable with:
 //
@@ -154,15 +169,108 @@ func (i *Instance) Rpop() Cell {
 // If the VM was exited cleanly from a user program with the `bye` word, the PC
 // will be equal to len(i.Image) and err will be nil.
 //
+// If the PC hits a breakpoint set with SetBreakpoint, Run returns an error whose
+// root cause is ErrBreakpoint. Calling Run again resumes execution.
+//
+// Runtime errors can be handled without returning from Run with OnError.
+//
 // Note that this package makes heavy use of the github.com/pkg/errors package.
 // The "root cause" error can be obtained with errors.Cause().
 //
 // If the last input stream gets closed, the VM will exit and the root cause
 // error will be io.EOF. This is a normal exit condition in most use cases.
 func (i *Instance) Run() (err error) {
+	i.ctl.enter()
+	defer i.ctl.exit()
+	if i.sdPort != 0 {
+		defer func() { err = i.endShutdown(err) }()
+	}
+	if i.wdWindow > 0 {
+		w := i.startWatchdog()
+		defer func() { err = i.stopWatchdog(w, err) }()
+	}
+	if atomic.LoadInt32(&i.ctl.flags) != 0 {
+		if err = i.control(); err != nil {
+			return err
+		}
+	}
+
+	i.insCount = 0
+	if i.deadline > 0 {
+		i.runEnd = time.Now().Add(i.deadline)
+	}
+	// do not break again on the breakpoint we stopped at
+	resumePC := i.bpPC
+	i.bpPC = -1
+	if i.wpPC != i.PC {
+		i.wpPC = -1
+	}
+	return i.exit(i.exec(resumePC))
+}
+
+// exec calls run until it returns, growing the stacks, recovering from
+// runtime errors and switching tasks as needed.
+func (i *Instance) exec(resumePC int) error {
+	for {
+		err := i.run(resumePC)
+		switch {
+		case err == errStackGrown:
+			// resume at the instruction that overflowed the stack.
+			resumePC = i.PC
+			continue
+		case err != nil && i.recoverError(err):
+			resumePC = -1
+			continue
+		case err == nil && i.sched != nil:
+			ok, err := i.endTask()
+			if err != nil {
+				return err
+			}
+			if ok {
+				resumePC = -1
+				continue
+			}
+		}
+		return err
+	}
+}
+
+// RunToWait runs the VM until the next WAIT instruction and returns before
+// executing it, with the PC pointing to the WAIT instruction. This allows the
+// host to service I/O requests at its own pace, for example from a GUI frame
+// loop or game tick: the host can inspect the I/O ports and reply by itself
+// (see WaitReply), then call RunToWait again, which executes the pending WAIT
+// (bound WAIT handlers are called as usual, unless port 0 has been set to 1)
+// and runs until the next one.
+//
+// RunToWait returns true if the VM is waiting. Otherwise it returns false
+// along with the error returned by Run, and the VM is not waiting. As with
+// Run, a nil error means that the program has exited.
+func (i *Instance) RunToWait() (waiting bool, err error) {
+	if i.PC != i.waitPC {
+		i.waitPC = -1
+	}
+	i.toWait = true
+	err = i.Run()
+	i.toWait = false
+	if err == errWaitReached {
+		return true, nil
+	}
+	return false, err
+}
+
+// run executes instructions until an error occurs or the PC goes past the end
+// of the memory image. The breakpoint at resumePC, if any, is ignored.
+func (i *Instance) run(resumePC int) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			switch e := e.(type) {
+			case runtime.Error:
+				if err = i.runtimeError(e); err != nil {
+					break
+				}
+				err = errors.Wrapf(e, "Recovered error @pc=%d/%d, stack %d/%d, rstack %d/%d",
+					i.PC, len(i.Mem), i.sp, len(i.data)-1, i.rsp, len(i.address)-1)
 			case error:
 				err = errors.Wrapf(e, "Recovered error @pc=%d/%d, stack %d/%d, rstack %d/%d",
 					i.PC, len(i.Mem), i.sp, len(i.data)-1, i.rsp, len(i.address)-1)
@@ -172,14 +280,22 @@ func (i *Instance) Run() (err error) {
 		}
 	}()
 
-	i.insCount = 0
+	if i.timeOps {
+		defer i.timer.stop()
+	}
 	for i.PC < len(i.Mem) {
+		if i.debug {
+			if err = i.debugHook(resumePC); err != nil {
+				return err
+			}
+			resumePC = -1
+		}
 		op := i.Mem[i.PC]
 		switch op {
 		case OpNop:
 			i.PC++
 		case OpLit:
-			i.Push(i.Mem[i.PC+1])
+			i.push(i.Mem[i.PC+1])
 			i.PC += 2
 		case OpDup:
 			i.sp++
@@ -192,10 +308,16 @@ func (i *Instance) Run() (err error) {
 			i.tos, i.data[i.sp] = i.data[i.sp], i.tos
 			i.PC++
 		case OpPush:
-			i.Rpush(i.Pop())
+			// do not Pop before Rpush: the value must not be lost if the
+			// address stack needs to grow.
+			i.Rpush(i.tos)
+			i.Drop()
 			i.PC++
 		case OpPop:
-			i.Push(i.Rpop())
+			// do not Rpop before push: the value must not be lost if the data
+			// stack needs to grow.
+			i.push(i.rtos)
+			i.Rpop()
 			i.PC++
 		case OpLoop:
 			v := i.tos - 1
@@ -239,28 +361,52 @@ func (i *Instance) Run() (err error) {
 			}
 			i.Drop2()
 		case OpFetch:
-			i.tos = i.Mem[i.tos]
+			if i.memHook || uint64(i.tos) >= uint64(len(i.Mem)) {
+				if err = i.fetch(); err != nil {
+					return err
+				}
+			} else {
+				i.tos = i.Mem[i.tos]
+			}
 			i.PC++
 		case OpStore:
-			i.Mem[i.tos] = i.data[i.sp]
-			i.Drop2()
+			if i.memHook || uint64(i.tos) >= uint64(len(i.Mem)) {
+				if err = i.store(); err != nil {
+					return err
+				}
+			} else {
+				i.Mem[i.tos] = i.data[i.sp]
+				i.Drop2()
+			}
 			i.PC++
 		case OpAdd:
 			rhs := i.Pop()
 			i.tos += rhs
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpSub:
 			rhs := i.Pop()
 			i.tos -= rhs
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpMul:
 			rhs := i.Pop()
 			i.tos *= rhs
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpDimod:
 			lhs, rhs := i.data[i.sp], i.tos
 			i.data[i.sp] = lhs % rhs
 			i.tos = lhs / rhs
+			if i.wrap32 {
+				i.data[i.sp], i.tos = wrap(i.data[i.sp]), wrap(i.tos)
+			}
 			i.PC++
 		case OpAnd:
 			rhs := i.Pop()
@@ -277,6 +423,9 @@ func (i *Instance) Run() (err error) {
 		case OpShl:
 			rhs := i.Pop()
 			i.tos <<= uint8(rhs)
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpShr:
 			rhs := i.Pop()
@@ -291,74 +440,204 @@ func (i *Instance) Run() (err error) {
 			}
 		case OpInc:
 			i.tos++
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpDec:
 			i.tos--
+			if i.wrap32 {
+				i.tos = wrap(i.tos)
+			}
 			i.PC++
 		case OpIn:
-			port := i.tos
-			if h := i.inH[port]; h != nil {
-				i.Drop()
-				if err = h(i, port); err != nil {
-					return errors.Wrap(err, "IN failed")
-				}
-			} else {
-				// we're not calling i.In so that we can optimize out a Pop/Push
-				// sequence
-				i.tos, i.Ports[port] = i.Ports[port], 0
+			if err = i.in(); err != nil {
+				return err
 			}
 			i.PC++
 		case OpOut:
-			v, port := i.data[i.sp], i.tos
-			i.Drop2()
-			if h := i.outH[port]; h != nil {
-				err = h(i, v, port)
-			} else {
-				err = i.Out(v, port)
-			}
-			if err != nil {
-				return errors.Wrap(err, "OUT failed")
+			if err = i.out(); err != nil {
+				return err
 			}
 			i.PC++
 		case OpWait:
-			if i.Ports[0] != 1 {
-				for p, h := range i.waitH {
-					v := i.Ports[p]
-					if v == 0 {
-						continue
-					}
-					if err = h(i, v, p); err != nil {
-						return errors.Wrap(err, "WAIT failed")
-					}
-				}
+			if err = i.wait(); err != nil {
+				return err
 			}
 			i.PC++
 		default:
-			if op >= 0 || i.opHandler == nil { // let it panic if op < 0 and no opHandler is set
-				i.rsp++
-				i.address[i.rsp] = i.rtos
-				i.rtos, i.PC = Cell(i.PC), int(op)
-				// this is retro specific: most words have a pair of nop at the
-				// beginning to enable vectoring, skip them. This shaves off a few cycles.
-				if i.PC < len(i.Mem) && i.Mem[i.PC] == OpNop {
-					i.PC++
+			if op < 0 {
+				if err = i.custom(op); err != nil {
+					return err
 				}
-				if i.PC < len(i.Mem) && i.Mem[i.PC] == OpNop {
-					i.PC++
-				}
-			} else if i.opHandler != nil {
-				// custom opcode
-				err = i.opHandler(i, op)
-				if err != nil {
-					return errors.Wrap(err, "custom opcode handler failed")
-				}
-				i.PC++
+				break
 			}
+			i.call(op)
 		}
 		i.insCount++
-		if i.tickFn != nil && i.insCount&i.tickMask == 0 {
-			i.tickFn(i)
+		if i.insCount&i.ctlMask == 0 || i.insCount == i.insLimit {
+			if err = i.tick(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// debugHook checks for breakpoints and calls the tracer before executing the
+// instruction at PC. The breakpoint at resumePC, if any, is ignored.
+func (i *Instance) debugHook(resumePC int) error {
+	if i.bp.test(i.PC) && i.PC != resumePC {
+		i.bpPC = i.PC
+		return errors.Wrapf(ErrBreakpoint, "@pc=%d", i.PC)
+	}
+	if i.tracer != nil {
+		i.tracer.Trace(i.PC, i.Mem[i.PC], i.tos, i.sp)
+	}
+	if i.timeOps {
+		i.timer.hook(i.Mem[i.PC])
+	}
+	return nil
+}
+
+// fetch is the slow path of OpFetch: memory mapped regions, watchpoints and
+// automatic memory growth.
+func (i *Instance) fetch() error {
+	if i.memHook {
+		if ok, err := i.fetchHook(i.tos); err != nil || ok {
+			return err
+		}
+	}
+	if uint64(i.tos) >= uint64(len(i.Mem)) {
+		if err := i.grow(i.tos); err != nil {
+			return err
+		}
+	}
+	i.tos = i.Mem[i.tos]
+	return nil
+}
+
+// store is the slow path of OpStore.
+func (i *Instance) store() error {
+	if i.memHook {
+		if ok, err := i.storeHook(i.tos, i.data[i.sp]); err != nil {
+			return err
+		} else if ok {
+			i.Drop2()
+			return nil
+		}
+	}
+	if uint64(i.tos) >= uint64(len(i.Mem)) {
+		if err := i.grow(i.tos); err != nil {
+			return err
+		}
+	}
+	i.Mem[i.tos] = i.data[i.sp]
+	i.Drop2()
+	return nil
+}
+
+func (i *Instance) in() error {
+	port := i.tos
+	if h := i.inH[port]; h != nil {
+		i.Drop()
+		if err := h(i, port); err != nil {
+			i.logError("IN handler failed", "port", port, "err", err)
+			return errors.Wrap(err, "IN failed")
 		}
+		i.recordPort(PortIn, port, i.tos)
+		return nil
+	}
+	// we're not calling i.In so that we can optimize out a Pop/Push
+	// sequence
+	if i.replyQ {
+		i.tos = i.readReply(port)
+	} else {
+		i.tos = i.swapPort(port, 0)
+	}
+	i.recordPort(PortIn, port, i.tos)
+	return nil
+}
+
+func (i *Instance) out() (err error) {
+	v, port := i.data[i.sp], i.tos
+	if port < 0 || int(port) >= len(i.Ports) {
+		return i.newRuntimeError(ErrPortOutOfRange, port)
+	}
+	i.Drop2()
+	i.recordPort(PortOut, port, v)
+	if h := i.outH[port]; h != nil {
+		err = h(i, v, port)
+	} else {
+		err = i.Out(v, port)
+	}
+	if err != nil {
+		i.logError("OUT failed", "port", port, "err", err)
+		return errors.Wrap(err, "OUT failed")
 	}
 	return nil
 }
+
+func (i *Instance) wait() error {
+	if i.toWait && i.PC != i.waitPC {
+		i.waitPC = i.PC
+		return errWaitReached
+	}
+	i.waitPC = -1
+	i.recordPort(PortWait, 0, i.port(0))
+	if i.wd != nil {
+		i.wd.enterWait()
+		defer i.wd.leaveWait()
+	}
+	if i.port(0) != 1 {
+		for _, p := range i.waitPorts {
+			h := i.waitH[p]
+			v := i.port(p)
+			if v == 0 {
+				continue
+			}
+			if err := h(i, v, p); err != nil {
+				i.logError("WAIT handler failed", "port", p, "err", err)
+				return errors.Wrap(err, "WAIT failed")
+			}
+		}
+	}
+	if atomic.LoadInt32(&i.notes.n) != 0 {
+		i.deliver()
+	}
+	return nil
+}
+
+// custom executes the custom opcode op and advances the PC.
+func (i *Instance) custom(op Cell) error {
+	h := i.opTable[op]
+	if h == nil {
+		h = i.opHandler
+	}
+	if h == nil {
+		// let it panic if no handler is set
+		i.call(op)
+		return nil
+	}
+	if err := h(i, op); err != nil {
+		i.logError("custom opcode handler failed", "opcode", op, "err", err)
+		return errors.Wrap(err, "custom opcode handler failed")
+	}
+	i.PC++
+	return nil
+}
+
+// call calls the subroutine at address addr.
+func (i *Instance) call(addr Cell) {
+	i.rsp++
+	i.address[i.rsp] = i.rtos
+	i.rtos, i.PC = Cell(i.PC), int(addr)
+	// this is retro specific: most words have a pair of nop at the
+	// beginning to enable vectoring, skip them. This shaves off a few cycles.
+	if i.PC < len(i.Mem) && i.Mem[i.PC] == OpNop {
+		i.PC++
+	}
+	if i.PC < len(i.Mem) && i.Mem[i.PC] == OpNop {
+		i.PC++
+	}
+}
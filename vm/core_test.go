@@ -19,11 +19,16 @@ package vm_test
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/db47h/ngaro/asm"
 	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
 )
 
 type C []vm.Cell
@@ -391,7 +396,374 @@ func TestVM_error(t *testing.T) {
 	if err == nil {
 		t.Fatal("Unexpected nil error")
 	}
-	assertEqual(t, "VM_error", "Recovered error @pc=2/3, stack 1/1024, rstack 0/1024: runtime error: index out of range", err.Error())
+	assertEqual(t, "VM_error", "memory access out of range @pc=2, address 16, stack depth 1, rstack depth 0", err.Error())
+	e, ok := errors.Cause(err).(*vm.RuntimeError)
+	if !ok || e.Err != vm.ErrMemOutOfRange || e.PC != 2 || e.Addr != 16 {
+		t.Fatalf("Unexpected error: %#v", errors.Cause(err))
+	}
+
+	for _, test := range []struct {
+		code string
+		err  error
+		pc   int
+		addr vm.Cell
+	}{
+		{"1 -1 !", vm.ErrMemOutOfRange, 4, -1},
+		{"2000 in", vm.ErrPortOutOfRange, 2, 2000},
+		{"1 -1 out", vm.ErrPortOutOfRange, 4, -1},
+		{":0 1 jump 0-", vm.ErrStackOverflow, 0, 0},
+		{"jump 0+ .org 32 :0 0-", vm.ErrReturnStackOverflow, 32, 0},
+		{"-5 push ;", vm.ErrMemOutOfRange, -4, -4},
+	} {
+		i, err := runAsmImage(test.code, "VM_error")
+		e, ok := errors.Cause(err).(*vm.RuntimeError)
+		if !ok || e.Err != test.err || e.PC != test.pc || e.Addr != test.addr {
+			t.Fatalf("%s: unexpected error: %v", test.code, err)
+		}
+		if test.err == vm.ErrStackOverflow && (len(e.Data) != 1024 || i.Depth() != 1024) {
+			t.Fatalf("%s: bad stack depth %d/%d", test.code, len(e.Data), i.Depth())
+		}
+	}
+}
+
+func TestVM_MaxCallDepth(t *testing.T) {
+	_, err := runAsmImage(`
+		foo
+		.org 32
+		:foo nop bar ;
+		:bar foo ;`, "VM_MaxCallDepth", vm.MaxCallDepth(10))
+	e, ok := errors.Cause(err).(*vm.RuntimeError)
+	if !ok || e.Err != vm.ErrCallDepthExceeded || len(e.Address) != 10 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqual(t, "VM_MaxCallDepth", "call depth exceeded @pc=35, stack depth 0, rstack depth 10, calls from 33 35 33 35 ...", err.Error())
+	if _, err = vm.New(nil, "", vm.MaxCallDepth(0)); err == nil {
+		t.Fatal("Expected error for zero call depth")
+	}
+}
+
+func TestVM_AutoGrowAddressStack(t *testing.T) {
+	// recurse 100 times, using both calls and push
+	code := `
+		100 down
+		.org 32
+		:down dup 0 =jump 0+ 1- dup push down pop drop ;
+		:0 ;`
+	i, err := runAsmImage(code, "VM_AutoGrowAddressStack", vm.AddressSize(8), vm.AutoGrowAddressStack(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "VM_AutoGrowAddressStack", "[0]", fmt.Sprint(i.Data()))
+	_, err = runAsmImage(code, "VM_AutoGrowAddressStack", vm.AddressSize(8), vm.AutoGrowAddressStack(150))
+	if c, ok := errors.Cause(err).(*vm.RuntimeError); !ok || c.Err != vm.ErrReturnStackOverflow || len(c.Address) != 150 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = runAsmImage(code, "VM_AutoGrowAddressStack", vm.MaxCallDepth(100), vm.AutoGrowAddressStack(256))
+	if c, ok := errors.Cause(err).(*vm.RuntimeError); !ok || c.Err != vm.ErrCallDepthExceeded || len(c.Address) != 100 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestVM_GrowableStacks(t *testing.T) {
+	// recurse 100 times, leaving one value per level on the data stack
+	code := `
+		100 down jump end
+		.org 32
+		:down dup 0 =jump 0+ dup push 1- down pop ;
+		:0 ;
+		:end`
+	i, err := runAsmImage(code, "VM_GrowableStacks", vm.GrowableStacks(8, 256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := i.Data()
+	if len(d) != 101 || d[0] != 0 || d[100] != 100 {
+		t.Fatalf("Unexpected data stack: %v", d)
+	}
+	_, err = runAsmImage(code, "VM_GrowableStacks", vm.GrowableStacks(8, 64))
+	if c, ok := errors.Cause(err).(*vm.RuntimeError); !ok || c.Err != vm.ErrStackOverflow && c.Err != vm.ErrReturnStackOverflow {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// host pushes
+	i, err = vm.New(nil, "", vm.GrowableStacks(4, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 16; n++ {
+		i.Push(vm.Cell(n))
+	}
+	assertEqualI(t, "VM_GrowableStacks depth", 16, i.Depth())
+	if _, err = vm.New(nil, "", vm.GrowableStacks(16, 4)); err == nil {
+		t.Fatal("Expected error on invalid sizes")
+	}
+}
+
+func TestVM_CellSize(t *testing.T) {
+	code := `
+		2147483647 1 +
+		-2147483648 1-
+		65536 65536 *
+		-2147483648 -1 /mod
+		1 31 <<
+		-2147483648 1 -`
+	exp := []vm.Cell{-2147483648, 2147483647, 0, 0, -2147483648, -2147483648, 2147483647}
+	i, err := runAsmImage(code, "VM_CellSize", vm.CellSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := i.Data(); !reflect.DeepEqual(d, exp) {
+		t.Fatalf("Expected %v, got %v", exp, d)
+	}
+	if _, err := vm.New(nil, "", vm.CellSize(16)); err == nil {
+		t.Fatal("Expected error on unsupported cell size")
+	}
+
+	// back to native cells
+	i, err = runAsmImage("2147483647 1 +", "VM_CellSize", vm.CellSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_CellSize 32", -2147483648, int(i.Pop()))
+	if err = i.SetOptions(vm.CellSize(vm.CellBits)); err != nil {
+		t.Fatal(err)
+	}
+	i.PC = 0
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	max := vm.Cell(2147483647)
+	assertEqualI(t, "VM_CellSize native", int(max+1), int(i.Pop()))
+}
+
+func TestVM_Watchdog(t *testing.T) {
+	_, err := runAsmImage(":0 jump 0-", "VM_Watchdog", vm.Watchdog(10*time.Millisecond, nil))
+	e, ok := errors.Cause(err).(*vm.StuckError)
+	if !ok || e.Kind != vm.StuckSpinning {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	unblock := make(chan struct{})
+	var kind vm.StuckKind
+	var inWait bool
+	_, err = runAsmImage("1 10 out 0 0 out wait 10 in", "VM_Watchdog",
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			<-unblock
+			i.WaitReply(0, port)
+			return nil
+		}),
+		vm.Watchdog(10*time.Millisecond, func(i *vm.Instance, e *vm.StuckError) {
+			if kind == 0 {
+				kind, inWait = e.Kind, e.InWait
+				close(unblock)
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != vm.StuckBlocked || !inWait {
+		t.Fatalf("Unexpected watchdog report: %v, %v", kind, inWait)
+	}
+}
+
+func TestVM_RequestStop(t *testing.T) {
+	run := func(code string, requests int) (*vm.Instance, error) {
+		img, err := asm.Assemble("VM_RequestStop", strings.NewReader(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := vm.New(img, "VM_RequestStop", vm.ShutdownPort(20, 20*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < requests; n++ {
+			i.RequestStop()
+		}
+		return i, i.Run()
+	}
+	// graceful
+	i, err := run(":0 0 0 out wait 20 in 0 =jump 0- 42", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "VM_RequestStop", "[42]", fmt.Sprint(i.Data()))
+	// forced
+	_, err = run(":0 jump 0-", 1)
+	if errors.Cause(err) != vm.ErrShutdownTimeout {
+		t.Fatalf("Expected ErrShutdownTimeout, got %v", err)
+	}
+	// second request
+	_, err = run(":0 jump 0-", 2)
+	if errors.Cause(err) != vm.ErrStopped {
+		t.Fatalf("Expected ErrStopped, got %v", err)
+	}
+	_, err = runAsmImage("", "VM_RequestStop", vm.ShutdownPort(0, 0))
+	if errors.Cause(err) != vm.ErrPortOutOfRange {
+		t.Fatalf("Expected ErrPortOutOfRange, got %v", err)
+	}
+}
+
+func TestVM_RunToWait(t *testing.T) {
+	img, err := asm.Assemble("VM_RunToWait", strings.NewReader(`
+		:0 1 10 out 0 0 out wait 10 in dup 0 =jump 1+ jump 0-
+		:1 drop 42`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled int
+	i, err := vm.New(img, "VM_RunToWait",
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			handled++
+			i.WaitReply(0, port)
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 3; n > 0; n-- {
+		waiting, err := i.RunToWait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !waiting || i.Mem[i.PC] != vm.OpWait || i.Ports[10] != 1 {
+			t.Fatalf("Expected VM to be waiting, got PC %d", i.PC)
+		}
+		i.WaitReply(vm.Cell(n), 10)
+	}
+	// let the handler reply
+	waiting, err := i.RunToWait()
+	if err != nil || !waiting {
+		t.Fatalf("Expected VM to be waiting, got %v", err)
+	}
+	waiting, err = i.RunToWait()
+	if err != nil || waiting {
+		t.Fatalf("Expected VM to exit, got %v, %v", waiting, err)
+	}
+	assertEqualI(t, "VM_RunToWait", 1, handled)
+	assertEqual(t, "VM_RunToWait", "[3 2 1 42]", fmt.Sprint(i.Data()))
+}
+
+func TestOnError(t *testing.T) {
+	img, err := asm.Assemble("OnError", strings.NewReader(`
+		1 2 -1 @ 7 1000000 @ 8 jump 1+
+		:0 99 :1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	actions := []vm.Action{vm.ActionContinue, vm.ActionReset, vm.ActionAbort}
+	onError := vm.OnError(func(i *vm.Instance, err error) vm.Action {
+		errs = append(errs, err)
+		a := actions[len(errs)-1]
+		switch a {
+		case vm.ActionContinue:
+			i.SetTos(0)
+		case vm.ActionReset:
+			i.PC = len(i.Mem) - 2
+		}
+		return a
+	})
+	i, err := vm.New(img, "OnError", onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "OnError", 2, len(errs))
+	for _, err := range errs {
+		if !errors.Is(err, vm.ErrMemOutOfRange) {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	assertEqual(t, "OnError", "[99]", fmt.Sprint(i.Data()))
+
+	// abort
+	errs = errs[:2]
+	i, err = vm.New(img, "OnError", onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.Run()
+	if !errors.Is(err, vm.ErrMemOutOfRange) || len(errs) != 3 {
+		t.Fatalf("Expected error, got %v", err)
+	}
+}
+
+func TestVSyncTicker(t *testing.T) {
+	var frames []int64
+	i, err := runAsmImage(`jump start
+		.org 32
+		:vsync 0 0 out wait 10 in dup 0 !jump 1+ drop jump vsync :1 ;
+		:start vsync vsync vsync`, "VSyncTicker",
+		vm.Deterministic(0),
+		vm.Ticker(vm.VSyncTicker(60, 10, vm.NewClock(1e9, 0), func(i *vm.Instance, frame int64) {
+			frames = append(frames, frame)
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "VSyncTicker", "[1 2 3]", fmt.Sprint(i.Data()))
+	assertEqual(t, "VSyncTicker", "[1 2 3]", fmt.Sprint(frames[:3]))
+}
+
+func TestVM_Tasks(t *testing.T) {
+	i, err := runAsmImage(`jump start
+		:ptr .dat 3 .dat 0 .dat 0 .dat 0 .dat 0
+		.org 32
+		:task 20 out 0 0 out wait 20 in ;
+		:log 2 @ ! 2 @ 1+ 2 ! ;
+		:t1 1 log 2 task drop 2 log ;
+		:t2 3 log 2 task drop 4 log 42 ;
+		:start
+			lit t1 1 task lit t2 1 task
+			3 task drop 3 task drop 4 task
+			2 task 9 3 task`, "VM_Tasks", vm.Tasks(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "VM_Tasks", "[1 3 2 4]", fmt.Sprint(i.Mem[3:7]))
+	assertEqual(t, "VM_Tasks", "[1 0 0]", fmt.Sprint(i.Data()))
+	assertEqualI(t, "VM_Tasks", 0, int(i.TaskID()))
+
+	_, err = runAsmImage(`jump start
+		.org 32
+		:task 20 out 0 0 out wait 20 in ;
+		:t1 1 3 task ;
+		:start lit t1 1 task 3 task`, "VM_Tasks", vm.Tasks(20))
+	if errors.Cause(err) != vm.ErrTasksBlocked {
+		t.Fatalf("Expected ErrTasksBlocked, got %v", err)
+	}
+}
+
+func TestImageBuilder(t *testing.T) {
+	img, err := vm.NewImageBuilder().
+		Lit(3).Label("loop").Ops(vm.OpDup, vm.OpPush).Jump(vm.OpLoop, "loop").
+		Ops(vm.OpLit).Addr("data").Ops(vm.OpFetch).
+		Label("data").Data(42).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := asm.Assemble("ImageBuilder", strings.NewReader("3 :loop dup push loop loop lit data @ :data .dat 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ImageBuilder", fmt.Sprint(exp), fmt.Sprint(img))
+
+	for _, test := range []struct {
+		b   *vm.ImageBuilder
+		err string
+	}{
+		{vm.NewImageBuilder().Call("foo"), "undefined label foo"},
+		{vm.NewImageBuilder().Label("a").Call("a"), "call to a: address 0 would be decoded as an opcode"},
+		{vm.NewImageBuilder().Label("a").Label("a"), "label a already defined"},
+		{vm.NewImageBuilder().Jump(vm.OpDup, "a"), "opcode 2 is not a jump"},
+		{vm.NewImageBuilder().Data(1, 2).Org(1), "org 1: address already used"},
+	} {
+		if _, err = test.b.Build(); err == nil || err.Error() != test.err {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
 }
 
 func TestVM_inHandler(t *testing.T) {
@@ -417,6 +789,26 @@ func TestVM_InstructionCount(t *testing.T) {
 	assertEqualI(t, "VM_InstructionCount", 11, int(i.InstructionCount()))
 }
 
+func TestVM_StackAccessors(t *testing.T) {
+	i := setup(nil, C{1, 2, 3}, C{10, 20})
+	for n, exp := range []vm.Cell{3, 2, 1, 0, 0} {
+		assertEqualI(t, "VM_StackAccessors StackAt", int(exp), int(i.StackAt(n)))
+	}
+	assertEqualI(t, "VM_StackAccessors StackAt", 0, int(i.StackAt(-1)))
+	d, a := i.StackSnapshot()
+	assertEqual(t, "VM_StackAccessors data", "[1 2 3]", fmt.Sprint(d))
+	assertEqual(t, "VM_StackAccessors address", "[10 20]", fmt.Sprint(a))
+	// changes to snapshots must not affect the stacks
+	d[0], d[2], a[1] = 42, 42, 42
+	d = i.Data()
+	d[1] = 42
+	_ = append(d[:1], 7, 7, 7)
+	assertEqual(t, "VM_StackAccessors data", "[1 2 3]", fmt.Sprint(i.Data()))
+	assertEqual(t, "VM_StackAccessors address", "[10 20]", fmt.Sprint(i.Address()))
+	i.Push(4)
+	assertEqual(t, "VM_StackAccessors push", "[1 2 3 4]", fmt.Sprint(i.Data()))
+}
+
 func TestVM_DataSize(t *testing.T) {
 	i, err := vm.New(nil, "")
 	if err != nil {
@@ -434,6 +826,14 @@ func TestVM_DataSize(t *testing.T) {
 		t.Fatal(err)
 	}
 	assertEqualI(t, "VM_DataSize", 10, len(i.Data()))
+	// growing the stack must preserve its contents
+	err = i.SetOptions(vm.DataSize(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 9; n >= 0; n-- {
+		assertEqualI(t, "VM_DataSize", n, int(i.Pop()))
+	}
 }
 
 func TestVM_AddressSize(t *testing.T) {
@@ -454,3 +854,417 @@ func TestVM_AddressSize(t *testing.T) {
 	}
 	assertEqualI(t, "VM_DataSize", 10, len(i.Address()))
 }
+
+func TestVM_SetOptions(t *testing.T) {
+	i, err := vm.New(C{0}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := func(v vm.Cell) vm.Option {
+		return vm.PatchImage(func(mem []vm.Cell) error {
+			if v < 0 {
+				return errors.New("patch failed")
+			}
+			mem[0] = v
+			return nil
+		})
+	}
+	region := vm.Regions(vm.Region{Name: "r", Start: 0, End: 1})
+	err = i.SetOptions(region, patch(1), patch(-1))
+	if err == nil {
+		t.Fatal("Unexpected nil error")
+	}
+	// the instance must be left unchanged
+	assertEqualI(t, "VM_SetOptions mem", 0, int(i.Mem[0]))
+	if _, ok := i.Region("r"); ok {
+		t.Error("VM_SetOptions: region set after error")
+	}
+
+	err = i.SetOptions(region, patch(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_SetOptions mem", 42, int(i.Mem[0]))
+	if _, ok := i.Region("r"); !ok {
+		t.Error("VM_SetOptions: region not set")
+	}
+}
+
+func TestVM_Clone(t *testing.T) {
+	img, err := asm.Assemble("Clone", strings.NewReader("0 :0 1+ dup 1000 !jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := setup(img, C{7}, nil)
+	c := p.Clone()
+	c.Mem[5] = 500
+	errs := make(chan error)
+	for _, i := range []*vm.Instance{p, c} {
+		go func(i *vm.Instance) { errs <- i.Run() }(i)
+	}
+	for n := 0; n < 2; n++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, "Clone parent", "[7 1000]", fmt.Sprint(p.Data()))
+	assertEqual(t, "Clone", "[7 500]", fmt.Sprint(c.Data()))
+	assertEqualI(t, "Clone parent image", 1000, int(p.Mem[5]))
+}
+
+func TestLoadFS(t *testing.T) {
+	exp, n, err := vm.Load(retroImage, 0, imageBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := os.DirFS(filepath.Dir(retroImage))
+	mem, fn, err := vm.LoadFS(fsys, filepath.Base(retroImage), 50000, imageBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "LoadFS file cells", n, fn)
+	assertEqualI(t, "LoadFS image size", 50000, len(mem))
+	if !reflect.DeepEqual(exp, mem[:n]) {
+		t.Fatal("LoadFS: image mismatch")
+	}
+	if _, _, err = vm.LoadFS(fsys, "missing", 0, imageBits); err == nil {
+		t.Fatal("Expected error on missing file")
+	}
+}
+
+func TestVM_ReloadImage(t *testing.T) {
+	v2, err := asm.Assemble("v2", strings.NewReader("2 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func(i *vm.Instance, v, port vm.Cell) error {
+		i.WaitReply(0, port)
+		return i.ReloadImage(v2, false)
+	}
+	// program v1 requests a reload and loops until reloaded
+	i, err := runAsmImage("1 :0 1 10 out wait jump 0-", "v1", vm.BindWaitHandler(10, reload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ReloadImage", "[2 3]", fmt.Sprint(i.Data()))
+
+	// reload a stopped instance, preserving stacks
+	if err = i.ReloadImage(append(C{}, v2...), true); err != nil {
+		t.Fatal(err)
+	}
+	i.PC = 2
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ReloadImage", "[2 3 3]", fmt.Sprint(i.Data()))
+}
+
+func TestVM_PatchImage(t *testing.T) {
+	i, err := runAsmImage("lit 0 jump 4", "VM_PatchImage",
+		vm.PatchImage(func(mem []vm.Cell) error {
+			mem[1] = 42
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_PatchImage", 42, int(i.Tos()))
+}
+
+func TestVM_Pause(t *testing.T) {
+	img, err := asm.Assemble("VM_Pause", strings.NewReader("0 :0 1+ jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- i.Run() }()
+
+	i.Pause()
+	v := i.Tos()
+	time.Sleep(10 * time.Millisecond)
+	if i.Tos() != v {
+		t.Fatalf("VM not paused: %d != %d", i.Tos(), v)
+	}
+	i.Resume()
+	for i.Pause(); i.Tos() == v; i.Pause() {
+		i.Resume()
+	}
+	i.Stop()
+	i.Resume()
+	if err = <-done; errors.Cause(err) != vm.ErrStopped {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// pause before Run: no instruction should be executed
+	i.Pause()
+	v = i.Tos()
+	go func() { done <- i.Run() }()
+	time.Sleep(10 * time.Millisecond)
+	i.Pause()
+	if i.Tos() != v {
+		t.Fatalf("VM not paused: %d != %d", i.Tos(), v)
+	}
+	i.Stop()
+	if err = <-done; errors.Cause(err) != vm.ErrStopped {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestSharedImage(t *testing.T) {
+	img, err := asm.Assemble("SharedImage", strings.NewReader(`
+		lit v @ 1+ lit v ! jump end
+		.org 1000
+		:v .dat 41
+		:end`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := vm.NewSharedImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	img[1000] = 0
+	assertEqualI(t, "SharedImage Len", len(img), s.Len())
+	var mems [][]vm.Cell
+	for n := 0; n < 2; n++ {
+		mem, release, err := s.Map()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		mems = append(mems, mem)
+	}
+	i, err := vm.New(mems[0], "SharedImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "SharedImage mapped", 42, int(mems[0][1000]))
+	assertEqualI(t, "SharedImage other mapping", 41, int(mems[1][1000]))
+	mem, release, err := s.Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "SharedImage new mapping", 41, int(mem[1000]))
+	release()
+}
+
+func Benchmark_ImageCopy(b *testing.B) {
+	img := make([]vm.Cell, 100000)
+	for n := 0; n < b.N; n++ {
+		mem := make([]vm.Cell, len(img))
+		copy(mem, img)
+		mem[50000]++
+	}
+}
+
+func Benchmark_SharedImageMap(b *testing.B) {
+	s, err := vm.NewSharedImage(make([]vm.Cell, 100000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	for n := 0; n < b.N; n++ {
+		mem, release, err := s.Map()
+		if err != nil {
+			b.Fatal(err)
+		}
+		mem[50000]++
+		release()
+	}
+}
+
+func TestVM_Inspect(t *testing.T) {
+	img, err := asm.Assemble("VM_Inspect", strings.NewReader("0 :0 1+ jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- i.Run() }()
+	var prev vm.Cell
+	for n := 0; n < 3; n++ {
+		var v vm.Cell
+		i.Inspect(func(view vm.ReadOnlyView) {
+			d, pc := view.Data(), view.PC()
+			if pc == 0 && len(d) == 0 {
+				// not started yet
+				return
+			}
+			if len(d) != 1 || pc < 2 || pc > 3 {
+				t.Errorf("Inconsistent view: PC %d, data %v", pc, d)
+				return
+			}
+			v = d[0]
+		})
+		if v < prev {
+			t.Fatalf("Expected %d >= %d", v, prev)
+		}
+		prev = v
+	}
+	i.Stop()
+	if err = <-done; errors.Cause(err) != vm.ErrStopped {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// not running
+	var mem []vm.Cell
+	i.Inspect(func(view vm.ReadOnlyView) { mem = view.Mem(-1, 2) })
+	assertEqual(t, "VM_Inspect", "[1 0]", fmt.Sprint(mem))
+}
+
+func TestVM_MaxInstructions(t *testing.T) {
+	i, err := runAsmImage("0 :0 1+ jump 0-", "VM_MaxInstructions", vm.MaxInstructions(101))
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxInstructions" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqualI(t, "VM_MaxInstructions count", 101, int(i.InstructionCount()))
+	assertEqualI(t, "VM_MaxInstructions tos", 50, int(i.Tos()))
+	// resume
+	err = i.Run()
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxInstructions" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqualI(t, "VM_MaxInstructions tos", 101, int(i.Tos()))
+}
+
+func TestVM_Deadline(t *testing.T) {
+	start := time.Now()
+	i, err := runAsmImage("0 :0 1+ jump 0-", "VM_Deadline", vm.Deadline(20*time.Millisecond))
+	if errors.Cause(err) != vm.ErrDeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("Run returned too early: %v", d)
+	}
+	// resume with a new budget
+	v := i.Tos()
+	if err = i.Run(); errors.Cause(err) != vm.ErrDeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if i.Tos() <= v {
+		t.Fatalf("VM not resumed: %d <= %d", i.Tos(), v)
+	}
+	// disable
+	i.SetOptions(vm.Deadline(0), vm.MaxInstructions(100))
+	if err = i.Run(); errors.Cause(err) == vm.ErrDeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestVM_AutoGrowMemory(t *testing.T) {
+	i, err := runAsmImage("42 1000 ! 999 @ 1000 @ jump 1001", "VM_AutoGrowMemory", vm.AutoGrowMemory(2000))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqualI(t, "VM_AutoGrowMemory size", 1001, len(i.Mem))
+	assertEqualI(t, "VM_AutoGrowMemory", 42, int(i.Pop()))
+	assertEqualI(t, "VM_AutoGrowMemory", 0, int(i.Pop()))
+
+	_, err = runAsmImage("2000 @", "VM_AutoGrowMemory", vm.AutoGrowMemory(2000))
+	if e, ok := errors.Cause(err).(*vm.RuntimeError); !ok || e.Err != vm.ErrMemOutOfRange {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = runAsmImage("1500 @", "VM_AutoGrowMemory",
+		vm.AutoGrowMemory(2000), vm.ResourceLimits(vm.Limits{MaxMemCells: 1000}))
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxMemCells" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestVM_BindMemRegion(t *testing.T) {
+	var fb [16]vm.Cell
+	fetch := func(i *vm.Instance, addr vm.Cell) (vm.Cell, error) { return fb[addr-1000] + 1, nil }
+	store := func(i *vm.Instance, addr, v vm.Cell) error { fb[addr-1000] = v; return nil }
+	i, err := runAsmImage("42 1003 ! 1003 @ 1015 @", "VM_BindMemRegion",
+		vm.BindMemRegion(1000, 1016, fetch, store))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqualI(t, "VM_BindMemRegion fb", 42, int(fb[3]))
+	assertEqualI(t, "VM_BindMemRegion", 1, int(i.Pop()))
+	assertEqualI(t, "VM_BindMemRegion", 43, int(i.Pop()))
+
+	_, err = vm.New(nil, "",
+		vm.BindMemRegion(1000, 1016, fetch, store),
+		vm.BindMemRegion(990, 1001, fetch, store))
+	if err == nil {
+		t.Fatal("Expected error for overlapping regions")
+	}
+}
+
+func TestVM_SharedSegment(t *testing.T) {
+	seg := vm.NewSegment(4)
+	seg.Store(1, 41)
+	done := make(chan error)
+	go func() {
+		// consumer: wait for a value at 2000, then store it + 1 at 2001
+		_, err := runAsmImage(":0 2000 @ 0 =jump 0- 2000 @ 1+ 2001 !", "VM_SharedSegment",
+			vm.SharedSegment(2000, seg))
+		done <- err
+	}()
+	// producer
+	_, err := runAsmImage("1001 @ 1000 !", "VM_SharedSegment", vm.SharedSegment(1000, seg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_SharedSegment", 42, int(seg.Load(1)))
+	_, err = vm.New(nil, "", vm.SharedSegment(0, vm.NewSegment(0)))
+	if err == nil {
+		t.Fatal("Expected error for empty segment")
+	}
+}
+
+func TestVM_UnsignedOps(t *testing.T) {
+	i, err := runAsmImage(fmt.Sprintf(`
+		.opcode u<    -10
+		.opcode u>    -11
+		.opcode u>>   -12
+		.opcode u/mod -13
+		1 -1 u<   -1 1 u<   1 2 u<
+		1 -1 u>   -1 1 u>   2 2 u>
+		-1 %d u>>   -8 1 >>
+		-1 -1 u/mod   -2 -1 u/mod   7 2 u/mod`, vm.CellBits-1),
+		"VM_UnsignedOps", vm.UnsignedOps(-10))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "VM_UnsignedOps", "[-1 0 -1 0 -1 0 1 -4 0 1 -2 0 1 3]", fmt.Sprint(i.Data()))
+
+	if _, err = vm.New(nil, "", vm.UnsignedOps(0)); err == nil {
+		t.Fatal("Expected error for positive opcode")
+	}
+	_, err = runAsmImage(".opcode u/mod -13 1 0 u/mod", "VM_UnsignedOps", vm.UnsignedOps(-10))
+	if err == nil {
+		t.Fatal("Expected error for division by zero")
+	}
+}
+
+func TestVM_BindOpcode(t *testing.T) {
+	sq := func(i *vm.Instance, op vm.Cell) error { i.SetTos(i.Tos() * i.Tos()); return nil }
+	i, err := runAsmImage(".opcode sq -2 .opcode fib -1 7 sq 10 fib", "VM_BindOpcode",
+		vm.BindOpcodeHandler(fibHandler),
+		vm.BindOpcode(-2, sq))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqualI(t, "VM_BindOpcode fib", 55, int(i.Pop()))
+	assertEqualI(t, "VM_BindOpcode sq", 49, int(i.Pop()))
+
+	_, err = vm.New(nil, "", vm.BindOpcode(1, sq))
+	if err == nil {
+		t.Fatal("Expected error for positive opcode")
+	}
+}
@@ -0,0 +1,185 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// ErrBreakpoint is the root cause of the error returned by Run when the PC
+// hits a breakpoint.
+var ErrBreakpoint = errors.New("breakpoint")
+
+// Tracer is the interface implemented by instruction tracers. Trace is called
+// before each instruction is executed with the current PC, the opcode at PC,
+// the value on top of the data stack and the data stack depth.
+type Tracer interface {
+	Trace(pc int, opcode, tos Cell, depth int)
+}
+
+// TracerFunc is an adapter to allow the use of ordinary functions as Tracer.
+type TracerFunc func(pc int, opcode, tos Cell, depth int)
+
+// Trace calls f(pc, opcode, tos, depth).
+func (f TracerFunc) Trace(pc int, opcode, tos Cell, depth int) {
+	f(pc, opcode, tos, depth)
+}
+
+// Trace sets the instruction tracer. A nil Tracer disables tracing.
+//
+// Tracing, like breakpoints, is handled out of the fast path: as long as no
+// tracer and no breakpoints are set, there is no performance penalty.
+func Trace(t Tracer) Option {
+	return func(i *Instance) error {
+		i.tracer = t
+		i.updateDebug()
+		return nil
+	}
+}
+
+// updateDebug enables the slow debug path in Run if any debugging feature is
+// in use, including instruction timing.
+func (i *Instance) updateDebug() {
+	i.debug = i.bp != nil || i.tracer != nil || i.timeOps
+}
+
+// bitmap is a simple bit set used for breakpoints.
+type bitmap []uint64
+
+func (b bitmap) test(n int) bool {
+	w := n >> 6
+	return w < len(b) && b[w]&(1<<uint(n&63)) != 0
+}
+
+func (b *bitmap) set(n int) {
+	w := n >> 6
+	if w >= len(*b) {
+		*b = append(*b, make(bitmap, w-len(*b)+1)...)
+	}
+	(*b)[w] |= 1 << uint(n&63)
+}
+
+func (b bitmap) clear(n int) {
+	if w := n >> 6; w < len(b) {
+		b[w] &^= 1 << uint(n&63)
+	}
+}
+
+func (b bitmap) empty() bool {
+	for _, w := range b {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetBreakpoint sets a breakpoint at the given address. When the PC reaches
+// addr, Run returns an error whose root cause is ErrBreakpoint, before executing
+// the instruction at addr. The PC is left pointing to the breakpoint, so that
+// calling Run again resumes execution from there.
+func (i *Instance) SetBreakpoint(addr int) {
+	if addr < 0 {
+		return
+	}
+	i.bp.set(addr)
+	i.updateDebug()
+}
+
+// ClearBreakpoint removes the breakpoint at the given address.
+func (i *Instance) ClearBreakpoint(addr int) {
+	if addr < 0 {
+		return
+	}
+	i.bp.clear(addr)
+	if i.bp.empty() {
+		i.bp = nil
+	}
+	i.updateDebug()
+}
+
+// Breakpoint returns true if a breakpoint is set at the given address.
+func (i *Instance) Breakpoint(addr int) bool {
+	return addr >= 0 && i.bp.test(addr)
+}
+
+// ErrWatchpoint can be returned by WatchFunc callbacks to stop the VM.
+var ErrWatchpoint = errors.New("watchpoint")
+
+// WatchFunc is the prototype for memory watchpoint callbacks. addr is the
+// address being accessed, v is the value being read or written.
+//
+// Returning a non-nil error stops the VM before the memory access takes place:
+// Run will return the error and the PC will point to the instruction that
+// triggered the watchpoint. Calling Run again resumes execution from there
+// without triggering the watchpoint again.
+type WatchFunc func(i *Instance, addr, v Cell) error
+
+type watch struct {
+	onRead, onWrite WatchFunc
+}
+
+// WatchCell sets a memory watchpoint on the given address. onRead will be
+// called when the cell is read by the fetch opcode, onWrite when it is written
+// to by the store opcode. Either function can be nil.
+func (i *Instance) WatchCell(addr Cell, onRead, onWrite WatchFunc) {
+	if onRead == nil && onWrite == nil {
+		i.UnwatchCell(addr)
+		return
+	}
+	if i.watch == nil {
+		i.watch = make(map[Cell]watch)
+	}
+	i.watch[addr] = watch{onRead, onWrite}
+	i.updateMemHook()
+}
+
+// UnwatchCell removes any watchpoint set on the given address.
+func (i *Instance) UnwatchCell(addr Cell) {
+	delete(i.watch, addr)
+	if len(i.watch) == 0 {
+		i.watch = nil
+	}
+	i.updateMemHook()
+}
+
+// watchRead calls the read watchpoint for addr, if any.
+func (i *Instance) watchRead(addr Cell) error {
+	if w := i.watch[addr]; w.onRead != nil && addr >= 0 && int(addr) < len(i.Mem) {
+		return i.watchHit(w.onRead, addr, i.Mem[addr])
+	}
+	return nil
+}
+
+// watchWrite calls the write watchpoint for addr, if any.
+func (i *Instance) watchWrite(addr, v Cell) error {
+	if w := i.watch[addr]; w.onWrite != nil {
+		return i.watchHit(w.onWrite, addr, v)
+	}
+	return nil
+}
+
+func (i *Instance) watchHit(fn WatchFunc, addr, v Cell) error {
+	if i.wpPC == i.PC {
+		// resuming after a stop on this watchpoint
+		i.wpPC = -1
+		return nil
+	}
+	if err := fn(i, addr, v); err != nil {
+		i.wpPC = i.PC
+		return errors.Wrapf(err, "watchpoint @pc=%d, address %d", i.PC, addr)
+	}
+	return nil
+}
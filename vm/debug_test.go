@@ -0,0 +1,216 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+func TestVM_Breakpoint(t *testing.T) {
+	img, err := asm.Assemble("VM_Breakpoint", strings.NewReader("3 :0 nop loop 0- 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// break on nop
+	i.SetBreakpoint(2)
+	for n := 0; n < 3; n++ {
+		err = i.Run()
+		if errors.Cause(err) != vm.ErrBreakpoint {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		assertEqualI(t, "VM_Breakpoint PC", 2, i.PC)
+	}
+	i.ClearBreakpoint(2)
+	if i.Breakpoint(2) {
+		t.Fatal("Breakpoint not cleared")
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_Breakpoint", 42, int(i.Tos()))
+}
+
+func TestVM_WatchCell(t *testing.T) {
+	img, err := asm.Assemble("VM_WatchCell", strings.NewReader("jump start :var .dat 0 :start lit var @ 1+ lit var ! lit var @"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reads int
+	i.WatchCell(2, func(i *vm.Instance, addr, v vm.Cell) error {
+		reads++
+		return nil
+	}, func(i *vm.Instance, addr, v vm.Cell) error {
+		if v != 1 {
+			t.Errorf("Unexpected write value %d", v)
+		}
+		return vm.ErrWatchpoint
+	})
+	err = i.Run()
+	if errors.Cause(err) != vm.ErrWatchpoint {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqualI(t, "VM_WatchCell value before write", 0, int(i.Mem[2]))
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_WatchCell reads", 2, reads)
+	assertEqualI(t, "VM_WatchCell value", 1, int(i.Tos()))
+}
+
+func TestVM_Trace(t *testing.T) {
+	var pcs []int
+	tr := vm.TracerFunc(func(pc int, op, tos vm.Cell, depth int) {
+		pcs = append(pcs, pc)
+	})
+	_, err := runAsmImage("1 2 + drop", "VM_Trace", vm.Trace(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []int{0, 2, 4, 5}
+	if len(pcs) != len(exp) {
+		t.Fatalf("Expected %v, got %v", exp, pcs)
+	}
+	for n := range exp {
+		if pcs[n] != exp[n] {
+			t.Fatalf("Expected %v, got %v", exp, pcs)
+		}
+	}
+}
+
+func TestVM_InstructionTiming(t *testing.T) {
+	i, err := runAsmImage("1 10 out 0 0 out wait 1 2 + 3 @", "VM_InstructionTiming",
+		vm.TimeInstructions(true),
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			time.Sleep(2 * time.Millisecond)
+			i.WaitReply(0, port)
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := i.InstructionTiming()
+	var counts []int64
+	for _, c := range tm {
+		counts = append(counts, c.Count)
+	}
+	assertEqual(t, "VM_InstructionTiming counts", "[7 1 1 0 2 1 0]", fmt.Sprint(counts))
+	if w := tm[vm.CatWait].Time; w < 2*time.Millisecond || tm[vm.CatStack].Time >= w {
+		t.Fatalf("Unexpected timings: %v", tm)
+	}
+}
+
+func TestVM_CallStack(t *testing.T) {
+	img, dbg, err := asm.AssembleDebug("VM_CallStack", strings.NewReader(`
+		:main outer jump main
+		.org 32
+		:outer 1 inner ;
+		:inner 2 nop ;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetBreakpoint(38)
+	if err = i.Run(); errors.Cause(err) != vm.ErrBreakpoint {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exp := []string{"inner+2 (38)", "outer+2 (34)", "main (0)"}
+	f := i.CallStack(dbg.Symbols())
+	if len(f) != len(exp) {
+		t.Fatalf("Expected %d frames, got %v", len(exp), f)
+	}
+	for n := range f {
+		assertEqual(t, "CallStack", exp[n], f[n].String())
+	}
+	f = i.CallStack(nil)
+	assertEqual(t, "CallStack nil", "34", f[1].String())
+}
+
+func TestSymbolTable(t *testing.T) {
+	st := vm.NewSymbolTable(vm.Symbol{Addr: 10, Name: "b"}, vm.Symbol{Addr: 2, Name: "a"})
+	st.Add(10, "alias")
+	if _, _, ok := st.Lookup(1); ok {
+		t.Error("Unexpected symbol for address 1")
+	}
+	for _, tt := range []struct {
+		addr vm.Cell
+		name string
+		off  vm.Cell
+	}{{2, "a", 0}, {9, "a", 7}, {10, "b", 0}, {100, "b", 90}} {
+		sym, off, ok := st.Lookup(tt.addr)
+		if !ok || sym.Name != tt.name || off != tt.off {
+			t.Errorf("Lookup(%d): expected %s+%d, got %s+%d, %v", tt.addr, tt.name, tt.off, sym.Name, off, ok)
+		}
+	}
+	assertEqualI(t, "Len", 3, st.Len())
+}
+
+func TestProfiler(t *testing.T) {
+	img, dbg, err := asm.AssembleDebug("Profiler", strings.NewReader(`
+		:main 100 :0 outer loop 0-
+		.org 32
+		:outer 1 inner ;
+		:inner drop ;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := vm.NewProfiler(3)
+	i, err := vm.New(img, "Profiler", vm.Profile(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err = p.WriteTo(&b, dbg.Symbols()); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"main", "outer", "inner", "instructions", "Profiler"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("String %q not found in profile", s)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"math/rand"
+	"time"
+)
+
+// fakeEpoch is the start time of the fake clock used in deterministic mode.
+var fakeEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeClock is the clock used in deterministic mode. It starts at fakeEpoch
+// and advances by one second on every call to now.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	now := c.t
+	c.t = c.t.Add(time.Second)
+	return now
+}
+
+// Deterministic configures the VM for reproducible runs: given the same image
+// and the same inputs, two runs with the same seed are guaranteed to produce
+// identical results. In deterministic mode:
+//
+//   - time queries on port 5 return the time of a fake clock that starts on
+//     2000-01-01 00:00:00 UTC and advances by one second on every query
+//   - the random number generator (port 5, query -18) is seeded with seed
+//   - ClockLimiter tickers do not sleep
+//
+// WAIT handlers are always dispatched in port number order, so this does not
+// need to be enforced here.
+func Deterministic(seed int64) Option {
+	return func(i *Instance) error {
+		i.detMode = true
+		i.clock = &fakeClock{fakeEpoch}
+		i.rng = rand.New(rand.NewSource(seed))
+		return nil
+	}
+}
+
+// now returns the current time as seen by the VM.
+func (i *Instance) now() time.Time {
+	if i.clock != nil {
+		return i.clock.now()
+	}
+	return time.Now()
+}
+
+// random returns a non-negative pseudo-random Cell.
+func (i *Instance) random() Cell {
+	if i.rng == nil {
+		i.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return Cell(i.rng.Int63() >> (64 - CellBits))
+}
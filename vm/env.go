@@ -0,0 +1,75 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Environ gives the VM a private environment, initialized from env, a list of
+// "key=value" strings like the one returned by os.Environ. Environment queries
+// on port 5 then read from it instead of the host environment, the setEnv
+// query -33 can modify it, and processes spawned by the Exec device inherit
+// it. Pass os.Environ() to start with a copy of the host environment.
+//
+// Without this option, variables are read from the host environment, which
+// cannot be modified or enumerated by the VM.
+func Environ(env []string) Option {
+	return func(i *Instance) error {
+		i.env = make(map[string]string, len(env))
+		for _, kv := range env {
+			if n := strings.IndexByte(kv, '='); n >= 0 {
+				i.env[kv[:n]] = kv[n+1:]
+			}
+		}
+		return nil
+	}
+}
+
+// getenv returns the value of the environment variable name.
+func (i *Instance) getenv(name string) string {
+	if i.env != nil {
+		return i.env[name]
+	}
+	return os.Getenv(name)
+}
+
+// environ returns the private environment as a sorted list of "key=value"
+// strings. It returns nil if the VM has no private environment.
+func (i *Instance) environ() []string {
+	if i.env == nil {
+		return nil
+	}
+	env := make([]string, 0, len(i.env))
+	for k, v := range i.env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// setenv sets the environment variable name to value in the VM's private
+// environment and reports whether it succeeded.
+func (i *Instance) setenv(name, value string) bool {
+	if i.env == nil || i.disabled&DevEnv != 0 || name == "" || strings.ContainsAny(name, "=\x00") {
+		return false
+	}
+	i.env[name] = value
+	return true
+}
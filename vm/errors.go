@@ -0,0 +1,138 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"runtime"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Runtime error kinds. They are returned by RuntimeError.Unwrap, so that
+// errors.Is(err, ErrStackOverflow) works on errors returned by Run.
+var (
+	ErrMemOutOfRange       = errors.New("memory access out of range")
+	ErrPortOutOfRange      = errors.New("port number out of range")
+	ErrStackOverflow       = errors.New("data stack overflow")
+	ErrReturnStackOverflow = errors.New("address stack overflow")
+	ErrCallDepthExceeded   = errors.New("call depth exceeded")
+)
+
+// errStackGrown is returned by runtimeError when the data or address stack has
+// been grown and the faulting instruction can be executed again.
+var errStackGrown = errors.New("stack grown")
+
+// errWaitReached is returned by wait when RunToWait reaches a WAIT instruction.
+var errWaitReached = errors.New("WAIT reached")
+
+// number of address stack entries reported by RuntimeError.Error on address
+// stack overflows.
+const callStackTop = 4
+
+// RuntimeError is the root cause of errors returned by Run when the program
+// being executed triggers a runtime error (stack overflow, out of range memory
+// access or port number).
+type RuntimeError struct {
+	Err     error  // kind of error: ErrMemOutOfRange, ErrStackOverflow, etc.
+	PC      int    // address of the instruction that triggered the error
+	Addr    Cell   // offending memory address or port number, if any
+	Data    []Cell // snapshot of the data stack
+	Address []Cell // snapshot of the address stack
+}
+
+func (e *RuntimeError) Error() string {
+	s := e.Err.Error() + " @pc=" + strconv.Itoa(e.PC)
+	switch e.Err {
+	case ErrMemOutOfRange:
+		s += ", address " + strconv.FormatInt(int64(e.Addr), 10)
+	case ErrPortOutOfRange:
+		s += ", port " + strconv.FormatInt(int64(e.Addr), 10)
+	}
+	s += ", stack depth " + strconv.Itoa(len(e.Data)) + ", rstack depth " + strconv.Itoa(len(e.Address))
+	if e.Err == ErrCallDepthExceeded || e.Err == ErrReturnStackOverflow {
+		s += ", calls from"
+		for n := len(e.Address) - 1; n >= 0 && n >= len(e.Address)-callStackTop; n-- {
+			s += " " + strconv.FormatInt(int64(e.Address[n]), 10)
+		}
+		if len(e.Address) > callStackTop {
+			s += " ..."
+		}
+	}
+	return s
+}
+
+// Unwrap returns the kind of error.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// stackSnapshot returns a copy of a stack with the given stack pointer and top
+// of stack.
+func stackSnapshot(s []Cell, sp int, tos Cell) []Cell {
+	if sp < 1 {
+		return nil
+	}
+	r := make([]Cell, sp)
+	copy(r, s[2:sp+1])
+	r[sp-1] = tos
+	return r
+}
+
+// newRuntimeError returns a new *RuntimeError for the instruction at PC.
+func (i *Instance) newRuntimeError(kind error, addr Cell) error {
+	return errors.WithStack(&RuntimeError{
+		Err:     kind,
+		PC:      i.PC,
+		Addr:    addr,
+		Data:    stackSnapshot(i.data, i.sp, i.tos),
+		Address: stackSnapshot(i.address, i.rsp, i.rtos),
+	})
+}
+
+// runtimeError converts a runtime.Error that occurred while executing the
+// instruction at PC into a *RuntimeError. It returns nil if the cause of the
+// error cannot be determined.
+func (i *Instance) runtimeError(e runtime.Error) error {
+	switch {
+	case i.sp >= len(i.data):
+		// push failed, restore stack pointer
+		i.sp = len(i.data) - 1
+		if i.growData() {
+			return errStackGrown
+		}
+		return i.newRuntimeError(ErrStackOverflow, 0)
+	case i.rsp >= len(i.address):
+		i.rsp = len(i.address) - 1
+		if i.growAddress() {
+			return errStackGrown
+		}
+		if i.callDepth > 0 {
+			return i.newRuntimeError(ErrCallDepthExceeded, 0)
+		}
+		return i.newRuntimeError(ErrReturnStackOverflow, 0)
+	case i.PC < 0 || i.PC >= len(i.Mem):
+		return i.newRuntimeError(ErrMemOutOfRange, Cell(i.PC))
+	}
+	switch i.Mem[i.PC] {
+	case OpFetch, OpStore:
+		return i.newRuntimeError(ErrMemOutOfRange, i.tos)
+	case OpIn:
+		return i.newRuntimeError(ErrPortOutOfRange, i.tos)
+	}
+	return nil
+}
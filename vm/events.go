@@ -0,0 +1,163 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQueueFull is returned by EventQueue.Post when the queue is full.
+var ErrQueueFull = errors.New("event queue full")
+
+// EventType identifies the kind of an Event.
+type EventType Cell
+
+// Predefined event types. The meaning of event arguments is up to the host and
+// VM code; the suggested payloads are given below.
+const (
+	EventKey     EventType = iota + 1 // key code, modifiers (see KeyDecoder)
+	EventMouse                        // x, y, button state
+	EventTimer                        // timer ID
+	EventNetwork                      // connection or file ID that is ready
+	EventUser    EventType = 256      // first user defined event type
+)
+
+// Event is a host event.
+type Event struct {
+	Type EventType
+	Args []Cell
+}
+
+// Event queue requests.
+const (
+	eqDequeue Cell = 1 + iota
+	eqLen
+	eqWait
+)
+
+// EventQueue is a device that delivers host events to VM code. Events are
+// posted by the host from any goroutine and dequeued in order by the VM with a
+// WAIT on the port the queue is bound to (see Events). Events are not recorded
+// in journals (see Record).
+//
+// The following requests are supported, where p is the bound port:
+//
+//	1 p out 0 0 out wait p in	( dequeue: -- args... n type )
+//	2 p out 0 0 out wait p in	( queue length: -- n )
+//	3 p out 0 0 out wait p in	( blocking dequeue: -- args... n type )
+//
+// A dequeue request pushes the event arguments followed by their count on the
+// data stack and replies with the event type. If the queue is empty, nothing is
+// pushed and the reply is 0. A blocking dequeue waits until an event is posted:
+// the VM will not respond to Pause or Stop requests while blocked.
+//
+// Since all events are delivered by a WAIT handler in the VM goroutine, VM code
+// never sees partially posted events, whatever the number of posting
+// goroutines.
+type EventQueue struct {
+	mu    sync.Mutex
+	q     []Event
+	max   int
+	ready chan struct{} // signaled when an event is posted
+}
+
+// NewEventQueue returns a new EventQueue holding at most max events. If max <=
+// 0, the queue is unbounded.
+func NewEventQueue(max int) *EventQueue {
+	return &EventQueue{max: max, ready: make(chan struct{}, 1)}
+}
+
+// Post appends an event to the queue. It can be called from any goroutine and
+// does not block. It returns ErrQueueFull if the queue is full. The Args slice
+// must not be modified after the call.
+func (q *EventQueue) Post(e Event) error {
+	q.mu.Lock()
+	if q.max > 0 && len(q.q) >= q.max {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.q = append(q.q, e)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of pending events.
+func (q *EventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.q)
+}
+
+// pop removes the first event from the queue.
+func (q *EventQueue) pop() (e Event, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.q) == 0 {
+		return e, false
+	}
+	e = q.q[0]
+	q.q[0] = Event{}
+	q.q = q.q[1:]
+	return e, true
+}
+
+// Events binds the event queue q to the given port.
+func Events(port Cell, q *EventQueue) Option {
+	return func(i *Instance) error {
+		if port <= 0 || int(port) >= len(i.Ports) {
+			return errors.Wrapf(ErrPortOutOfRange, "port %d", port)
+		}
+		i.bindWait(port, q.wait)
+		return nil
+	}
+}
+
+// wait is the WAIT handler of an event queue.
+func (q *EventQueue) wait(i *Instance, v, port Cell) error {
+	switch v {
+	case eqLen:
+		i.WaitReply(Cell(q.Len()), port)
+		return nil
+	case eqDequeue, eqWait:
+		e, ok := q.pop()
+		for !ok && v == eqWait {
+			<-q.ready
+			e, ok = q.pop()
+		}
+		if !ok {
+			i.WaitReply(0, port)
+			return nil
+		}
+		if i.sp+len(e.Args)+1 >= len(i.data) {
+			return i.newRuntimeError(ErrStackOverflow, 0)
+		}
+		for _, a := range e.Args {
+			i.Push(a)
+		}
+		i.Push(Cell(len(e.Args)))
+		i.WaitReply(Cell(e.Type), port)
+		return nil
+	}
+	i.WaitReply(0, port)
+	return nil
+}
@@ -109,6 +109,8 @@ func ExampleBindOutHandler() {
 // here to implement a (dummy) canvas. We'll need to override port 5 in order to
 // report canvas availability and its size and implement the actual drawing on
 // port 6. See http://retroforth.org/docs/The_Ngaro_Virtual_Machine.html
+//
+// A complete canvas implementation is available with NewCanvas and BindCanvas.
 func ExampleBindWaitHandler() {
 	imageFile := "testdata/retroImage"
 	img, _, err := vm.Load(imageFile, 50000, 32)
@@ -299,3 +301,29 @@ func ExampleBindOpcodeHandler() {
 	// Output:
 	// [1836311903]
 }
+
+// Shows how to build a memory image without the assembler.
+func ExampleImageBuilder() {
+	img, err := vm.NewImageBuilder().
+		Lit(5).Call("square").
+		Lit(3).Call("square").
+		Jump(vm.OpJump, "end").
+		Org(32).
+		Label("square").Ops(vm.OpDup, vm.OpMul, vm.OpReturn).
+		Label("end").
+		Build()
+	if err != nil {
+		panic(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		panic(err)
+	}
+	if err = i.Run(); err != nil {
+		panic(err)
+	}
+	fmt.Println(i.Data())
+
+	// Output:
+	// [25 9]
+}
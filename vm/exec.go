@@ -0,0 +1,190 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type process struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// Exec implements a subprocess device that spawns host commands with piped
+// standard input and output. Since it gives programs running in the VM access
+// to the host, it is never enabled by default and must be explicitly bound to
+// a port with BindWaitHandler:
+//
+//	e := vm.NewExec("ls", "grep")
+//	defer e.Close()
+//	i, err := vm.New(mem, "retroImage",
+//		vm.StringCodec(retro.StringCodec),
+//		vm.BindWaitHandler(10, e.WaitHandler))
+//
+// Command lines are given as strings encoded in memory with the instance's
+// StringCodec. They are split into fields separated by white space, the first
+// one being the command name. No shell is involved. The standard error of
+// commands is discarded. Commands inherit the environment of the VM (see
+// Environ).
+//
+// The device is disabled if the DevExec device is disabled (see
+// DisableDevices). Subprocess output is not recorded in journals (see Record).
+// Commands that are not allowed and commands that fail to start are reported
+// to the instance's Logger.
+type Exec struct {
+	mu      sync.Mutex
+	allowed map[string]bool
+	next    Cell
+	procs   map[Cell]*process
+}
+
+// AllowAnyCommand can be given to NewExec in place of command names to allow
+// any command to be spawned.
+const AllowAnyCommand = "*"
+
+// NewExec returns a new subprocess device that can only spawn the given
+// commands. With no arguments, no command can be spawned. Use
+// NewExec(AllowAnyCommand) to allow any command.
+func NewExec(allowed ...string) *Exec {
+	e := &Exec{next: 1, procs: make(map[Cell]*process)}
+	e.allowed = make(map[string]bool, len(allowed))
+	for _, c := range allowed {
+		e.allowed[c] = true
+	}
+	return e
+}
+
+// Close kills all running processes spawned by the device.
+func (e *Exec) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, p := range e.procs {
+		p.in.Close()
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		delete(e.procs, id)
+	}
+	return nil
+}
+
+func (e *Exec) spawn(i *Instance, line string) Cell {
+	args := strings.Fields(line)
+	if len(args) == 0 || !e.allowed[AllowAnyCommand] && !e.allowed[args[0]] {
+		i.logError("command not allowed", "cmd", line)
+		return 0
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if i.env != nil {
+		cmd.Env = i.environ()
+	}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		i.logError("command start failed", "cmd", line, "err", err)
+		return 0
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		in.Close()
+		i.logError("command start failed", "cmd", line, "err", err)
+		return 0
+	}
+	if err = cmd.Start(); err != nil {
+		// Start closes the pipes on failure
+		i.logError("command start failed", "cmd", line, "err", err)
+		return 0
+	}
+	e.mu.Lock()
+	id := e.next
+	e.next++
+	e.procs[id] = &process{cmd: cmd, in: in, out: bufio.NewReader(out)}
+	e.mu.Unlock()
+	return id
+}
+
+func (e *Exec) process(id Cell) *process {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.procs[id]
+}
+
+// WaitHandler implements the subprocess device. The following requests are
+// supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	a-h	spawn the command line at a. Returns a process handle, 0 on failure
+//	2	h-f	close the standard input of process h
+//	3	ch-n	write byte c to the standard input of process h. Returns the number of bytes written
+//	4	h-c	read a byte from the standard output of process h. Returns -1 at the end of the output
+//	5	h-n	wait for process h to exit and release it. Returns its exit code
+//
+// Reads block until the process writes to its standard output or closes it, and
+// so does the wait request until the process exits, without checking for Stop
+// or Pause requests. Flags (f) are -1 on success, 0 on failure. The exit code
+// is -1 if the process could not be waited for or was killed by a signal.
+func (e *Exec) WaitHandler(i *Instance, v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		a := i.Pop()
+		if i.sEnc != nil && i.disabled&DevExec == 0 {
+			reply = e.spawn(i, string(i.sEnc.Decode(i.Mem, a)))
+		}
+	case 2:
+		if p := e.process(i.Pop()); p != nil && p.in.Close() == nil {
+			reply = -1
+		}
+	case 3:
+		id, c := i.Pop(), i.Pop()
+		if p := e.process(id); p != nil {
+			n, _ := p.in.Write([]byte{byte(c)})
+			reply = Cell(n)
+		}
+	case 4:
+		reply = -1
+		if p := e.process(i.Pop()); p != nil {
+			if c, err := p.out.ReadByte(); err == nil {
+				reply = Cell(c)
+			}
+		}
+	case 5:
+		id := i.Pop()
+		reply = -1
+		e.mu.Lock()
+		p := e.procs[id]
+		delete(e.procs, id)
+		e.mu.Unlock()
+		if p != nil {
+			p.in.Close()
+			// drain the output so that the process does not block on writes
+			io.Copy(io.Discard, p.out)
+			if p.cmd.Wait(); p.cmd.ProcessState != nil {
+				reply = Cell(p.cmd.ProcessState.ExitCode())
+			}
+		}
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
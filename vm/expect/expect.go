@@ -0,0 +1,267 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expect provides an expect-like driver for interactive programs
+// running in an Ngaro VM, mainly intended for integration tests.
+//
+// A Session runs a VM instance in its own goroutine. Input is sent to the VM
+// with Send and Sendln, and its output is matched against regular expressions
+// with Expect, which waits until the output matches or a timeout expires:
+//
+//	s, err := expect.Start(img, "retroImage")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer s.Close()
+//	s.Sendln("1 2 + putn")
+//	if _, err := s.Expect(`putn (\d+)`); err != nil {
+//		t.Fatal(err)
+//	}
+package expect
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the default timeout of Expect.
+const DefaultTimeout = 5 * time.Second
+
+// ErrTimeout is the root cause of the error returned by Expect when the
+// output does not match before the timeout expires.
+var ErrTimeout = errors.New("expect timeout")
+
+// ErrExited is the root cause of the error returned by Expect when the VM
+// exits before its output matches.
+var ErrExited = errors.New("program exited")
+
+// Session is an interactive session with a VM instance.
+type Session struct {
+	// Timeout is the timeout used by Expect. Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	i      *vm.Instance
+	in     input
+	mu     sync.Mutex
+	out    bytes.Buffer
+	pos    int // start of unmatched output
+	notify chan struct{}
+	done   chan struct{}
+	err    error // Run error, set before done is closed
+}
+
+// Start creates a new VM instance with the given memory image and options and
+// runs it in a new goroutine. The VM reads its input from the session and
+// writes its output to the session. Readers set with the Input option are read
+// before the session's input; an Output option overrides the session's output.
+func Start(mem []vm.Cell, imageFile string, opts ...vm.Option) (*Session, error) {
+	s := &Session{
+		Timeout: DefaultTimeout,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.in.init()
+	opts = append([]vm.Option{
+		vm.Input(&s.in),
+		vm.Output(vm.NewVT100Terminal((*output)(s), nil, nil)),
+	}, opts...)
+	i, err := vm.New(mem, imageFile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.i = i
+	go func() {
+		s.err = i.Run()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// Instance returns the session's VM instance. The VM runs in its own
+// goroutine, so its state must only be accessed while paused (see
+// vm.Instance.Pause) or after the session has been closed.
+func (s *Session) Instance() *vm.Instance {
+	return s.i
+}
+
+// Send sends the given text to the VM input. It does not wait for the VM to
+// read it.
+func (s *Session) Send(text string) error {
+	return s.in.write(text)
+}
+
+// Sendln sends the given text followed by a new line to the VM input.
+func (s *Session) Sendln(text string) error {
+	return s.in.write(text + "\n")
+}
+
+// Expect waits until the output of the VM that has not been matched yet by a
+// previous call to Expect matches the given regular expression, and returns
+// the text of the match and its submatches as returned by
+// regexp.FindStringSubmatch. Output up to the end of the match is then
+// consumed.
+//
+// If the output does not match before s.Timeout expires, the returned error
+// has ErrTimeout as its root cause. If the VM exits first, the root cause is
+// ErrExited. In both cases, the error message includes the unmatched output.
+func (s *Session) Expect(pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	for {
+		// check done before matching so that no output is missed on exit
+		exited := false
+		select {
+		case <-s.done:
+			exited = true
+		default:
+		}
+		if m := s.match(re); m != nil {
+			return m, nil
+		}
+		if exited {
+			return nil, errors.Wrapf(ErrExited, "%v, expected %q, got %q", s.err, pattern, s.Output())
+		}
+		select {
+		case <-s.notify:
+		case <-s.done:
+		case <-timer.C:
+			return nil, errors.Wrapf(ErrTimeout, "expected %q, got %q", pattern, s.Output())
+		}
+	}
+}
+
+func (s *Session) match(re *regexp.Regexp) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.out.Bytes()[s.pos:]
+	loc := re.FindSubmatchIndex(out)
+	if loc == nil {
+		return nil
+	}
+	m := make([]string, len(loc)/2)
+	for n := range m {
+		if loc[2*n] >= 0 {
+			m[n] = string(out[loc[2*n]:loc[2*n+1]])
+		}
+	}
+	s.pos += loc[1]
+	return m
+}
+
+// Output returns the output of the VM that has not been matched yet.
+func (s *Session) Output() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.out.Bytes()[s.pos:])
+}
+
+// Wait closes the VM input and waits for the VM to exit, at most for s.Timeout.
+// It returns the error returned by Run, or nil if the VM exited because of the
+// end of its input.
+func (s *Session) Wait() error {
+	s.in.close()
+	select {
+	case <-s.done:
+	case <-time.After(s.Timeout):
+		return errors.Wrap(ErrTimeout, "VM still running")
+	}
+	if errors.Cause(s.err) == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// Close stops the VM and waits for it to exit. It returns the error returned
+// by Run, or nil if the VM exited because of the end of its input or because it
+// was stopped.
+func (s *Session) Close() error {
+	s.in.close()
+	s.i.Stop()
+	<-s.done
+	switch errors.Cause(s.err) {
+	case io.EOF, vm.ErrStopped:
+		return nil
+	}
+	return s.err
+}
+
+// output is the io.Writer for the VM output.
+type output Session
+
+func (o *output) Write(p []byte) (int, error) {
+	s := (*Session)(o)
+	s.mu.Lock()
+	n, err := s.out.Write(p)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+// input is the VM input. Reads block until input is sent or the input is
+// closed.
+type input struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (in *input) init() {
+	in.cond = sync.NewCond(&in.mu)
+}
+
+func (in *input) Read(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for in.buf.Len() == 0 && !in.closed {
+		in.cond.Wait()
+	}
+	if in.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return in.buf.Read(p)
+}
+
+func (in *input) write(text string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return errors.New("input closed")
+	}
+	in.buf.WriteString(text)
+	in.cond.Broadcast()
+	return nil
+}
+
+func (in *input) close() {
+	in.mu.Lock()
+	in.closed = true
+	in.cond.Broadcast()
+	in.mu.Unlock()
+}
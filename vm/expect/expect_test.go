@@ -0,0 +1,60 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expect_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/db47h/ngaro/vm"
+	"github.com/db47h/ngaro/vm/expect"
+	"github.com/pkg/errors"
+)
+
+func TestSession(t *testing.T) {
+	img, _, err := vm.Load("../testdata/retroImage", 50000, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := expect.Start(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.Expect(`Retro [0-9.]+\n`); err != nil {
+		t.Fatal(err)
+	}
+	s.Sendln("1 2 + putn")
+	m, err := s.Expect(`putn (\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m[1] != "3" {
+		t.Errorf("expected 3, got %q", m[1])
+	}
+	s.Timeout = 50 * time.Millisecond
+	if _, err = s.Expect("never"); errors.Cause(err) != expect.ErrTimeout {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	s.Sendln("bye")
+	if _, err = s.Expect("never"); errors.Cause(err) != expect.ErrExited {
+		t.Errorf("expected exit error, got %v", err)
+	}
+	if err = s.Wait(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,227 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is a source code format for ExportImage.
+type ExportFormat int
+
+// Supported export formats.
+const (
+	ExportGo ExportFormat = iota // Go []vm.Cell literal
+	ExportC                      // C array of int32_t or int64_t
+)
+
+// ExportOptions holds options for ExportImage. The zero value is ready to use.
+type ExportOptions struct {
+	Format ExportFormat
+	// Name is the variable name. Defaults to "image".
+	Name string
+	// Package is the package name for the Go format. Defaults to "main".
+	Package string
+	// Bits is the cell size in bits for the C format. Defaults to 32.
+	Bits int
+	// Compress enables run-length compression of the image (see
+	// CompressImage). In Go, the variable is initialized with ExpandImage. In
+	// C, the image must be expanded at run time with the generated
+	// <Name>_expand function.
+	Compress bool
+}
+
+// ExportImage writes the memory image mem to w as Go or C source code so that
+// it can be embedded into other programs.
+func ExportImage(w io.Writer, mem []Cell, opts *ExportOptions) error {
+	var o ExportOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Name == "" {
+		o.Name = "image"
+	}
+	if o.Package == "" {
+		o.Package = "main"
+	}
+	if o.Bits == 0 {
+		o.Bits = 32
+	}
+	data := mem
+	if o.Compress {
+		data = CompressImage(mem)
+	}
+	bw := bufio.NewWriter(w)
+	switch o.Format {
+	case ExportGo:
+		exportGo(bw, len(mem), data, &o)
+	case ExportC:
+		if err := exportC(bw, len(mem), data, &o); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown export format %d", o.Format)
+	}
+	return errors.Wrap(bw.Flush(), "export failed")
+}
+
+func exportGo(w *bufio.Writer, size int, data []Cell, o *ExportOptions) {
+	w.WriteString("// Code generated by ngaro; DO NOT EDIT.\n\npackage " + o.Package +
+		"\n\nimport \"github.com/db47h/ngaro/vm\"\n\n")
+	w.WriteString("// " + o.Name + " is a " + strconv.Itoa(size) + " cells memory image.\n")
+	if o.Compress {
+		w.WriteString("var " + o.Name + " = vm.ExpandImage([]vm.Cell{\n")
+		writeCells(w, data)
+		w.WriteString("})\n")
+		return
+	}
+	w.WriteString("var " + o.Name + " = []vm.Cell{\n")
+	writeCells(w, data)
+	w.WriteString("}\n")
+}
+
+func exportC(w *bufio.Writer, size int, data []Cell, o *ExportOptions) error {
+	var typ string
+	switch o.Bits {
+	case 32:
+		typ = "int32_t"
+		for k, v := range data {
+			if Cell(int32(v)) != v {
+				return errors.Errorf("64 bits value %d at index %d too large", v, k)
+			}
+		}
+	case 64:
+		typ = "int64_t"
+	default:
+		return errors.Errorf("exporting %d bits images is not supported", o.Bits)
+	}
+	sz := strings.ToUpper(o.Name) + "_SIZE"
+	w.WriteString("/* Code generated by ngaro; DO NOT EDIT. */\n\n#include <stdint.h>\n\n")
+	w.WriteString("#define " + sz + " " + strconv.Itoa(size) + "\n\n")
+	if !o.Compress {
+		w.WriteString("const " + typ + " " + o.Name + "[" + sz + "] = {\n")
+		writeCells(w, data)
+		w.WriteString("};\n")
+		return nil
+	}
+	packed := o.Name + "_packed"
+	w.WriteString("static const " + typ + " " + packed + "[] = {\n")
+	writeCells(w, data)
+	w.WriteString("};\n\n")
+	w.WriteString("/* " + o.Name + "_expand expands the memory image into dst, which must hold at\n" +
+		"   least " + sz + " cells. */\n")
+	w.WriteString("static void " + o.Name + "_expand(" + typ + " *dst) {\n" +
+		"\tconst " + typ + " *p = " + packed + ";\n" +
+		"\tconst " + typ + " *end = p + sizeof(" + packed + ") / sizeof(" + packed + "[0]);\n" +
+		"\twhile (p < end) {\n" +
+		"\t\t" + typ + " n = *p++;\n" +
+		"\t\tif (n < 0) {\n" +
+		"\t\t\t" + typ + " v = *p++;\n" +
+		"\t\t\tfor (; n < 0; n++)\n" +
+		"\t\t\t\t*dst++ = v;\n" +
+		"\t\t} else {\n" +
+		"\t\t\tfor (; n > 0; n--)\n" +
+		"\t\t\t\t*dst++ = *p++;\n" +
+		"\t\t}\n" +
+		"\t}\n" +
+		"}\n")
+	return nil
+}
+
+// writeCells writes the comma separated values of data, 8 per line.
+func writeCells(w *bufio.Writer, data []Cell) {
+	var b []byte
+	for k, v := range data {
+		if k%8 == 0 {
+			b = append(b, '\t')
+		} else {
+			b = append(b, ' ')
+		}
+		b = strconv.AppendInt(b, int64(v), 10)
+		b = append(b, ',')
+		if k%8 == 7 || k == len(data)-1 {
+			b = append(b, '\n')
+			w.Write(b)
+			b = b[:0]
+		}
+	}
+}
+
+// minRun is the minimum length of a run of identical cells compressed by
+// CompressImage.
+const minRun = 3
+
+// CompressImage returns a run-length encoded copy of mem. The result is a
+// sequence of blocks starting with a count n: if n is positive, it is followed
+// by n literal cells; if n is negative, it is followed by a single cell that is
+// repeated -n times.
+func CompressImage(mem []Cell) []Cell {
+	var out []Cell
+	lit := 0 // start of pending literals
+	flush := func(end int) {
+		if end > lit {
+			out = append(out, Cell(end-lit))
+			out = append(out, mem[lit:end]...)
+		}
+	}
+	for k := 0; k < len(mem); {
+		n := 1
+		for k+n < len(mem) && mem[k+n] == mem[k] {
+			n++
+		}
+		if n >= minRun {
+			flush(k)
+			out = append(out, Cell(-n), mem[k])
+			lit = k + n
+		}
+		k += n
+	}
+	flush(len(mem))
+	return out
+}
+
+// ExpandImage expands a memory image compressed with CompressImage. Truncated
+// input is expanded as far as possible.
+func ExpandImage(packed []Cell) []Cell {
+	var mem []Cell
+	for k := 0; k < len(packed); {
+		n := int(packed[k])
+		k++
+		switch {
+		case n < 0:
+			if k >= len(packed) {
+				return mem
+			}
+			for v := packed[k]; n < 0; n++ {
+				mem = append(mem, v)
+			}
+			k++
+		default:
+			if k+n > len(packed) {
+				n = len(packed) - k
+			}
+			mem = append(mem, packed[k:k+n]...)
+			k += n
+		}
+	}
+	return mem
+}
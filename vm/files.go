@@ -0,0 +1,366 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// fileOpArgs is the number of stack arguments of each file operation on
+// port 4, indexed by -op.
+var fileOpArgs = [...]int{0, 2, 1, 2, 1, 1, 2, 1, 1, 1, 2, 1, 1, 2}
+
+func (i *Instance) openfile(name string, mode Cell) (Cell, error) {
+	i.auditName(AuditFileOpen, name, mode)
+	var flags int
+	switch mode {
+	case 0:
+		flags = os.O_RDONLY
+	case 1:
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case 2:
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	case 3:
+		flags = os.O_RDWR
+	default:
+		return 0, nil
+	}
+	path, ok := i.filePath(name)
+	if !ok {
+		i.logError("file access denied", "file", name)
+		return 0, nil
+	}
+	if err := i.checkFileLimit(); err != nil {
+		return 0, err
+	}
+	var (
+		f   fs.File
+		err error
+	)
+	if flags == os.O_RDONLY {
+		f, err = i.fileSys().Open(path)
+	} else {
+		f, err = i.writableFS().OpenFile(path, flags, 0666)
+	}
+	if err != nil {
+		i.logError("file open failed", "file", path, "err", err)
+		return 0, nil
+	}
+	return i.addFile(f), nil
+}
+
+// opendir opens the named directory for reading with readdir. Directory
+// handles share the file ID space and are closed like regular files.
+func (i *Instance) opendir(name string) (Cell, error) {
+	i.auditName(AuditDirOpen, name, 0)
+	path, ok := i.filePath(name)
+	if !ok {
+		i.logError("file access denied", "file", name)
+		return 0, nil
+	}
+	if err := i.checkFileLimit(); err != nil {
+		return 0, err
+	}
+	f, err := i.fileSys().Open(path)
+	if err != nil {
+		i.logError("directory open failed", "file", path, "err", err)
+		return 0, nil
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		f.Close()
+		i.logError("directory open failed", "file", path, "err", "not a directory")
+		return 0, nil
+	}
+	return i.addFile(f), nil
+}
+
+// addFile registers f and returns its ID.
+func (i *Instance) addFile(f fs.File) Cell {
+	for ; i.files[i.fid] != nil; i.fid++ {
+	}
+	i.files[i.fid] = f
+	i.nFiles++
+	return i.fid
+}
+
+// readdir handles the readdir file operation: the name of the next entry of
+// the directory at TOS is stored at the address in NOS. Returns the length of
+// the name, or -1 if there are no more entries. The name is journaled so that
+// it is written to memory on replay as well.
+func (i *Instance) readdir() (Cell, error) {
+	dst, id := i.data[i.sp], i.tos
+	i.Drop2()
+	name, err := i.nondetBytes(jFile, func() []byte {
+		d, ok := i.files[id].(fs.ReadDirFile)
+		if !ok {
+			return nil
+		}
+		entries, err := d.ReadDir(1)
+		if err != nil || len(entries) == 0 {
+			return nil
+		}
+		return []byte(entries[0].Name())
+	})
+	if err != nil || len(name) == 0 || i.sEnc == nil {
+		return -1, err
+	}
+	i.sEnc.Encode(i.Mem, dst, name)
+	return Cell(len(name)), nil
+}
+
+// fileIO handles WAIT requests on port 4. File operations use negative
+// request numbers:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	-1	am-h	open file a with mode m. Returns a handle, 0 on failure
+//	-2	h-c	read a byte from file h
+//	-3	ch-n	write byte c to file h. Returns the number of bytes written
+//	-4	h-f	close file or directory h. Returns 0 on success
+//	-5	h-n	current position in file h
+//	-6	nh-n	seek to position n in file h
+//	-7	h-n	size of file h
+//	-8	a-f	delete file a. Returns -1 on success
+//	-9	a-h	open directory a. Returns a handle, 0 on failure
+//	-10	bh-n	store the name of the next entry of directory h at b. Returns its length, -1 at the end
+//	-11	a-f	create directory a. Returns -1 on success
+//	-12	a-n	size of file a, -1 if it does not exist, -2 if it is a directory
+//	-13	ab-f	rename file a to b. Returns -1 on success
+//
+// File names are decoded with the instance's StringCodec.
+func (i *Instance) fileIO(v Cell) error {
+	switch v {
+	case 1: // save image
+		if i.disabled&DevFiles != 0 {
+			i.WaitReply(-1, 4)
+			break
+		}
+		if i.saveHook != nil {
+			st, err := i.saveHook(i)
+			if err != nil {
+				return errors.Wrap(err, "image save hook failed")
+			}
+			i.logInfo("image saved by save hook", "status", st)
+			i.WaitReply(st, 4)
+			break
+		}
+		// the image is saved by memDump in the host file system.
+		path, ok := i.hostPath(i.imageFile)
+		if !ok {
+			i.logError("file access denied", "file", i.imageFile)
+			i.WaitReply(-1, 4)
+			break
+		}
+		err := i.memDump(path, i.Mem)
+		if err != nil {
+			return errors.Wrap(err, "image dump failed")
+		}
+		i.logInfo("image saved", "file", path)
+		i.WaitReply(0, 4)
+	case 2: // include file
+		i.WaitReply(0, 4)
+		addr := i.Pop()
+		if i.journal != nil && i.journal.replay {
+			// included file contents are replayed as regular input
+			break
+		}
+		if i.sEnc == nil {
+			// no string codec to decode the file name, ignore.
+			break
+		}
+		name := string(i.sEnc.Decode(i.Mem, addr))
+		i.auditName(AuditInclude, name, 0)
+		r, err := i.openInclude(name)
+		if err != nil {
+			return errors.Wrap(err, "file include failed")
+		}
+		i.PushInput(r)
+	case -10: // read directory
+		r, err := i.readdir()
+		if err != nil {
+			return err
+		}
+		i.WaitReply(r, 4)
+	default:
+		if v >= 0 || -int(v) >= len(fileOpArgs) {
+			i.WaitReply(0, 4)
+			break
+		}
+		if i.journal != nil && i.journal.replay {
+			// file operations are not executed on replay, drop arguments.
+			for n := fileOpArgs[-v]; n > 0; n-- {
+				i.Drop()
+			}
+		}
+		r, err := i.nondetCell(jFile, func() (Cell, error) { return i.fileOp(v) })
+		if err != nil {
+			return err
+		}
+		i.WaitReply(r, 4)
+	}
+	return nil
+}
+
+// fileOp executes the file operation v (v < 0) and returns its result.
+func (i *Instance) fileOp(v Cell) (Cell, error) {
+	var b [1]byte
+	switch v {
+	case -1: // open file
+		var (
+			fd  Cell
+			err error
+		)
+		if i.sEnc != nil {
+			fd, err = i.openfile(string(i.sEnc.Decode(i.Mem, i.data[i.sp])), i.tos)
+		}
+		i.Drop2()
+		return fd, err
+	case -2: // read byte
+		f := i.files[i.Pop()]
+		if f != nil {
+			f.Read(b[:])
+		}
+		return Cell(b[0]), nil
+	case -3: // write byte
+		var l int
+		b[0] = byte(i.data[i.sp])
+		w, ok := i.files[i.tos].(io.Writer)
+		i.Drop2()
+		if ok {
+			l, _ = w.Write(b[:])
+		}
+		return Cell(l), nil
+	case -4: // close fd
+		var ret Cell = 1
+		id := i.Pop()
+		if f := i.files[id]; f != nil {
+			if err := f.Close(); err == nil {
+				i.files[id] = nil
+				i.fid = id
+				i.nFiles--
+				ret = 0
+			} else {
+				i.logError("file close failed", "fd", id, "err", err)
+			}
+		}
+		return ret, nil
+	case -5: // ftell
+		var p int64
+		if f, ok := i.files[i.Pop()].(io.Seeker); ok {
+			p, _ = f.Seek(0, io.SeekCurrent)
+		}
+		return Cell(p), nil
+	case -6: // seek
+		var p int64
+		o := i.data[i.sp]
+		f, ok := i.files[i.tos].(io.Seeker)
+		i.Drop2()
+		if ok {
+			p, _ = f.Seek(int64(o), io.SeekStart)
+		}
+		return Cell(p), nil
+	case -7: // file size
+		var sz Cell
+		if f := i.files[i.Pop()]; f != nil {
+			if fi, err := f.Stat(); err == nil {
+				sz = Cell(fi.Size())
+			}
+		}
+		return sz, nil
+	case -8: // delete
+		var r Cell
+		addr := i.Pop()
+		if i.sEnc != nil {
+			name := string(i.sEnc.Decode(i.Mem, addr))
+			i.auditName(AuditFileDelete, name, 0)
+			if path, ok := i.filePath(name); !ok {
+				i.logError("file access denied", "file", name)
+			} else if err := i.writableFS().Remove(path); err != nil {
+				i.logError("file delete failed", "file", path, "err", err)
+			} else {
+				r = -1
+			}
+		}
+		return r, nil
+	case -9: // open directory
+		var (
+			fd  Cell
+			err error
+		)
+		addr := i.Pop()
+		if i.sEnc != nil {
+			fd, err = i.opendir(string(i.sEnc.Decode(i.Mem, addr)))
+		}
+		return fd, err
+	case -11: // mkdir
+		var r Cell
+		addr := i.Pop()
+		if i.sEnc != nil {
+			name := string(i.sEnc.Decode(i.Mem, addr))
+			i.auditName(AuditMkdir, name, 0)
+			if path, ok := i.filePath(name); !ok {
+				i.logError("file access denied", "file", name)
+			} else if err := i.writableFS().Mkdir(path, 0777); err != nil {
+				i.logError("mkdir failed", "file", path, "err", err)
+			} else {
+				r = -1
+			}
+		}
+		return r, nil
+	case -12: // stat
+		var r Cell = -1
+		addr := i.Pop()
+		if i.sEnc != nil {
+			name := string(i.sEnc.Decode(i.Mem, addr))
+			i.auditName(AuditStat, name, 0)
+			if path, ok := i.filePath(name); !ok {
+				i.logError("file access denied", "file", name)
+			} else if fi, err := fs.Stat(i.fileSys(), path); err == nil {
+				if fi.IsDir() {
+					r = -2
+				} else {
+					r = Cell(fi.Size())
+				}
+			}
+		}
+		return r, nil
+	case -13: // rename
+		var r Cell
+		src, dst := i.data[i.sp], i.tos
+		i.Drop2()
+		if i.sEnc != nil {
+			from, to := string(i.sEnc.Decode(i.Mem, src)), string(i.sEnc.Decode(i.Mem, dst))
+			i.auditName(AuditRename, from, 0)
+			i.auditName(AuditRename, to, 0)
+			fp, ok := i.filePath(from)
+			tp, ok2 := i.filePath(to)
+			if !ok || !ok2 {
+				i.logError("file access denied", "file", from, "to", to)
+			} else if err := i.writableFS().Rename(fp, tp); err != nil {
+				i.logError("file rename failed", "file", fp, "to", tp, "err", err)
+			} else {
+				r = -1
+			}
+		}
+		return r, nil
+	}
+	return 0, nil
+}
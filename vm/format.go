@@ -0,0 +1,379 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encoding is the encoding of a memory image file.
+type Encoding int
+
+// Supported memory image file encodings.
+const (
+	EncodingRaw      Encoding = iota // raw binary cells
+	EncodingIntelHex                 // Intel HEX records of raw binary cells
+)
+
+// Format describes the file format of a memory image. The zero value describes
+// the native format used by Load and Save: raw little-endian cells of CellBits
+// bits.
+//
+// When Header is not nil, images are saved with a self-describing header that
+// records the cell size, byte order, entry point and symbol table of the image.
+// Images with a header are detected when loaded, and the cell size and byte
+// order from the header take precedence over the requested ones.
+type Format struct {
+	Encoding  Encoding
+	Bits      int          // cell size in bits: 8, 16, 32 or 64. 0 means CellBits.
+	BigEndian bool         // byte order of cells
+	Header    *ImageHeader // image header, if any
+}
+
+// ParseFormat parses a memory image file format description of the form:
+//
+//	encoding[:bits][:be|:le][:hdr]
+//
+// where encoding is either raw or ihex (Intel HEX). For example, "ihex:16:be"
+// describes an Intel HEX file of 16 bits big-endian cells. The default cell
+// size is CellBits and the default byte order is little-endian. The hdr suffix
+// adds an empty header to the format.
+func ParseFormat(s string) (f Format, err error) {
+	fields := strings.Split(s, ":")
+	switch fields[0] {
+	case "raw":
+		f.Encoding = EncodingRaw
+	case "ihex":
+		f.Encoding = EncodingIntelHex
+	default:
+		return f, errors.Errorf("unknown image encoding %q", fields[0])
+	}
+	for _, v := range fields[1:] {
+		switch v {
+		case "be":
+			f.BigEndian = true
+		case "le":
+			f.BigEndian = false
+		case "hdr":
+			f.Header = &ImageHeader{}
+		default:
+			if f.Bits, err = strconv.Atoi(v); err != nil {
+				return f, errors.Errorf("invalid image format %q", s)
+			}
+		}
+	}
+	return f, f.check()
+}
+
+// String returns the description of the format as parsed by ParseFormat.
+func (f Format) String() string {
+	s := "raw"
+	if f.Encoding == EncodingIntelHex {
+		s = "ihex"
+	}
+	s += ":" + strconv.Itoa(f.bits())
+	if f.BigEndian {
+		s += ":be"
+	} else {
+		s += ":le"
+	}
+	if f.Header != nil {
+		s += ":hdr"
+	}
+	return s
+}
+
+func (f Format) bits() int {
+	if f.Bits == 0 {
+		return CellBits
+	}
+	return f.Bits
+}
+
+func (f Format) order() binary.ByteOrder {
+	if f.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (f Format) check() error {
+	switch f.bits() {
+	case 8, 16, 32, 64:
+	default:
+		return errors.Errorf("%d bits cells not supported", f.Bits)
+	}
+	switch f.Encoding {
+	case EncodingRaw, EncodingIntelHex:
+	default:
+		return errors.Errorf("unknown image encoding %d", f.Encoding)
+	}
+	return nil
+}
+
+// LoadFormat loads a memory image in the given format from file fileName. Like
+// Load, it returns a VM Cell slice of at least minSize cells, the actual number
+// of cells read from the file and any error.
+//
+// Cells of less than 64 bits are sign extended.
+func LoadFormat(fileName string, minSize int, f Format) (mem []Cell, fileCells int, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "open failed")
+	}
+	defer file.Close()
+	mem, _, err = readImage(bufio.NewReader(file), f)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "load failed")
+	}
+	fileCells = len(mem)
+	if minSize > fileCells {
+		mem = append(mem, make([]Cell, minSize-fileCells)...)
+	}
+	return mem, fileCells, nil
+}
+
+// SaveFormat saves a Cell slice to a memory image file in the given format.
+func SaveFormat(fileName string, mem []Cell, f Format) (err error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrap(err, "create failed")
+	}
+	w := bufio.NewWriter(file)
+	defer func() {
+		if e := w.Flush(); err == nil {
+			err = errors.Wrap(e, "write failed")
+		}
+		file.Close()
+		// delete file on error
+		if err != nil {
+			os.Remove(fileName)
+		}
+	}()
+	return errors.Wrap(WriteImage(w, mem, f), "save failed")
+}
+
+// ReadImage reads a memory image in the given format from r.
+func ReadImage(r io.Reader, f Format) ([]Cell, error) {
+	mem, _, err := readImage(r, f)
+	return mem, err
+}
+
+// readImage reads a memory image in the given format from r. It returns the
+// actual format of the image, as found in its header, if any.
+func readImage(r io.Reader, f Format) ([]Cell, Format, error) {
+	if err := f.check(); err != nil {
+		return nil, f, err
+	}
+	var b []byte
+	var err error
+	if f.Encoding == EncodingIntelHex {
+		b, err = readIntelHex(r)
+	} else {
+		b, err = ioutil.ReadAll(r)
+		err = errors.Wrap(err, "read failed")
+	}
+	if err != nil {
+		return nil, f, err
+	}
+	if hasHeader(b) {
+		if f, b, err = decodeHeader(b, f.Encoding); err != nil {
+			return nil, f, err
+		}
+	}
+	mem, err := decodeCells(b, f)
+	return mem, f, err
+}
+
+// WriteImage writes the memory image mem in the given format to w.
+func WriteImage(w io.Writer, mem []Cell, f Format) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	b, err := encodeCells(mem, f)
+	if err != nil {
+		return err
+	}
+	if f.Header != nil {
+		b = append(encodeHeader(f, len(mem)), b...)
+	}
+	if f.Encoding == EncodingIntelHex {
+		return writeIntelHex(w, b)
+	}
+	_, err = w.Write(b)
+	return errors.Wrap(err, "write failed")
+}
+
+// decodeCells decodes raw binary cells.
+func decodeCells(b []byte, f Format) ([]Cell, error) {
+	sz := f.bits() / 8
+	if len(b)%sz != 0 {
+		return nil, errors.Errorf("image size %d is not a multiple of the cell size (%d bytes)", len(b), sz)
+	}
+	order := f.order()
+	mem := make([]Cell, len(b)/sz)
+	for p := range mem {
+		c := b[p*sz : p*sz+sz]
+		var v int64
+		switch sz {
+		case 1:
+			v = int64(int8(c[0]))
+		case 2:
+			v = int64(int16(order.Uint16(c)))
+		case 4:
+			v = int64(int32(order.Uint32(c)))
+		case 8:
+			v = int64(order.Uint64(c))
+		}
+		n := Cell(v)
+		if int64(n) != v {
+			return nil, errors.Errorf("64 bits value %d at memory location %d too large", v, p)
+		}
+		mem[p] = n
+	}
+	return mem, nil
+}
+
+// encodeCells encodes cells as raw binary data.
+func encodeCells(mem []Cell, f Format) ([]byte, error) {
+	bits := f.bits()
+	sz := bits / 8
+	order := f.order()
+	b := make([]byte, len(mem)*sz)
+	for p, v := range mem {
+		if bits < 64 && !fits(v, bits) {
+			return nil, errors.Errorf("value %d at memory location %d does not fit in %d bits", v, p, bits)
+		}
+		c := b[p*sz : p*sz+sz]
+		switch sz {
+		case 1:
+			c[0] = byte(v)
+		case 2:
+			order.PutUint16(c, uint16(v))
+		case 4:
+			order.PutUint32(c, uint32(v))
+		case 8:
+			order.PutUint64(c, uint64(v))
+		}
+	}
+	return b, nil
+}
+
+// Intel HEX record types.
+const (
+	ihexData = iota
+	ihexEOF
+	ihexSegment
+	ihexStartSegment
+	ihexLinear
+	ihexStartLinear
+)
+
+// readIntelHex reads Intel HEX records and returns the binary data.
+func readIntelHex(r io.Reader) ([]byte, error) {
+	var data []byte
+	var base int
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		t := strings.TrimSpace(s.Text())
+		if t == "" {
+			continue
+		}
+		if t[0] != ':' {
+			return nil, errors.Errorf("line %d: invalid Intel HEX record", line)
+		}
+		rec, err := hex.DecodeString(t[1:])
+		if err != nil || len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, errors.Errorf("line %d: invalid Intel HEX record", line)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, errors.Errorf("line %d: Intel HEX checksum error", line)
+		}
+		payload := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case ihexData:
+			addr := base + int(binary.BigEndian.Uint16(rec[1:3]))
+			if end := addr + len(payload); end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[addr:], payload)
+		case ihexEOF:
+			return data, nil
+		case ihexSegment, ihexLinear:
+			if len(payload) != 2 {
+				return nil, errors.Errorf("line %d: invalid Intel HEX record", line)
+			}
+			base = int(binary.BigEndian.Uint16(payload))
+			if rec[3] == ihexSegment {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case ihexStartSegment, ihexStartLinear:
+			// start address, ignored
+		default:
+			return nil, errors.Errorf("line %d: unknown Intel HEX record type %d", line, rec[3])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "read failed")
+	}
+	return nil, errors.New("missing Intel HEX end of file record")
+}
+
+// writeIntelHex writes the binary data b as Intel HEX records.
+func writeIntelHex(w io.Writer, b []byte) error {
+	bw := bufio.NewWriter(w)
+	rec := make([]byte, 0, 21)
+	write := func(typ byte, addr int, payload []byte) {
+		rec = append(rec[:0], byte(len(payload)), byte(addr>>8), byte(addr), typ)
+		rec = append(rec, payload...)
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		rec = append(rec, -sum)
+		bw.WriteByte(':')
+		bw.WriteString(strings.ToUpper(hex.EncodeToString(rec)))
+		bw.WriteByte('\n')
+	}
+	for addr := 0; addr < len(b); addr += 16 {
+		if addr&0xffff == 0 && addr > 0 {
+			write(ihexLinear, 0, []byte{byte(addr >> 24), byte(addr >> 16)})
+		}
+		end := addr + 16
+		if end > len(b) {
+			end = len(b)
+		}
+		write(ihexData, addr, b[addr:end])
+	}
+	write(ihexEOF, 0, nil)
+	return errors.Wrap(bw.Flush(), "write failed")
+}
@@ -0,0 +1,120 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// WritableFS is implemented by file systems that support write operations.
+// Files returned by OpenFile must implement io.Writer to be written to, and
+// io.Seeker to support the tell and seek file operations.
+//
+// The flag and perm arguments of OpenFile have the same meaning as for
+// os.OpenFile.
+type WritableFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Remove(name string) error
+	Mkdir(name string, perm fs.FileMode) error
+	Rename(oldname, newname string) error
+}
+
+// FileSystem substitutes the host file system with fsys for file operations on
+// port 4 and include files. Read operations and directory listings only require
+// an fs.FS, like an embed.FS, a zip.Reader or a fstest.MapFS; file creation,
+// writes, deletion, renames and directory creation are only available if fsys
+// implements WritableFS, and fail otherwise.
+//
+// File names requested by the program must be valid fs.FS paths once cleaned
+// (see fs.ValidPath): absolute names and names escaping the root with ".." are
+// rejected. FileRoot does not apply to them. Image saves are not affected: they
+// are handled by the function set with SaveMemImage, in the host file system,
+// and are still subject to FileRoot.
+func FileSystem(fsys fs.FS) Option {
+	return func(i *Instance) error {
+		i.fsys = fsys
+		return nil
+	}
+}
+
+// osFS implements WritableFS on top of the host file system, with names
+// interpreted as host paths.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Remove(name string) error                  { return os.Remove(name) }
+func (osFS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+func (osFS) Rename(oldname, newname string) error      { return os.Rename(oldname, newname) }
+
+// fileSys returns the file system used for file operations.
+func (i *Instance) fileSys() fs.FS {
+	if i.fsys != nil {
+		return i.fsys
+	}
+	return osFS{}
+}
+
+// errReadOnly is returned by write operations on file systems that do not
+// implement WritableFS.
+var errReadOnly = errors.New("read-only file system")
+
+// readOnlyFS wraps a file system that does not implement WritableFS.
+type readOnlyFS struct {
+	fs.FS
+}
+
+func (readOnlyFS) OpenFile(string, int, fs.FileMode) (fs.File, error) { return nil, errReadOnly }
+func (readOnlyFS) Remove(string) error                                { return errReadOnly }
+func (readOnlyFS) Mkdir(string, fs.FileMode) error                    { return errReadOnly }
+func (readOnlyFS) Rename(string, string) error                        { return errReadOnly }
+
+// writableFS returns the file system used for file operations. If it does not
+// implement WritableFS, write operations fail with errReadOnly.
+func (i *Instance) writableFS() WritableFS {
+	fsys := i.fileSys()
+	if w, ok := fsys.(WritableFS); ok {
+		return w
+	}
+	return readOnlyFS{fsys}
+}
+
+// fsPath resolves the file name requested by the VM in the file system set by
+// FileSystem.
+func fsPath(name string) (string, bool) {
+	p := path.Clean(name)
+	return p, fs.ValidPath(p)
+}
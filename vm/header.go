@@ -0,0 +1,157 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Self-describing memory image files start with a header of the following
+// form, with all fields stored in little-endian byte order:
+//
+//	offset	size	field
+//	0	8	magic: "NGAROIMG"
+//	8	2	version: 1
+//	10	1	cell size in bits
+//	11	1	flags: bit 0 is set for big-endian cells
+//	12	8	entry point
+//	20	8	number of cells
+//	28	4	number of symbols
+//
+// The header is followed by the symbol table, where each symbol is stored as
+// its address (8 bytes), the length of its name (2 bytes) and the name itself,
+// then by the memory image cells in the format given in the header.
+const (
+	imageMagic   = "NGAROIMG"
+	imageVersion = 1
+	headerSize   = 32
+
+	hdrBigEndian = 1 << 0
+)
+
+// ImageHeader holds the data stored in the header of self-describing memory
+// image files, in addition to the cell size and byte order. See Format.
+type ImageHeader struct {
+	Entry   Cell         // entry point: initial value of the PC
+	Symbols *SymbolTable // symbol table, may be nil
+}
+
+// hasHeader returns true if b starts with a memory image header.
+func hasHeader(b []byte) bool {
+	return len(b) >= len(imageMagic) && string(b[:len(imageMagic)]) == imageMagic
+}
+
+// encodeHeader returns the header for an image of n cells in format f.
+func encodeHeader(f Format, n int) []byte {
+	h := f.Header
+	le := binary.LittleEndian
+	b := make([]byte, headerSize)
+	copy(b, imageMagic)
+	le.PutUint16(b[8:], imageVersion)
+	b[10] = byte(f.bits())
+	if f.BigEndian {
+		b[11] |= hdrBigEndian
+	}
+	le.PutUint64(b[12:], uint64(h.Entry))
+	le.PutUint64(b[20:], uint64(n))
+	le.PutUint32(b[28:], uint32(h.Symbols.Len()))
+	if h.Symbols == nil {
+		return b
+	}
+	var s [10]byte
+	for _, sym := range h.Symbols.syms {
+		name := sym.Name
+		if len(name) > 0xffff {
+			name = name[:0xffff]
+		}
+		le.PutUint64(s[:], uint64(sym.Addr))
+		le.PutUint16(s[8:], uint16(len(name)))
+		b = append(b, s[:]...)
+		b = append(b, name...)
+	}
+	return b
+}
+
+// decodeHeader decodes the header at the start of b, for an image with the
+// given encoding. It returns the format of the image and the encoded cells
+// that follow the header.
+func decodeHeader(b []byte, enc Encoding) (f Format, cells []byte, err error) {
+	if len(b) < headerSize {
+		return f, nil, errors.New("truncated image header")
+	}
+	le := binary.LittleEndian
+	if v := le.Uint16(b[8:]); v != imageVersion {
+		return f, nil, errors.Errorf("unsupported image header version %d", v)
+	}
+	entry := int64(le.Uint64(b[12:]))
+	f = Format{
+		Encoding:  enc,
+		Bits:      int(b[10]),
+		BigEndian: b[11]&hdrBigEndian != 0,
+		Header:    &ImageHeader{Entry: Cell(entry)},
+	}
+	if int64(f.Header.Entry) != entry {
+		return f, nil, errors.Errorf("entry point %d too large", entry)
+	}
+	if err = f.check(); err != nil {
+		return f, nil, err
+	}
+	n := le.Uint64(b[20:])
+	nsyms := le.Uint32(b[28:])
+	b = b[headerSize:]
+	if nsyms > 0 {
+		t := new(SymbolTable)
+		for ; nsyms > 0; nsyms-- {
+			if len(b) < 10 || len(b) < 10+int(le.Uint16(b[8:])) {
+				return f, nil, errors.New("truncated image symbol table")
+			}
+			l := 10 + int(le.Uint16(b[8:]))
+			t.syms = append(t.syms, Symbol{Cell(int64(le.Uint64(b))), string(b[10:l])})
+			b = b[l:]
+		}
+		f.Header.Symbols = NewSymbolTable(t.syms...)
+	}
+	if sz := uint64(f.bits() / 8); n > uint64(len(b)) || n*sz != uint64(len(b)) {
+		return f, nil, errors.Errorf("image size mismatch: header has %d cells, file has %d bytes of data", n, len(b))
+	}
+	return f, b, nil
+}
+
+// LoadHeader returns the header of the memory image file fileName, encoded
+// with f.Encoding, or nil if the file has no header.
+func LoadHeader(fileName string, f Format) (*ImageHeader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "open failed")
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	if f.Encoding == EncodingRaw {
+		if p, _ := r.Peek(len(imageMagic)); !hasHeader(p) {
+			return nil, nil
+		}
+	}
+	_, f, err = readImage(r, f)
+	if err != nil {
+		return nil, errors.Wrap(err, "load failed")
+	}
+	return f.Header, nil
+}
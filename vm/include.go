@@ -0,0 +1,107 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IncludeHook is the prototype for functions that can veto or rewrite the file
+// names of include requests (port 4, request 2, as issued by the Retro word
+// :include). It returns the name to use instead, or false to deny access.
+type IncludeHook func(name string) (string, bool)
+
+// IncludePath appends the given directories to the include search path. Files
+// requested by include requests that are not found relative to the current
+// directory (or to the directory set by FileRoot, or in the file system set by
+// FileSystem) are searched for in these host directories, in order. Absolute
+// names and names that point outside of the search directory (like "../foo")
+// are not searched.
+//
+// The include search path only applies to include requests, not to other file
+// operations.
+func IncludePath(dirs ...string) Option {
+	return func(i *Instance) error {
+		i.incPath = append(i.incPath, dirs...)
+		return nil
+	}
+}
+
+// Includes sets an IncludeHook that is called for every include request before
+// the file name is resolved.
+func Includes(hook IncludeHook) Option {
+	return func(i *Instance) error {
+		i.incHook = hook
+		return nil
+	}
+}
+
+// VirtualIncludes registers virtual include files: include requests for any of
+// the given names are served from memory, without accessing the host file
+// system, even if file access is disabled with DisableDevices. Names are
+// matched after applying the IncludeHook, if any.
+func VirtualIncludes(files map[string][]byte) Option {
+	return func(i *Instance) error {
+		if i.incFiles == nil {
+			i.incFiles = make(map[string][]byte, len(files))
+		}
+		for k, v := range files {
+			i.incFiles[k] = v
+		}
+		return nil
+	}
+}
+
+// openInclude resolves and opens the include file name.
+func (i *Instance) openInclude(name string) (io.Reader, error) {
+	if i.incHook != nil {
+		var ok bool
+		if name, ok = i.incHook(name); !ok {
+			return nil, errors.New("access denied")
+		}
+	}
+	if b, ok := i.incFiles[name]; ok {
+		return bytes.NewReader(b), nil
+	}
+	p, ok := i.filePath(name)
+	if !ok {
+		return nil, errors.New("access denied")
+	}
+	f, err := i.fileSys().Open(p)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) || len(i.incPath) == 0 || filepath.IsAbs(name) {
+		return nil, err
+	}
+	rel := filepath.Clean(name)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, err
+	}
+	for _, dir := range i.incPath {
+		if sf, serr := os.Open(filepath.Join(dir, rel)); serr == nil {
+			return sf, nil
+		}
+	}
+	return nil, err
+}
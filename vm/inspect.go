@@ -0,0 +1,129 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+// ReadOnlyView is a read-only view of the VM state handed to Inspect
+// functions. All methods return copies, and a ReadOnlyView must not be used
+// after the Inspect function returns.
+type ReadOnlyView struct {
+	i *Instance
+}
+
+// PC returns the program counter.
+func (v ReadOnlyView) PC() int {
+	return v.i.PC
+}
+
+// InstructionCount returns the number of instructions executed so far.
+func (v ReadOnlyView) InstructionCount() int64 {
+	return v.i.insCount
+}
+
+// Data returns a copy of the data stack.
+func (v ReadOnlyView) Data() []Cell {
+	return stackSnapshot(v.i.data, v.i.sp, v.i.tos)
+}
+
+// Address returns a copy of the address stack.
+func (v ReadOnlyView) Address() []Cell {
+	return stackSnapshot(v.i.address, v.i.rsp, v.i.rtos)
+}
+
+// MemSize returns the size of the memory image in cells.
+func (v ReadOnlyView) MemSize() int {
+	return len(v.i.Mem)
+}
+
+// Mem returns a copy of the memory range [start, end), clipped to the bounds
+// of the memory image.
+func (v ReadOnlyView) Mem(start, end int) []Cell {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(v.i.Mem) {
+		end = len(v.i.Mem)
+	}
+	if start >= end {
+		return nil
+	}
+	return append([]Cell(nil), v.i.Mem[start:end]...)
+}
+
+// Port returns the value of the given I/O port, or 0 if out of range.
+func (v ReadOnlyView) Port(p Cell) Cell {
+	if p < 0 || int(p) >= len(v.i.Ports) {
+		return 0
+	}
+	return v.i.port(p)
+}
+
+// inspectRequest is a pending call to Inspect.
+type inspectRequest struct {
+	fn   func(v ReadOnlyView)
+	done bool
+}
+
+// Inspect calls fn with a consistent read-only view of the VM state. It can be
+// called from any goroutine, and is the safe way for monitoring goroutines to
+// look at a running VM.
+//
+// If the VM is running, fn is called from the Run loop at the next control
+// check (every 1024 VM ticks at most), between two instructions, and Inspect
+// returns once fn has returned. Otherwise, or if the VM is paused, fn is called
+// right away. Execution resumes as soon as fn returns, so fn should be quick.
+//
+// As with Pause, a VM blocked in an I/O handler is only inspected once the
+// handler returns, and Inspect must not be called from a handler of the same
+// instance. fn must not call any method of the Instance.
+func (i *Instance) Inspect(fn func(v ReadOnlyView)) {
+	c := &i.ctl
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running || c.halted {
+		fn(ReadOnlyView{i})
+		return
+	}
+	r := &inspectRequest{fn: fn}
+	c.inspect = append(c.inspect, r)
+	c.setLocked(ctlInspect)
+	for !r.done && c.running {
+		c.cond.Wait()
+	}
+	if r.done {
+		return
+	}
+	// Run returned before the request could be served.
+	for n, p := range c.inspect {
+		if p == r {
+			c.inspect = append(c.inspect[:n], c.inspect[n+1:]...)
+			break
+		}
+	}
+	fn(ReadOnlyView{i})
+}
+
+// serveInspect calls pending Inspect functions. It must be called from the Run
+// loop with i.ctl.mu held.
+func (i *Instance) serveInspect() {
+	c := &i.ctl
+	for _, r := range c.inspect {
+		r.fn(ReadOnlyView{i})
+		r.done = true
+	}
+	c.inspect = nil
+	c.cond.Broadcast()
+}
@@ -18,8 +18,8 @@ package vm
 
 import (
 	"io"
-	"os"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -43,6 +43,9 @@ import (
 //
 // Port8Enabled should return true if the MoveCursor, FgColor and BgColor
 // methods have any effect.
+//
+// Terminals that also implement MouseProvider provide the mouse device on port
+// 7.
 type Terminal interface {
 	io.Writer
 	Flush() error
@@ -54,33 +57,91 @@ type Terminal interface {
 	Port8Enabled() bool
 }
 
-func (i *Instance) openfile(name string, mode Cell) Cell {
-	var flags int
-	switch mode {
-	case 0:
-		flags = os.O_RDONLY
-	case 1:
-		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	case 2:
-		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
-	case 3:
-		flags = os.O_RDWR
-	default:
-		return 0
+// EOFPolicy defines what happens when the VM reaches the end of its last input
+// stream. See InputEOF.
+type EOFPolicy int
+
+// Input EOF policies.
+const (
+	// EOFReturn makes Run return an error whose root cause is io.EOF.
+	EOFReturn EOFPolicy = iota
+	// EOFBlock blocks the VM until a new input is pushed with PushInput
+	// from another goroutine.
+	EOFBlock
+	// EOFReply replies -1 to the VM, like a read error, and lets it
+	// continue. Subsequent reads return -1 until new input is pushed with
+	// PushInput.
+	EOFReply
+)
+
+// InputEOF sets the policy applied when the VM reaches the end of its last
+// input stream. The default is EOFReturn.
+//
+// With EOFBlock, the VM blocks in the WAIT handler of port 1, so Stop and Pause
+// requests only take effect once input is available. EOFReply is meant for
+// programs that handle the end of their input themselves, for example by
+// doing background work while waiting for more.
+//
+// Once the input pipe has been closed with CloseInput, the VM gets an EOF
+// regardless of the policy.
+func InputEOF(policy EOFPolicy) Option {
+	return func(i *Instance) error {
+		switch policy {
+		case EOFReturn, EOFBlock, EOFReply:
+		default:
+			return errors.Errorf("invalid EOF policy %d", policy)
+		}
+		i.eofPolicy = policy
+		return nil
+	}
+}
+
+// OnInputEOF sets a function that is called when the VM reaches the end of its
+// last input stream. If fn returns a non-nil io.Reader, it becomes the new VM
+// input and execution continues. Otherwise, the policy set with InputEOF
+// applies.
+func OnInputEOF(fn func(i *Instance) io.Reader) Option {
+	return func(i *Instance) error {
+		i.eofFn = fn
+		return nil
 	}
-	f, err := os.OpenFile(name, flags, 0666)
-	if err != nil {
-		return 0
+}
+
+// UTF8Output sets the output mode of port 2. By default, only the low byte of
+// characters written to port 2 is sent to the output Terminal, so images must
+// encode multi-byte characters themselves. When enabled, characters are
+// treated as Unicode code points and encoded to UTF-8 before being sent to the
+// Terminal. Invalid code points are replaced with U+FFFD.
+//
+// The output limit (see ResourceLimits) counts encoded bytes.
+func UTF8Output(enable bool) Option {
+	return func(i *Instance) error {
+		i.utf8Out = enable
+		return nil
 	}
-	for ; i.files[i.fid] != nil; i.fid++ {
+}
+
+// UTF8Input sets the input mode of port 1. By default, input is delivered to
+// the VM one byte at a time. When enabled, input is decoded as UTF-8 and each
+// read returns a full Unicode code point. Invalid UTF-8 sequences are returned
+// as U+FFFD, one per invalid byte.
+//
+// The input limit (see ResourceLimits) counts encoded bytes.
+func UTF8Input(enable bool) Option {
+	return func(i *Instance) error {
+		i.utf8In = enable
+		return nil
 	}
-	i.files[i.fid] = f
-	return i.fid
 }
 
 // PushInput sets r as the current input io.Reader for the VM. When this reader
 // reaches EOF, the previously pushed reader will be used.
+//
+// With the EOFBlock policy, PushInput can be called from another goroutine to
+// wake up a VM blocked on input.
 func (i *Instance) PushInput(r io.Reader) {
+	i.inMu.Lock()
+	defer i.inMu.Unlock()
 	// dont use a multi reader unless necessary
 	switch in := i.input.(type) {
 	case nil:
@@ -91,65 +152,243 @@ func (i *Instance) PushInput(r io.Reader) {
 		in.pushReader(r)
 	default:
 		// build multireader from two single readers
-		i.input = &multiReader{[]io.Reader{r, i.input}}
+		i.input = &multiReader{readers: []io.Reader{r, i.input}}
+	}
+	i.wakeInput()
+}
+
+// WriteInput appends a copy of p to the VM's input pipe. The input pipe is read
+// once all readers pushed with Input or PushInput have reached EOF.
+//
+// WriteInput can be safely called from any goroutine, including while the VM
+// is running, so that hosts can feed input as it comes. To prevent Run from
+// returning when the VM has consumed all available input, use the EOFBlock
+// policy (see InputEOF): WriteInput then wakes up a VM waiting for input.
+func (i *Instance) WriteInput(p []byte) {
+	i.inMu.Lock()
+	defer i.inMu.Unlock()
+	if i.inClosed {
+		return
+	}
+	i.inBuf = append(i.inBuf, p...)
+	i.wakeInput()
+}
+
+// CloseInput closes the VM's input pipe. Once the pipe is drained, the VM gets
+// an EOF on input, regardless of the policy set with InputEOF. Any subsequent
+// call to WriteInput is ignored.
+func (i *Instance) CloseInput() {
+	i.inMu.Lock()
+	defer i.inMu.Unlock()
+	i.inClosed = true
+	i.wakeInput()
+}
+
+// wakeInput wakes up a VM waiting for input. i.inMu must be held.
+func (i *Instance) wakeInput() {
+	i.inGen++
+	if i.inWake != nil {
+		close(i.inWake)
+		i.inWake = nil
+	}
+}
+
+// readPipe reads a single byte from the input pipe.
+func (i *Instance) readPipe() (b byte, ok, closed bool) {
+	i.inMu.Lock()
+	defer i.inMu.Unlock()
+	if len(i.inBuf) == 0 {
+		i.inBuf = nil
+		return 0, false, i.inClosed
+	}
+	b, i.inBuf = i.inBuf[0], i.inBuf[1:]
+	return b, true, false
+}
+
+// readRune reads a UTF-8 encoded code point with read, which returns the
+// first byte, and readInput for the following ones. Invalid sequences are
+// returned as U+FFFD.
+func (i *Instance) readRune(read func() (Cell, error)) (Cell, error) {
+	if c := i.unread; c >= 0 {
+		i.unread = -1
+		read = func() (Cell, error) { return c, nil }
+	}
+	c, err := read()
+	if err != nil || c < utf8.RuneSelf {
+		return c, err
+	}
+	b := [utf8.UTFMax]byte{byte(c)}
+	n := 1
+	for ; n < len(b) && !utf8.FullRune(b[:n]); n++ {
+		c, err = i.readInput()
+		if err != nil || c < 0 {
+			return utf8.RuneError, nil
+		}
+		if c&0xc0 != 0x80 {
+			// not a continuation byte, keep it for the next read.
+			i.unread = c
+			return utf8.RuneError, nil
+		}
+		b[n] = byte(c)
+	}
+	r, _ := utf8.DecodeRune(b[:n])
+	return Cell(r), nil
+}
+
+// readInput reads a single byte from the input. It returns -1 if no byte
+// could be read, or -2 on error.
+func (i *Instance) readInput() (Cell, error) {
+	var b [1]byte
+	for {
+		i.inMu.Lock()
+		in, gen := i.input, i.inGen
+		i.inMu.Unlock()
+		var (
+			size int
+			err  = io.EOF
+		)
+		if in != nil {
+			size, err = in.Read(b[:])
+			if e := i.countInput(size); e != nil {
+				return -2, e
+			}
+			if size > 0 {
+				return Cell(b[0]), nil
+			}
+			if err == nil {
+				return -1, nil
+			}
+		}
+		if err != io.EOF {
+			return -2, errors.Wrap(err, "input read failed")
+		}
+		c, ok, closed := i.readPipe()
+		if ok {
+			if e := i.countInput(1); e != nil {
+				return -2, e
+			}
+			return Cell(c), nil
+		}
+		if i.eofFn != nil && !closed {
+			if r := i.eofFn(i); r != nil {
+				i.PushInput(r)
+				continue
+			}
+		}
+		if i.eofPolicy == EOFReply && !closed {
+			return -1, nil
+		}
+		if i.eofPolicy != EOFBlock || closed {
+			if in == nil {
+				return -2, io.EOF
+			}
+			return -2, errors.Wrap(err, "input read failed")
+		}
+		i.inMu.Lock()
+		if i.inGen != gen {
+			i.inMu.Unlock()
+			continue
+		}
+		wake := make(chan struct{})
+		i.inWake = wake
+		i.inMu.Unlock()
+		<-wake
 	}
 }
 
 // In is the default IN handler for all ports.
 func (i *Instance) In(port Cell) error {
-	i.Push(i.Ports[port])
-	i.Ports[port] = 0
+	if i.replyQ {
+		i.Push(i.readReply(port))
+		return nil
+	}
+	i.Push(i.swapPort(port, 0))
 	return nil
 }
 
 // Out is the default OUT handler for all ports.
 func (i *Instance) Out(v, port Cell) error {
 	if port == 3 {
-		if i.output == nil {
+		out := i.terminal()
+		if out == nil {
 			return nil
 		}
-		return i.output.Flush()
+		return out.Flush()
 	}
-	i.Ports[port] = v
+	i.setPort(port, v)
 	return nil
 }
 
 // WaitReply writes the value v to the given port and sets port 0 to 1. This
-// should only be used by WAIT port handlers.
+// should only be used by WAIT port handlers. With QueueReplies, v is queued if
+// the port holds a reply not yet read by the VM.
 func (i *Instance) WaitReply(v, port Cell) {
-	i.Ports[port] = v
-	i.Ports[0] = 1
+	i.recordPort(PortReply, port, v)
+	if i.replyQ {
+		i.queueReply(v, port)
+		return
+	}
+	i.setPort(port, v)
+	i.setPort(0, 1)
 }
 
-// Wait is the default WAIT handler bound to ports 1, 2, 4, 5 and 8. It can be
+// Wait is the default WAIT handler bound to ports 1, 2, 4, 5, 7 and 8. It can be
 // called manually by custom handlers that override default behaviour.
 func (i *Instance) Wait(v, port Cell) error {
 	switch port {
 	case 1: // input
-		if v == 1 {
-			var b [1]byte
-			if i.input == nil {
-				return io.EOF
+		if v >= 1 && v <= 3 {
+			read := i.readInput
+			switch v {
+			case 2:
+				read = i.pollInput
+			case 3:
+				d := time.Duration(i.Pop()) * time.Millisecond
+				read = func() (Cell, error) { return i.readTimeout(d) }
 			}
-			size, err := i.input.Read(b[:])
-			if size > 0 {
-				i.WaitReply(Cell(b[0]), 1)
-			} else {
+			if i.utf8In {
+				r := read
+				read = func() (Cell, error) { return i.readRune(r) }
+			}
+			c, err := i.nondetCell(jInput, read)
+			switch {
+			case c >= 0:
+				i.WaitReply(c, 1)
+			case c == -2 && err == nil:
+				// EOF or read error during replay
+				return io.EOF
+			default:
 				i.WaitReply(-1, 1)
-				if err != nil {
-					return errors.Wrap(err, "input read failed")
-				}
+			}
+			if err != nil {
+				return err
 			}
 		}
 	case 2: // output
 		if v == 1 {
 			c := i.Pop()
-			if i.output != nil {
-				var err error
+			if out := i.terminal(); out != nil {
+				var (
+					b   [utf8.UTFMax]byte
+					n   = 1
+					err error
+				)
+				if c >= 0 && i.utf8Out {
+					r := rune(c)
+					if Cell(r) != c {
+						r = utf8.RuneError
+					}
+					n = utf8.EncodeRune(b[:], r)
+				} else {
+					b[0] = byte(c)
+				}
+				if err = i.countOutput(n); err != nil {
+					return err
+				}
 				if c < 0 {
-					i.output.Clear()
+					out.Clear()
 				} else {
-					_, err = i.output.Write([]byte{byte(c)})
+					_, err = out.Write(b[:n])
 				}
 				if err != nil {
 					return errors.Wrap(err, "output write failed")
@@ -159,174 +398,233 @@ func (i *Instance) Wait(v, port Cell) error {
 		}
 	case 4: // FileIO
 		if v != 0 {
-			var b [1]byte
-			switch v {
-			case 1: // save image
-				err := i.memDump(i.imageFile, i.Mem)
-				if err != nil {
-					return errors.Wrap(err, "image dump failed")
-				}
-				i.WaitReply(0, 4)
-			case 2: // include file
-				i.WaitReply(0, 4)
-				var (
-					f    *os.File
-					err  error
-					addr = i.Pop()
-				)
-				if i.sEnc != nil {
-					f, err = os.Open(string(i.sEnc.Decode(i.Mem, addr)))
-					if err != nil {
-						return errors.Wrap(err, "file include failed")
-					}
-					i.PushInput(f)
-					break
-				}
-				return errors.Wrap(err, "file include failed: no string encoder configured")
-			case -1: // open file
-				var fd Cell
-				if i.sEnc != nil {
-					fd = i.openfile(string(i.sEnc.Decode(i.Mem, i.data[i.sp])), i.tos)
-				}
-				i.Drop2()
-				i.WaitReply(fd, 4)
-			case -2: // read byte
-				f := i.files[i.Pop()]
-				if f != nil {
-					f.Read(b[:])
-				}
-				i.WaitReply(Cell(b[0]), 4)
-			case -3: // write byte
-				var l int
-				b[0] = byte(i.data[i.sp])
-				f := i.files[i.tos]
-				i.Drop2()
-				if f != nil {
-					l, _ = f.Write(b[:])
-				}
-				i.WaitReply(Cell(l), 4)
-			case -4: // close fd
-				var ret Cell = 1
-				id := i.Pop()
-				if f := i.files[id]; f != nil {
-					if err := f.Close(); err == nil {
-						i.files[id] = nil
-						i.fid = id
-						ret = 0
-					}
-				}
-				i.WaitReply(ret, 4)
-			case -5: // ftell
-				var p int64
-				if f := i.files[i.Pop()]; f != nil {
-					p, _ = f.Seek(0, 1)
-				}
-				i.WaitReply(Cell(p), 4)
-			case -6: // seek
-				var p int64
-				o, f := i.data[i.sp], i.files[i.tos]
-				i.Drop2()
-				if f != nil {
-					p, _ = f.Seek(int64(o), os.SEEK_SET)
-				}
-				i.WaitReply(Cell(p), 4)
-			case -7: // file size
-				var sz Cell
-				if f := i.files[i.Pop()]; f != nil {
-					if fi, err := f.Stat(); err == nil {
-						sz = Cell(fi.Size())
-					}
-				}
-				i.WaitReply(sz, 4)
-			case -8: // delete
-				var r Cell
-				addr := i.Pop()
-				if i.sEnc != nil {
-					if os.Remove(string(i.sEnc.Decode(i.Mem, addr))) == nil {
-						r = -1
-					}
-				}
-				i.WaitReply(r, 4)
-			default:
-				i.WaitReply(0, 4)
-			}
+			return i.fileIO(v)
 		}
 	case 5: // VM capabilities
-		if i.Ports[5] != 0 {
-			switch i.Ports[5] {
+		if q := i.port(5); q != 0 {
+			switch q {
 			case -1:
 				// image size
-				i.Ports[5] = Cell(len(i.Mem))
-			// -2, -3, -4: canvas related
+				i.setPort(5, Cell(len(i.Mem)))
+			case -2:
+				// canvas present
+				i.setPort(5, 0)
+				if i.canvas != nil {
+					i.setPort(5, -1)
+				}
+			case -3:
+				// canvas width
+				i.setPort(5, 0)
+				if i.canvas != nil {
+					i.setPort(5, Cell(i.canvas.Bounds().Dx()))
+				}
+			case -4:
+				// canvas height
+				i.setPort(5, 0)
+				if i.canvas != nil {
+					i.setPort(5, Cell(i.canvas.Bounds().Dy()))
+				}
 			case -5:
 				// data depth
-				i.Ports[5] = Cell(i.Depth())
+				i.setPort(5, Cell(i.Depth()))
 			case -6:
 				// address depth
-				i.Ports[5] = Cell(i.rsp)
-			// -7: mouse enabled
+				i.setPort(5, Cell(i.rsp))
+			case -7:
+				// mouse enabled
+				i.setPort(5, 0)
+				if i.mouseProvider() != nil {
+					i.setPort(5, -1)
+				}
 			case -8:
 				// unix time
-				i.Ports[5] = Cell(time.Now().Unix())
+				t, err := i.nondetCell(jTime, func() (Cell, error) { return Cell(i.now().Unix()), nil })
+				if err != nil {
+					return err
+				}
+				i.setPort(5, t)
 			case -9:
 				// exit VM
-				i.Ports[5] = 0
+				i.setPort(5, 0)
 				i.PC = len(i.Mem) - 1 // will be incremented when returning
 			case -10:
 				// environment query
 				src, dst := i.tos, i.data[i.sp]
 				i.Drop2()
 				if i.sEnc != nil {
-					i.sEnc.Encode(i.Mem, dst, []byte(os.Getenv(string(i.sEnc.Decode(i.Mem, src)))))
-				}
-				i.Ports[5] = 0
-			case -11:
-				// console width
-				if i.output != nil {
-					w, _ := i.output.Size()
-					i.Ports[5] = Cell(w)
-				} else {
-					i.Ports[5] = 0
+					name := string(i.sEnc.Decode(i.Mem, src))
+					i.auditName(AuditEnv, name, 0)
+					env, err := i.nondetBytes(jEnv, func() []byte {
+						if i.disabled&DevEnv != 0 {
+							return nil
+						}
+						return []byte(i.getenv(name))
+					})
+					if err != nil {
+						return err
+					}
+					i.sEnc.Encode(i.Mem, dst, env)
 				}
-			case -12:
-				// console height
-				if i.output != nil {
-					_, h := i.output.Size()
-					i.Ports[5] = Cell(h)
-				} else {
-					i.Ports[5] = 0
+				i.setPort(5, 0)
+			case -11, -12:
+				// console width/height
+				sz, err := i.nondetCell(jConsole, func() (Cell, error) {
+					out := i.terminal()
+					if out == nil {
+						return 0, nil
+					}
+					w, h := out.Size()
+					if q == -11 {
+						return Cell(w), nil
+					}
+					return Cell(h), nil
+				})
+				if err != nil {
+					return err
 				}
+				i.setPort(5, sz)
 			case -13:
-				i.Ports[5] = CellBits
+				i.setPort(5, i.cellSize())
 			case -14:
 				v = 0x01000000
-				i.Ports[5] = Cell(*(*int8)(unsafe.Pointer(&v)))
+				i.setPort(5, Cell(*(*int8)(unsafe.Pointer(&v))))
 			case -15:
 				// port 8 enabled
-				if i.output != nil && i.output.Port8Enabled() {
-					i.Ports[5] = -1
+				if out := i.terminal(); out != nil && out.Port8Enabled() {
+					i.setPort(5, -1)
 				} else {
-					i.Ports[5] = 0
+					i.setPort(5, 0)
 				}
 			case -16:
-				i.Ports[5] = Cell(len(i.data) - 1)
+				i.setPort(5, Cell(len(i.data)-1))
 			case -17:
-				i.Ports[5] = Cell(len(i.address) - 1)
+				i.setPort(5, Cell(len(i.address)-1))
+			case -18:
+				// random number
+				r, err := i.nondetCell(jRand, func() (Cell, error) { return i.random(), nil })
+				if err != nil {
+					return err
+				}
+				i.setPort(5, r)
+			case -19:
+				i.setPort(5, Version)
+			case -20:
+				i.setPort(5, Cell(allDevices&^i.disabled))
+			case -21:
+				i.setPort(5, clampCell(int64(i.limits.MaxMemCells)))
+			case -22:
+				i.setPort(5, clampCell(i.limits.MaxInstructions))
+			case -23:
+				i.setPort(5, clampCell(i.limits.MaxOutputBytes))
+			case -24:
+				i.setPort(5, clampCell(i.limits.MaxInputBytes))
+			case -25:
+				i.setPort(5, Cell(len(i.args)))
+			case -26:
+				// argument query
+				n, dst := i.tos, i.data[i.sp]
+				i.Drop2()
+				i.setPort(5, -1)
+				if n >= 0 && int(n) < len(i.args) {
+					i.setPort(5, Cell(len(i.args[n])))
+					if i.sEnc != nil {
+						i.sEnc.Encode(i.Mem, dst, []byte(i.args[n]))
+					}
+				}
+			case -27:
+				// register exit hook
+				i.AtExit(i.Pop())
+				i.setPort(5, 0)
+			case -28:
+				// string buffer size
+				n := i.Pop()
+				i.setPort(5, -1)
+				if i.sEnc != nil && n >= 0 {
+					i.setPort(5, clampCell(int64(i.sEnc.EncodedLen(int(n)))))
+				}
+			case -29, -30:
+				// monotonic clock
+				t, err := i.nondetCell(jTime, func() (Cell, error) {
+					if q == -29 {
+						return Cell(i.uptime() / time.Millisecond), nil
+					}
+					return Cell(i.uptime()), nil
+				})
+				if err != nil {
+					return err
+				}
+				i.setPort(5, t)
+			case -31:
+				// sleep
+				ms := i.Pop()
+				left, err := i.nondetCell(jTime, func() (Cell, error) {
+					d := i.sleep(time.Duration(ms) * time.Millisecond)
+					return Cell((d + time.Millisecond - 1) / time.Millisecond), nil
+				})
+				if err != nil {
+					return err
+				}
+				i.setPort(5, left)
+			case -32:
+				// date component
+				c := i.Pop()
+				d, err := i.nondetCell(jTime, func() (Cell, error) { return i.date(c), nil })
+				if err != nil {
+					return err
+				}
+				i.setPort(5, d)
+			case -33:
+				// set environment variable
+				name, val := i.tos, i.data[i.sp]
+				i.Drop2()
+				i.setPort(5, 0)
+				if i.sEnc != nil {
+					k := string(i.sEnc.Decode(i.Mem, name))
+					i.auditName(AuditSetEnv, k, 0)
+					if i.setenv(k, string(i.sEnc.Decode(i.Mem, val))) {
+						i.setPort(5, -1)
+					}
+				}
+			case -34:
+				// environment enumeration
+				n, dst := i.tos, i.data[i.sp]
+				i.Drop2()
+				kv, err := i.nondetBytes(jEnv, func() []byte {
+					if i.disabled&DevEnv != 0 {
+						return nil
+					}
+					if env := i.environ(); n >= 0 && int64(n) < int64(len(env)) {
+						return []byte(env[n])
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				i.setPort(5, -1)
+				if len(kv) > 0 && i.sEnc != nil {
+					i.sEnc.Encode(i.Mem, dst, kv)
+					i.setPort(5, Cell(len(kv)))
+				}
 			default:
-				i.Ports[5] = 0
+				i.setPort(5, 0)
 			}
-			i.Ports[0] = 1
+			i.setPort(0, 1)
+		}
+	case 7: // mouse
+		if v != 0 {
+			i.mouseWait(v)
 		}
 	case 8:
-		if v := i.Ports[8]; v != 0 && i.output != nil {
-			switch i.Ports[8] {
+		if q, out := i.port(8), i.terminal(); q != 0 && out != nil {
+			switch q {
 			case 1:
-				i.output.MoveCursor(int(i.tos), int(i.data[i.sp]))
+				out.MoveCursor(int(i.tos), int(i.data[i.sp]))
 				i.Drop2()
 			case 2:
-				i.output.FgColor(int(i.Pop()))
+				out.FgColor(int(i.Pop()))
 			case 3:
-				i.output.BgColor(int(i.Pop()))
+				out.BgColor(int(i.Pop()))
 			}
 			i.WaitReply(0, 8)
 		}
@@ -20,15 +20,29 @@ import (
 	"bytes"
 	"io"
 	"strconv"
+	"sync"
 )
 
+// multiReader reads from a stack of readers in sequence. Readers can be pushed
+// by other goroutines while a Read is in progress: they are used once that Read
+// returns.
 type multiReader struct {
+	mu      sync.Mutex
 	readers []io.Reader
 }
 
 func (mr *multiReader) Read(p []byte) (n int, err error) {
-	for len(mr.readers) > 0 {
-		n, err = mr.readers[0].Read(p)
+	for {
+		mr.mu.Lock()
+		// readers are only pushed in front, so r stays at index len-k.
+		k := len(mr.readers)
+		if k == 0 {
+			mr.mu.Unlock()
+			return 0, io.EOF
+		}
+		r := mr.readers[0]
+		mr.mu.Unlock()
+		n, err = r.Read(p)
 		if n > 0 || err != io.EOF {
 			if err == io.EOF {
 				// Don't return EOF yet. There may be more bytes
@@ -37,16 +51,27 @@ func (mr *multiReader) Read(p []byte) (n int, err error) {
 			}
 			return
 		}
-		if c, ok := mr.readers[0].(io.Closer); ok {
+		if c, ok := r.(io.Closer); ok {
 			c.Close()
 		}
-		mr.readers = mr.readers[1:]
+		mr.mu.Lock()
+		x := len(mr.readers) - k
+		mr.readers = append(mr.readers[:x:x], mr.readers[x+1:]...)
+		mr.mu.Unlock()
 	}
-	return 0, io.EOF
 }
 
 func (mr *multiReader) pushReader(r io.Reader) {
+	mr.mu.Lock()
 	mr.readers = append([]io.Reader{r}, mr.readers...)
+	mr.mu.Unlock()
+}
+
+// list returns a copy of the reader stack.
+func (mr *multiReader) list() []io.Reader {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return append([]io.Reader(nil), mr.readers...)
 }
 
 type vt100Terminal struct {
@@ -18,10 +18,18 @@ package vm_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/db47h/ngaro/asm"
@@ -45,6 +53,142 @@ func Test_io_GetEnv(t *testing.T) {
 	assertEqual(t, "GetEnv", envGo, envRetro)
 }
 
+func Test_io_Args(t *testing.T) {
+	var b = bytes.NewBuffer(nil)
+	_, err := runImageFile(retroImage, imageBits,
+		vm.Output(vm.NewVT100Terminal(b, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.Args("foo", "hello world"),
+		vm.Input(strings.NewReader(": argc -25 5 out 0 0 out wait 5 in ; "+
+			": arg here swap -26 5 out 0 0 out wait 5 in ; "+
+			": t cr argc putn space 1 arg putn space here puts space 2 arg putn cr ; t bye ")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.Contains(b.String(), "\n2 11 hello world -1\n") {
+		t.Errorf("Unexpected output: %q", b.String())
+	}
+}
+
+func Test_io_SetEnv(t *testing.T) {
+	prog := ": setEnv -33 5 out 0 0 out wait 5 in ; " +
+		": env here swap -34 5 out 0 0 out wait 5 in ; " +
+		": pEnv here dup push swap getEnv pop puts ; " +
+		": t cr \"3\" \"C\" setEnv putn space \"C\" pEnv space " +
+		"2 env putn space here puts space 3 env putn cr ; t bye "
+	var b = bytes.NewBuffer(nil)
+	_, err := runImageFile(retroImage, imageBits,
+		vm.Output(vm.NewVT100Terminal(b, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.Environ([]string{"B=2", "A=1"}),
+		vm.Input(strings.NewReader(prog)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.Contains(b.String(), "\n-1 3 3 C=3 -1\n") {
+		t.Errorf("Unexpected output: %q", b.String())
+	}
+
+	// host environment is read-only and cannot be enumerated
+	b.Reset()
+	_, err = runImageFile(retroImage, imageBits,
+		vm.Output(vm.NewVT100Terminal(b, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.Input(strings.NewReader(": setEnv -33 5 out 0 0 out wait 5 in ; "+
+			": env here swap -34 5 out 0 0 out wait 5 in ; "+
+			": t cr \"3\" \"NGARO_TEST\" setEnv putn space 0 env putn cr ; t bye ")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.Contains(b.String(), "\n0 -1\n") {
+		t.Errorf("Unexpected output: %q", b.String())
+	}
+}
+
+// packedCodec packs 4 bytes per cell, zero terminated.
+type packedCodec struct{}
+
+func (packedCodec) Decode(mem []vm.Cell, start vm.Cell) []byte {
+	var s []byte
+	for p := int(start); p >= 0 && p < len(mem); p++ {
+		for n := uint(0); n < 32; n += 8 {
+			b := byte(mem[p] >> n)
+			if b == 0 {
+				return s
+			}
+			s = append(s, b)
+		}
+	}
+	return s
+}
+
+func (packedCodec) Encode(mem []vm.Cell, start vm.Cell, s []byte) {
+	for n := 0; n <= len(s); n += 4 {
+		var c vm.Cell
+		for k := 0; k < 4 && n+k < len(s); k++ {
+			c |= vm.Cell(s[n+k]) << uint(8*k)
+		}
+		if p := int(start) + n/4; p < len(mem) {
+			mem[p] = c
+		}
+	}
+}
+
+func (packedCodec) BytesPerCell() int { return 4 }
+
+func (packedCodec) EncodedLen(n int) int { return n/4 + 1 }
+
+func Test_io_StringBufferSize(t *testing.T) {
+	code := "11 -28 5 out 0 0 out wait 5 in 12 -28 5 out 0 0 out wait 5 in"
+	for _, tc := range []struct {
+		name string
+		opts []vm.Option
+		exp  string
+	}{
+		{"none", nil, "[-1 -1]"},
+		{"retro", []vm.Option{vm.StringCodec(retro.StringCodec)}, "[12 13]"},
+		{"packed", []vm.Option{vm.StringCodec(packedCodec{})}, "[3 4]"},
+	} {
+		i, err := runAsmImage(code, "StringBufferSize", tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.name, err)
+		}
+		assertEqual(t, tc.name, tc.exp, fmt.Sprint(i.Data()))
+	}
+}
+
+func TestAtExit(t *testing.T) {
+	code := `jump start
+		.org 32
+		:h1 1 ;
+		:h2 2 ;
+		:start
+			lit h1 -27 5 out 0 0 out wait 5 in drop
+			lit h2 -27 5 out 0 0 out wait 5 in drop
+			42 `
+	onExit := vm.OnExit(func(i *vm.Instance) error {
+		i.Push(3)
+		return nil
+	})
+	i, err := runAsmImage(code, "AtExit", onExit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "AtExit", "[42 2 1 3]", fmt.Sprint(i.Data()))
+	// EOF
+	i, err = runAsmImage(code+"1 1 out 0 0 out wait 1 in", "AtExit", onExit)
+	if errors.Cause(err) != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	assertEqual(t, "AtExit", "[42 2 1 3]", fmt.Sprint(i.Data()))
+	// abnormal exit
+	i, err = runAsmImage(code+"5000 @", "AtExit", onExit)
+	if errors.Cause(err) == nil {
+		t.Fatal("Expected error")
+	}
+	assertEqual(t, "AtExit", "[42 5000]", fmt.Sprint(i.Data()))
+}
+
 func Test_io_Files(t *testing.T) {
 	err := os.Chdir("testdata")
 	if err != nil {
@@ -83,6 +227,299 @@ func Test_io_Files(t *testing.T) {
 	assertEqualI(t, "io_Files fd", 1, int(i.Pop()))
 }
 
+func Test_io_Dirs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	i, err := runAsmImage(`jump start
+		:dir .dat "d"
+		:a .dat "d/a"
+		:b .dat "d/b"
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit dir -11 4 io			( mkdir )
+			lit a 1 -1 4 io				( create d/a )
+			dup 120 swap -3 4 io drop	( write one byte )
+			-4 4 io drop
+			lit a -12 4 io				( stat file )
+			lit dir -12 4 io			( stat directory )
+			lit a lit b -13 4 io		( rename d/a to d/b )
+			lit a -12 4 io				( stat missing file )
+			lit b -12 4 io
+			lit dir -9 4 io 3 !			( opendir )
+			lit buf 3 @ -10 4 io		( readdir )
+			lit buf 3 @ -10 4 io		( end of directory )
+			3 @ -4 4 io
+			jump end
+		.org 200 :buf
+		.org 210 :end`,
+		"io_Dirs", vm.StringCodec(retro.StringCodec))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_Dirs", "[-1 1 -2 -1 -1 1 1 -1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_Dirs readdir", "b", string(retro.StringCodec.Decode(i.Mem, 200)))
+
+	// disabled
+	i, err = runAsmImage("jump start\n:dir .dat \"e\"\n:start lit dir -11 4 out 0 0 out wait 4 in lit dir -9 4 out 0 0 out wait 4 in",
+		"io_Dirs", vm.StringCodec(retro.StringCodec), vm.DisableDevices(vm.DevFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Dirs disabled", "[0 0]", fmt.Sprint(i.Data()))
+}
+
+func Test_io_FileRoot(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("x"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(root, "a")
+	var saved string
+	save := func(name string, mem []vm.Cell) error { saved = name; return nil }
+	code := fmt.Sprintf(`jump start
+		:a .dat "a"
+		:up .dat "../a"
+		:abs .dat %q
+		.org 64
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit a 0 -1 4 io
+			lit up 0 -1 4 io
+			lit abs 0 -1 4 io
+			lit up -12 4 io
+			1 4 io`, abs)
+	i, err := runAsmImage(code, "io_FileRoot", vm.StringCodec(retro.StringCodec), vm.FileRoot(root), vm.SaveMemImage(save))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileRoot", "[1 0 0 -1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_FileRoot save", filepath.Join(root, "io_FileRoot"), saved)
+
+	// image saves outside of the root
+	saved = ""
+	i, err = runAsmImage("1 4 out 0 0 out wait 4 in", abs, vm.FileRoot(root), vm.SaveMemImage(save))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_FileRoot abs save", "[-1]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_FileRoot abs save", "", saved)
+
+	// deny all
+	i, err = runAsmImage(code, "io_FileRoot", vm.StringCodec(retro.StringCodec), vm.FileRoot(""), vm.SaveMemImage(save))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileRoot deny", "[0 0 0 -1 -1]", fmt.Sprint(i.Data()))
+
+	// symbolic links
+	out := t.TempDir()
+	for l, target := range map[string]string{
+		"out":      out,
+		"dangling": filepath.Join(out, "nofile"),
+		"in":       ".",
+	} {
+		if err = os.Symlink(target, filepath.Join(root, l)); err != nil {
+			t.Skip(err)
+		}
+	}
+	i, err = runAsmImage(`jump start
+		:out .dat "out/x"
+		:dangling .dat "dangling"
+		:in .dat "in/y"
+		.org 64
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit out 1 -1 4 io
+			lit dangling 1 -1 4 io
+			lit in 1 -1 4 io`,
+		"io_FileRoot", vm.StringCodec(retro.StringCodec), vm.FileRoot(root))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileRoot links", "[0 0 1]", fmt.Sprint(i.Data()))
+	if _, err = os.Stat(filepath.Join(out, "nofile")); err == nil {
+		t.Fatal("File created through a dangling link")
+	}
+}
+
+func Test_io_FileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"d/a":    {Data: []byte("xy")},
+		"inc.rx": {Data: []byte("42")},
+	}
+	i, err := runAsmImage(`jump start
+		:a .dat "d/a"
+		:b .dat "d/b"
+		:d .dat "d"
+		:up .dat "../d/a"
+		:fd .dat 0
+		.org 64
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit a 0 -1 4 io lit fd !		( open d/a )
+			lit fd @ -2 4 io				( read )
+			lit fd @ -2 4 io
+			lit fd @ -7 4 io				( size )
+			lit fd @ -4 4 io				( close )
+			lit b 1 -1 4 io			( create, read-only fs )
+			lit up 0 -1 4 io		( escape )
+			lit a -12 4 io			( stat )
+			lit d -11 4 io			( mkdir, read-only fs )
+			lit d -9 4 io lit fd !		( opendir )
+			lit buf lit fd @ -10 4 io	( readdir )
+			lit buf lit fd @ -10 4 io
+			lit fd @ -4 4 io
+			jump end
+		.org 200 :buf
+		.org 210 :end`,
+		"io_FileSystem", vm.StringCodec(retro.StringCodec), vm.FileSystem(fsys))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileSystem", "[120 121 2 0 0 0 2 0 1 -1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_FileSystem readdir", "a", string(retro.StringCodec.Decode(i.Mem, 200)))
+
+	// include
+	img, err := asm.Assemble("io_FileSystem", strings.NewReader(`jump start
+		:inc .dat "inc.rx"
+		:start lit inc 2 4 out 0 0 out wait 1 1 out 0 0 out wait 1 in 1 1 out 0 0 out wait 1 in`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = vm.New(img, "", vm.StringCodec(retro.StringCodec), vm.FileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Run(); errors.Cause(err) != io.EOF && err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileSystem include", "[52 50]", fmt.Sprint(i.Data()))
+
+	// image saves use the host file system
+	name := filepath.Join(t.TempDir(), "retroImage")
+	i, err = runAsmImage("1 4 out 0 0 out wait 4 in", name, vm.FileSystem(fsys))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "io_FileSystem save", "[0]", fmt.Sprint(i.Data()))
+	if _, err = os.Stat(name); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_io_UTF8Output(t *testing.T) {
+	code := `jump start
+		.org 32
+		:emit 1 2 out 0 0 out wait ;
+		:start 233 emit 128512 emit 65 emit`
+	var b bytes.Buffer
+	_, err := runAsmImage(code, "io_UTF8Output", vm.Output(vm.NewVT100Terminal(&b, nil, nil)), vm.UTF8Output(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UTF8Output", "\u00e9\U0001f600A", b.String())
+
+	b.Reset()
+	_, err = runAsmImage(code, "io_UTF8Output", vm.Output(vm.NewVT100Terminal(&b, nil, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UTF8Output bytes", "\xe9\x00A", b.String())
+}
+
+func Test_io_UTF8Input(t *testing.T) {
+	code := `jump start
+		.org 32
+		:key 1 1 out 0 0 out wait 1 in ;
+		:start key key key key key key key key`
+	in := "\u00e9\u20ac\U0001f600A\xffB\xe2("
+	i, err := runAsmImage(code, "io_UTF8Input", vm.Input(strings.NewReader(in)), vm.UTF8Input(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UTF8Input", fmt.Sprint([]int{0xe9, 0x20ac, 0x1f600, 'A', utf8.RuneError, 'B', utf8.RuneError, '('}), fmt.Sprint(i.Data()))
+
+	i, err = runAsmImage(code, "io_UTF8Input", vm.Input(strings.NewReader(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UTF8Input bytes", fmt.Sprint([]int{0xc3, 0xa9, 0xe2, 0x82, 0xac, 0xf0, 0x9f, 0x98}), fmt.Sprint(i.Data()))
+}
+
+func TestLineEditor(t *testing.T) {
+	keys := "ab\x02\x02X\x05c\x7f\r" +
+		"hello world\x17\x19\x19\n" +
+		"\u00e9\x7f\u20ac\n" +
+		"ab\x1b[D\x1b[3~\n" +
+		"xyz\x15q\n" +
+		"\x04"
+	var out bytes.Buffer
+	e := vm.NewLineEditor(strings.NewReader(keys), &out)
+	b, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "LineEditor", "Xab\nhello worldworld\n\u20ac\na\nq\n\x04", string(b))
+	// the display is erased before each line is delivered
+	assertEqual(t, "LineEditor display", "\b\x1b[K", out.String()[out.Len()-4:])
+
+	// polling
+	pr, pw := io.Pipe()
+	e = vm.NewLineEditor(vm.NewAsyncReader(pr), &out)
+	out.Reset()
+	go func() {
+		pw.Write([]byte("ab"))
+		pw.Write([]byte("\n"))
+		pw.Close()
+	}()
+	for out.Len() < 2 {
+		if n := e.Buffered(); n != 0 && out.Len() < 2 {
+			t.Fatalf("LineEditor: expected no input, got %d bytes", n)
+		}
+	}
+	for e.Buffered() == 0 {
+	}
+	b, err = io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "LineEditor poll", "ab\n", string(b))
+}
+
+func TestLineEditor_history(t *testing.T) {
+	e := vm.NewLineEditor(strings.NewReader("one\ntwo\n\x1b[A\x1b[A\nx\x10\x0e\n"), io.Discard)
+	b, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "LineEditor history", "one\ntwo\none\nx\n", string(b))
+	var h bytes.Buffer
+	if err = e.WriteHistory(&h); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "LineEditor WriteHistory", "one\ntwo\none\nx\n", h.String())
+
+	e = vm.NewLineEditor(strings.NewReader("\x1b[A\x1b[A\n"), io.Discard)
+	if err = e.ReadHistory(&h); err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "LineEditor ReadHistory", "one\n", string(b))
+}
+
 func Test_io_Stacks(t *testing.T) {
 	i, err := runAsmImage("-16 5 out 0 0 out wait 5 in -17 5 out 0 0 out wait 5 in", "io_Stacks",
 		vm.DataSize(24), vm.AddressSize(42))
@@ -93,6 +530,23 @@ func Test_io_Stacks(t *testing.T) {
 	assertEqualI(t, "io_Stacks", 24, int(i.Pop()))
 }
 
+func Test_io_HostCaps(t *testing.T) {
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup 3 ! out 0 0 out wait 3 @ in ;
+		:start
+			-19 5 io
+			-20 5 io
+			-21 5 io
+			-22 5 io
+			-24 5 io`,
+		"io_HostCaps", vm.DisableDevices(vm.DevEnv), vm.ResourceLimits(vm.Limits{MaxMemCells: 100, MaxInputBytes: 42}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_HostCaps", fmt.Sprint([]int{vm.Version, int(vm.DevFiles | vm.DevNet | vm.DevExec), 100, 0, 42}), fmt.Sprint(i.Data()))
+}
+
 func Test_io_Caps(t *testing.T) {
 	// TODO: although the VM should return a correct value for endianness,
 	// the test will fail on BigEndian platforms
@@ -284,3 +738,1393 @@ func TestSave_32(t *testing.T) {
 		t.Fatalf("Save image error:\nexpected %v, got %v", img, saved[:cells])
 	}
 }
+
+func TestShrinkImage(t *testing.T) {
+	for _, test := range []struct {
+		size int
+		here vm.Cell
+		exp  int
+	}{
+		{20, 12, 12},
+		{20, 20, 20},
+		{20, 21, -1},
+		{20, 3, -1},
+		{20, -5, -1},
+		{3, 0, -1},
+	} {
+		mem := make([]vm.Cell, test.size)
+		if test.size > vm.HereAddr {
+			mem[vm.HereAddr] = test.here
+		}
+		m, err := vm.ShrinkImage(mem)
+		if test.exp < 0 {
+			if _, ok := errors.Cause(err).(*vm.ShrinkError); !ok {
+				t.Errorf("ShrinkImage(%d, %d): expected *ShrinkError, got %v", test.size, test.here, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ShrinkImage(%d, %d): %v", test.size, test.here, err)
+			continue
+		}
+		assertEqualI(t, "ShrinkImage", test.exp, len(m))
+	}
+
+	d := "testdata/testShrink"
+	mem := make([]vm.Cell, 20)
+	mem[vm.HereAddr] = 42
+	err := vm.ShrinkSave(true, 32)(d, mem)
+	if _, ok := errors.Cause(err).(*vm.ShrinkError); !ok {
+		t.Errorf("ShrinkSave: expected *ShrinkError, got %v", err)
+	}
+	if _, err = os.Stat(d); err == nil {
+		os.Remove(d)
+		t.Error("ShrinkSave: image saved despite invalid HERE")
+	}
+
+	mem[vm.HereAddr] = 10
+	mem[5] = 0x1234
+	f := vm.Format{Bits: 32, BigEndian: true}
+	if err = vm.ShrinkSaveFormat(true, f)(d, mem); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(d)
+	b, err := os.ReadFile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "ShrinkSaveFormat size", 40, len(b))
+	assertEqual(t, "ShrinkSaveFormat cell", "\x00\x00\x124", string(b[20:24]))
+	m, _, err := vm.LoadFormat(d, 0, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ShrinkSaveFormat", fmt.Sprint(mem[:10]), fmt.Sprint(m))
+}
+
+func Test_io_Limits(t *testing.T) {
+	_, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+		'a' 1 2 io drop
+		'b' 1 2 io drop
+		'c' 1 2 io drop`,
+		"io_Limits",
+		vm.Output(vm.NewVT100Terminal(bytes.NewBuffer(nil), nil, nil)),
+		vm.ResourceLimits(vm.Limits{MaxOutputBytes: 2}))
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxOutputBytes" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = runAsmImage(`jump start
+		:fileName .dat "testdata/retroImage"
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit fileName 0 -1 4 io
+			lit fileName 0 -1 4 io`,
+		"io_Limits",
+		vm.StringCodec(retro.StringCodec),
+		vm.ResourceLimits(vm.Limits{MaxOpenFiles: 1}))
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxOpenFiles" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = vm.New(make([]vm.Cell, 100), "", vm.ResourceLimits(vm.Limits{MaxMemCells: 99}))
+	if _, ok := errors.Cause(err).(*vm.LimitError); !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	i, err := runAsmImage(`jump start
+		:fileName .dat "nonexistent"
+		:envName .dat "PATH"
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			50 @ drop 200 @ drop 42 250 !
+			lit fileName 0 -1 4 io drop
+			lit fileName -8 4 io drop
+			200 lit envName -10 5 io drop
+			jump end
+		.org 300
+		:end`,
+		"Audit",
+		vm.StringCodec(retro.StringCodec),
+		vm.Audit(vm.Region{Start: 0, End: 100}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	events, dropped := i.AuditLog()
+	var log []string
+	for _, e := range events {
+		log = append(log, fmt.Sprintf("%v %d %d %q", e.Kind, e.Addr, e.Value, e.Name))
+	}
+	assertEqualI(t, "Audit dropped", 0, dropped)
+	assertEqual(t, "Audit", `[fetch 200 0 "" store 250 42 "" open 0 0 "nonexistent" delete 0 0 "nonexistent" env 0 0 "PATH"]`, fmt.Sprint(log))
+	if events, _ = i.AuditLog(); events != nil {
+		t.Fatalf("Expected empty audit log, got %v", events)
+	}
+}
+
+func TestPortRecorder(t *testing.T) {
+	r := vm.NewPortRecorder(3)
+	_, err := runAsmImage("5 10 out 0 0 out wait 10 in", "PortRecorder",
+		vm.RecordPorts(r),
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			i.WaitReply(v*2, port)
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var b bytes.Buffer
+	if err = r.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "PortRecorder", `[{"op":"wait","count":6,"pc":10,"port":0,"value":0},`+
+		`{"op":"reply","count":6,"pc":10,"port":10,"value":10},`+
+		`{"op":"in","count":8,"pc":13,"port":10,"value":10}]`+"\n", b.String())
+	r.Reset()
+	if ev := r.Events(); len(ev) != 0 {
+		t.Fatalf("Expected no events, got %v", ev)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var c vm.Capture
+	var b bytes.Buffer
+	_, err := runAsmImage(`jump start
+		.org 32
+		:emit 1 2 out 0 0 out wait ;
+		:start 'h' emit 'i' emit 5 10 out 0 0 out wait 10 in`, "Capture",
+		vm.Output(c.Terminal(vm.NewVT100Terminal(&b, nil, nil))),
+		vm.CapturePorts(&c, 10),
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			i.WaitReply(v*2, port)
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "Capture", "hi", c.String())
+	assertEqual(t, "Capture", "hi", b.String())
+	var ev []string
+	for _, e := range c.Events() {
+		if e.Output != nil {
+			ev = append(ev, string(e.Output))
+		} else {
+			ev = append(ev, fmt.Sprintf("%v %d %d", e.Op, e.Port, e.Value))
+		}
+	}
+	assertEqual(t, "Capture", "[h i out 10 5 reply 10 10 in 10 10]", fmt.Sprint(ev))
+	c.Reset()
+	if ev := c.Events(); len(ev) != 0 {
+		t.Fatalf("Expected no events, got %v", ev)
+	}
+}
+
+// testLogger records logged messages.
+type testLogger []string
+
+func (l *testLogger) log(level, msg string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf("%s %s %v", level, msg, args))
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args...) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+func TestLog(t *testing.T) {
+	var l testLogger
+	_, err := runAsmImage(`jump start
+		:fileName .dat "testdata/nonexistent"
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit fileName 0 -1 4 io drop
+			1 10 io`,
+		"Log",
+		vm.StringCodec(retro.StringCodec),
+		vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+			return errors.New("oops")
+		}),
+		vm.Log(&l))
+	if errors.Cause(err) == nil || errors.Cause(err).Error() != "oops" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(l) != 2 ||
+		!strings.HasPrefix(l[0], "ERROR file open failed [file testdata/nonexistent err ") ||
+		l[1] != "ERROR WAIT handler failed [port 10 err oops]" {
+		t.Fatalf("Unexpected log: %q", l)
+	}
+}
+
+func Test_io_Sandbox(t *testing.T) {
+	i, err := runAsmImage(`jump start
+		:fileName .dat "testdata/retroImage"
+		:envName .dat "PATH"
+		:env .dat 42
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			lit fileName 0 -1 4 io		( open should fail )
+			1 4 io						( save should fail )
+			lit env lit envName -10 5 io drop
+			lit env @`,
+		"io_Sandbox",
+		vm.StringCodec(retro.StringCodec),
+		vm.ProfileSandboxed())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqualI(t, "io_Sandbox env", 0, int(i.Pop()))
+	assertEqualI(t, "io_Sandbox save", -1, int(i.Pop()))
+	assertEqualI(t, "io_Sandbox open", 0, int(i.Pop()))
+
+	_, err = runAsmImage(":0 jump 0", "io_Sandbox",
+		vm.ProfileSandboxed(),
+		vm.ResourceLimits(vm.Limits{MaxInstructions: 5000}))
+	if e, ok := errors.Cause(err).(*vm.LimitError); !ok || e.Resource != "MaxInstructions" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	code := `jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			-8 5 io -8 5 io -18 5 io -18 5 io`
+	var prev []vm.Cell
+	for n := 0; n < 2; n++ {
+		i, err := runAsmImage(code, "Deterministic", vm.Deterministic(42))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		d := i.Data()
+		assertEqualI(t, "Deterministic time", 946684800, int(d[0]))
+		assertEqualI(t, "Deterministic time+1", 946684801, int(d[1]))
+		if d[2] < 0 || d[3] < 0 || d[2] == d[3] {
+			t.Fatalf("Bad random numbers: %v", d[2:])
+		}
+		if prev != nil {
+			assertEqual(t, "Deterministic", fmt.Sprint(prev), fmt.Sprint(d))
+		}
+		prev = d
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := vm.NewClock(0, time.Millisecond)
+	start := time.Now()
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			2 9 io
+			1000000 1 9 io
+			100000 :0 loop 0-
+			2 9 io`,
+		"Clock",
+		vm.Ticker(c.Ticker()),
+		vm.BindWaitHandler(9, c.WaitHandler))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("Clock throttling failed: 100000 instructions at 1MHz ran in %v", d)
+	}
+	assertEqualI(t, "Clock freq", 1000000, int(i.Pop()))
+	assertEqualI(t, "Clock previous freq", 0, int(i.Pop()))
+	assertEqualI(t, "Clock freq", 0, int(i.Pop()))
+}
+
+func Test_io_Include(t *testing.T) {
+	var b = bytes.NewBuffer(nil)
+	hook := func(name string) (string, bool) {
+		switch name {
+		case "alias.rx":
+			return "virtual.rx", true
+		case "denied.rx":
+			return "", false
+		}
+		return name, true
+	}
+	opts := []vm.Option{
+		vm.Output(vm.NewVT100Terminal(b, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.IncludePath("testdata/library", "testdata"),
+		vm.Includes(hook),
+		vm.VirtualIncludes(map[string][]byte{"virtual.rx": []byte("1 2 + putn\n")}),
+	}
+	_, err := runImageFile(retroImage, imageBits, append(opts,
+		vm.Input(strings.NewReader("\"include.rx\" :include space \"alias.rx\" :include bye\n")))...)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if out := b.String(); !strings.Contains(out, "putn 42\n") || !strings.Contains(out, "putn 3\n") {
+		t.Errorf("Unexpected output: %q", out)
+	}
+
+	for _, name := range []string{"denied.rx", "../testdata/include.rx", "missing.rx"} {
+		_, err = runImageFile(retroImage, imageBits, append(opts,
+			vm.Input(strings.NewReader("\""+name+"\" :include\n")))...)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	img, err := asm.Assemble("Notify", strings.NewReader(`
+		:0 wait 10 in dup 0 !jump 1+ drop jump 0-
+		:1 wait 10 in`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Notify(1024, 1); errors.Cause(err) != vm.ErrPortOutOfRange {
+		t.Errorf("Expected ErrPortOutOfRange, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		i.Notify(10, 7)
+		i.Notify(10, 8)
+	}()
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Notify", 8, int(i.Pop()))
+	assertEqualI(t, "Notify", 7, int(i.Pop()))
+}
+
+func TestSyncPorts(t *testing.T) {
+	img, err := asm.Assemble("SyncPorts", strings.NewReader(`
+		0 :0 drop 10 in dup 0 =jump 0-
+		1+ 11 out`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "SyncPorts", vm.SyncPorts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan vm.Cell)
+	go func() {
+		i.WritePort(10, 41)
+		for {
+			if v := i.ReadPort(11); v != 0 {
+				done <- v
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "SyncPorts", 42, int(<-done))
+}
+
+func TestSyncPorts_wait(t *testing.T) {
+	img, err := asm.Assemble("SyncPortsWait", strings.NewReader(`
+		10000 :0 -5 5 out 0 0 out wait 5 in drop 1- 0; jump 0-`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "SyncPortsWait", vm.SyncPorts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				i.ReadPort(5)
+				i.ReadPort(8)
+			}
+		}
+	}()
+	err = i.Run()
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	// out of range ports
+	i.WritePort(-1, 1)
+	i.WritePort(vm.Cell(len(i.Ports)), 1)
+	assertEqualI(t, "ReadPort", 0, int(i.ReadPort(vm.Cell(len(i.Ports)))))
+}
+
+func TestInputEOF(t *testing.T) {
+	const code = `jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:start getc getc getc getc`
+	var called int
+	onEOF := vm.OnInputEOF(func(i *vm.Instance) io.Reader {
+		called++
+		if called == 1 {
+			return strings.NewReader("c")
+		}
+		if called == 2 {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				i.PushInput(strings.NewReader("d"))
+			}()
+		}
+		return nil
+	})
+	i, err := runAsmImage(code, "InputEOF",
+		vm.Input(strings.NewReader("ab")), vm.InputEOF(vm.EOFBlock), onEOF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "InputEOF", "[97 98 99 100]", fmt.Sprint(i.Data()))
+	assertEqualI(t, "InputEOF", 2, called)
+
+	_, err = runAsmImage(code, "InputEOF", vm.Input(strings.NewReader("ab")))
+	if errors.Cause(err) != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	_, err = runAsmImage(code, "InputEOF", vm.InputEOF(vm.EOFPolicy(-1)))
+	if err == nil {
+		t.Error("Expected error for invalid policy")
+	}
+}
+
+func TestPushInput_concurrent(t *testing.T) {
+	img, err := asm.Assemble("PushInput", strings.NewReader(`jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:start getc getc getc`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	i, err := vm.New(img, "PushInput", vm.Input(pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stack an empty reader on top of the pipe so that the VM blocks in a
+	// multi reader.
+	i.PushInput(strings.NewReader(""))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		i.PushInput(strings.NewReader("b"))
+		i.PushInput(strings.NewReader("c"))
+		pw.Write([]byte("a"))
+	}()
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "PushInput", "[97 99 98]", fmt.Sprint(i.Data()))
+}
+
+func TestWriteInput(t *testing.T) {
+	img, err := asm.Assemble("WriteInput", strings.NewReader(`jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:start getc getc getc getc getc`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "WriteInput",
+		vm.Input(strings.NewReader("a")), vm.InputEOF(vm.EOFBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.WriteInput([]byte("b"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		i.WriteInput([]byte("cd"))
+		time.Sleep(10 * time.Millisecond)
+		i.CloseInput()
+		i.WriteInput([]byte("e"))
+	}()
+	err = i.Run()
+	if errors.Cause(err) != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	assertEqual(t, "WriteInput", "[97 98 99 100]", fmt.Sprint(i.Data()))
+}
+
+func TestInputEOFReply(t *testing.T) {
+	code := `jump start
+		.org 32
+		:getc 1 1 out 0 0 out wait 1 in ;
+		:start getc getc getc`
+	i, err := runAsmImage(code, "InputEOFReply",
+		vm.Input(strings.NewReader("a")), vm.InputEOF(vm.EOFReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "InputEOFReply", "[97 -1 -1]", fmt.Sprint(i.Data()))
+
+	img, err := asm.Assemble("InputEOFReply", strings.NewReader(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = vm.New(img, "InputEOFReply", vm.InputEOF(vm.EOFReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.WriteInput([]byte("a"))
+	i.CloseInput()
+	err = i.Run()
+	if errors.Cause(err) != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	assertEqual(t, "InputEOFReply", "[97]", fmt.Sprint(i.Data()))
+}
+
+func TestTerminals(t *testing.T) {
+	var bufs [3]bytes.Buffer
+	i, err := runAsmImage(`jump start
+		:ui .dat 'u' .dat 'i' .dat 0
+		:foo .dat 'f' .dat 0
+		.org 32
+		:emit 1 2 out 0 0 out wait ;
+		:term 10 out 0 0 out wait 10 in ;
+		:start
+			'a' emit
+			lit ui 1 term dup 2 term drop 'b' emit
+			1 2 term drop 'c' emit
+			3 term
+			lit foo 1 term
+			5 2 term
+			0 2 term drop 'd' emit`, "Terminals",
+		vm.StringCodec(retro.StringCodec),
+		vm.Output(vm.NewVT100Terminal(&bufs[0], nil, nil)),
+		vm.Terminals(10, map[string]vm.Terminal{
+			"ui":  vm.NewVT100Terminal(&bufs[2], nil, nil),
+			"log": vm.NewVT100Terminal(&bufs[1], nil, nil),
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Terminals", "ad c b", bufs[0].String()+" "+bufs[1].String()+" "+bufs[2].String())
+	assertEqual(t, "Terminals", "[2 1 -1 0]", fmt.Sprint(i.Data()))
+}
+
+func TestQueueReplies(t *testing.T) {
+	const code = `1 10 out 0 0 out wait 10 in 0 in 10 in 0 in`
+	h := vm.BindWaitHandler(10, func(i *vm.Instance, v, port vm.Cell) error {
+		i.WaitReply(5, port)
+		i.WaitReply(6, port)
+		i.WaitReply(7, port)
+		return nil
+	})
+	i, err := runAsmImage(code, "QueueReplies", h, vm.QueueReplies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "QueueReplies", "[5 1 6 1]", fmt.Sprint(i.Data()))
+	assertEqualI(t, "QueueReplies", 1, i.PendingReplies(10))
+	assertEqualI(t, "QueueReplies", 7, int(i.Ports[10]))
+	c := i.Clone()
+	assertEqualI(t, "QueueReplies", 1, c.PendingReplies(10))
+
+	// without reply queue, last reply wins
+	i, err = runAsmImage(code, "QueueReplies", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "QueueReplies", "[7 1 0 0]", fmt.Sprint(i.Data()))
+}
+
+func TestEvents(t *testing.T) {
+	q := vm.NewEventQueue(2)
+	if err := q.Post(vm.Event{Type: vm.EventKey, Args: []vm.Cell{'a'}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Post(vm.Event{Type: vm.EventMouse, Args: []vm.Cell{10, 20, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Post(vm.Event{Type: vm.EventTimer}); err != vm.ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Post(vm.Event{Type: vm.EventTimer, Args: []vm.Cell{7}})
+	}()
+	i, err := runAsmImage(`
+		2 10 out 0 0 out wait 10 in
+		1 10 out 0 0 out wait 10 in
+		1 10 out 0 0 out wait 10 in
+		1 10 out 0 0 out wait 10 in
+		3 10 out 0 0 out wait 10 in`, "Events",
+		vm.Events(10, q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []vm.Cell{2, 'a', 1, vm.Cell(vm.EventKey), 10, 20, 1, 3, vm.Cell(vm.EventMouse), 0, 7, 1, vm.Cell(vm.EventTimer)}
+	assertEqual(t, "Events", fmt.Sprint(exp), fmt.Sprint(i.Data()))
+	_, err = runAsmImage("", "Events", vm.Events(1024, q))
+	if errors.Cause(err) != vm.ErrPortOutOfRange {
+		t.Errorf("Expected ErrPortOutOfRange, got %v", err)
+	}
+}
+
+func TestKeyDecoder(t *testing.T) {
+	q := vm.NewEventQueue(0)
+	d := vm.NewKeyDecoder(strings.NewReader("a\x1b[A\x1b[1;5C\x1bOP\x1b[15~\x1b[3;2~\x1b[Z\x1bx\x7f\x1b[?25hé\x1b"))
+	if err := d.Post(q); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][2]vm.Cell{
+		{'a', 0},
+		{vm.Cell(vm.KeyUp), 0},
+		{vm.Cell(vm.KeyRight), vm.Cell(vm.ModCtrl)},
+		{vm.Cell(vm.KeyF1), 0},
+		{vm.Cell(vm.KeyF5), 0},
+		{vm.Cell(vm.KeyDelete), vm.Cell(vm.ModShift)},
+		{'\t', vm.Cell(vm.ModShift)},
+		{'x', vm.Cell(vm.ModAlt)},
+		{vm.Cell(vm.KeyBackspace), 0},
+		{'é', 0},
+		{vm.Cell(vm.KeyEscape), 0},
+	}
+	var code string
+	for range exp {
+		code += "1 10 out 0 0 out wait 10 in drop drop "
+	}
+	i, err := runAsmImage(code, "KeyDecoder", vm.Events(10, q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]vm.Cell
+	data := i.Data()
+	for n := 0; n+1 < len(data); n += 2 {
+		got = append(got, [2]vm.Cell{data[n], data[n+1]})
+	}
+	assertEqual(t, "KeyDecoder", fmt.Sprint(exp), fmt.Sprint(got))
+}
+
+func TestOnSave(t *testing.T) {
+	var saved string
+	hook := func(i *vm.Instance) (vm.Cell, error) {
+		saved = i.ImageFile() + ".1"
+		return -1, nil
+	}
+	i, err := runAsmImage("1 4 out 0 0 out wait 4 in", "testImage", vm.OnSave(hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "OnSave", -1, int(i.Pop()))
+	assertEqual(t, "OnSave", "testImage.1", saved)
+}
+
+func TestSnapshots(t *testing.T) {
+	fn := "testdata/test[Snapshot]"
+	s := &vm.Snapshots{Path: fn, Keep: 2}
+	defer func() {
+		l, _ := s.Versions()
+		for _, v := range l {
+			os.Remove(v)
+		}
+		os.Remove(fn)
+	}()
+	i, err := vm.New([]vm.Cell{1}, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 4; n++ {
+		i.Mem[0] = vm.Cell(n)
+		if err = s.Save(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := s.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Snapshots versions", 2, len(l))
+	if err = s.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+	mem, _, err := vm.Load(fn, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Snapshots rollback", 2, int(mem[0]))
+	if l, _ = s.Versions(); len(l) != 0 {
+		t.Fatalf("Unexpected versions after rollback: %v", l)
+	}
+
+	// failed saves leave the current image untouched
+	err = i.SetOptions(vm.SaveMemImage(func(string, []vm.Cell) error { return errors.New("disk full") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.SaveHook(i); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mem, _, err = vm.Load(fn, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Snapshots failed save", 2, int(mem[0]))
+	if l, _ = s.Versions(); len(l) != 0 {
+		t.Fatalf("Unexpected versions after failed save: %v", l)
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	if vm.CellBits < 64 {
+		t.Skip("64 bits cells required")
+	}
+	img, err := asm.Assemble("ConvertImage", strings.NewReader("1 2 + 4294967296 drop 4294967295 drop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vm.ConvertImage(img, 64, 32, &vm.ConvertOptions{Disassemble: asm.Disassemble})
+	e, ok := err.(*vm.ConvertError)
+	if !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(e.Cells) != 2 || e.Cells[0].Addr != 6 || e.Cells[1].Addr != 9 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(e.Cells[0].Context, "=> 5\t4294967296") {
+		t.Fatalf("Unexpected context: %v", e.Cells[0].Context)
+	}
+	_, err = vm.ConvertImage(img, 64, 32, &vm.ConvertOptions{MaxErrors: 1})
+	if e, ok = err.(*vm.ConvertError); !ok || e.Count != 2 || len(e.Cells) != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(e.Error(), "2 cell(s) do not fit in 32 bits, showing the first 1\n") {
+		t.Fatalf("Unexpected error message: %v", e)
+	}
+	// rewrite 32 bits masks
+	mask := func(mem []vm.Cell, addr int) (vm.Cell, bool) {
+		if int64(mem[addr]) == 0xffffffff {
+			return -1, true
+		}
+		return 0, false
+	}
+	_, err = vm.ConvertImage(img, 64, 32, &vm.ConvertOptions{Rewrite: mask})
+	if e, ok = err.(*vm.ConvertError); !ok || len(e.Cells) != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	img[6] = 0
+	mem, err := vm.ConvertImage(img, 64, 32, &vm.ConvertOptions{Rewrite: mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "ConvertImage", -1, int(mem[9]))
+}
+
+func Test_io_Canvas(t *testing.T) {
+	c := vm.NewCanvas(16, 12)
+	i, err := runAsmImage(`jump start
+		.org 32
+		:cv 6 out 0 0 out wait 6 in drop ;
+		:cap 5 out 0 0 out wait 5 in ;
+		:start
+		-2 cap -3 cap -4 cap
+		12 1 cv
+		1 2 2 cv
+		4 1 cv
+		3 3 2 4 4 cv
+		14 1 cv
+		8 3 4 3 3 cv
+		9 1 cv
+		0 10 16 6 cv
+		10 1 cv
+		13 6 2 8 cv
+		jump end
+		:end`, "io_Canvas", vm.BindCanvas(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Canvas caps", "[-1 16 12]", fmt.Sprint(i.Data()))
+	img := c.Image()
+	for _, p := range []struct {
+		x, y int
+		c    int
+	}{
+		{0, 0, 0}, {1, 2, 12}, {3, 3, 4}, {6, 4, 4}, {7, 4, 0},
+		{8, 3, 14}, {10, 5, 14}, {9, 4, 0}, {0, 10, 9}, {15, 10, 9},
+		{13, 6, 10}, {15, 6, 10}, {12, 8, 10}, {13, 9, 0}, {11, 4, 0},
+	} {
+		if got := img.At(p.x, p.y); got != vm.CanvasPalette[p.c] {
+			t.Errorf("io_Canvas: pixel %d,%d: expected %v, got %v", p.x, p.y, vm.CanvasPalette[p.c], got)
+		}
+	}
+	var b bytes.Buffer
+	if err = c.WriteGIF(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.WritePNG(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = runAsmImage("-2 5 out 0 0 out wait 5 in", "io_Canvas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Canvas no canvas", "[0]", fmt.Sprint(i.Data()))
+}
+
+type testAudio struct {
+	beeps []string
+	pcm   [][]int16
+}
+
+func (a *testAudio) Beep(freq int, d time.Duration) error {
+	a.beeps = append(a.beeps, fmt.Sprintf("%dHz/%v", freq, d))
+	return nil
+}
+
+func (a *testAudio) Play(samples []int16, rate int) error {
+	a.pcm = append(a.pcm, append([]int16(nil), samples...))
+	return nil
+}
+
+func Test_io_Audio(t *testing.T) {
+	var a testAudio
+	i, err := runAsmImage(`jump start
+		.org 32
+		:snd 11 out 0 0 out wait 11 in ;
+		:start
+		440 100 1 snd
+		0 100 1 snd
+		lit pcm 8000 3 2 snd
+		lit pcm 8000 500 2 snd
+		jump end
+		:pcm .dat 100 .dat -40000 .dat 40000
+		:end`, "io_Audio", vm.BindWaitHandler(11, vm.AudioHandler(&a)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Audio replies", "[-1 0 -1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_Audio beeps", "[440Hz/100ms]", fmt.Sprint(a.beeps))
+	assertEqual(t, "io_Audio pcm", "[[100 -32768 32767]]", fmt.Sprint(a.pcm))
+
+	var b bytes.Buffer
+	bell := vm.NewBellAudio(&b)
+	bell.Beep(440, time.Second)
+	bell.Play([]int16{1}, 8000)
+	assertEqual(t, "io_Audio bell", "\a\a", b.String())
+}
+
+func Test_io_PollInput(t *testing.T) {
+	const poll = ":poll 2 1 out 0 0 out wait 1 in ;\n"
+	i, err := runAsmImage("jump start\n.org 32\n"+poll+":start poll poll poll jump end\n:end",
+		"io_PollInput", vm.Input(strings.NewReader("ab")), vm.InputEOF(vm.EOFBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_PollInput", "[97 98 -1]", fmt.Sprint(i.Data()))
+
+	pr, pw := io.Pipe()
+	a := vm.NewAsyncReader(pr)
+	go pw.Write([]byte{'x'})
+	for a.Buffered() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	i, err = runAsmImage("jump start\n.org 32\n"+poll+":start poll poll jump end\n:end",
+		"io_PollInput", vm.Input(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_PollInput async", "[120 -1]", fmt.Sprint(i.Data()))
+	pw.Close()
+	for a.Buffered() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	i.PC = 0
+	if err = i.Run(); errors.Cause(err) != io.EOF {
+		t.Errorf("io_PollInput: expected EOF, got %v", err)
+	}
+}
+
+func Test_io_ReadTimeout(t *testing.T) {
+	const code = "jump start\n.org 32\n:key 3 1 out 0 0 out wait 1 in ;\n:start 30 key 5000 key jump end\n:end"
+
+	check := func(name string, in io.Reader, w io.Writer) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte{'x'})
+		}()
+		start := time.Now()
+		i, err := runAsmImage(code, name, vm.Input(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, name, "[-1 120]", fmt.Sprint(i.Data()))
+		if d := time.Since(start); d < 30*time.Millisecond || d > 2*time.Second {
+			t.Errorf("%s: unexpected duration %v", name, d)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	check("io_ReadTimeout async", vm.NewAsyncReader(pr), pw)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	check("io_ReadTimeout deadline", r, w)
+}
+
+func Test_io_Time(t *testing.T) {
+	code := `jump start
+		.org 32
+		:cap 5 out 0 0 out wait 5 in ;
+		:start
+		-29 cap 500 -31 cap drop -29 cap
+		0 -32 cap 3 -32 cap 8 -32 cap 42 -32 cap
+		jump end
+		:end`
+	i, err := runAsmImage(code, "io_Time", vm.Deterministic(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Time", "[0 1500 2000 0 0 -1]", fmt.Sprint(i.Data()))
+	i, err = runAsmImage(code, "io_Time", vm.Deterministic(0), vm.TimeZone(time.FixedZone("UTC+1", 3600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Time zone", "[0 1500 2000 1 3600 -1]", fmt.Sprint(i.Data()))
+
+	// real clock
+	i, err = runAsmImage("-30 5 out 0 0 out wait 5 in 20 -31 5 out 0 0 out wait 5 in drop -30 5 out 0 0 out wait 5 in", "io_Time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Duration(i.Tos() - i.Nos()); d < 20*time.Millisecond && vm.CellBits == 64 {
+		t.Errorf("io_Time: expected at least 20ms between readings, got %v", d)
+	}
+
+	// clones share the monotonic clock origin
+	img, err := asm.Assemble("io_Time", strings.NewReader("-29 5 out 0 0 out wait 5 in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := i.Clone()
+	if err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if ms := c.Tos(); ms < 0 || ms > 60000 {
+		t.Errorf("io_Time clone: unexpected uptime %dms", ms)
+	}
+
+	// long sleeps are clamped
+	i, err = runAsmImage("7200000 -31 5 out 0 0 out wait 5 in -29 5 out 0 0 out wait 5 in", "io_Time", vm.Deterministic(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Time clamp", "[3600000 3600000]", fmt.Sprint(i.Data()))
+}
+
+func Test_io_Sleep(t *testing.T) {
+	code := "60000 -31 5 out 0 0 out wait 5 in :0 jump 0-"
+	img, err := asm.Assemble("io_Sleep", strings.NewReader(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, i.Stop)
+	start := time.Now()
+	if err = i.Run(); errors.Cause(err) != vm.ErrStopped {
+		t.Fatalf("io_Sleep stop: unexpected error %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("io_Sleep stop: VM stopped after %v", d)
+	}
+	if left := i.Tos(); left <= 0 || left > 60000 {
+		t.Errorf("io_Sleep stop: unexpected time left %dms", left)
+	}
+
+	// deadline
+	i, err = vm.New(img, "", vm.Deadline(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if err = i.Run(); errors.Cause(err) != vm.ErrDeadlineExceeded {
+		t.Fatalf("io_Sleep deadline: unexpected error %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("io_Sleep deadline: VM stopped after %v", d)
+	}
+}
+
+func Test_io_UDP(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer peer.Close()
+	// pick a free port for the VM
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := c.LocalAddr().String()
+	c.Close()
+
+	u := vm.NewUDP()
+	defer u.Close()
+	img, err := asm.Assemble("io_UDP", strings.NewReader(fmt.Sprintf(`jump start
+		.org 32
+		:udp 12 out 0 0 out wait 12 in ;
+		:start
+		lit local 1 udp dup 3 !
+		lit msg 3 lit peer 3 @ 3 udp
+		:1 lit buf 16 3 @ 4 udp dup -1 !jump 2+ drop jump 1-
+		:2
+		lit from 3 @ 5 udp
+		3 @ 2 udp
+		jump end
+		:local .dat %q
+		:peer .dat %q
+		:msg .dat 'h' .dat 'i' .dat 0
+		.org 100 :buf
+		.org 150 :from
+		.org 200 :end`, local, peer.LocalAddr().String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "", vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(12, u.WaitHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- i.Run() }()
+
+	b := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UDP send", "hi\x00", string(b[:n]))
+	assertEqual(t, "io_UDP local", local, from.String())
+	if _, err = peer.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	d := i.Data()
+	assertEqual(t, "io_UDP results", fmt.Sprint([]int{3, 4, len(peer.LocalAddr().String()), -1}), fmt.Sprint(d[1:]))
+	assertEqual(t, "io_UDP recv", "pong", string(retro.StringCodec.Decode(i.Mem, 100)[:4]))
+	assertEqual(t, "io_UDP from", peer.LocalAddr().String(), string(retro.StringCodec.Decode(i.Mem, 150)))
+
+	// disabled
+	i, err = runAsmImage("jump start\n:a .dat 0\n:start lit a 1 12 out 0 0 out wait 12 in", "io_UDP",
+		vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(12, u.WaitHandler), vm.DisableDevices(vm.DevNet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_UDP disabled", "[0]", fmt.Sprint(i.Data()))
+}
+
+func Test_io_Exec(t *testing.T) {
+	for _, c := range []string{"cat", "false"} {
+		if _, err := exec.LookPath(c); err != nil {
+			t.Skip(err)
+		}
+	}
+	e := vm.NewExec("cat", "false")
+	defer e.Close()
+	code := `jump start
+		:cat .dat "cat"
+		:false .dat "false"
+		:ls .dat "ls -l"
+		:p .dat 0
+		.org 64
+		:exec 10 out 0 0 out wait 10 in ;
+		:start
+			lit cat 1 exec lit p !
+			104 lit p @ 3 exec
+			105 lit p @ 3 exec
+			lit p @ 2 exec
+			lit p @ 4 exec
+			lit p @ 4 exec
+			lit p @ 4 exec
+			lit p @ 5 exec
+			lit false 1 exec 5 exec
+			lit ls 1 exec`
+	i, err := runAsmImage(code, "io_Exec", vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(10, e.WaitHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Exec", "[1 1 -1 104 105 -1 0 1 0]", fmt.Sprint(i.Data()))
+
+	// disabled
+	i, err = runAsmImage(code, "io_Exec", vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(10, e.WaitHandler),
+		vm.DisableDevices(vm.DevExec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Exec disabled", "[0 0 0 -1 -1 -1 -1 -1 0]", fmt.Sprint(i.Data()))
+
+	// no allowed commands
+	none := vm.NewExec()
+	defer none.Close()
+	i, err = runAsmImage(code, "io_Exec", vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(10, none.WaitHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Exec none", "[0 0 0 -1 -1 -1 -1 -1 0]", fmt.Sprint(i.Data()))
+
+	// any command
+	all := vm.NewExec(vm.AllowAnyCommand)
+	defer all.Close()
+	i, err = runAsmImage(`jump start
+		:true .dat "true"
+		.org 32
+		:exec 10 out 0 0 out wait 10 in ;
+		:start lit true 1 exec 5 exec`, "io_Exec", vm.StringCodec(retro.StringCodec), vm.BindWaitHandler(10, all.WaitHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Exec any", "[0]", fmt.Sprint(i.Data()))
+}
+
+func Test_io_Mouse(t *testing.T) {
+	var m vm.Mouse
+	m.Move(12, 34)
+	m.SetButton(true)
+	i, err := runAsmImage(`jump start
+		.org 32
+		:mouse 7 out 0 0 out wait 7 in drop ;
+		:start
+		-7 5 out 0 0 out wait 5 in
+		1 mouse 2 mouse
+		jump end
+		:end`, "io_Mouse", vm.BindMouse(&m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Mouse", "[-1 12 34 -1]", fmt.Sprint(i.Data()))
+
+	// mouse provided by the output terminal
+	term := &mouseTerminal{Terminal: vm.NewVT100Terminal(bytes.NewBuffer(nil), nil, nil)}
+	term.Move(5, 6)
+	i, err = runAsmImage(`-7 5 out 0 0 out wait 5 in 1 7 out 0 0 out wait 7 in drop`, "io_Mouse", vm.Output(term))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Mouse terminal", "[-1 5 6]", fmt.Sprint(i.Data()))
+
+	// no mouse
+	i, err = runAsmImage(`-7 5 out 0 0 out wait 5 in 1 7 out 0 0 out wait 7 in`, "io_Mouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Mouse disabled", "[0 1]", fmt.Sprint(i.Data()))
+}
+
+type mouseTerminal struct {
+	vm.Terminal
+	vm.Mouse
+}
+
+func TestImageFormats(t *testing.T) {
+	mem := []vm.Cell{0, 1, -1, 127, -128, 42}
+	for _, f := range []string{"raw:8", "raw:16:be", "raw:32", "raw:64:be", "ihex:8", "ihex:16", "ihex:32:be", "ihex:64"} {
+		fm, err := vm.ParseFormat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err = vm.WriteImage(&b, mem, fm); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		m, err := vm.ReadImage(&b, fm)
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		assertEqual(t, f, fmt.Sprint(mem), fmt.Sprint(m))
+	}
+
+	var b bytes.Buffer
+	err := vm.WriteImage(&b, []vm.Cell{1, 0x203}, vm.Format{Encoding: vm.EncodingIntelHex, Bits: 16, BigEndian: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ihex", ":0400000000010203F6\n:00000001FF\n", b.String())
+
+	if err = vm.WriteImage(&b, []vm.Cell{128}, vm.Format{Bits: 8}); err == nil {
+		t.Error("expected error for value out of range")
+	}
+	if _, err = vm.ReadImage(strings.NewReader(":0400000000010203F7\n:00000001FF\n"), vm.Format{Encoding: vm.EncodingIntelHex}); err == nil {
+		t.Error("expected checksum error")
+	}
+	for _, f := range []string{"foo", "raw:12", "ihex:x"} {
+		if _, err = vm.ParseFormat(f); err == nil {
+			t.Errorf("ParseFormat(%q): expected error", f)
+		}
+	}
+}
+
+func TestImageHeader(t *testing.T) {
+	mem := []vm.Cell{0, 1, -1, 127, -128, 42}
+	syms := vm.NewSymbolTable(vm.Symbol{Addr: 1, Name: "foo"}, vm.Symbol{Addr: 4, Name: "bar"})
+	f := vm.Format{Bits: 16, BigEndian: true, Header: &vm.ImageHeader{Entry: 3, Symbols: syms}}
+	assertEqual(t, "ImageHeader format", "raw:16:be:hdr", f.String())
+	fn := "testdata/testHeader"
+	if err := vm.SaveFormat(fn, mem, f); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn)
+
+	// the cell size given to Load must be ignored
+	m, n, err := vm.Load(fn, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "ImageHeader cells", len(mem), n)
+	assertEqual(t, "ImageHeader Load", fmt.Sprint(mem), fmt.Sprint(m[:n]))
+	assertEqualI(t, "ImageHeader size", 10, len(m))
+	if m, _, err = vm.LoadFormat(fn, 0, vm.Format{Bits: 8}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ImageHeader LoadFormat", fmt.Sprint(mem), fmt.Sprint(m))
+
+	h, err := vm.LoadHeader(fn, vm.Format{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "ImageHeader entry", 3, int(h.Entry))
+	assertEqualI(t, "ImageHeader symbols", 2, h.Symbols.Len())
+	if sym, off, _ := h.Symbols.Lookup(5); sym.Name != "bar" || off != 1 {
+		t.Errorf("ImageHeader: unexpected symbol %v+%d", sym, off)
+	}
+	if h, err = vm.LoadHeader(retroImage, vm.Format{}); h != nil || err != nil {
+		t.Errorf("ImageHeader: unexpected header %v, error %v", h, err)
+	}
+
+	// Intel HEX
+	var b bytes.Buffer
+	f.Encoding = vm.EncodingIntelHex
+	if err = vm.WriteImage(&b, mem, f); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = vm.ReadImage(&b, vm.Format{Encoding: vm.EncodingIntelHex}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ImageHeader ihex", fmt.Sprint(mem), fmt.Sprint(m))
+
+	// truncated image
+	b.Reset()
+	f.Encoding = vm.EncodingRaw
+	if err = vm.WriteImage(&b, mem, f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vm.ReadImage(bytes.NewReader(b.Bytes()[:b.Len()-1]), vm.Format{}); err == nil {
+		t.Error("expected error for truncated image")
+	}
+}
+
+func TestCompressImage(t *testing.T) {
+	img, _, err := vm.Load(retroImage, 0, imageBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mem := range [][]vm.Cell{img, {}, {1}, {1, 1, 1}, {0, 0, 1, 2, 2, 2, 2, 3}} {
+		packed := vm.CompressImage(mem)
+		exp := vm.ExpandImage(packed)
+		if len(exp) != len(mem) {
+			t.Fatalf("CompressImage: expanded size %d != %d", len(exp), len(mem))
+		}
+		for n := range mem {
+			if mem[n] != exp[n] {
+				t.Fatalf("CompressImage: mismatch at %d: %d != %d", n, exp[n], mem[n])
+			}
+		}
+	}
+	assertEqual(t, "CompressImage", "[2 0 0 -4 2 1 3]",
+		fmt.Sprint(vm.CompressImage([]vm.Cell{0, 0, 2, 2, 2, 2, 3})))
+}
+
+func TestExportImage(t *testing.T) {
+	var b bytes.Buffer
+	err := vm.ExportImage(&b, []vm.Cell{1, 2, 3}, &vm.ExportOptions{Package: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "ExportImage", "// Code generated by ngaro; DO NOT EDIT.\n\npackage foo\n\n"+
+		"import \"github.com/db47h/ngaro/vm\"\n\n"+
+		"// image is a 3 cells memory image.\nvar image = []vm.Cell{\n\t1, 2, 3,\n}\n", b.String())
+
+	b.Reset()
+	err = vm.ExportImage(&b, []vm.Cell{7, 7, 7, 7}, &vm.ExportOptions{Format: vm.ExportC, Name: "img", Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); !strings.Contains(s, "#define IMG_SIZE 4\n") ||
+		!strings.Contains(s, "static const int32_t img_packed[] = {\n\t-4, 7,\n};") ||
+		!strings.Contains(s, "static void img_expand(int32_t *dst)") {
+		t.Errorf("ExportImage: unexpected C output:\n%s", s)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var journal, out1, out2 bytes.Buffer
+	prog := ": pEnv here dup push swap getEnv cr pop puts ; \"PATH\" pEnv time putn bye\n"
+	_, err := runImageFile(retroImage, imageBits,
+		vm.Output(vm.NewVT100Terminal(&out1, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.Input(strings.NewReader(prog)),
+		vm.Record(&journal))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// replay with a different environment and no input
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "/nowhere")
+	defer os.Setenv("PATH", path)
+	_, err = runImageFile(retroImage, imageBits,
+		vm.Output(vm.NewVT100Terminal(&out2, nil, nil)),
+		vm.StringCodec(retro.StringCodec),
+		vm.Replay(&journal))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqual(t, "RecordReplay", out1.String(), out2.String())
+}
+
+func TestReplay_badLength(t *testing.T) {
+	// env query entry (kind 4) with a huge length
+	var b [binary.MaxVarintLen64]byte
+	journal := append([]byte{4}, b[:binary.PutVarint(b[:], 1<<40)]...)
+	_, err := runAsmImage(`jump start
+		:name .dat "PATH"
+		.org 32
+		:start lit name 1000 -10 5 out 0 0 out wait`,
+		"Replay_badLength",
+		vm.StringCodec(retro.StringCodec),
+		vm.Replay(bytes.NewReader(journal)))
+	if errors.Cause(err) != vm.ErrJournal {
+		t.Fatalf("Expected ErrJournal, got %v", err)
+	}
+}
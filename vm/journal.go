@@ -0,0 +1,159 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrJournal is the root cause of errors returned by Run when a replay
+// journal does not match the execution being replayed.
+var ErrJournal = errors.New("journal mismatch")
+
+// maxJournalBytes is the maximum length of byte entries in journals.
+const maxJournalBytes = 1 << 20
+
+// journal entry kinds.
+const (
+	jInput byte = iota + 1
+	jFile
+	jTime
+	jEnv
+	jConsole
+	jRand
+)
+
+// journal records or replays nondeterministic inputs.
+type journal struct {
+	replay bool
+	w      io.Writer
+	r      *bufio.Reader
+	buf    [binary.MaxVarintLen64 + 1]byte
+}
+
+// Record configures the VM to record all nondeterministic inputs into the
+// journal w: bytes read from port 1, results of file operations on port 4,
+// time, environment, console size and random number queries on port 5.
+//
+// The journal can be replayed with Replay. Writes to w are not buffered.
+//
+// Read timeouts on port 1 are recorded as their outcome, so they replay
+// identically. Other sources of nondeterminism are not recorded, and programs
+// using them diverge on replay: values sent with Notify, events posted to an
+// EventQueue, and the results of the UDP and Exec devices.
+func Record(w io.Writer) Option {
+	return func(i *Instance) error {
+		i.journal = &journal{w: w}
+		return nil
+	}
+}
+
+// Replay configures the VM to replay a journal recorded with Record. All
+// nondeterministic inputs will be read from the journal instead of their
+// actual source: input readers are ignored, file operations on port 4 are not
+// executed and only their recorded results are returned to the VM.
+//
+// If the program being replayed diverges from the journal, Run will return an
+// error whose root cause is ErrJournal. If the end of the journal is reached,
+// Run will return io.EOF.
+func Replay(r io.Reader) Option {
+	return func(i *Instance) error {
+		i.journal = &journal{replay: true, r: bufio.NewReader(r)}
+		return nil
+	}
+}
+
+func (j *journal) writeCell(kind byte, v Cell) error {
+	j.buf[0] = kind
+	n := binary.PutVarint(j.buf[1:], int64(v))
+	_, err := j.w.Write(j.buf[:n+1])
+	return errors.Wrap(err, "journal write failed")
+}
+
+func (j *journal) readKind(kind byte) error {
+	k, err := j.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if k != kind {
+		return errors.Wrapf(ErrJournal, "expected entry kind %d, got %d", kind, k)
+	}
+	return nil
+}
+
+func (j *journal) readCell(kind byte) (Cell, error) {
+	if err := j.readKind(kind); err != nil {
+		return 0, err
+	}
+	v, err := binary.ReadVarint(j.r)
+	if err != nil {
+		return 0, errors.Wrap(err, "journal read failed")
+	}
+	return Cell(v), nil
+}
+
+// nondetCell returns the result of f and records it if recording. When
+// replaying, f is not called and the recorded value is returned instead.
+func (i *Instance) nondetCell(kind byte, f func() (Cell, error)) (Cell, error) {
+	j := i.journal
+	if j == nil {
+		return f()
+	}
+	if j.replay {
+		return j.readCell(kind)
+	}
+	v, err := f()
+	if e := j.writeCell(kind, v); e != nil && err == nil {
+		err = e
+	}
+	return v, err
+}
+
+// nondetBytes works like nondetCell for byte slices.
+func (i *Instance) nondetBytes(kind byte, f func() []byte) ([]byte, error) {
+	j := i.journal
+	if j == nil {
+		return f(), nil
+	}
+	if j.replay {
+		n, err := j.readCell(kind)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > maxJournalBytes {
+			return nil, errors.Wrapf(ErrJournal, "invalid entry length %d", n)
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(j.r, b); err != nil {
+			return nil, errors.Wrap(err, "journal read failed")
+		}
+		return b, nil
+	}
+	b := f()
+	if len(b) > maxJournalBytes {
+		return b, errors.Errorf("journal entry too long (%d bytes)", len(b))
+	}
+	if err := j.writeCell(kind, Cell(len(b))); err != nil {
+		return b, err
+	}
+	_, err := j.w.Write(b)
+	return b, errors.Wrap(err, "journal write failed")
+}
@@ -0,0 +1,222 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Key is a key code as decoded by KeyDecoder. Characters are reported as their
+// Unicode code point, and special keys as negative values.
+type Key Cell
+
+// Special keys.
+const (
+	KeyUp Key = -1 - iota
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyHome
+	KeyEnd
+	KeyInsert
+	KeyDelete
+	KeyPageUp
+	KeyPageDown
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+	KeyBackspace
+	KeyEscape
+)
+
+// KeyMod is a bitmask of modifier keys.
+type KeyMod Cell
+
+// Modifier keys.
+const (
+	ModShift KeyMod = 1 << iota
+	ModAlt
+	ModCtrl
+	ModMeta
+)
+
+// csiKeys maps the final byte of CSI and SS3 sequences to keys.
+var csiKeys = map[byte]Key{
+	'A': KeyUp,
+	'B': KeyDown,
+	'C': KeyRight,
+	'D': KeyLeft,
+	'H': KeyHome,
+	'F': KeyEnd,
+	'P': KeyF1,
+	'Q': KeyF2,
+	'R': KeyF3,
+	'S': KeyF4,
+}
+
+// tildeKeys maps the first parameter of CSI n ~ sequences to keys.
+var tildeKeys = map[int]Key{
+	1: KeyHome, 2: KeyInsert, 3: KeyDelete, 4: KeyEnd, 5: KeyPageUp, 6: KeyPageDown,
+	7: KeyHome, 8: KeyEnd, 11: KeyF1, 12: KeyF2, 13: KeyF3, 14: KeyF4, 15: KeyF5,
+	17: KeyF6, 18: KeyF7, 19: KeyF8, 20: KeyF9, 21: KeyF10, 23: KeyF11, 24: KeyF12,
+}
+
+// KeyDecoder decodes the input of a raw terminal into structured key events:
+// UTF-8 characters, and ANSI/xterm escape sequences for cursor, editing and
+// function keys, with modifiers.
+//
+// Control characters are reported as is (e.g. Ctrl+A is reported as key 1
+// without modifiers), except DEL (127) which is reported as KeyBackspace. An
+// escape character followed by a character is reported as that character with
+// ModAlt, and Shift+Tab as '\t' with ModShift. Since there is no reliable way
+// to tell the Escape key from the start of an escape sequence, an escape
+// character is reported as KeyEscape if no input immediately follows it.
+// Unknown escape sequences are ignored.
+type KeyDecoder struct {
+	r *bufio.Reader
+}
+
+// NewKeyDecoder returns a new KeyDecoder reading from r.
+func NewKeyDecoder(r io.Reader) *KeyDecoder {
+	return &KeyDecoder{bufio.NewReader(r)}
+}
+
+// ReadKey reads and decodes the next key.
+func (d *KeyDecoder) ReadKey() (key Key, mods KeyMod, err error) {
+	for {
+		c, _, err := d.r.ReadRune()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch c {
+		case 127:
+			return KeyBackspace, 0, nil
+		case 27:
+			if d.r.Buffered() == 0 {
+				return KeyEscape, 0, nil
+			}
+			key, mods, ok, err := d.escape()
+			if err != nil || ok {
+				return key, mods, err
+			}
+			// unknown sequence
+			continue
+		case utf8.RuneError:
+			continue
+		}
+		return Key(c), 0, nil
+	}
+}
+
+// escape decodes the escape sequence following an escape character.
+func (d *KeyDecoder) escape() (key Key, mods KeyMod, ok bool, err error) {
+	c, _, err := d.r.ReadRune()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	switch c {
+	case '[':
+		return d.csi()
+	case 'O':
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		key, ok = csiKeys[b]
+		return key, 0, ok, nil
+	case 27:
+		// Alt+Escape
+		return KeyEscape, ModAlt, true, nil
+	case 127:
+		return KeyBackspace, ModAlt, true, nil
+	}
+	return Key(c), ModAlt, true, nil
+}
+
+// csi decodes a CSI sequence.
+func (d *KeyDecoder) csi() (key Key, mods KeyMod, ok bool, err error) {
+	var params []byte
+	var b byte
+	for {
+		if b, err = d.r.ReadByte(); err != nil {
+			return 0, 0, false, err
+		}
+		if b < 0x20 || b > 0x3f {
+			break
+		}
+		params = append(params, b)
+	}
+	var p []int
+	if len(params) > 0 {
+		for _, s := range strings.Split(string(params), ";") {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				// private or intermediate bytes
+				return 0, 0, false, nil
+			}
+			p = append(p, n)
+		}
+	}
+	// xterm modifiers are encoded as 1 + bitmask in the second parameter
+	if len(p) > 1 && p[1] > 1 {
+		mods = KeyMod(p[1] - 1)
+	}
+	switch b {
+	case '~':
+		if len(p) == 0 {
+			return 0, 0, false, nil
+		}
+		key, ok = tildeKeys[p[0]]
+		return key, mods, ok, nil
+	case 'Z':
+		return '\t', mods | ModShift, true, nil
+	}
+	key, ok = csiKeys[b]
+	return key, mods, ok, nil
+}
+
+// Post reads and decodes keys until an error occurs, and posts them to the
+// event queue q as EventKey events with two arguments: the key code and the
+// modifiers bitmask. Keys that do not fit in the queue are dropped. Post
+// returns nil when the end of the input is reached.
+//
+// Post is meant to be run in its own goroutine.
+func (d *KeyDecoder) Post(q *EventQueue) error {
+	for {
+		key, mods, err := d.ReadKey()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		q.Post(Event{Type: EventKey, Args: []Cell{Cell(key), Cell(mods)}})
+	}
+}
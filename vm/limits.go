@@ -0,0 +1,291 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDeadlineExceeded is the root cause of the error returned by Run when the
+// time budget set with Deadline is exceeded.
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+// Limits holds per instance resource limits. A zero value means no limit.
+type Limits struct {
+	MaxMemCells    int   // maximum memory image size in cells
+	MaxOpenFiles   int   // maximum number of simultaneously open files
+	MaxOutputBytes int64 // maximum number of bytes written to the output Terminal
+	MaxInputBytes  int64 // maximum number of bytes read from input
+	// MaxInstructions is the maximum number of instructions executed per call
+	// to Run.
+	MaxInstructions int64
+}
+
+// LimitError is returned when a resource limit set with ResourceLimits is
+// exceeded.
+type LimitError struct {
+	Resource string // name of the Limits field
+	Limit    int64  // limit value
+}
+
+func (e *LimitError) Error() string {
+	return e.Resource + " limit exceeded (" + strconv.FormatInt(e.Limit, 10) + ")"
+}
+
+// ResourceLimits sets resource limits for the instance. When a limit is
+// exceeded, Run returns an error whose root cause is a *LimitError.
+//
+// The memory limit is checked when the option is set (so it should be set after
+// any option that changes the memory size).
+func ResourceLimits(l Limits) Option {
+	return func(i *Instance) error {
+		i.limits = l
+		i.updateInsLimit()
+		return i.checkMemLimit(len(i.Mem))
+	}
+}
+
+// MaxInstructions sets the maximum number of instructions executed per call to
+// Run. Once n instructions have been executed, Run returns an error whose root
+// cause is a *LimitError with Resource set to "MaxInstructions". The PC then
+// points to the next instruction to execute, so the VM can be resumed by
+// calling Run again.
+//
+// This is a shorthand for setting the MaxInstructions field of Limits without
+// changing other limits.
+func MaxInstructions(n int64) Option {
+	return func(i *Instance) error {
+		i.limits.MaxInstructions = n
+		i.updateInsLimit()
+		return nil
+	}
+}
+
+// Deadline sets a wall-clock time budget for each call to Run. Once d has
+// elapsed since Run was called, Run returns an error whose root cause is
+// ErrDeadlineExceeded. As with MaxInstructions, the PC then points to the next
+// instruction to execute, so the VM can be resumed by calling Run again, with
+// a new budget. A zero or negative duration disables the deadline.
+//
+// The deadline is checked along with asynchronous control requests (every 1024
+// VM ticks at most), so it can be changed with SetOptions between calls to Run
+// with no overhead on execution. A VM blocked in an I/O handler (like waiting
+// for input) will only return once the handler returns.
+func Deadline(d time.Duration) Option {
+	return func(i *Instance) error {
+		i.deadline = d
+		return nil
+	}
+}
+
+// checkDeadline returns ErrDeadlineExceeded if the deadline set for the
+// current call to Run has passed.
+func (i *Instance) checkDeadline() error {
+	if i.deadline > 0 && !time.Now().Before(i.runEnd) {
+		return errors.WithStack(ErrDeadlineExceeded)
+	}
+	return nil
+}
+
+// MaxCallDepth caps the depth of the address stack to n cells. Calls (or
+// pushes to the address stack) beyond that depth make Run fail with a
+// *RuntimeError whose Err field is ErrCallDepthExceeded and whose error message
+// includes the top of the address stack, i.e. the addresses of the last calls.
+//
+// This is useful to get an intelligible diagnostic on infinite recursion. Since
+// the limit is enforced by sizing the address stack, MaxCallDepth overrides any
+// previous AddressSize option and vice versa. It will fail if the current
+// address stack is deeper than n.
+func MaxCallDepth(n int) Option {
+	return func(i *Instance) error {
+		if n <= 0 {
+			return errors.Errorf("invalid call depth %d", n)
+		}
+		if err := AddressSize(n)(i); err != nil {
+			return err
+		}
+		i.callDepth = n
+		return nil
+	}
+}
+
+// updateInsLimit updates the instruction count at which Run checks the
+// instruction limit.
+func (i *Instance) updateInsLimit() {
+	if m := i.limits.MaxInstructions; m > 0 {
+		i.insLimit = m
+	} else {
+		i.insLimit = -1
+	}
+}
+
+// checkMemLimit returns a *LimitError if size exceeds the memory limit.
+func (i *Instance) checkMemLimit(size int) error {
+	if m := i.limits.MaxMemCells; m > 0 && size > m {
+		return &LimitError{"MaxMemCells", int64(m)}
+	}
+	return nil
+}
+
+// checkInsLimit returns a *LimitError if the instruction limit is exceeded.
+func (i *Instance) checkInsLimit() error {
+	if m := i.limits.MaxInstructions; m > 0 && i.insCount >= m {
+		return &LimitError{"MaxInstructions", m}
+	}
+	return nil
+}
+
+// checkFileLimit returns a *LimitError if opening a new file would exceed the
+// open files limit.
+func (i *Instance) checkFileLimit() error {
+	if m := i.limits.MaxOpenFiles; m > 0 && i.nFiles >= m {
+		return &LimitError{"MaxOpenFiles", int64(m)}
+	}
+	return nil
+}
+
+// countOutput adds n bytes to the output counter and returns a *LimitError if
+// the output limit is exceeded.
+func (i *Instance) countOutput(n int) error {
+	i.outBytes += int64(n)
+	if m := i.limits.MaxOutputBytes; m > 0 && i.outBytes > m {
+		return &LimitError{"MaxOutputBytes", m}
+	}
+	return nil
+}
+
+// countInput adds n bytes to the input counter and returns a *LimitError if
+// the input limit is exceeded.
+func (i *Instance) countInput(n int) error {
+	i.inBytes += int64(n)
+	if m := i.limits.MaxInputBytes; m > 0 && i.inBytes > m {
+		return &LimitError{"MaxInputBytes", m}
+	}
+	return nil
+}
+
+// AutoGrowMemory enables automatic growth of the memory image: fetching from or
+// storing to an address beyond the end of the memory image extends it, up to
+// maxCells cells, instead of failing with ErrMemOutOfRange. New cells are
+// initialized to 0. A value of 0 or less disables automatic growth.
+//
+// Growth is also bound by the MaxMemCells resource limit, if any. Note that
+// growing the memory image reallocates Instance.Mem, so slices of the previous
+// image (as returned by RegionMem) are not updated.
+func AutoGrowMemory(maxCells int) Option {
+	return func(i *Instance) error {
+		i.growMax = maxCells
+		return nil
+	}
+}
+
+// grow grows the memory image so that addr is a valid address. It returns a
+// *RuntimeError if this is not possible.
+func (i *Instance) grow(addr Cell) error {
+	if addr < 0 || int64(addr) >= int64(i.growMax) {
+		return i.newRuntimeError(ErrMemOutOfRange, addr)
+	}
+	sz := 2 * len(i.Mem)
+	if sz <= int(addr) {
+		sz = int(addr) + 1
+	}
+	if sz > i.growMax {
+		sz = i.growMax
+	}
+	if m := i.limits.MaxMemCells; m > 0 && sz > m {
+		if int(addr) >= m {
+			return i.checkMemLimit(int(addr) + 1)
+		}
+		sz = m
+	}
+	mem := make([]Cell, sz)
+	copy(mem, i.Mem)
+	i.Mem = mem
+	return nil
+}
+
+// AutoGrowAddressStack enables automatic growth of the address stack: when the
+// address stack is full, its size is doubled, up to maxDepth cells, instead of
+// failing with ErrReturnStackOverflow. A value of 0 or less disables automatic
+// growth.
+//
+// This lets deeply recursive programs run with a small initial address stack
+// while still catching runaway recursion. If a call depth limit is set with
+// MaxCallDepth, the address stack never grows beyond that limit.
+func AutoGrowAddressStack(maxDepth int) Option {
+	return func(i *Instance) error {
+		i.rGrowMax = maxDepth
+		return nil
+	}
+}
+
+// GrowableStacks sets the size of both the data and address stacks to initial
+// cells, and lets them grow on demand up to max cells: when a stack is full, its
+// size is doubled instead of failing with ErrStackOverflow or
+// ErrReturnStackOverflow. This lets deeply recursive programs run without
+// allocating large stacks up front.
+//
+// GrowableStacks overrides any previous DataSize, AddressSize, MaxCallDepth or
+// AutoGrowAddressStack option, and later ones override it.
+func GrowableStacks(initial, max int) Option {
+	return func(i *Instance) error {
+		if initial <= 0 || max < initial {
+			return errors.Errorf("invalid stack sizes: initial %d, max %d", initial, max)
+		}
+		if err := DataSize(initial)(i); err != nil {
+			return err
+		}
+		if err := AddressSize(initial)(i); err != nil {
+			return err
+		}
+		i.dGrowMax, i.rGrowMax = max, max
+		return nil
+	}
+}
+
+// growData grows the data stack if allowed and reports whether it did.
+func (i *Instance) growData() bool {
+	size := len(i.data) - 1
+	if size >= i.dGrowMax {
+		return false
+	}
+	if size *= 2; size > i.dGrowMax || size <= 0 {
+		size = i.dGrowMax
+	}
+	i.data = resizeStack(i.data, size)
+	return true
+}
+
+// growAddress grows the address stack if allowed and reports whether it did.
+func (i *Instance) growAddress() bool {
+	max := i.rGrowMax
+	if i.callDepth > 0 && i.callDepth < max {
+		max = i.callDepth
+	}
+	size := len(i.address) - 1
+	if size >= max {
+		return false
+	}
+	if size *= 2; size > max || size <= 0 {
+		size = max
+	}
+	i.address = resizeStack(i.address, size)
+	return true
+}
@@ -0,0 +1,332 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// LineEditor is a line editing input layer for interactive sessions with the
+// terminal in raw mode. It reads keys from an input, lets the user edit the
+// current line, and delivers it to the VM once Enter is pressed:
+//
+//	e := vm.NewLineEditor(vm.NewAsyncReader(os.Stdin), output)
+//	i, err := vm.New(mem, imageFile,
+//		vm.Output(output),
+//		vm.Input(e))
+//
+// The following keys are supported:
+//
+//	Left, Ctrl-B	move the cursor one character left
+//	Right, Ctrl-F	move the cursor one character right
+//	Home, Ctrl-A	move the cursor to the start of the line
+//	End, Ctrl-E	move the cursor to the end of the line
+//	Backspace	delete the character before the cursor
+//	Delete		delete the character under the cursor
+//	Ctrl-D		delete the character under the cursor, or end the input on an empty line
+//	Ctrl-K		kill the text from the cursor to the end of the line
+//	Ctrl-U		kill the text from the start of the line to the cursor
+//	Ctrl-W		kill the word before the cursor
+//	Ctrl-Y		yank the last killed text
+//	Up, Ctrl-P	recall the previous line from the history
+//	Down, Ctrl-N	recall the next line from the history
+//
+// Non-empty lines are added to the history once delivered, unless identical to
+// the previous one. The history keeps the last HistorySize lines and can be
+// saved and restored with WriteHistory and ReadHistory.
+//
+// Characters are edited as Unicode code points, so backspace deletes whole
+// multi-byte characters. Other control characters are ignored.
+//
+// The line being edited is displayed on the output with VT100 escape
+// sequences, assuming one column per character. When the line is delivered, it
+// is erased from the output since programs like the Retro listener echo their
+// input. Ctrl-D on an empty line is delivered as is (ASCII 4).
+//
+// Programs reading keys one at a time, like games, only get them once the
+// line is complete, so the line editor should only be used for listeners.
+//
+// All methods must be called from the goroutine running the VM. Since the
+// VM polls for input with the Buffered method, which only processes the keys
+// that can be read without blocking, the input should be an AsyncReader.
+type LineEditor struct {
+	src  io.Reader
+	r    *bufio.Reader
+	w    io.Writer
+	line []rune
+	pos  int
+	kill []rune
+	esc  []rune // escape sequence being read
+	out  []byte // line being delivered
+	err  error
+	hist []string
+	hpos int    // position in the history, len(hist) for the line being edited
+	cur  []rune // line being edited while browsing the history
+}
+
+// HistorySize is the maximum number of lines kept in the LineEditor history.
+const HistorySize = 1000
+
+// NewLineEditor returns a new LineEditor reading keys from r and displaying the
+// line being edited on w. If w has a Flush() error method, it is called after
+// each update of the display.
+func NewLineEditor(r io.Reader, w io.Writer) *LineEditor {
+	return &LineEditor{src: r, r: bufio.NewReader(r), w: w}
+}
+
+// Read reads edited input into p. It blocks until a line is complete.
+func (e *LineEditor) Read(p []byte) (int, error) {
+	for len(e.out) == 0 && e.err == nil {
+		e.step()
+	}
+	if len(e.out) == 0 {
+		return 0, e.err
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// Buffered processes the keys that can be read without blocking and returns
+// the number of bytes of edited input ready to be read. Once the input has
+// returned an error, Buffered returns at least 1 so that pollers can get the
+// error.
+func (e *LineEditor) Buffered() int {
+	for len(e.out) == 0 && e.err == nil && (e.r.Buffered() > 0 || inputState(e.src) != inputWaiting) {
+		e.step()
+	}
+	if len(e.out) == 0 && e.err != nil {
+		return 1
+	}
+	return len(e.out)
+}
+
+// step reads and processes one key.
+func (e *LineEditor) step() {
+	r, _, err := e.r.ReadRune()
+	if err != nil {
+		// deliver what's left
+		e.deliver("")
+		e.err = err
+		return
+	}
+	if len(e.esc) > 0 || r == '\033' {
+		e.escape(r)
+		return
+	}
+	switch r {
+	case '\r', '\n':
+		e.deliver("\n")
+	case 1: // Ctrl-A
+		e.move(0)
+	case 2: // Ctrl-B
+		e.move(e.pos - 1)
+	case 4: // Ctrl-D
+		if len(e.line) == 0 {
+			e.out = append(e.out, 4)
+			return
+		}
+		e.delete(e.pos, e.pos+1)
+	case 5: // Ctrl-E
+		e.move(len(e.line))
+	case 6: // Ctrl-F
+		e.move(e.pos + 1)
+	case 14: // Ctrl-N
+		e.recall(e.hpos + 1)
+	case 16: // Ctrl-P
+		e.recall(e.hpos - 1)
+	case 8, 127: // Backspace
+		e.delete(e.pos-1, e.pos)
+	case 11: // Ctrl-K
+		e.cut(e.pos, len(e.line))
+	case 21: // Ctrl-U
+		e.cut(0, e.pos)
+	case 23: // Ctrl-W
+		p := e.pos
+		for p > 0 && unicode.IsSpace(e.line[p-1]) {
+			p--
+		}
+		for p > 0 && !unicode.IsSpace(e.line[p-1]) {
+			p--
+		}
+		e.cut(p, e.pos)
+	case 25: // Ctrl-Y
+		e.insert(e.kill...)
+	default:
+		if r >= ' ' && r != utf8.RuneError {
+			e.insert(r)
+		}
+	}
+}
+
+// escape processes rune r of an escape sequence.
+func (e *LineEditor) escape(r rune) {
+	e.esc = append(e.esc, r)
+	if len(e.esc) < 2 || len(e.esc) == 2 && (r == '[' || r == 'O') || r < '@' || r > '~' {
+		// incomplete sequence
+		return
+	}
+	switch seq := string(e.esc[1:]); seq {
+	case "[A", "OA":
+		e.recall(e.hpos - 1)
+	case "[B", "OB":
+		e.recall(e.hpos + 1)
+	case "[D", "OD":
+		e.move(e.pos - 1)
+	case "[C", "OC":
+		e.move(e.pos + 1)
+	case "[H", "OH", "[1~", "[7~":
+		e.move(0)
+	case "[F", "OF", "[4~", "[8~":
+		e.move(len(e.line))
+	case "[3~":
+		e.delete(e.pos, e.pos+1)
+	}
+	e.esc = e.esc[:0]
+}
+
+func (e *LineEditor) move(p int) {
+	if p < 0 || p > len(e.line) || p == e.pos {
+		return
+	}
+	var b strings.Builder
+	if p < e.pos {
+		b.WriteString(strings.Repeat("\b", e.pos-p))
+	} else {
+		b.WriteString(string(e.line[e.pos:p]))
+	}
+	e.pos = p
+	e.write(b.String())
+}
+
+func (e *LineEditor) insert(r ...rune) {
+	if len(r) == 0 {
+		return
+	}
+	e.line = append(e.line[:e.pos], append(r, e.line[e.pos:]...)...)
+	e.pos += len(r)
+	e.redraw(e.pos - len(r))
+}
+
+func (e *LineEditor) delete(start, end int) {
+	if start < 0 || end > len(e.line) || start >= end {
+		return
+	}
+	e.line = append(e.line[:start], e.line[end:]...)
+	old := e.pos
+	e.pos = start
+	e.write(strings.Repeat("\b", old-start))
+	e.redraw(start)
+}
+
+// cut deletes the text between start and end and saves it in the kill buffer.
+func (e *LineEditor) cut(start, end int) {
+	if start >= end {
+		return
+	}
+	e.kill = append(e.kill[:0], e.line[start:end]...)
+	e.delete(start, end)
+}
+
+// redraw redraws the line from position from, where the cursor is on the
+// display, and moves it to the current position.
+func (e *LineEditor) redraw(from int) {
+	var b strings.Builder
+	b.WriteString(string(e.line[from:]))
+	b.WriteString("\033[K")
+	b.WriteString(strings.Repeat("\b", len(e.line)-e.pos))
+	e.write(b.String())
+}
+
+// recall replaces the line being edited with line n of the history.
+func (e *LineEditor) recall(n int) {
+	if n < 0 || n > len(e.hist) || n == e.hpos {
+		return
+	}
+	if e.hpos == len(e.hist) {
+		e.cur = append(e.cur[:0], e.line...)
+	}
+	e.hpos = n
+	if n == len(e.hist) {
+		e.line = append(e.line[:0], e.cur...)
+	} else {
+		e.line = append(e.line[:0], []rune(e.hist[n])...)
+	}
+	e.write(strings.Repeat("\b", e.pos))
+	e.pos = len(e.line)
+	e.redraw(0)
+}
+
+// deliver erases the line from the display and queues it for reading,
+// followed by term.
+func (e *LineEditor) deliver(term string) {
+	if e.pos > 0 {
+		e.write(strings.Repeat("\b", e.pos) + "\033[K")
+	}
+	l := string(e.line)
+	e.out = append(e.out, l+term...)
+	e.line, e.pos = e.line[:0], 0
+	if l != "" && (len(e.hist) == 0 || e.hist[len(e.hist)-1] != l) {
+		e.addHistory(l)
+	}
+	e.hpos = len(e.hist)
+}
+
+func (e *LineEditor) addHistory(l string) {
+	if len(e.hist) >= HistorySize {
+		e.hist = append(e.hist[:0], e.hist[len(e.hist)-HistorySize+1:]...)
+	}
+	e.hist = append(e.hist, l)
+}
+
+// ReadHistory appends the lines read from r to the history, oldest first.
+func (e *LineEditor) ReadHistory(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if l := s.Text(); l != "" {
+			e.addHistory(l)
+		}
+	}
+	e.hpos = len(e.hist)
+	return errors.Wrap(s.Err(), "history read failed")
+}
+
+// WriteHistory writes the history to w, one line per entry, oldest first.
+func (e *LineEditor) WriteHistory(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range e.hist {
+		bw.WriteString(l)
+		bw.WriteByte('\n')
+	}
+	return errors.Wrap(bw.Flush(), "history write failed")
+}
+
+func (e *LineEditor) write(s string) {
+	if len(s) == 0 {
+		return
+	}
+	io.WriteString(e.w, s)
+	if f, ok := e.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,56 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+// Logger is the interface implemented by loggers that the VM reports notable
+// events to: image saves, file operation failures, I/O handler errors and
+// clock throttling. Arguments following the message are alternating keys and
+// values.
+//
+// Logger is implemented by *slog.Logger from the standard library.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Log sets the Logger the VM reports events to. A nil Logger disables logging,
+// which is the default.
+func Log(l Logger) Option {
+	return func(i *Instance) error {
+		i.logger = l
+		return nil
+	}
+}
+
+func (i *Instance) logDebug(msg string, args ...interface{}) {
+	if i.logger != nil {
+		i.logger.Debug(msg, args...)
+	}
+}
+
+func (i *Instance) logInfo(msg string, args ...interface{}) {
+	if i.logger != nil {
+		i.logger.Info(msg, args...)
+	}
+}
+
+func (i *Instance) logError(msg string, args ...interface{}) {
+	if i.logger != nil {
+		i.logger.Error(msg, args...)
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
+	"io/fs"
 	"os"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -29,11 +31,19 @@ import (
 // This is primarily used to encode/decode strings: the VM needs to know how to
 // encode/decode strings in some I/O operations, like when retrieving
 // environment variables.
+//
+// Codecs may pack several bytes in a single Cell. Devices and programs use
+// BytesPerCell and EncodedLen to compute buffer sizes.
 type Codec interface {
 	// Decode returns the decoded byte slice starting at position start in the specified slice.
 	Decode(mem []Cell, start Cell) []byte
 	// Encode writes the given byte slice at position start in specified slice.
 	Encode(mem []Cell, start Cell, s []byte)
+	// BytesPerCell returns the number of bytes packed in a single Cell.
+	BytesPerCell() int
+	// EncodedLen returns the number of Cells needed to encode n bytes,
+	// including any terminator.
+	EncodedLen(n int) int
 }
 
 // load32 loads a 32 bits image.
@@ -85,20 +95,67 @@ func load64(mem []Cell, r io.Reader, fileCells int) error {
 
 // Load loads a memory image from file fileName. Returns a VM Cell slice ready
 // to run from, the actual number of cells read from the file and any error. The
-// cellBits parameter specifies the number of bits per Cell in the file.
+// cellBits parameter specifies the number of bits per Cell in the file. It is
+// ignored for files with a self-describing header (see Format).
+//
+// Cells are read in little-endian byte order. Big-endian images, or images in
+// other file formats, can be loaded with LoadFormat.
 func Load(fileName string, minSize, cellBits int) (mem []Cell, fileCells int, err error) {
-	switch cellBits {
-	case 0:
-		cellBits = CellBits
-	case 32, 64:
-	default:
-		return nil, 0, errors.Errorf("loading of %d bits images is not supported", cellBits)
+	if err = checkLoadBits(cellBits); err != nil {
+		return nil, 0, err
 	}
 	f, err := os.Open(fileName)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "open failed")
 	}
 	defer f.Close()
+	return loadFile(f, fileName, minSize, cellBits)
+}
+
+// LoadFS works like Load but reads the memory image from the file system fsys.
+// This allows for example to embed a memory image in the host program with a
+// go:embed directive:
+//
+//	//go:embed retroImage
+//	var images embed.FS
+//
+//	mem, _, err := vm.LoadFS(images, "retroImage", 50000, 32)
+func LoadFS(fsys fs.FS, name string, minSize, cellBits int) (mem []Cell, fileCells int, err error) {
+	if err = checkLoadBits(cellBits); err != nil {
+		return nil, 0, err
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "open failed")
+	}
+	defer f.Close()
+	return loadFile(f, name, minSize, cellBits)
+}
+
+// checkLoadBits checks that images with the given cell size can be loaded.
+func checkLoadBits(cellBits int) error {
+	switch cellBits {
+	case 0, 32, 64:
+		return nil
+	}
+	return errors.Errorf("loading of %d bits images is not supported", cellBits)
+}
+
+// loadFile loads a memory image from the open file f.
+func loadFile(f fs.File, fileName string, minSize, cellBits int) (mem []Cell, fileCells int, err error) {
+	if cellBits == 0 {
+		cellBits = CellBits
+	}
+	r := bufio.NewReader(f)
+	if p, _ := r.Peek(len(imageMagic)); hasHeader(p) {
+		if mem, _, err = readImage(r, Format{}); err != nil {
+			return nil, 0, errors.Wrap(err, "load failed")
+		}
+		if fileCells = len(mem); minSize > fileCells {
+			mem = append(mem, make([]Cell, minSize-fileCells)...)
+		}
+		return mem, fileCells, nil
+	}
 	st, err := f.Stat()
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "fstat failed")
@@ -115,9 +172,9 @@ func Load(fileName string, minSize, cellBits int) (mem []Cell, fileCells int, er
 	mem = make([]Cell, imgCells)
 	switch cellBits {
 	case 32:
-		err = load32(mem, bufio.NewReader(f), fileCells)
+		err = load32(mem, r, fileCells)
 	case 64:
-		err = load64(mem, bufio.NewReader(f), fileCells)
+		err = load64(mem, r, fileCells)
 	}
 	if err != nil {
 		return nil, fileCells, errors.Wrap(err, "load failed")
@@ -127,6 +184,9 @@ func Load(fileName string, minSize, cellBits int) (mem []Cell, fileCells int, er
 
 // Save saves a Cell slice to an memory image file. The cellBits parameter
 // specifies the number of bits per Cell in the file.
+//
+// Cells are written in little-endian byte order. Big-endian images, or images
+// in other file formats, can be saved with SaveFormat.
 func Save(fileName string, mem []Cell, cellBits int) error {
 	f, err := os.Create(fileName)
 	if err != nil {
@@ -170,3 +230,68 @@ func Save(fileName string, mem []Cell, cellBits int) error {
 	}
 	return errors.Wrap(err, "save failed")
 }
+
+// HereAddr is the address of the cell holding the value of HERE in Retro
+// memory images, i.e. the address of the first unused cell.
+const HereAddr = 3
+
+// ShrinkError is returned by ShrinkImage when the value of HERE in a memory
+// image is out of range.
+type ShrinkError struct {
+	Here Cell // value of HERE
+	Size int  // memory image size
+}
+
+func (e *ShrinkError) Error() string {
+	return "invalid HERE value " + strconv.FormatInt(int64(e.Here), 10) +
+		" in a memory image of " + strconv.Itoa(e.Size) + " cells"
+}
+
+// ShrinkImage returns the used part of the Retro memory image mem, that is
+// mem[:HERE]. It returns a *ShrinkError if mem is too small to hold HERE or if
+// the value of HERE is not in the range (HereAddr, len(mem)].
+func ShrinkImage(mem []Cell) ([]Cell, error) {
+	if len(mem) <= HereAddr {
+		return nil, &ShrinkError{-1, len(mem)}
+	}
+	here := mem[HereAddr]
+	if here <= HereAddr || int64(here) > int64(len(mem)) {
+		return nil, &ShrinkError{here, len(mem)}
+	}
+	return mem[:here], nil
+}
+
+// ShrinkSave returns a memory image dump function for SaveMemImage that saves
+// only the used part of a Retro memory image, as returned by ShrinkImage, if
+// shrink is true. The cellBits parameter specifies the Cell size in bits to use
+// when saving.
+//
+// If the value of HERE is invalid, nothing is saved and the error returned has
+// a root cause of type *ShrinkError.
+func ShrinkSave(shrink bool, cellBits int) func(fileName string, mem []Cell) error {
+	return shrinkSave(shrink, func(fileName string, mem []Cell) error {
+		return Save(fileName, mem, cellBits)
+	})
+}
+
+// ShrinkSaveFormat works like ShrinkSave but saves the memory image in the
+// given file format. See SaveFormat.
+func ShrinkSaveFormat(shrink bool, f Format) func(fileName string, mem []Cell) error {
+	return shrinkSave(shrink, func(fileName string, mem []Cell) error {
+		return SaveFormat(fileName, mem, f)
+	})
+}
+
+// shrinkSave returns a dump function that shrinks mem if requested, then calls save.
+func shrinkSave(shrink bool, save func(string, []Cell) error) func(fileName string, mem []Cell) error {
+	return func(fileName string, mem []Cell) error {
+		if shrink {
+			m, err := ShrinkImage(mem)
+			if err != nil {
+				return errors.Wrap(err, "image shrink failed")
+			}
+			mem = m
+		}
+		return save(fileName, mem)
+	}
+}
@@ -0,0 +1,123 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FetchHandler is the prototype for memory mapped fetch handlers. It must return
+// the value of the cell at address addr.
+type FetchHandler func(i *Instance, addr Cell) (Cell, error)
+
+// StoreHandler is the prototype for memory mapped store handlers. v is the
+// value being stored at address addr.
+type StoreHandler func(i *Instance, addr, v Cell) error
+
+// memRegion is a memory mapped device region.
+type memRegion struct {
+	start, end Cell
+	onFetch    FetchHandler
+	onStore    StoreHandler
+}
+
+// BindMemRegion binds handlers to the memory address range [start, end). The
+// fetch and store opcodes will call onFetch and onStore instead of accessing the
+// memory image when the address is within that range. This enables memory
+// mapped I/O devices like frame buffers or buffers shared with the host.
+//
+// Either handler can be nil, in which case the corresponding access goes to the
+// memory image, as usual. The region does not need to be within the bounds of
+// the memory image. Regions cannot overlap.
+//
+// As long as no memory regions or watchpoints are set, there is no performance
+// penalty on memory accesses.
+func BindMemRegion(start, end Cell, onFetch FetchHandler, onStore StoreHandler) Option {
+	return func(i *Instance) error {
+		if end <= start {
+			return errors.Errorf("invalid memory region [%d, %d)", start, end)
+		}
+		n := sort.Search(len(i.mmio), func(n int) bool { return i.mmio[n].end > start })
+		if n < len(i.mmio) && i.mmio[n].start < end {
+			return errors.Errorf("memory region [%d, %d) overlaps [%d, %d)", start, end, i.mmio[n].start, i.mmio[n].end)
+		}
+		i.mmio = append(i.mmio, memRegion{})
+		copy(i.mmio[n+1:], i.mmio[n:])
+		i.mmio[n] = memRegion{start, end, onFetch, onStore}
+		i.updateMemHook()
+		return nil
+	}
+}
+
+// updateMemHook enables the slow path for memory accesses in Run if any
+// memory regions or watchpoints are set, or in audit mode.
+func (i *Instance) updateMemHook() {
+	i.memHook = i.watch != nil || i.mmio != nil || i.audit
+}
+
+// mappedRegion returns the memory mapped region containing addr, or nil.
+func (i *Instance) mappedRegion(addr Cell) *memRegion {
+	n := sort.Search(len(i.mmio), func(n int) bool { return i.mmio[n].end > addr })
+	if n < len(i.mmio) && i.mmio[n].start <= addr {
+		return &i.mmio[n]
+	}
+	return nil
+}
+
+// fetchHook handles watchpoints and memory mapped fetches. If addr is memory
+// mapped, it sets TOS to the fetched value and returns true.
+func (i *Instance) fetchHook(addr Cell) (bool, error) {
+	if i.audit {
+		i.auditMem(AuditFetch, addr, 0)
+	}
+	if i.watch != nil {
+		if err := i.watchRead(addr); err != nil {
+			return false, err
+		}
+	}
+	if r := i.mappedRegion(addr); r != nil && r.onFetch != nil {
+		v, err := r.onFetch(i, addr)
+		if err != nil {
+			return false, errors.Wrap(err, "memory mapped fetch failed")
+		}
+		i.tos = v
+		return true, nil
+	}
+	return false, nil
+}
+
+// storeHook handles watchpoints and memory mapped stores. It returns true if
+// addr is memory mapped.
+func (i *Instance) storeHook(addr, v Cell) (bool, error) {
+	if i.audit {
+		i.auditMem(AuditStore, addr, v)
+	}
+	if i.watch != nil {
+		if err := i.watchWrite(addr, v); err != nil {
+			return false, err
+		}
+	}
+	if r := i.mappedRegion(addr); r != nil && r.onStore != nil {
+		if err := r.onStore(i, addr, v); err != nil {
+			return false, errors.Wrap(err, "memory mapped store failed")
+		}
+		return true, nil
+	}
+	return false, nil
+}
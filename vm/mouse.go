@@ -0,0 +1,113 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync"
+
+// MouseProvider is the interface implemented by the providers of the Ngaro mouse
+// device on port 7.
+//
+// MouseState returns the pointer position and whether the button is pressed.
+// It may be called from the goroutine running the VM while the provider is
+// being updated from another goroutine.
+//
+// The mouse device is enabled either by setting a provider with BindMouse, or
+// by using an output Terminal that also implements MouseProvider. When it is
+// enabled, the VM capabilities query -7 on port 5 reports -1, and programs can
+// query port 7:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	-xy	pointer position
+//	2	-f	button state: -1 if pressed, 0 otherwise
+type MouseProvider interface {
+	MouseState() (x, y int, pressed bool)
+}
+
+// Mouse is a MouseProvider fed by the host, for example from the events of a
+// GUI window. All methods can be called from any goroutine.
+//
+// The zero value is a mouse at 0, 0 with no button pressed.
+type Mouse struct {
+	mu      sync.Mutex
+	x, y    int
+	pressed bool
+}
+
+// BindMouse sets the provider of the mouse device. It takes precedence over
+// the output Terminal. See MouseProvider.
+func BindMouse(p MouseProvider) Option {
+	return func(i *Instance) error {
+		i.mouse = p
+		return nil
+	}
+}
+
+// Move sets the pointer position.
+func (m *Mouse) Move(x, y int) {
+	m.mu.Lock()
+	m.x, m.y = x, y
+	m.mu.Unlock()
+}
+
+// SetButton sets the button state.
+func (m *Mouse) SetButton(pressed bool) {
+	m.mu.Lock()
+	m.pressed = pressed
+	m.mu.Unlock()
+}
+
+// MouseState implements MouseProvider.
+func (m *Mouse) MouseState() (x, y int, pressed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.x, m.y, m.pressed
+}
+
+// mouseProvider returns the provider of the mouse device, nil if disabled.
+func (i *Instance) mouseProvider() MouseProvider {
+	if i.mouse != nil {
+		return i.mouse
+	}
+	if p, ok := i.terminal().(MouseProvider); ok {
+		return p
+	}
+	return nil
+}
+
+// mouseWait handles WAIT requests on port 7.
+func (i *Instance) mouseWait(v Cell) {
+	p := i.mouseProvider()
+	if p == nil {
+		return
+	}
+	x, y, pressed := p.MouseState()
+	switch v {
+	case 1:
+		i.Push(Cell(x))
+		i.Push(Cell(y))
+	case 2:
+		if pressed {
+			i.Push(-1)
+		} else {
+			i.Push(0)
+		}
+	default:
+		return
+	}
+	i.WaitReply(0, 7)
+}
@@ -0,0 +1,79 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// notification is a value to deliver to a port.
+type notification struct {
+	port, v Cell
+}
+
+// notifier holds the notifications sent by other goroutines until they get
+// delivered by the VM.
+type notifier struct {
+	n  int32 // pending notifications, accessed atomically
+	mu sync.Mutex
+	q  []notification
+}
+
+// Notify sends the value v to the given I/O port. It can be called from any
+// goroutine and does not block. The value is delivered to the VM by the first
+// WAIT instruction executed once the port is free (i.e. its value is 0, which
+// is the case after it has been read by the IN instruction): Ports[port] is set
+// to v and Ports[0] to 1, just like a WAIT handler reply. Values sent to the
+// same port are queued and delivered in order, one per WAIT.
+//
+// Notify is intended to push asynchronous events (keyboard, network, timers)
+// to ports that have no WAIT handler bound. Since a 0 value means that the port
+// is free, v should not be 0.
+//
+// Notifications are not recorded in journals.
+func (i *Instance) Notify(port, v Cell) error {
+	if port <= 0 || int(port) >= len(i.Ports) {
+		return errors.Wrapf(ErrPortOutOfRange, "port %d", port)
+	}
+	n := &i.notes
+	n.mu.Lock()
+	n.q = append(n.q, notification{port, v})
+	atomic.StoreInt32(&n.n, int32(len(n.q)))
+	n.mu.Unlock()
+	return nil
+}
+
+// deliver delivers pending notifications to free ports.
+func (i *Instance) deliver() {
+	n := &i.notes
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	q := n.q[:0]
+	for _, e := range n.q {
+		if i.port(e.port) != 0 {
+			q = append(q, e)
+			continue
+		}
+		i.setPort(e.port, e.v)
+		i.setPort(0, 1)
+	}
+	n.q = q
+	atomic.StoreInt32(&n.n, int32(len(q)))
+}
@@ -0,0 +1,74 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// Action tells Run what to do after a runtime error has been handled by the
+// function set with OnError.
+type Action int
+
+// Actions returned by OnError functions.
+const (
+	// ActionAbort makes Run return the error. This is the default behavior.
+	ActionAbort Action = iota
+	// ActionContinue resumes execution at the current PC. The error function
+	// is expected to have fixed the cause of the error, for example by
+	// dropping values from a full stack or by changing the PC.
+	ActionContinue
+	// ActionReset clears the data and address stacks and resumes execution
+	// at the current PC, which the error function would usually set to the
+	// address of some recovery code, like an interactive listener.
+	ActionReset
+)
+
+// OnError sets a function that is called when the program being executed
+// triggers a runtime error (see Run and RuntimeError). The error function can
+// log the error, patch the VM state and decide with the returned Action
+// whether Run should return the error or continue execution. When fn is
+// called, the PC points to the instruction that triggered the error.
+//
+// Errors returned by I/O handlers or caused by VM control functions (Stop,
+// breakpoints, etc.) are not passed to fn.
+//
+// Note that returning ActionContinue without fixing the cause of the error
+// will trigger the same error again, in an endless loop.
+func OnError(fn func(i *Instance, err error) Action) Option {
+	return func(i *Instance) error {
+		i.errFn = fn
+		return nil
+	}
+}
+
+// recoverError calls the error function set with OnError if err is a runtime
+// error, and returns true if execution should resume at the current PC.
+func (i *Instance) recoverError(err error) bool {
+	if i.errFn == nil {
+		return false
+	}
+	if _, ok := errors.Cause(err).(*RuntimeError); !ok {
+		return false
+	}
+	switch i.errFn(i, err) {
+	case ActionContinue:
+		return true
+	case ActionReset:
+		i.sp, i.tos, i.rsp, i.rtos = 0, 0, 0, 0
+		return true
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// input states returned by inputState
+const (
+	inputReady   = iota // a read won't block
+	inputWaiting        // a read may block
+	inputEOF            // a read will return io.EOF
+)
+
+// inputState returns the state of input reader r.
+func inputState(r io.Reader) int {
+	if mr, ok := r.(*multiReader); ok {
+		for _, r := range mr.list() {
+			if s := inputState(r); s != inputEOF {
+				return s
+			}
+		}
+		return inputEOF
+	}
+	switch r := r.(type) {
+	case nil:
+		return inputEOF
+	case interface{ Len() int }:
+		if r.Len() == 0 {
+			return inputEOF
+		}
+	case interface{ Buffered() int }:
+		if r.Buffered() == 0 {
+			return inputWaiting
+		}
+	}
+	return inputReady
+}
+
+// pollInterval is the interval between polls of readers that cannot notify
+// the arrival of input during reads with a timeout.
+const pollInterval = 10 * time.Millisecond
+
+// readTimeout works like readInput but returns -1 if no input arrives within
+// d.
+func (i *Instance) readTimeout(d time.Duration) (Cell, error) {
+	deadline := time.Now().Add(d)
+	i.inMu.Lock()
+	in := i.input
+	i.inMu.Unlock()
+	if dr, ok := in.(interface{ SetReadDeadline(time.Time) error }); ok && dr.SetReadDeadline(deadline) == nil {
+		defer dr.SetReadDeadline(time.Time{})
+		c, err := i.readInput()
+		if err != nil && os.IsTimeout(errors.Cause(err)) {
+			return -1, nil
+		}
+		return c, err
+	}
+	for {
+		c, err := i.pollInput()
+		if c != -1 || err != nil {
+			return c, err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return -1, nil
+		}
+		if a, ok := in.(*AsyncReader); ok {
+			a.wait(deadline)
+		} else {
+			if left > pollInterval {
+				left = pollInterval
+			}
+			time.Sleep(left)
+		}
+	}
+}
+
+// pollInput works like readInput but returns -1 instead of blocking if no
+// input is pending.
+func (i *Instance) pollInput() (Cell, error) {
+	i.inMu.Lock()
+	s := inputState(i.input)
+	pipe := len(i.inBuf) > 0 || i.inClosed
+	i.inMu.Unlock()
+	switch {
+	case s == inputWaiting:
+		return -1, nil
+	case s == inputEOF && !pipe && i.eofPolicy == EOFBlock && i.eofFn == nil:
+		return -1, nil
+	}
+	return i.readInput()
+}
+
+// AsyncReader reads from an underlying reader in a separate goroutine and
+// buffers the data read, so that the VM can poll for input without blocking.
+// It should be used to wrap interactive inputs like terminals.
+//
+// Besides the standard blocking read request (1), the input device on port 1
+// supports a polling request (2) that returns -1 immediately if no key is
+// pending, and a read request with a timeout (3) that takes a number of
+// milliseconds on the stack and returns -1 if no key arrived in time:
+//
+//	2 1 out 0 0 out wait 1 in
+//	100 3 1 out 0 0 out wait 1 in
+//
+// Whether input is pending is determined by the current input reader:
+//
+//   - readers with a Len() int method (like strings.Reader or bytes.Buffer)
+//     have pending input if Len returns a non-zero value
+//   - readers with a Buffered() int method (like bufio.Reader or AsyncReader)
+//     have pending input if Buffered returns a non-zero value
+//   - any other reader is considered to always have pending input, so that
+//     polling works like a blocking read.
+//
+// Reads with a timeout use the SetReadDeadline(time.Time) error method of the
+// current reader if it has one (like os.File or net.Conn), otherwise they poll
+// the reader until the timeout expires. An AsyncReader wakes them up as soon
+// as input arrives.
+//
+// This is why terminal input should be wrapped in an AsyncReader.
+type AsyncReader struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	buf  []byte
+	err  error
+}
+
+// NewAsyncReader returns a new AsyncReader reading from r. The reading
+// goroutine exits when a read from r returns an error, including io.EOF.
+func NewAsyncReader(r io.Reader) *AsyncReader {
+	a := new(AsyncReader)
+	a.cond.L = &a.mu
+	go a.run(r)
+	return a
+}
+
+func (a *AsyncReader) run(r io.Reader) {
+	var b [256]byte
+	for {
+		n, err := r.Read(b[:])
+		a.mu.Lock()
+		a.buf = append(a.buf, b[:n]...)
+		a.err = err
+		a.cond.Broadcast()
+		a.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads buffered data into p. It blocks until data is available or the
+// underlying reader has returned an error.
+func (a *AsyncReader) Read(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.buf) == 0 && a.err == nil {
+		a.cond.Wait()
+	}
+	if len(a.buf) == 0 {
+		return 0, a.err
+	}
+	n := copy(p, a.buf)
+	a.buf = a.buf[n:]
+	return n, nil
+}
+
+// wait waits until data is available, the underlying reader has returned an
+// error, or the deadline has passed.
+func (a *AsyncReader) wait(deadline time.Time) {
+	t := time.AfterFunc(time.Until(deadline), func() {
+		a.mu.Lock()
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	})
+	defer t.Stop()
+	a.mu.Lock()
+	for len(a.buf) == 0 && a.err == nil && time.Now().Before(deadline) {
+		a.cond.Wait()
+	}
+	a.mu.Unlock()
+}
+
+// Buffered returns the number of bytes that can be read without blocking.
+// Once the underlying reader has returned an error, Buffered returns at least
+// 1 so that pollers can get the error.
+func (a *AsyncReader) Buffered() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.buf) == 0 && a.err != nil {
+		return 1
+	}
+	return len(a.buf)
+}
@@ -0,0 +1,149 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PortOp is the kind of a port event.
+type PortOp int
+
+// Port event kinds.
+const (
+	PortIn    PortOp = iota // IN instruction, Value is the value read
+	PortOut                 // OUT instruction, Value is the value written
+	PortWait                // WAIT instruction, Value is the value of port 0
+	PortReply               // WAIT handler reply (see WaitReply)
+)
+
+var portOps = [...]string{"in", "out", "wait", "reply"}
+
+func (op PortOp) String() string {
+	if op < 0 || int(op) >= len(portOps) {
+		return "unknown"
+	}
+	return portOps[op]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (op PortOp) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// PortEvent is an entry of a PortRecorder.
+type PortEvent struct {
+	Op    PortOp `json:"op"`
+	Count int64  `json:"count"` // instruction count, see InstructionCount
+	PC    int    `json:"pc"`
+	Port  Cell   `json:"port"`
+	Value Cell   `json:"value"`
+}
+
+func (e PortEvent) String() string {
+	return fmt.Sprintf("%12d @%-6d %-5s port %-4d %d", e.Count, e.PC, e.Op, e.Port, e.Value)
+}
+
+// PortRecorder records the port activity of a VM in a ring buffer: IN, OUT and
+// WAIT instructions, as well as WAIT handler replies. This helps debugging the
+// handshake between programs and custom devices. A PortRecorder can be read
+// from any goroutine while the VM is running.
+type PortRecorder struct {
+	mu     sync.Mutex
+	events []PortEvent
+	next   int
+	full   bool
+}
+
+// NewPortRecorder returns a new PortRecorder that keeps the last size events.
+func NewPortRecorder(size int) *PortRecorder {
+	if size < 1 {
+		size = 1
+	}
+	return &PortRecorder{events: make([]PortEvent, size)}
+}
+
+// RecordPorts records the port activity of the VM in r.
+func RecordPorts(r *PortRecorder) Option {
+	return func(i *Instance) error {
+		i.portRec = r
+		return nil
+	}
+}
+
+func (r *PortRecorder) record(e PortEvent) {
+	r.mu.Lock()
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+}
+
+// Events returns the recorded events, oldest first.
+func (r *PortRecorder) Events() []PortEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]PortEvent(nil), r.events[:r.next]...)
+	}
+	return append(append([]PortEvent(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// Reset clears the recorded events.
+func (r *PortRecorder) Reset() {
+	r.mu.Lock()
+	r.next, r.full = 0, false
+	r.mu.Unlock()
+}
+
+// WriteText writes the recorded events to w, one per line, oldest first.
+func (r *PortRecorder) WriteText(w io.Writer) error {
+	for _, e := range r.Events() {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the recorded events to w as a JSON array, oldest first.
+func (r *PortRecorder) WriteJSON(w io.Writer) error {
+	ev := r.Events()
+	if ev == nil {
+		ev = []PortEvent{}
+	}
+	return json.NewEncoder(w).Encode(ev)
+}
+
+// recordPort records a port event if a PortRecorder or a Capture is set.
+func (i *Instance) recordPort(op PortOp, port, v Cell) {
+	if i.portRec == nil && i.capture == nil {
+		return
+	}
+	e := PortEvent{op, i.InstructionCount(), i.PC, port, v}
+	if i.portRec != nil {
+		i.portRec.record(e)
+	}
+	if i.capture != nil {
+		i.capturePort(e)
+	}
+}
@@ -0,0 +1,114 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// SyncPorts enables synchronized port access: the VM accesses I/O ports
+// atomically when executing IN, OUT and WAIT instructions (including the
+// default In, Out and WaitReply functions), so that host goroutines can safely
+// post values to ports with WritePort, or poll them with ReadPort, while the VM
+// runs.
+//
+// Since the VM only accesses ports when executing I/O instructions, this has
+// no performance impact on other instructions.
+func SyncPorts() Option {
+	return func(i *Instance) error {
+		i.syncPorts = true
+		return nil
+	}
+}
+
+// ReadPort atomically loads the value of the given I/O port. It can be called
+// from any goroutine.
+//
+// If the VM has been configured with SyncPorts, any value written to the port
+// by the VM before ReadPort is called is observed by ReadPort (writes by the VM
+// and ReadPort are synchronized in the sense of the Go memory model). Custom
+// handlers that access ports written by other goroutines must use ReadPort and
+// WritePort as well.
+//
+// ReadPort returns 0 if port is out of range.
+func (i *Instance) ReadPort(port Cell) Cell {
+	if port < 0 || int64(port) >= int64(len(i.Ports)) {
+		return 0
+	}
+	return loadCell(&i.Ports[port])
+}
+
+// WritePort atomically stores v in the given I/O port. It can be called from
+// any goroutine. With SyncPorts, the value is observed by the VM at its next
+// I/O instruction accessing the port. See ReadPort.
+//
+// WritePort does nothing if port is out of range.
+func (i *Instance) WritePort(port, v Cell) {
+	if port < 0 || int64(port) >= int64(len(i.Ports)) {
+		return
+	}
+	storeCell(&i.Ports[port], v)
+}
+
+// port returns the value of the given port.
+func (i *Instance) port(p Cell) Cell {
+	if i.syncPorts {
+		return loadCell(&i.Ports[p])
+	}
+	return i.Ports[p]
+}
+
+// setPort sets the value of the given port.
+func (i *Instance) setPort(p, v Cell) {
+	if i.syncPorts {
+		storeCell(&i.Ports[p], v)
+		return
+	}
+	i.Ports[p] = v
+}
+
+// swapPort sets the value of the given port and returns its previous value.
+func (i *Instance) swapPort(p, v Cell) (old Cell) {
+	if i.syncPorts {
+		return swapCell(&i.Ports[p], v)
+	}
+	old, i.Ports[p] = i.Ports[p], v
+	return old
+}
+
+func loadCell(p *Cell) Cell {
+	if CellBits == 64 {
+		return Cell(atomic.LoadInt64((*int64)(unsafe.Pointer(p))))
+	}
+	return Cell(atomic.LoadInt32((*int32)(unsafe.Pointer(p))))
+}
+
+func storeCell(p *Cell, v Cell) {
+	if CellBits == 64 {
+		atomic.StoreInt64((*int64)(unsafe.Pointer(p)), int64(v))
+		return
+	}
+	atomic.StoreInt32((*int32)(unsafe.Pointer(p)), int32(v))
+}
+
+func swapCell(p *Cell, v Cell) Cell {
+	if CellBits == 64 {
+		return Cell(atomic.SwapInt64((*int64)(unsafe.Pointer(p)), int64(v)))
+	}
+	return Cell(atomic.SwapInt32((*int32)(unsafe.Pointer(p)), int32(v)))
+}
@@ -0,0 +1,249 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Profiler samples the call stack of a VM instance and writes the result as a
+// pprof profile that can be viewed with `go tool pprof` or any pprof compatible
+// tool (flame graphs, etc.).
+//
+// The profiler is installed as the instance Tracer by the Profile option and
+// takes a sample every n instructions, where n is the rate given to
+// NewProfiler. Since samples are attributed to word names only when the profile
+// is written, a Retro dictionary can be used to resolve names even if words
+// have been defined while profiling:
+//
+//	p := vm.NewProfiler(1)
+//	i, err := vm.New(img, "retroImage", vm.Profile(p))
+//	// ...
+//	err = i.Run()
+//	// ...
+//	err = p.WriteTo(f, retro.Symbols(i.Mem))
+//
+// A Profiler must not be used with more than one instance.
+type Profiler struct {
+	i       *Instance
+	rate    int
+	n       int
+	start   time.Time
+	samples map[string]*pSample
+	buf     []byte
+}
+
+type pSample struct {
+	stack []Cell
+	count int64
+}
+
+// NewProfiler returns a new profiler that takes a sample every rate
+// instructions. If rate <= 0, a sample is taken for every instruction.
+func NewProfiler(rate int) *Profiler {
+	if rate <= 0 {
+		rate = 1
+	}
+	return &Profiler{rate: rate, samples: make(map[string]*pSample)}
+}
+
+// Profile enables profiling with the given profiler. It replaces any Tracer set
+// with the Trace option.
+func Profile(p *Profiler) Option {
+	return func(i *Instance) error {
+		p.i = i
+		p.start = time.Now()
+		return Trace(p)(i)
+	}
+}
+
+// Trace implements Tracer.
+func (p *Profiler) Trace(pc int, opcode, tos Cell, depth int) {
+	if p.n++; p.n < p.rate {
+		return
+	}
+	p.n = 0
+	i := p.i
+	b := appendUvarint(p.buf[:0], uint64(pc))
+	if i.rsp > 0 {
+		// walk the address stack in place, top first.
+		b = appendUvarint(b, uint64(i.rtos))
+		for n := i.rsp; n >= 2; n-- {
+			b = appendUvarint(b, uint64(i.address[n]))
+		}
+	}
+	p.buf = b
+	if s := p.samples[string(b)]; s != nil {
+		s.count++
+		return
+	}
+	f := p.i.CallStack(nil)
+	s := &pSample{stack: make([]Cell, len(f)), count: 1}
+	for n := range f {
+		s.stack[n] = f[n].PC
+	}
+	p.samples[string(b)] = s
+}
+
+// WriteTo writes the profile in the gzip compressed protocol buffer format
+// expected by pprof. Sample addresses are attributed to the closest symbol in
+// symbols, which may be nil. The PC offset from the symbol address is reported
+// as the line number.
+func (p *Profiler) WriteTo(w io.Writer, symbols *SymbolTable) error {
+	var (
+		pb      protobuf
+		strs    = map[string]int64{"": 0}
+		strList = []string{""}
+		funcs   = make(map[string]uint64)
+		locs    = make(map[Cell]uint64)
+		fb      protobuf
+		lb      protobuf
+	)
+	str := func(s string) int64 {
+		if n, ok := strs[s]; ok {
+			return n
+		}
+		strs[s] = int64(len(strList))
+		strList = append(strList, s)
+		return strs[s]
+	}
+	valueType := func(tag int, typ, unit string) {
+		pb.message(tag, func(m *protobuf) {
+			m.int64(1, str(typ))
+			m.int64(2, str(unit))
+		})
+	}
+	location := func(pc Cell) uint64 {
+		if id, ok := locs[pc]; ok {
+			return id
+		}
+		name, line := strconv.FormatInt(int64(pc), 10), int64(0)
+		if sym, off, ok := symbols.Lookup(pc); ok {
+			name, line = sym.Name, int64(off)
+		}
+		fid, ok := funcs[name]
+		if !ok {
+			fid = uint64(len(funcs) + 1)
+			funcs[name] = fid
+			fb.message(5, func(m *protobuf) {
+				m.uint64(1, fid)
+				m.int64(2, str(name))
+				m.int64(3, str(name))
+				m.int64(4, str(p.i.imageFile))
+			})
+		}
+		id := uint64(len(locs) + 1)
+		locs[pc] = id
+		lb.message(4, func(m *protobuf) {
+			m.uint64(1, id)
+			m.uint64(2, 1)
+			m.uint64(3, uint64(pc))
+			m.message(4, func(l *protobuf) {
+				l.uint64(1, fid)
+				l.int64(2, line)
+			})
+		})
+		return id
+	}
+
+	valueType(1, "samples", "count")
+	valueType(1, "instructions", "count")
+	for _, s := range p.samples {
+		ids := make([]uint64, len(s.stack))
+		for n, pc := range s.stack {
+			ids[n] = location(pc)
+		}
+		pb.message(2, func(m *protobuf) {
+			m.packed(1, ids)
+			m.packed(2, []uint64{uint64(s.count), uint64(s.count * int64(p.rate))})
+		})
+	}
+	pb.message(3, func(m *protobuf) {
+		m.uint64(1, 1)
+		m.uint64(3, uint64(len(p.i.Mem)))
+		m.int64(5, str(p.i.imageFile))
+		m.uint64(7, 1)
+	})
+	pb.b = append(pb.b, lb.b...)
+	pb.b = append(pb.b, fb.b...)
+	valueType(11, "instructions", "count")
+	pb.int64(12, int64(p.rate))
+	pb.int64(9, p.start.UnixNano())
+	pb.int64(10, int64(time.Since(p.start)))
+	for _, s := range strList {
+		pb.string(6, s)
+	}
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(pb.b); err != nil {
+		return errors.Wrap(err, "profile write failed")
+	}
+	return errors.Wrap(z.Close(), "profile write failed")
+}
+
+// protobuf is a minimal protocol buffer encoder.
+type protobuf struct {
+	b []byte
+}
+
+func (p *protobuf) key(tag int, wire byte) {
+	p.b = appendUvarint(p.b, uint64(tag)<<3|uint64(wire))
+}
+
+func (p *protobuf) uint64(tag int, v uint64) {
+	p.key(tag, 0)
+	p.b = appendUvarint(p.b, v)
+}
+
+func (p *protobuf) int64(tag int, v int64) {
+	p.uint64(tag, uint64(v))
+}
+
+func (p *protobuf) bytes(tag int, b []byte) {
+	p.key(tag, 2)
+	p.b = appendUvarint(p.b, uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protobuf) string(tag int, s string) {
+	p.bytes(tag, []byte(s))
+}
+
+func (p *protobuf) packed(tag int, v []uint64) {
+	var m protobuf
+	for _, x := range v {
+		m.b = appendUvarint(m.b, x)
+	}
+	p.bytes(tag, m.b)
+}
+
+func (p *protobuf) message(tag int, f func(m *protobuf)) {
+	var m protobuf
+	f(&m)
+	p.bytes(tag, m.b)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
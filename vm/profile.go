@@ -0,0 +1,197 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Device identifies a set of host devices that can be disabled with
+// DisableDevices.
+type Device uint
+
+// Host devices.
+const (
+	DevFiles Device = 1 << iota // file I/O on port 4, including image saves and includes
+	DevEnv                      // environment queries on port 5
+	DevNet                      // network devices, like UDP
+	DevExec                     // subprocesses, see Exec
+
+	allDevices = DevFiles | DevEnv | DevNet | DevExec
+)
+
+// DisableDevices disables the given host devices. Requests to a disabled
+// device fail as if the underlying host resource was not available: file
+// operations return 0, image saves reply -1 and environment queries return an
+// empty string.
+func DisableDevices(d Device) Option {
+	return func(i *Instance) error {
+		i.disabled |= d
+		return nil
+	}
+}
+
+// FileRoot confines all file accesses of the VM to the directory dir: file
+// operations on port 4, include files and image saves. File names are resolved
+// relative to dir, and absolute names or names escaping dir with ".." or
+// symbolic links are rejected. Links are resolved when the file is opened: a
+// link changed by another process between the check and the actual file
+// access is not detected. Only the names requested by the program are
+// checked: the include search path (see IncludePath) and virtual include files
+// are not affected.
+//
+// If dir is empty, all file accesses are denied, as with
+// DisableDevices(DevFiles).
+func FileRoot(dir string) Option {
+	return func(i *Instance) error {
+		if dir == "" {
+			i.disabled |= DevFiles
+			return nil
+		}
+		d, err := filepath.Abs(dir)
+		if err != nil {
+			return errors.Wrap(err, "invalid file root")
+		}
+		if r, err := filepath.EvalSymlinks(d); err == nil {
+			d = r
+		}
+		i.fileRoot = d
+		return nil
+	}
+}
+
+// filePath resolves a file name requested by the VM in the file system used for
+// file operations. It returns false if file access is disabled or if the name
+// points outside of the file root directory.
+func (i *Instance) filePath(name string) (string, bool) {
+	if i.fsys != nil {
+		if i.disabled&DevFiles != 0 {
+			return "", false
+		}
+		return fsPath(name)
+	}
+	return i.hostPath(name)
+}
+
+// hostPath resolves a file name in the host file system, like filePath.
+func (i *Instance) hostPath(name string) (string, bool) {
+	if i.disabled&DevFiles != 0 {
+		return "", false
+	}
+	if i.fileRoot == "" {
+		return name, true
+	}
+	if filepath.IsAbs(name) {
+		return "", false
+	}
+	p := filepath.Clean(name)
+	if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	// symbolic links must not escape the root either.
+	p, err := resolveLinks(filepath.Join(i.fileRoot, p))
+	if err != nil || !inDir(i.fileRoot, p) {
+		return "", false
+	}
+	return p, true
+}
+
+// resolveLinks returns the absolute path p with all symbolic links resolved.
+// Trailing path elements that do not exist are kept as is. Dangling links are
+// rejected since creating a file through them would escape any check.
+func resolveLinks(p string) (string, error) {
+	r, err := filepath.EvalSymlinks(p)
+	if err == nil || !os.IsNotExist(err) {
+		return r, err
+	}
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", errors.Errorf("dangling symbolic link %s", p)
+	}
+	dir, file := filepath.Split(p)
+	dir = filepath.Clean(dir)
+	if dir == p {
+		return p, nil
+	}
+	if dir, err = resolveLinks(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, file), nil
+}
+
+// inDir returns true if path p is dir or a descendant of dir.
+func inDir(dir, p string) bool {
+	r, err := filepath.Rel(dir, p)
+	return err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator))
+}
+
+// Default limits used by ProfileSandboxed.
+const (
+	SandboxMaxMemCells     = 1 << 20
+	SandboxMaxInstructions = 1 << 30
+	SandboxMaxOutputBytes  = 1 << 20
+	SandboxMaxInputBytes   = 1 << 20
+)
+
+// options returns an Option that applies all the given options in order.
+func options(opts ...Option) Option {
+	return func(i *Instance) error {
+		for _, o := range opts {
+			if err := o(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ProfileSandboxed returns an Option suitable for running untrusted images:
+// file, environment, network and subprocess devices are disabled, and memory
+// size, instruction count and I/O volume are limited (see the Sandbox*
+// constants). No input or output is configured; use the Input and Output
+// options to set them.
+//
+// Since it sets resource limits, this option must be set after any option
+// changing the memory size. Limits can be adjusted by setting a ResourceLimits
+// option after this one.
+func ProfileSandboxed() Option {
+	return options(
+		DisableDevices(DevFiles|DevEnv|DevNet|DevExec),
+		ResourceLimits(Limits{
+			MaxMemCells:     SandboxMaxMemCells,
+			MaxInstructions: SandboxMaxInstructions,
+			MaxOutputBytes:  SandboxMaxOutputBytes,
+			MaxInputBytes:   SandboxMaxInputBytes,
+		}),
+	)
+}
+
+// ProfileInteractive returns an Option suitable for interactive sessions: input
+// is read from os.Stdin, output goes to a VT100 terminal on os.Stdout, and file
+// operations are allowed, but confined to the current working directory.
+func ProfileInteractive() Option {
+	w := bufio.NewWriter(os.Stdout)
+	return options(
+		Input(os.Stdin),
+		Output(NewVT100Terminal(w, w.Flush, nil)),
+		FileRoot("."),
+	)
+}
@@ -0,0 +1,74 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// Region describes a named memory region [Start, End) of the memory image.
+type Region struct {
+	Name       string
+	Start, End int
+}
+
+// Size returns the size of the region in cells.
+func (r Region) Size() int {
+	return r.End - r.Start
+}
+
+// Contains returns true if addr is within the region.
+func (r Region) Contains(addr int) bool {
+	return addr >= r.Start && addr < r.End
+}
+
+// Regions defines named memory regions, for example the ones defined in
+// assembly with the .region directive (see asm.AssembleDebug). Regions
+// are checked against the memory image size when the option is set.
+func Regions(regions ...Region) Option {
+	return func(i *Instance) error {
+		for _, r := range regions {
+			if r.Start < 0 || r.End < r.Start || r.End > len(i.Mem) {
+				return errors.Errorf("region %s [%d, %d) out of memory bounds", r.Name, r.Start, r.End)
+			}
+			if i.regions == nil {
+				i.regions = make(map[string]Region)
+			}
+			i.regions[r.Name] = r
+		}
+		return nil
+	}
+}
+
+// Region returns the memory region with the given name.
+func (i *Instance) Region(name string) (r Region, ok bool) {
+	r, ok = i.regions[name]
+	return r, ok
+}
+
+// RegionMem returns the slice of the memory image corresponding to the named
+// region. An error is returned if no such region exists or if the memory image
+// has been replaced by a smaller one since the region was defined (see
+// ReloadImage).
+func (i *Instance) RegionMem(name string) ([]Cell, error) {
+	r, ok := i.regions[name]
+	if !ok {
+		return nil, errors.Errorf("no region named %s", name)
+	}
+	if r.End > len(i.Mem) {
+		return nil, errors.Errorf("region %s [%d, %d) out of memory bounds", r.Name, r.Start, r.End)
+	}
+	return i.Mem[r.Start:r.End], nil
+}
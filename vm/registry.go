@@ -0,0 +1,283 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Spawner is the prototype for functions that create new VM instances on
+// behalf of a Registry. The returned instance must not be running.
+type Spawner func(name string) (*Instance, error)
+
+// InstanceInfo describes an instance in a Registry.
+type InstanceInfo struct {
+	ID     Cell
+	Name   string
+	Paused bool
+}
+
+type regEntry struct {
+	i    *Instance
+	name string
+}
+
+// Registry keeps track of live VM instances within the host process and
+// provides basic management functions: list, spawn, pause, resume and kill.
+//
+// All Registry methods are safe for concurrent use.
+type Registry struct {
+	mu    sync.Mutex
+	next  Cell
+	vms   map[Cell]*regEntry
+	ids   map[*Instance]Cell
+	spawn Spawner
+}
+
+// DefaultRegistry is the process-wide VM registry.
+var DefaultRegistry = NewRegistry(nil)
+
+// NewRegistry returns a new, empty Registry. The spawn function is used by
+// Spawn to create new instances. If nil, Spawn will always fail.
+func NewRegistry(spawn Spawner) *Registry {
+	return &Registry{next: 1, vms: make(map[Cell]*regEntry), ids: make(map[*Instance]Cell), spawn: spawn}
+}
+
+// Register adds the new instance to the given Registry under the given name.
+// If r is nil, DefaultRegistry will be used.
+//
+// The instance stays registered after Run returns, since it can be run again,
+// until it is removed with Remove, Unregister or Kill. Hosts must unregister
+// instances they no longer use, otherwise the registry keeps them alive.
+func Register(r *Registry, name string) Option {
+	return func(i *Instance) error {
+		if r == nil {
+			r = DefaultRegistry
+		}
+		i.stage.registries = append(i.stage.registries, registration{r, name})
+		return nil
+	}
+}
+
+// SetSpawner sets the function used by Spawn to create new instances.
+func (r *Registry) SetSpawner(spawn Spawner) {
+	r.mu.Lock()
+	r.spawn = spawn
+	r.mu.Unlock()
+}
+
+// Add adds the given instance to the registry and returns its ID. Names do not
+// need to be unique. Adding an instance already in the registry returns its
+// current ID.
+func (r *Registry) Add(i *Instance, name string) Cell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id := r.idOf(i); id != 0 {
+		return id
+	}
+	id := r.next
+	r.next++
+	r.vms[id] = &regEntry{i, name}
+	r.ids[i] = id
+	return id
+}
+
+// Remove removes the instance with the given ID from the registry. It does not
+// stop the instance.
+func (r *Registry) Remove(id Cell) {
+	r.mu.Lock()
+	if e := r.vms[id]; e != nil {
+		delete(r.ids, e.i)
+		delete(r.vms, id)
+	}
+	r.mu.Unlock()
+}
+
+// Unregister removes the given instance from the registry. It does not stop
+// the instance.
+func (r *Registry) Unregister(i *Instance) {
+	r.mu.Lock()
+	if id, ok := r.ids[i]; ok {
+		delete(r.ids, i)
+		delete(r.vms, id)
+	}
+	r.mu.Unlock()
+}
+
+// Lookup returns the instance with the given ID or nil if no such instance
+// exists.
+func (r *Registry) Lookup(id Cell) *Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.vms[id]; e != nil {
+		return e.i
+	}
+	return nil
+}
+
+// ID returns the ID of the given instance in the registry, or 0 if not found.
+func (r *Registry) ID(i *Instance) Cell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.idOf(i)
+}
+
+func (r *Registry) idOf(i *Instance) Cell {
+	return r.ids[i]
+}
+
+// List returns information about all registered instances, sorted by ID.
+func (r *Registry) List() []InstanceInfo {
+	r.mu.Lock()
+	l := make([]InstanceInfo, 0, len(r.vms))
+	for id, e := range r.vms {
+		l = append(l, InstanceInfo{id, e.name, atomic.LoadInt32(&e.i.ctl.flags)&ctlPause != 0})
+	}
+	r.mu.Unlock()
+	sort.Slice(l, func(a, b int) bool { return l[a].ID < l[b].ID })
+	return l
+}
+
+// Spawn creates a new instance with the registry's Spawner, registers it and
+// runs it in a new goroutine. The instance is removed from the registry when
+// Run returns.
+func (r *Registry) Spawn(name string) (Cell, error) {
+	r.mu.Lock()
+	spawn := r.spawn
+	r.mu.Unlock()
+	if spawn == nil {
+		return 0, errors.New("no spawner configured")
+	}
+	i, err := spawn(name)
+	if err != nil {
+		return 0, errors.Wrap(err, "spawn failed")
+	}
+	id := r.Add(i, name)
+	go func() {
+		i.Run()
+		r.Remove(id)
+	}()
+	return id, nil
+}
+
+func (r *Registry) get(id Cell) (*Instance, error) {
+	i := r.Lookup(id)
+	if i == nil {
+		return nil, errors.Errorf("no instance with ID %d", id)
+	}
+	return i, nil
+}
+
+// Pause requests the instance with the given ID to pause.
+func (r *Registry) Pause(id Cell) error {
+	i, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	i.pause()
+	return nil
+}
+
+// Resume resumes the instance with the given ID.
+func (r *Registry) Resume(id Cell) error {
+	i, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	i.Resume()
+	return nil
+}
+
+// Kill stops the instance with the given ID and removes it from the registry.
+// A paused instance is stopped as well, and does not pause if run again.
+func (r *Registry) Kill(id Cell) error {
+	i, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	r.Remove(id)
+	i.Stop()
+	return nil
+}
+
+// WaitHandler implements a management device that can be bound to any port with
+// BindWaitHandler. Only instances with this handler bound can manage other
+// instances. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-----------------------------------------------------
+//	1	-n	number of registered instances
+//	2	n-id	ID of the n-th registered instance (sorted by ID), 0 if n is out of range
+//	3	-id	ID of the calling instance, 0 if not registered
+//	4	a-id	spawn a new instance named by the string at address a, 0 on failure
+//	5	id-f	pause instance id
+//	6	id-f	resume instance id
+//	7	id-f	kill instance id
+//	8	id-n	state of instance id: 0 = unknown, 1 = active, 2 = paused
+//
+// Flags (f) are -1 on success, 0 on failure. Spawning requires a StringCodec
+// to be configured on the calling instance.
+func (r *Registry) WaitHandler(i *Instance, v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		r.mu.Lock()
+		reply = Cell(len(r.vms))
+		r.mu.Unlock()
+	case 2:
+		n := i.Pop()
+		if l := r.List(); n >= 0 && int(n) < len(l) {
+			reply = l[n].ID
+		}
+	case 3:
+		reply = r.ID(i)
+	case 4:
+		addr := i.Pop()
+		if i.sEnc != nil {
+			reply, _ = r.Spawn(string(i.sEnc.Decode(i.Mem, addr)))
+		}
+	case 5, 6, 7:
+		var err error
+		id := i.Pop()
+		switch v {
+		case 5:
+			err = r.Pause(id)
+		case 6:
+			err = r.Resume(id)
+		case 7:
+			err = r.Kill(id)
+		}
+		if err == nil {
+			reply = -1
+		}
+	case 8:
+		if t := r.Lookup(i.Pop()); t != nil {
+			reply = 1
+			if atomic.LoadInt32(&t.ctl.flags)&ctlPause != 0 {
+				reply = 2
+			}
+		}
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
@@ -0,0 +1,166 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/db47h/ngaro/asm"
+	"github.com/db47h/ngaro/lang/retro"
+	"github.com/db47h/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+func TestVM_Stop(t *testing.T) {
+	img, err := asm.Assemble("VM_Stop", strings.NewReader(":0 jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- i.Run() }()
+	i.Stop()
+	select {
+	case err = <-done:
+		if errors.Cause(err) != vm.ErrStopped {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("VM did not stop")
+	}
+}
+
+func TestVM_Yield(t *testing.T) {
+	img, err := asm.Assemble("VM_Yield", strings.NewReader("0 :0 1+ dup 10000 <jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vms []*vm.Instance
+	for n := 0; n < 2; n++ {
+		i, err := vm.New(append([]vm.Cell(nil), img...), "",
+			vm.Ticker(func(i *vm.Instance) { i.Yield() }, 256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vms = append(vms, i)
+	}
+	var yields int
+	for len(vms) > 0 {
+		for n := 0; n < len(vms); {
+			err := vms[n].Run()
+			switch errors.Cause(err) {
+			case vm.ErrYield:
+				yields++
+				n++
+			case nil:
+				if tos := vms[n].Tos(); tos != 10000 {
+					t.Fatalf("Unexpected result %d", tos)
+				}
+				vms = append(vms[:n], vms[n+1:]...)
+			default:
+				t.Fatal(err)
+			}
+		}
+	}
+	if yields < 2*10000*4/256 {
+		t.Fatalf("Expected more yields, got %d", yields)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	loop, err := asm.Assemble("Registry", strings.NewReader(":0 jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := vm.NewRegistry(func(name string) (*vm.Instance, error) {
+		return vm.New(append([]vm.Cell(nil), loop...), name)
+	})
+	// management VM: spawn "child", check its state, pause, check state, kill.
+	mgr, err := runAsmImage(`jump start
+		:name .dat "child"
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+			3 9 io					( self ID )
+			lit name 4 9 io dup push	( spawn )
+			pop dup push 8 9 io		( state )
+			pop dup push 5 9 io drop	( pause )
+			pop dup push 8 9 io		( state )
+			pop 7 9 io				( kill )
+			1 9 io					( count )`,
+		"Registry",
+		vm.Register(r, "manager"),
+		vm.StringCodec(retro.StringCodec),
+		vm.BindWaitHandler(9, r.WaitHandler))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assertEqualI(t, "Registry count", 1, int(mgr.Pop()))
+	assertEqualI(t, "Registry kill", -1, int(mgr.Pop()))
+	assertEqualI(t, "Registry paused state", 2, int(mgr.Pop()))
+	assertEqualI(t, "Registry state", 1, int(mgr.Pop()))
+	assertEqualI(t, "Registry spawn", 2, int(mgr.Pop()))
+	assertEqualI(t, "Registry self", 1, int(mgr.Pop()))
+	l := r.List()
+	if len(l) != 1 || l[0].Name != "manager" || l[0].ID != 1 {
+		t.Fatalf("Unexpected registry content: %v", l)
+	}
+	if r.Lookup(2) != nil {
+		t.Fatal("Killed instance still registered")
+	}
+	r.Unregister(mgr)
+	if len(r.List()) != 0 || r.ID(mgr) != 0 {
+		t.Fatal("Unregistered instance still registered")
+	}
+}
+
+func TestRegistry_killPaused(t *testing.T) {
+	img, err := asm.Assemble("Registry", strings.NewReader(":0 jump 0-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := vm.NewRegistry(nil)
+	for _, kill := range []func(id vm.Cell){
+		func(vm.Cell) { i.Stop() },
+		func(id vm.Cell) { r.Kill(id) },
+	} {
+		id := r.Add(i, "paused")
+		done := make(chan error)
+		go func() { done <- i.Run() }()
+		r.Pause(id)
+		i.Pause()
+		kill(id)
+		if err = <-done; errors.Cause(err) != vm.ErrStopped {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		r.Remove(id)
+		id = r.Add(i, "stopped")
+		if l := r.List(); l[0].Paused {
+			t.Fatal("Pause request not cleared")
+		}
+		r.Remove(id)
+	}
+}
@@ -0,0 +1,116 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync"
+
+// QueueReplies enables per-port reply queues.
+//
+// By default, calling WaitReply on a port before the VM has read the previous
+// reply from that port with IN silently overwrites the previous reply. With
+// QueueReplies, the new reply is queued instead. Queued replies are delivered
+// one at a time, in order, as the VM reads the port: each IN on the port loads
+// the next queued value in the port and sets port 0 back to 1.
+//
+// This allows asynchronous WAIT handlers to complete out of order without
+// losing results. WaitReply can then be safely called from other goroutines
+// if SyncPorts is enabled as well.
+//
+// Queued replies are only delivered by the default IN handler. Custom IN
+// handlers must call In in order to consume them.
+func QueueReplies() Option {
+	return func(i *Instance) error {
+		i.replyQ = true
+		return nil
+	}
+}
+
+// PendingReplies returns the number of replies on the given port that have not
+// yet been read by the VM, including the one currently in the port.
+func (i *Instance) PendingReplies(port Cell) int {
+	r := &i.replies
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q, ok := r.q[port]
+	if !ok {
+		return 0
+	}
+	return len(q) + 1
+}
+
+// replyQueue holds the replies waiting for delivery. A port is in q if its
+// current value is an unread reply. Its slice holds the replies queued after
+// that one.
+type replyQueue struct {
+	mu sync.Mutex
+	q  map[Cell][]Cell
+}
+
+// clone returns a copy of r's queued replies.
+func (r *replyQueue) clone() map[Cell][]Cell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.q == nil {
+		return nil
+	}
+	q := make(map[Cell][]Cell, len(r.q))
+	for k, v := range r.q {
+		q[k] = append([]Cell(nil), v...)
+	}
+	return q
+}
+
+// queueReply writes v to the given port and sets port 0 to 1, or queues v if
+// the port holds an unread reply.
+func (i *Instance) queueReply(v, port Cell) {
+	r := &i.replies
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if q, ok := r.q[port]; ok {
+		r.q[port] = append(q, v)
+		return
+	}
+	if r.q == nil {
+		r.q = make(map[Cell][]Cell)
+	}
+	r.q[port] = nil
+	i.setPort(port, v)
+	i.setPort(0, 1)
+}
+
+// readReply returns the value of the given port and replaces it with the next
+// queued reply, or 0 if there is none.
+func (i *Instance) readReply(port Cell) Cell {
+	r := &i.replies
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q, ok := r.q[port]
+	if !ok {
+		return i.swapPort(port, 0)
+	}
+	if len(q) == 0 {
+		delete(r.q, port)
+		return i.swapPort(port, 0)
+	}
+	if len(q) == 1 {
+		r.q[port] = nil
+	} else {
+		r.q[port] = q[1:]
+	}
+	i.setPort(0, 1)
+	return i.swapPort(port, q[0])
+}
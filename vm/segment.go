@@ -0,0 +1,79 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// Segment is a memory segment that can be shared between several instances
+// (see SharedSegment). All accesses to the segment cells are atomic, so that
+// instances running in different goroutines, as well as the host, can safely
+// exchange data through it.
+type Segment struct {
+	cells []Cell
+}
+
+// NewSegment returns a new memory segment of size cells, initialized to 0.
+func NewSegment(size int) *Segment {
+	return &Segment{make([]Cell, size)}
+}
+
+// Len returns the size of the segment in cells.
+func (s *Segment) Len() int {
+	return len(s.cells)
+}
+
+// Load atomically loads the value of the n-th cell of the segment.
+func (s *Segment) Load(n int) Cell {
+	return loadCell(&s.cells[n])
+}
+
+// Store atomically stores v in the n-th cell of the segment.
+func (s *Segment) Store(n int, v Cell) {
+	storeCell(&s.cells[n], v)
+}
+
+// Swap atomically stores v in the n-th cell of the segment and returns its
+// previous value.
+func (s *Segment) Swap(n int, v Cell) (old Cell) {
+	return swapCell(&s.cells[n], v)
+}
+
+// SharedSegment attaches the memory segment s to the address range
+// [start, start+s.Len()). The fetch and store instructions then access the
+// segment instead of the memory image for addresses in that range. Attaching
+// the same segment to several instances, each running in its own goroutine,
+// lets them exchange data without copying.
+//
+// The segment is implemented as a memory mapped region (see BindMemRegion) and
+// is subject to the same rules: it cannot overlap other regions and enabling it
+// slows down memory accesses. Only data can be stored in a segment: the VM
+// does not execute code from it.
+func SharedSegment(start Cell, s *Segment) Option {
+	return func(i *Instance) error {
+		if start < 0 || s.Len() == 0 {
+			return errors.Errorf("invalid shared segment at %d, size %d", start, s.Len())
+		}
+		return BindMemRegion(start, start+Cell(s.Len()),
+			func(i *Instance, addr Cell) (Cell, error) {
+				return s.Load(int(addr - start)), nil
+			},
+			func(i *Instance, addr, v Cell) error {
+				s.Store(int(addr-start), v)
+				return nil
+			})(i)
+	}
+}
@@ -0,0 +1,86 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"os"
+	"unsafe"
+)
+
+// cellSize is the size of a Cell in bytes.
+const cellSize = int(unsafe.Sizeof(Cell(0)))
+
+// SharedImage is a read-only memory image that can be mapped copy-on-write by
+// many VM instances: all mappings share the same physical memory, and only the
+// pages written to by an instance are privately copied. This makes creating
+// instances with large memory images much cheaper than allocating and copying
+// a new memory image for each of them:
+//
+//	s, err := vm.NewSharedImage(img)
+//	// ...
+//	mem, release, err := s.Map()
+//	// ...
+//	i, err := vm.New(mem, "retroImage", opts...)
+//	// ...
+//	err = i.Run()
+//	release()
+//
+// Copy-on-write mappings are only supported on Unix systems. On other
+// platforms, Map returns a copy of the image.
+type SharedImage struct {
+	f     *os.File // backing file, Unix only
+	base  []Cell   // copy of the image, other platforms
+	cells int
+}
+
+// NewSharedImage returns a new SharedImage with the contents of mem. Later
+// changes to mem do not affect the SharedImage.
+func NewSharedImage(mem []Cell) (*SharedImage, error) {
+	s := &SharedImage{cells: len(mem)}
+	if err := s.init(mem); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the size of the image in cells.
+func (s *SharedImage) Len() int {
+	return s.cells
+}
+
+// Map returns a private copy-on-write mapping of the image, along with a
+// function that unmaps it. The mapping can be used as the memory image of a
+// single VM instance. The release function must only be called once the
+// instance is no longer in use, since any access to the unmapped memory would
+// crash the process.
+//
+// Mappings remain valid after the SharedImage is closed.
+func (s *SharedImage) Map() (mem []Cell, release func() error, err error) {
+	if s.cells == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	return s.mmap()
+}
+
+// Close releases the resources held by the SharedImage.
+func (s *SharedImage) Close() error {
+	s.base = nil
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux darwin freebsd netbsd openbsd dragonfly
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// init writes mem to an unlinked temporary file used as backing store for
+// the mappings.
+func (s *SharedImage) init(mem []Cell) error {
+	f, err := ioutil.TempFile("", "ngaro-image-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create shared image")
+	}
+	os.Remove(f.Name())
+	if len(mem) > 0 {
+		b := unsafe.Slice((*byte)(unsafe.Pointer(&mem[0])), len(mem)*cellSize)
+		if _, err = f.Write(b); err != nil {
+			f.Close()
+			return errors.Wrap(err, "failed to create shared image")
+		}
+	}
+	s.f = f
+	return nil
+}
+
+func (s *SharedImage) mmap() ([]Cell, func() error, error) {
+	b, err := syscall.Mmap(int(s.f.Fd()), 0, s.cells*cellSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to map shared image")
+	}
+	mem := unsafe.Slice((*Cell)(unsafe.Pointer(&b[0])), s.cells)
+	return mem, func() error { return syscall.Munmap(b) }, nil
+}
@@ -0,0 +1,115 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrShutdownTimeout is the root cause of the error returned by Run when the VM
+// has been forcibly stopped because it did not terminate within the grace
+// period following a call to RequestStop.
+var ErrShutdownTimeout = errors.New("shutdown grace period expired")
+
+// ShutdownRequested is the value delivered to the shutdown port by
+// RequestStop. See ShutdownPort.
+const ShutdownRequested Cell = -1
+
+// ShutdownPort enables graceful shutdown requests: RequestStop sends the value
+// ShutdownRequested to the given port (with Notify) and the VM then has the
+// given grace period to run any cleanup code (flush files, save the image,
+// etc.) and terminate. Past this delay, the VM is stopped and Run returns an
+// error whose root cause is ErrShutdownTimeout. A grace period <= 0 disables
+// forced termination.
+//
+// Programs should check the port after each WAIT, like any notification, and
+// clear it with IN.
+func ShutdownPort(port Cell, grace time.Duration) Option {
+	return func(i *Instance) error {
+		if port <= 0 || int(port) >= len(i.Ports) {
+			return errors.Wrapf(ErrPortOutOfRange, "port %d", port)
+		}
+		i.sdPort = port
+		i.sdGrace = grace
+		return nil
+	}
+}
+
+// shutdown holds the state of a pending shutdown request.
+type shutdown struct {
+	mu      sync.Mutex
+	pending bool
+	timer   *time.Timer
+	expired bool
+}
+
+// RequestStop requests the VM to terminate gracefully. It can be called from
+// any goroutine. If a shutdown port has been set with ShutdownPort, the VM is
+// notified and given a grace period to terminate on its own; calling
+// RequestStop again while a shutdown is pending stops the VM immediately, like
+// Stop. Without a shutdown port, RequestStop is equivalent to Stop.
+func (i *Instance) RequestStop() {
+	if i.sdPort == 0 {
+		i.Stop()
+		return
+	}
+	sd := &i.sd
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.pending {
+		i.Stop()
+		return
+	}
+	sd.pending = true
+	i.Notify(i.sdPort, ShutdownRequested)
+	if i.sdGrace > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(i.sdGrace, func() {
+			sd.mu.Lock()
+			defer sd.mu.Unlock()
+			if sd.timer != t {
+				// Run already returned
+				return
+			}
+			sd.expired = true
+			i.Stop()
+		})
+		sd.timer = t
+	}
+}
+
+// endShutdown clears any pending shutdown request when Run returns. It replaces
+// the ErrStopped error returned by Run with ErrShutdownTimeout if the grace
+// period has expired.
+func (i *Instance) endShutdown(err error) error {
+	sd := &i.sd
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.timer != nil {
+		sd.timer.Stop()
+		sd.timer = nil
+	}
+	expired := sd.expired
+	sd.pending, sd.expired = false, false
+	if expired && errors.Cause(err) == ErrStopped {
+		return errors.WithStack(ErrShutdownTimeout)
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotTimeFormat is the time format used to suffix snapshot file names. It
+// sorts lexicographically.
+const snapshotTimeFormat = "20060102T150405.000000000"
+
+// Snapshots manages rotating, timestamped versions of a memory image file.
+//
+// Each time the image is saved, the previous image file at Path is renamed to
+// Path.<timestamp> and only the Keep most recent versions are kept. A previous
+// version can then be restored with Rollback.
+type Snapshots struct {
+	Path string // image file path
+	Keep int    // number of previous versions to keep. 0 means no limit.
+}
+
+// Versions returns the file names of all saved versions, most recent first.
+func (s *Snapshots) Versions() ([]string, error) {
+	dir, base := filepath.Split(s.Path)
+	d := dir
+	if d == "" {
+		d = "."
+	}
+	l, err := ioutil.ReadDir(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "directory listing failed")
+	}
+	var v []string
+	for _, fi := range l {
+		n := fi.Name()
+		if !strings.HasPrefix(n, base+".") {
+			continue
+		}
+		if _, err := time.Parse(snapshotTimeFormat, n[len(base)+1:]); err == nil {
+			v = append(v, s.Path+n[len(base):])
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(v)))
+	return v, nil
+}
+
+// rotate renames the current image file to a timestamped version and removes
+// old versions.
+func (s *Snapshots) rotate() error {
+	if _, err := os.Stat(s.Path); err == nil {
+		v := s.Path + "." + time.Now().UTC().Format(snapshotTimeFormat)
+		if err = os.Rename(s.Path, v); err != nil {
+			return errors.Wrap(err, "rename failed")
+		}
+	}
+	if s.Keep <= 0 {
+		return nil
+	}
+	l, err := s.Versions()
+	if err != nil {
+		return err
+	}
+	for n := s.Keep; n < len(l); n++ {
+		if err = os.Remove(l[n]); err != nil {
+			return errors.Wrap(err, "remove failed")
+		}
+	}
+	return nil
+}
+
+// Save saves the memory image of the given instance to Path, using the
+// instance's dump function (see SaveMemImage), and rotates versions. The image
+// is first saved to Path.tmp, so that the current image is left untouched if
+// the save fails.
+func (s *Snapshots) Save(i *Instance) error {
+	tmp := s.Path + ".tmp"
+	if err := i.SaveImage(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := s.rotate(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "snapshot rotation failed")
+	}
+	return errors.Wrap(os.Rename(tmp, s.Path), "rename failed")
+}
+
+// Rollback restores the n-th previous version of the image file, n = 1 being
+// the most recent one. The current image file and any versions more recent than
+// the restored one are deleted.
+func (s *Snapshots) Rollback(n int) error {
+	l, err := s.Versions()
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(l) {
+		return errors.Errorf("no such version: %d (%d available)", n, len(l))
+	}
+	if err = os.Rename(l[n-1], s.Path); err != nil {
+		return errors.Wrap(err, "rename failed")
+	}
+	for _, v := range l[:n-1] {
+		if err = os.Remove(v); err != nil {
+			return errors.Wrap(err, "remove failed")
+		}
+	}
+	return nil
+}
+
+// SaveHook is a SaveHook (see OnSave) that saves a new snapshot. It replies 0
+// to the VM on success. On failure, it returns the error, which aborts Run.
+func (s *Snapshots) SaveHook(i *Instance) (Cell, error) {
+	if err := s.Save(i); err != nil {
+		return -1, errors.Wrap(err, "snapshot failed")
+	}
+	return 0, nil
+}
+
+// WaitHandler implements a snapshot management device that can be bound to any
+// port with BindWaitHandler. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	-n	save a snapshot. Returns 0 on success, -1 on failure
+//	2	-n	number of available previous versions
+//	3	n-n	rollback to the n-th previous version. Returns 0 on success, -1 on failure
+//
+// Note that a rollback only affects the image file, not the running VM.
+func (s *Snapshots) WaitHandler(i *Instance, v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		if err := s.Save(i); err != nil {
+			i.logError("snapshot failed", "file", s.Path, "err", err)
+			reply = -1
+		}
+	case 2:
+		l, _ := s.Versions()
+		reply = Cell(len(l))
+	case 3:
+		if s.Rollback(int(i.Pop())) != nil {
+			reply = -1
+		}
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
@@ -0,0 +1,130 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Symbol is a named memory address.
+type Symbol struct {
+	Addr Cell
+	Name string
+}
+
+// SymbolTable maps memory addresses to names. Symbol tables can be built from
+// assembler labels (see asm.DebugInfo), from a Retro dictionary (see
+// retro.Symbols), or manually.
+//
+// A nil *SymbolTable is an empty table.
+type SymbolTable struct {
+	syms []Symbol // sorted by address
+}
+
+// NewSymbolTable returns a new symbol table containing the given symbols.
+func NewSymbolTable(syms ...Symbol) *SymbolTable {
+	t := &SymbolTable{syms: append([]Symbol(nil), syms...)}
+	sort.SliceStable(t.syms, func(i, j int) bool { return t.syms[i].Addr < t.syms[j].Addr })
+	return t
+}
+
+// Add adds a symbol to the table. If several symbols share the same address,
+// Lookup returns the first one added.
+func (t *SymbolTable) Add(addr Cell, name string) {
+	n := t.search(addr)
+	t.syms = append(t.syms, Symbol{})
+	copy(t.syms[n+1:], t.syms[n:])
+	t.syms[n] = Symbol{addr, name}
+}
+
+// Len returns the number of symbols in the table.
+func (t *SymbolTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.syms)
+}
+
+// Lookup returns the symbol closest to addr, at or below addr, and the offset
+// of addr from that symbol. The returned boolean is false if there is no such
+// symbol.
+func (t *SymbolTable) Lookup(addr Cell) (sym Symbol, offset Cell, ok bool) {
+	if t == nil {
+		return Symbol{}, 0, false
+	}
+	n := t.search(addr) - 1
+	// skip to the first symbol added at that address
+	for n > 0 && t.syms[n-1].Addr == t.syms[n].Addr {
+		n--
+	}
+	if n < 0 {
+		return Symbol{}, 0, false
+	}
+	return t.syms[n], addr - t.syms[n].Addr, true
+}
+
+// search returns the index of the first symbol whose address is above addr.
+func (t *SymbolTable) search(addr Cell) int {
+	return sort.Search(len(t.syms), func(n int) bool { return t.syms[n].Addr > addr })
+}
+
+// Frame is a call stack frame as returned by CallStack.
+type Frame struct {
+	PC     Cell   // address of the current instruction or of the call instruction
+	Name   string // name of the closest symbol at or below PC, if any
+	Offset Cell   // offset of PC from the symbol address
+}
+
+// String returns the frame formatted as "name+offset (pc)", or just the PC if
+// the frame has no symbol name.
+func (f Frame) String() string {
+	pc := strconv.FormatInt(int64(f.PC), 10)
+	if f.Name == "" {
+		return pc
+	}
+	s := f.Name
+	if f.Offset != 0 {
+		s += "+" + strconv.FormatInt(int64(f.Offset), 10)
+	}
+	return s + " (" + pc + ")"
+}
+
+// CallStack returns the call stack of the VM, innermost frame first. The first
+// frame is the current PC and the following frames are built from the address
+// stack, where call instructions store their own address. Symbol names are
+// resolved from the given symbol table, which may be nil.
+//
+// Since the address stack is also used to store temporary values (push/pop)
+// and loop counters, some frames may not be actual return addresses.
+func (i *Instance) CallStack(symbols *SymbolTable) []Frame {
+	a := i.Address()
+	f := make([]Frame, 0, len(a)+1)
+	f = append(f, newFrame(Cell(i.PC), symbols))
+	for n := len(a) - 1; n >= 0; n-- {
+		f = append(f, newFrame(a[n], symbols))
+	}
+	return f
+}
+
+func newFrame(pc Cell, symbols *SymbolTable) Frame {
+	f := Frame{PC: pc}
+	if sym, off, ok := symbols.Lookup(pc); ok {
+		f.Name, f.Offset = sym.Name, off
+	}
+	return f
+}
@@ -0,0 +1,215 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// ErrTasksBlocked is returned by Run when no task can run because all of them
+// are waiting for another task to terminate.
+var ErrTasksBlocked = errors.New("all tasks blocked")
+
+// Task requests.
+const (
+	tkSpawn Cell = 1 + iota
+	tkYield
+	tkJoin
+	tkSelf
+)
+
+// task is a saved execution context.
+type task struct {
+	id      Cell
+	pc      int
+	data    []Cell
+	address []Cell
+	sp, rsp int
+	tos     Cell
+	rtos    Cell
+	join    Cell // ID of the task waited for, 0 if runnable
+	reply   Cell // reply to the pending task request
+	started bool
+}
+
+// scheduler holds the tasks of an instance. The current task is tasks[cur].
+type scheduler struct {
+	port  Cell
+	tasks []*task
+	cur   int
+	next  Cell // next task ID
+}
+
+// Tasks enables green-thread multitasking within the instance and binds to the
+// given port a WAIT handler that lets programs manage tasks. Tasks are
+// execution contexts (PC, data and address stacks) sharing the same memory
+// image and I/O ports. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-----------------------------------------------------
+//	1	a-id	spawn a new task executing the word at address a
+//	2	-	yield to the next task
+//	3	id-	wait until task id terminates
+//	4	-id	ID of the current task
+//
+// The task that was running when the first request was made is the main task,
+// with ID 1. Other tasks start with empty stacks of the same size as the main
+// task's, and terminate when returning from their word (or when executing
+// `bye`). When the main task exits, Run returns and other tasks are discarded.
+//
+// Tasks are scheduled cooperatively in a round robin fashion: the current task
+// only changes when it yields, waits for another task or terminates. Other I/O
+// sequences (OUT, WAIT, IN) are therefore never interleaved between tasks. If
+// all tasks are waiting for one another, Run returns an error whose root cause
+// is ErrTasksBlocked.
+func Tasks(port Cell) Option {
+	return func(i *Instance) error {
+		if port <= 0 || int(port) >= len(i.Ports) {
+			return errors.Wrapf(ErrPortOutOfRange, "port %d", port)
+		}
+		i.bindWait(port, (*Instance).taskWait)
+		return nil
+	}
+}
+
+// TaskID returns the ID of the current task, 0 if multitasking has not been
+// started. See Tasks.
+func (i *Instance) TaskID() Cell {
+	if i.sched == nil {
+		return 0
+	}
+	return i.sched.tasks[i.sched.cur].id
+}
+
+// taskWait is the WAIT handler of the task management device.
+func (i *Instance) taskWait(v, port Cell) error {
+	s := i.sched
+	if s == nil {
+		s = &scheduler{port: port, tasks: []*task{{id: 1, started: true}}, next: 2}
+		i.sched = s
+	}
+	cur := s.tasks[s.cur]
+	switch v {
+	case tkSpawn:
+		addr := i.Pop()
+		t := &task{
+			id:      s.next,
+			pc:      int(addr),
+			data:    make([]Cell, len(i.data)),
+			address: make([]Cell, len(i.address)),
+			rsp:     1,
+			rtos:    Cell(len(i.Mem) - 1), // return to the end of the image
+		}
+		s.next++
+		s.tasks = append(s.tasks, t)
+		i.WaitReply(t.id, port)
+	case tkYield:
+		cur.reply = 0
+		return i.switchTask(s.cur+1, true)
+	case tkJoin:
+		id := i.Pop()
+		if id == cur.id || s.find(id) == nil {
+			i.WaitReply(0, port)
+			return nil
+		}
+		cur.join, cur.reply = id, 0
+		return i.switchTask(s.cur+1, true)
+	case tkSelf:
+		i.WaitReply(cur.id, port)
+	}
+	return nil
+}
+
+// find returns the task with the given ID.
+func (s *scheduler) find(id Cell) *task {
+	for _, t := range s.tasks {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// switchTask saves the current task and switches to the first runnable task,
+// starting at index n. If inWait is true, the switch occurs in the task WAIT
+// handler and the PC will be incremented once the handler returns.
+func (i *Instance) switchTask(n int, inWait bool) error {
+	s := i.sched
+	if s.cur < len(s.tasks) {
+		t := s.tasks[s.cur]
+		t.pc, t.data, t.address = i.PC, i.data, i.address
+		t.sp, t.rsp, t.tos, t.rtos = i.sp, i.rsp, i.tos, i.rtos
+	}
+	var next *task
+	for k := 0; k < len(s.tasks); k++ {
+		idx := (n + k) % len(s.tasks)
+		t := s.tasks[idx]
+		if t.join != 0 && s.find(t.join) != nil {
+			continue
+		}
+		t.join = 0
+		s.cur, next = idx, t
+		break
+	}
+	if next == nil {
+		return errors.WithStack(ErrTasksBlocked)
+	}
+	i.PC, i.data, i.address = next.pc, next.data, next.address
+	i.sp, i.rsp, i.tos, i.rtos = next.sp, next.rsp, next.tos, next.rtos
+	if !next.started {
+		next.started = true
+		i.setPort(s.port, 0)
+		if inWait {
+			i.PC--
+		}
+		return nil
+	}
+	i.WaitReply(next.reply, s.port)
+	if !inWait {
+		i.PC++
+	}
+	return nil
+}
+
+// endTask terminates the current task once it has run past the end of the
+// memory image, and switches to the next task. It returns false if the current
+// task is the main task.
+func (i *Instance) endTask() (bool, error) {
+	s := i.sched
+	if s.tasks[s.cur].id == 1 {
+		i.sched = nil
+		return false, nil
+	}
+	s.tasks = append(s.tasks[:s.cur], s.tasks[s.cur+1:]...)
+	n := s.cur
+	s.cur = len(s.tasks) // nothing to save
+	return true, i.switchTask(n, false)
+}
+
+// clone returns a deep copy of s.
+func (s *scheduler) clone() *scheduler {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.tasks = make([]*task, len(s.tasks))
+	for n, t := range s.tasks {
+		ct := *t
+		ct.data = append([]Cell(nil), t.data...)
+		ct.address = append([]Cell(nil), t.address...)
+		c.tasks[n] = &ct
+	}
+	return &c
+}
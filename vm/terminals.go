@@ -0,0 +1,105 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Terminals registers additional named output terminals, for example a log
+// window besides the main console, and binds to the given port a WAIT handler
+// that lets programs select the terminal used for output. All output on ports
+// 2, 3 and 8 (including console size queries on port 5) goes to the selected
+// terminal.
+//
+// Terminals are identified by their index in the list of names sorted in
+// ascending order, starting at 1. Terminal 0 is the main output terminal set
+// with Output, and is selected by default. The following requests are
+// supported:
+//
+//	value	stack	description
+//	-----	-----	-----------------------------------------------------
+//	1	a-id	ID of the terminal named by the string at address a, -1 if unknown
+//	2	id-f	select terminal id
+//	3	-id	ID of the selected terminal
+//
+// Flags (f) are -1 on success, 0 on failure. Looking up terminals by name
+// requires a StringCodec.
+func Terminals(port Cell, terms map[string]Terminal) Option {
+	return func(i *Instance) error {
+		if port <= 0 || int(port) >= len(i.Ports) {
+			return errors.Wrapf(ErrPortOutOfRange, "port %d", port)
+		}
+		names := make([]string, 0, len(terms))
+		for n := range terms {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		i.termNames = names
+		i.terms = make([]Terminal, len(names))
+		for n, name := range names {
+			i.terms[n] = terms[name]
+		}
+		i.bindWait(port, (*Instance).terminalWait)
+		return nil
+	}
+}
+
+// SelectTerminal selects the output terminal with the given ID. See Terminals.
+func (i *Instance) SelectTerminal(id Cell) error {
+	if id < 0 || int(id) > len(i.terms) {
+		return errors.Errorf("invalid terminal ID %d", id)
+	}
+	i.termSel = int(id)
+	return nil
+}
+
+// terminal returns the selected output terminal.
+func (i *Instance) terminal() Terminal {
+	if s := i.termSel; s > 0 && s <= len(i.terms) {
+		return i.terms[s-1]
+	}
+	return i.output
+}
+
+// terminalWait is the WAIT handler of the output terminal selection device.
+func (i *Instance) terminalWait(v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		addr := i.Pop()
+		reply = -1
+		if i.sEnc != nil {
+			name := string(i.sEnc.Decode(i.Mem, addr))
+			if n := sort.SearchStrings(i.termNames, name); n < len(i.termNames) && i.termNames[n] == name {
+				reply = Cell(n + 1)
+			}
+		}
+	case 2:
+		if i.SelectTerminal(i.Pop()) == nil {
+			reply = -1
+		}
+	case 3:
+		reply = Cell(i.termSel)
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
@@ -0,0 +1,131 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxSleep is the longest time the VM can be suspended for by a single sleep
+// query.
+const maxSleep = time.Hour
+
+// Date components returned by the date query -32 on port 5.
+const (
+	DateYear      = iota // year
+	DateMonth            // month of the year, from 1 to 12
+	DateDay              // day of the month, from 1
+	DateHour             // hour, from 0 to 23
+	DateMinute           // minute, from 0 to 59
+	DateSecond           // second, from 0 to 59
+	DateWeekday          // day of the week, from 0 (Sunday) to 6
+	DateYearDay          // day of the year, from 1
+	DateUTCOffset        // offset of the time zone from UTC, in seconds
+)
+
+// TimeZone sets the time zone used by the date query -32 on port 5. The
+// default is time.Local, or UTC in deterministic mode.
+func TimeZone(loc *time.Location) Option {
+	return func(i *Instance) error {
+		i.location = loc
+		return nil
+	}
+}
+
+// uptime returns the value of the monotonic clock: the time elapsed since the
+// instance was created. In deterministic mode, this is the time elapsed on the
+// fake clock since its epoch.
+func (i *Instance) uptime() time.Duration {
+	if i.clock != nil {
+		return i.clock.now().Sub(fakeEpoch)
+	}
+	return time.Since(i.epoch)
+}
+
+// sleep suspends the VM for d, at most maxSleep, and returns the time not
+// slept. The sleep is cut short by asynchronous control requests (Stop, Pause,
+// Yield or Inspect) and by the deadline set with Deadline, so that they are
+// processed without waiting for the sleep to end. In deterministic mode, it
+// advances the fake clock instead.
+func (i *Instance) sleep(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	s := d
+	if s > maxSleep {
+		s = maxSleep
+	}
+	if i.clock != nil {
+		i.clock.t = i.clock.t.Add(s)
+		return d - s
+	}
+	wake := time.Now().Add(s)
+	end := wake
+	if i.deadline > 0 && i.runEnd.Before(end) {
+		end = i.runEnd
+	}
+	c := &i.ctl
+	t := time.AfterFunc(time.Until(end), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer t.Stop()
+	c.mu.Lock()
+	for atomic.LoadInt32(&c.flags) == 0 && time.Now().Before(end) {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+	if left := time.Until(wake); left > 0 {
+		return d - s + left
+	}
+	return d - s
+}
+
+// date returns the requested date component of the current time, or -1 if c
+// is not a valid component.
+func (i *Instance) date(c Cell) Cell {
+	t := i.now()
+	if i.location != nil {
+		t = t.In(i.location)
+	} else if i.clock == nil {
+		t = t.Local()
+	}
+	switch c {
+	case DateYear:
+		return Cell(t.Year())
+	case DateMonth:
+		return Cell(t.Month())
+	case DateDay:
+		return Cell(t.Day())
+	case DateHour:
+		return Cell(t.Hour())
+	case DateMinute:
+		return Cell(t.Minute())
+	case DateSecond:
+		return Cell(t.Second())
+	case DateWeekday:
+		return Cell(t.Weekday())
+	case DateYearDay:
+		return Cell(t.YearDay())
+	case DateUTCOffset:
+		_, off := t.Zone()
+		return Cell(off)
+	}
+	return -1
+}
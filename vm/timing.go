@@ -0,0 +1,170 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "time"
+
+// OpCategory is an opcode category used for instruction timing.
+type OpCategory int
+
+// Opcode categories.
+const (
+	CatStack  OpCategory = iota // nop, lit, dup, drop, swap, push, pop
+	CatArith                    // arithmetic and logic opcodes
+	CatMemory                   // fetch and store
+	CatBranch                   // jumps, loop, return, 0; and calls
+	CatIO                       // in and out
+	CatWait                     // wait
+	CatCustom                   // custom opcodes
+	NumOpCategories
+)
+
+var opCategories = [...]string{"stack", "arith", "memory", "branch", "io", "wait", "custom"}
+
+func (c OpCategory) String() string {
+	if c < 0 || c >= NumOpCategories {
+		return "unknown"
+	}
+	return opCategories[c]
+}
+
+// OpcodeCategory returns the category of the given opcode.
+func OpcodeCategory(op Cell) OpCategory {
+	switch op {
+	case OpNop, OpLit, OpDup, OpDrop, OpSwap, OpPush, OpPop:
+		return CatStack
+	case OpLoop, OpJump, OpReturn, OpGtJump, OpLtJump, OpNeJump, OpEqJump, OpZeroExit:
+		return CatBranch
+	case OpFetch, OpStore:
+		return CatMemory
+	case OpIn, OpOut:
+		return CatIO
+	case OpWait:
+		return CatWait
+	}
+	switch {
+	case op < 0:
+		return CatCustom
+	case op > OpWait:
+		return CatBranch
+	}
+	return CatArith
+}
+
+// timingBatch is the number of fast instructions timed as a whole.
+const timingBatch = 256
+
+// OpTiming holds the instruction count and execution time of an opcode
+// category.
+type OpTiming struct {
+	Count int64
+	Time  time.Duration
+}
+
+// TimeInstructions enables or disables the instruction timing mode, where the
+// execution time of instructions is accumulated per opcode category. The
+// results can be retrieved with InstructionTiming.
+//
+// In order to keep the overhead low, I/O, WAIT and custom instructions are
+// timed individually, while other instructions are timed in batches whose
+// duration is distributed among categories in proportion to their instruction
+// counts in the batch. Like tracing, timing is handled out of the fast path and
+// slows down the VM.
+func TimeInstructions(enable bool) Option {
+	return func(i *Instance) error {
+		i.timeOps = enable
+		i.updateDebug()
+		return nil
+	}
+}
+
+// InstructionTiming returns the instruction counts and execution times of
+// each opcode category, indexed by OpCategory, accumulated since the timing
+// mode was enabled. Unlike InstructionCount, it is not reset by Run.
+func (i *Instance) InstructionTiming() []OpTiming {
+	t := make([]OpTiming, NumOpCategories)
+	for c := range t {
+		t[c] = OpTiming{i.timer.counts[c], i.timer.times[c]}
+	}
+	return t
+}
+
+// opTimer accumulates instruction timings.
+type opTimer struct {
+	counts  [NumOpCategories]int64
+	times   [NumOpCategories]time.Duration
+	batch   [NumOpCategories]int64 // instruction counts of the current batch
+	n       int                    // length of the current batch
+	mark    time.Time              // start of the current batch or slow instruction
+	slow    OpCategory             // category of the slow instruction being timed
+	pending bool                   // a slow instruction is being timed
+	running bool
+}
+
+// hook is called before executing instruction op.
+func (t *opTimer) hook(op Cell) {
+	if !t.running {
+		t.mark, t.running = time.Now(), true
+	}
+	if t.pending {
+		now := time.Now()
+		t.times[t.slow] += now.Sub(t.mark)
+		t.mark, t.pending = now, false
+	}
+	c := OpcodeCategory(op)
+	t.counts[c]++
+	switch c {
+	case CatIO, CatWait, CatCustom:
+		t.flush()
+		t.slow, t.pending = c, true
+		return
+	}
+	t.batch[c]++
+	t.n++
+	if t.n == timingBatch {
+		t.flush()
+	}
+}
+
+// flush distributes the duration of the current batch.
+func (t *opTimer) flush() {
+	now := time.Now()
+	if t.n > 0 {
+		d := now.Sub(t.mark)
+		for c, n := range t.batch {
+			if n != 0 {
+				t.times[c] += d * time.Duration(n) / time.Duration(t.n)
+				t.batch[c] = 0
+			}
+		}
+		t.n = 0
+	}
+	t.mark = now
+}
+
+// stop ends timing when run returns.
+func (t *opTimer) stop() {
+	if !t.running {
+		return
+	}
+	if t.pending {
+		t.times[t.slow] += time.Since(t.mark)
+		t.pending = false
+	}
+	t.flush()
+	t.running = false
+}
@@ -0,0 +1,210 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"net"
+	"sync"
+)
+
+// udpQueueLen is the maximum number of datagrams queued per UDP socket.
+// Datagrams received while the queue is full are dropped.
+const udpQueueLen = 64
+
+// udpMaxDatagram is the maximum size of received datagrams.
+const udpMaxDatagram = 65536
+
+type datagram struct {
+	b    []byte
+	from net.Addr
+}
+
+type udpSocket struct {
+	conn *net.UDPConn
+	q    chan datagram
+	from net.Addr // sender of the last datagram received
+}
+
+// UDP implements a UDP networking device that can be bound to any port with
+// BindWaitHandler:
+//
+//	u := vm.NewUDP()
+//	defer u.Close()
+//	i, err := vm.New(mem, "retroImage",
+//		vm.StringCodec(retro.StringCodec),
+//		vm.BindWaitHandler(12, u.WaitHandler))
+//
+// Addresses are given as strings of the form "host:port" encoded in memory
+// with the instance's StringCodec. Datagram payloads are stored in memory one
+// byte per cell. Network traffic is not recorded in journals (see Record).
+//
+// Received datagrams are queued in the background so that programs can poll for
+// them without blocking the VM.
+//
+// The device is disabled if the DevNet device is disabled (see
+// DisableDevices).
+type UDP struct {
+	mu    sync.Mutex
+	next  Cell
+	socks map[Cell]*udpSocket
+}
+
+// NewUDP returns a new UDP device.
+func NewUDP() *UDP {
+	return &UDP{next: 1, socks: make(map[Cell]*udpSocket)}
+}
+
+// Close closes all sockets opened by the device.
+func (u *UDP) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var err error
+	for id, s := range u.socks {
+		if e := s.conn.Close(); err == nil {
+			err = e
+		}
+		delete(u.socks, id)
+	}
+	return err
+}
+
+func (u *UDP) open(addr string) Cell {
+	la, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0
+	}
+	conn, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return 0
+	}
+	s := &udpSocket{conn: conn, q: make(chan datagram, udpQueueLen)}
+	go s.receive()
+	u.mu.Lock()
+	id := u.next
+	u.next++
+	u.socks[id] = s
+	u.mu.Unlock()
+	return id
+}
+
+// receive queues incoming datagrams until the socket is closed.
+func (s *udpSocket) receive() {
+	b := make([]byte, udpMaxDatagram)
+	for {
+		n, from, err := s.conn.ReadFrom(b)
+		if err != nil {
+			close(s.q)
+			return
+		}
+		select {
+		case s.q <- datagram{append([]byte(nil), b[:n]...), from}:
+		default:
+		}
+	}
+}
+
+func (u *UDP) socket(id Cell) *udpSocket {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.socks[id]
+}
+
+// WaitHandler implements the UDP device. The following requests are supported:
+//
+//	value	stack	description
+//	-----	-----	-------------------------------------------------
+//	1	a-s	open a socket bound to the local address at a. Returns the socket ID, 0 on failure
+//	2	s-f	close socket s
+//	3	bnas-n	send n bytes from buffer b to the address at a. Returns the number of bytes sent or -1
+//	4	bns-n	receive a datagram of at most n bytes into buffer b. Returns its length, -1 if none is pending
+//	5	as-n	store the address of the sender of the last datagram received at a. Returns its length or -1
+//
+// The local address of the open request can omit the host part to listen on
+// all interfaces, and the port number can be 0 to let the system pick one.
+// Received datagrams longer than the buffer are truncated. Flags (f) are -1 on
+// success, 0 on failure.
+func (u *UDP) WaitHandler(i *Instance, v, port Cell) error {
+	var reply Cell
+	switch v {
+	case 1:
+		a := i.Pop()
+		if i.sEnc != nil && i.disabled&DevNet == 0 {
+			reply = u.open(string(i.sEnc.Decode(i.Mem, a)))
+		}
+	case 2:
+		id := i.Pop()
+		u.mu.Lock()
+		if s := u.socks[id]; s != nil {
+			s.conn.Close()
+			delete(u.socks, id)
+			reply = -1
+		}
+		u.mu.Unlock()
+	case 3:
+		id, a, n, b := i.Pop(), i.Pop(), i.Pop(), i.Pop()
+		reply = -1
+		s := u.socket(id)
+		if s == nil || i.sEnc == nil || n < 0 || b < 0 || int64(b)+int64(n) > int64(len(i.Mem)) {
+			break
+		}
+		to, err := net.ResolveUDPAddr("udp", string(i.sEnc.Decode(i.Mem, a)))
+		if err != nil {
+			break
+		}
+		p := make([]byte, n)
+		for k, c := range i.Mem[b : b+n] {
+			p[k] = byte(c)
+		}
+		if sent, err := s.conn.WriteTo(p, to); err == nil {
+			reply = Cell(sent)
+		}
+	case 4:
+		id, n, b := i.Pop(), i.Pop(), i.Pop()
+		reply = -1
+		s := u.socket(id)
+		if s == nil || n < 0 || b < 0 || int64(b)+int64(n) > int64(len(i.Mem)) {
+			break
+		}
+		select {
+		case d, ok := <-s.q:
+			if !ok {
+				break
+			}
+			if len(d.b) > int(n) {
+				d.b = d.b[:n]
+			}
+			for k, c := range d.b {
+				i.Mem[int(b)+k] = Cell(c)
+			}
+			s.from = d.from
+			reply = Cell(len(d.b))
+		default:
+		}
+	case 5:
+		id, a := i.Pop(), i.Pop()
+		reply = -1
+		if s := u.socket(id); s != nil && s.from != nil && i.sEnc != nil {
+			from := s.from.String()
+			i.sEnc.Encode(i.Mem, a, []byte(from))
+			reply = Cell(len(from))
+		}
+	default:
+		return nil
+	}
+	i.WaitReply(reply, port)
+	return nil
+}
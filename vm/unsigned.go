@@ -0,0 +1,90 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "github.com/pkg/errors"
+
+// Unsigned arithmetic opcodes, as offsets from the base opcode given to
+// UnsignedOps: the actual opcode value of UOpGt is base-UOpGt, etc.
+const (
+	UOpLt     Cell = iota // u<    ( a b -- f ) f = -1 if a < b, 0 otherwise
+	UOpGt                 // u>    ( a b -- f ) f = -1 if a > b, 0 otherwise
+	UOpShr                // u>>   ( a n -- a>>n ) logical right shift
+	UOpDivMod             // u/mod ( a b -- rem quot )
+	uOpCount
+)
+
+// UnsignedOps binds a group of custom opcodes implementing unsigned
+// comparisons, logical right shift and unsigned division, which the core
+// instruction set only provides with signed semantics. Opcodes are numbered
+// downwards from base, which must be negative: with a base of -100, u< is
+// opcode -100, u> is -101, u>> is -102 and u/mod is -103.
+//
+// In assembler, the opcodes can be given names with the .opcode directive:
+//
+//	.opcode u<    -100
+//	.opcode u>    -101
+//	.opcode u>>   -102
+//	.opcode u/mod -103
+//
+// Just like /mod, u/mod makes Run fail if the divisor is 0.
+func UnsignedOps(base Cell) Option {
+	return func(i *Instance) error {
+		if base >= 0 || base-uOpCount+1 > base {
+			return errors.Errorf("invalid base opcode %d", base)
+		}
+		for n, h := range [...]OpcodeHandler{uLt, uGt, uShr, uDivMod} {
+			if err := BindOpcode(base-Cell(n), h)(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func uLt(i *Instance, op Cell) error {
+	rhs := uCell(i.Pop())
+	i.tos = flag(uCell(i.tos) < rhs)
+	return nil
+}
+
+func uGt(i *Instance, op Cell) error {
+	rhs := uCell(i.Pop())
+	i.tos = flag(uCell(i.tos) > rhs)
+	return nil
+}
+
+func uShr(i *Instance, op Cell) error {
+	rhs := i.Pop()
+	i.tos = Cell(uCell(i.tos) >> uint8(rhs))
+	return nil
+}
+
+func uDivMod(i *Instance, op Cell) error {
+	lhs, rhs := uCell(i.data[i.sp]), uCell(i.tos)
+	i.data[i.sp] = Cell(lhs % rhs)
+	i.tos = Cell(lhs / rhs)
+	return nil
+}
+
+// flag returns the Retro boolean value of b.
+func flag(b bool) Cell {
+	if b {
+		return -1
+	}
+	return 0
+}
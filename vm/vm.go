@@ -18,7 +18,10 @@ package vm
 
 import (
 	"io"
-	"os"
+	"io/fs"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -40,43 +43,208 @@ const (
 
 // Instance represents an Ngaro VM instance.
 type Instance struct {
-	PC        int    // Program Counter (aka. Instruction Pointer)
-	Mem       []Cell // Memory image
-	Ports     []Cell // I/O ports
-	tos       Cell   // cell on top of stack
-	sp        int
-	rsp       int
-	rtos      Cell
-	data      []Cell
-	address   []Cell
-	insCount  int64
+	PC       int    // Program Counter (aka. Instruction Pointer)
+	Mem      []Cell // Memory image
+	Ports    []Cell // I/O ports
+	tos      Cell   // cell on top of stack
+	sp       int
+	rsp      int
+	rtos     Cell
+	data     []Cell
+	address  []Cell
+	insCount int64
+	input    io.Reader
+	inMu     sync.Mutex    // guards input and the following fields
+	inGen    int           // incremented by PushInput and WriteInput
+	inWake   chan struct{} // closed to wake up a blocked reader
+	inBuf    []byte        // input pipe, see WriteInput
+	inClosed bool
+	fid      Cell
+	files    map[Cell]fs.File
+	ctl      control
+	bp       bitmap
+	bpPC     int
+	watch    map[Cell]watch
+	wpPC     int
+	waitPC   int // PC of the WAIT instruction RunToWait stopped at
+	toWait   bool
+	nFiles   int
+	outBytes int64
+	inBytes  int64
+	notes    notifier
+	wd       *watchdog
+	replies  replyQueue
+	sd       shutdown
+	atExit   []Cell // exit hooks
+	termSel  int    // selected output terminal
+	sched    *scheduler
+	auditLog []AuditEvent
+	auditOvf int // number of events dropped from a full audit log
+	timer    opTimer
+	runEnd   time.Time // end of the time budget of the current call to Run
+	epoch    time.Time // origin of the monotonic clock
+	unread   Cell      // byte read past an invalid UTF-8 sequence, -1 if none
+	stage    staging
+	config
+}
+
+// config holds the instance settings set by Options. It is saved by
+// SetOptions and restored if any option fails.
+type config struct {
 	inH       map[Cell]InHandler
 	outH      map[Cell]OutHandler
 	waitH     map[Cell]WaitHandler
 	sEnc      Codec
 	opHandler OpcodeHandler
 	imageFile string
-	input     io.Reader
 	output    Terminal
-	fid       Cell
-	files     map[Cell]*os.File
 	memDump   func(string, []Cell) error
 	tickMask  int64
 	tickFn    func(i *Instance)
+	ctlMask   int64
+	debug     bool
+	tracer    Tracer
+	limits    Limits
+	saveHook  SaveHook
+	journal   *journal
+	regions   map[string]Region
+	disabled  Device
+	fileRoot  string
+	fsys      fs.FS
+	waitPorts []Cell
+	clock     *fakeClock
+	rng       *rand.Rand
+	detMode   bool
+	insLimit  int64
+	growMax   int
+	mmio      []memRegion
+	memHook   bool
+	opTable   map[Cell]OpcodeHandler
+	syncPorts bool
+	callDepth int
+	rGrowMax  int
+	dGrowMax  int
+	wdWindow  time.Duration
+	wdFn      func(*Instance, *StuckError)
+	incPath   []string
+	incHook   IncludeHook
+	incFiles  map[string][]byte
+	env       map[string]string
+	eofPolicy EOFPolicy
+	utf8Out   bool
+	utf8In    bool
+	eofFn     func(*Instance) io.Reader
+	replyQ    bool
+	sdPort    Cell
+	sdGrace   time.Duration
+	args      []string
+	exitFn    func(*Instance) error
+	errFn     func(*Instance, error) Action
+	logger    Logger
+	audit     bool
+	auditOK   []Region
+	portRec   *PortRecorder
+	capture   *Capture
+	capPorts  []Cell
+	timeOps   bool
+	deadline  time.Duration
+	wrap32    bool
+	canvas    *Canvas
+	location  *time.Location
+	mouse     MouseProvider
+	termNames []string
+	terms     []Terminal
 }
 
-// An Option is a function for setting a VM Instance's options in New.
-//
-// Note that Option functions directly set instance parameters without going
-// through a delegate config structure, and since there is no locking mechanism
-// to access an Instance's fields, Option functions must only be used in a call
-// to New.
-//
-// The only exception is from a ticker function registered with Ticker where
-// the VM is actually paused during the call.
+// clone returns a copy of c that does not share any map or slice with c.
+func (c *config) clone() config {
+	n := *c
+	n.inH = make(map[Cell]InHandler, len(c.inH))
+	for k, v := range c.inH {
+		n.inH[k] = v
+	}
+	n.outH = make(map[Cell]OutHandler, len(c.outH))
+	for k, v := range c.outH {
+		n.outH[k] = v
+	}
+	n.waitH = make(map[Cell]WaitHandler, len(c.waitH))
+	for k, v := range c.waitH {
+		n.waitH[k] = v
+	}
+	if c.regions != nil {
+		n.regions = make(map[string]Region, len(c.regions))
+		for k, v := range c.regions {
+			n.regions[k] = v
+		}
+	}
+	if c.opTable != nil {
+		n.opTable = make(map[Cell]OpcodeHandler, len(c.opTable))
+		for k, v := range c.opTable {
+			n.opTable[k] = v
+		}
+	}
+	n.waitPorts = append([]Cell(nil), c.waitPorts...)
+	if c.mmio != nil {
+		n.mmio = append([]memRegion(nil), c.mmio...)
+	}
+	if c.terms != nil {
+		n.termNames = append([]string(nil), c.termNames...)
+		n.terms = append([]Terminal(nil), c.terms...)
+	}
+	if c.args != nil {
+		n.args = append([]string(nil), c.args...)
+	}
+	if c.capPorts != nil {
+		n.capPorts = append([]Cell(nil), c.capPorts...)
+	}
+	if c.auditOK != nil {
+		n.auditOK = append([]Region(nil), c.auditOK...)
+	}
+	if c.incPath != nil {
+		n.incPath = append([]string(nil), c.incPath...)
+	}
+	if c.incFiles != nil {
+		n.incFiles = make(map[string][]byte, len(c.incFiles))
+		for k, v := range c.incFiles {
+			n.incFiles[k] = v
+		}
+	}
+	if c.env != nil {
+		n.env = make(map[string]string, len(c.env))
+		for k, v := range c.env {
+			n.env[k] = v
+		}
+	}
+	return n
+}
+
+// staging holds the changes to the VM state requested by the options being
+// applied by SetOptions. They are committed once all options have been
+// successfully applied.
+type staging struct {
+	dataSize    int
+	addressSize int
+	inputs      []io.Reader
+	patches     []func(mem []Cell) error
+	registries  []registration
+}
+
+type registration struct {
+	r    *Registry
+	name string
+}
+
+// An Option is a function for setting a VM Instance's options in New or
+// SetOptions.
 //
-// There are plans to change this and use a delegate config structure.
+// Options are applied atomically: if any option fails, the instance
+// configuration is left unchanged. Options that change the VM state rather than
+// its configuration (DataSize, AddressSize, Input, PatchImage and Register) take
+// effect only once all options have been successfully applied, in the same way
+// in New and SetOptions.
 //
+// Option functions must only be applied with New or SetOptions. See SetOptions
+// for when an existing instance can be safely reconfigured.
 type Option func(*Instance) error
 
 // ClockLimiter returns a ticker function that sets the period between VM ticks.
@@ -125,6 +293,9 @@ func ClockLimiter(period, resolution time.Duration) (ticker func(i *Instance), t
 	var start time.Time
 
 	return func(i *Instance) {
+		if i.detMode {
+			return
+		}
 		if start.IsZero() {
 			start = time.Now()
 			return
@@ -143,6 +314,8 @@ func ClockLimiter(period, resolution time.Duration) (ticker func(i *Instance), t
 // The ticks parameter is rounded up to the nearest power of two.
 // If ticks <= 0, fn will never be called.
 //
+// fn can hand control back to the caller of Run by calling Instance.Yield.
+//
 // See ClockLimiter for an example use.
 //
 func Ticker(fn func(i *Instance), ticks int64) Option {
@@ -153,6 +326,7 @@ func Ticker(fn func(i *Instance), ticks int64) Option {
 		} else {
 			i.tickMask = -1
 		}
+		i.updateCtlMask()
 		return nil
 	}
 }
@@ -170,46 +344,49 @@ func nextPow2(n int64) int64 {
 }
 
 // DataSize sets the data stack size. It will not erase the stack, and will
-// panic if the requested size is not sufficient to hold the current stack. The
+// fail if the requested size is not sufficient to hold the current stack. The
 // default is 1024 cells.
 func DataSize(size int) Option {
 	return func(i *Instance) error {
 		if size < i.sp {
 			return errors.Errorf("requested stack size too small to hold current stack: %d < %d", size, i.sp)
 		}
-		size++
-		if size <= len(i.data) {
-			i.data = i.data[:size]
-		} else {
-			i.data = make([]Cell, size)
-			copy(i.address, i.data[:i.sp])
-		}
+		i.stage.dataSize = size
 		return nil
 	}
 }
 
 // AddressSize sets the address stack size. It will not erase the stack, and will
-// panic if the requested size is not sufficient to hold the current stack. The
+// fail if the requested size is not sufficient to hold the current stack. The
 // default is 1024 cells.
 func AddressSize(size int) Option {
 	return func(i *Instance) error {
 		if size < i.rsp {
 			return errors.Errorf("requested stack size too small to hold current stack: %d < %d", size, i.rsp)
 		}
-		size++
-		if size <= len(i.address) {
-			i.address = i.address[:size]
-		} else {
-			i.address = make([]Cell, size)
-			copy(i.address, i.address[:i.rsp])
-		}
+		i.stage.addressSize = size
+		i.callDepth = 0
 		return nil
 	}
 }
 
+// resizeStack resizes the stack s so that it can hold size cells.
+func resizeStack(s []Cell, size int) []Cell {
+	size++
+	if size <= cap(s) {
+		return s[:size]
+	}
+	ns := make([]Cell, size)
+	copy(ns, s)
+	return ns
+}
+
 // Input pushes the given io.Reader on top of the input stack.
 func Input(r io.Reader) Option {
-	return func(i *Instance) error { i.PushInput(r); return nil }
+	return func(i *Instance) error {
+		i.stage.inputs = append(i.stage.inputs, r)
+		return nil
+	}
 }
 
 // Output configures the output Terminal. For simple I/O, the helper function
@@ -233,6 +410,35 @@ func SaveMemImage(fn func(filename string, mem []Cell) error) Option {
 	return func(i *Instance) error { i.memDump = fn; return nil }
 }
 
+// SaveHook is the function prototype for image save hooks. See OnSave.
+type SaveHook func(i *Instance) (status Cell, err error)
+
+// OnSave sets a hook that will be called instead of the memory image dump
+// function when the VM requests an image save (by writing 1 to I/O port 4).
+//
+// The hook decides where and how to save the image (versioned snapshots,
+// object storage, etc.). It may call Instance.SaveImage to reuse the dump
+// function set with SaveMemImage. The returned status is written back to port
+// 4 as the result of the request: by convention, 0 means success. A non-nil
+// error aborts Run.
+func OnSave(hook SaveHook) Option {
+	return func(i *Instance) error { i.saveHook = hook; return nil }
+}
+
+// PatchImage calls fn with the instance's memory image so that hosts can apply
+// configuration values, feature flags or relocations into well known cells
+// without modifying the image file on disk.
+//
+// When used in New, fn is called after the memory image has been loaded and
+// before the VM runs. Any error returned by fn is returned by New (or
+// SetOptions), and the memory image is left unchanged.
+func PatchImage(fn func(mem []Cell) error) Option {
+	return func(i *Instance) error {
+		i.stage.patches = append(i.stage.patches, fn)
+		return nil
+	}
+}
+
 // InHandler is the function prototype for custom IN handlers.
 type InHandler func(i *Instance, port Cell) error
 
@@ -280,13 +486,26 @@ func BindOutHandler(port Cell, handler OutHandler) Option {
 //
 // Upon completion, a WAIT handler should call the WaitReply method which will
 // set the value of the bound port and set the value of port 0 to 1.
+//
+// WAIT handlers are called in port number order.
 func BindWaitHandler(port Cell, handler WaitHandler) Option {
 	return func(i *Instance) error {
-		i.waitH[port] = handler
+		i.bindWait(port, handler)
 		return nil
 	}
 }
 
+// bindWait binds a WAIT handler and keeps the list of bound ports sorted.
+func (i *Instance) bindWait(port Cell, h WaitHandler) {
+	if _, ok := i.waitH[port]; !ok {
+		n := sort.Search(len(i.waitPorts), func(n int) bool { return i.waitPorts[n] >= port })
+		i.waitPorts = append(i.waitPorts, 0)
+		copy(i.waitPorts[n+1:], i.waitPorts[n:])
+		i.waitPorts[n] = port
+	}
+	i.waitH[port] = h
+}
+
 // OpcodeHandler is the prototype for opcode handler functions. When an opcode
 // handler is called, the VM's PC points to the opcode. Opcode handlers must take
 // care of updating the VM's PC.
@@ -297,6 +516,9 @@ type OpcodeHandler func(i *Instance, opcode Cell) error
 //
 // When an opcode handler is called, the VM's PC points to the opcode. Opcode
 // handlers must take care of updating the VM's PC.
+//
+// Handlers bound to a specific opcode value with BindOpcode take precedence
+// over this handler.
 func BindOpcodeHandler(handler OpcodeHandler) Option {
 	return func(i *Instance) error {
 		i.opHandler = handler
@@ -304,6 +526,29 @@ func BindOpcodeHandler(handler OpcodeHandler) Option {
 	}
 }
 
+// BindOpcode binds the given function to handle the custom opcode op (op must
+// be negative). Opcodes bound with BindOpcode are dispatched directly, without
+// going through the catch-all handler set with BindOpcodeHandler. This makes it
+// easy to compose sets of custom opcodes implemented in different packages.
+//
+// A nil handler removes any handler bound to op.
+func BindOpcode(op Cell, handler OpcodeHandler) Option {
+	return func(i *Instance) error {
+		if op >= 0 {
+			return errors.Errorf("invalid custom opcode %d", op)
+		}
+		if handler == nil {
+			delete(i.opTable, op)
+			return nil
+		}
+		if i.opTable == nil {
+			i.opTable = make(map[Cell]OpcodeHandler)
+		}
+		i.opTable[op] = handler
+		return nil
+	}
+}
+
 // StringCodec delegates string encoding/decoding in the memory image to the
 // specified Codec. This is needed in file I/O where filenames are read from
 // memory. Clients that make use of these I/O calls must configure a
@@ -317,13 +562,63 @@ func StringCodec(e Codec) Option {
 	}
 }
 
-// SetOptions sets the provided options.
+// SetOptions sets the provided options. Options are applied atomically: if any
+// of them fails, the instance is left unchanged and the error is returned.
+//
+// An instance can be safely reconfigured when Run is not executing, while it is
+// paused with Pause, or from the goroutine running the VM (I/O handlers,
+// opcode handlers and ticker functions).
 func (i *Instance) SetOptions(opts ...Option) error {
+	c := &i.ctl
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	saved := i.config.clone()
+	i.stage = staging{}
+	defer func() { i.stage = staging{} }()
 	for _, opt := range opts {
 		if err := opt(i); err != nil {
+			i.config = saved
 			return err
 		}
 	}
+	if err := i.commit(); err != nil {
+		i.config = saved
+		return err
+	}
+	return nil
+}
+
+// commit applies the staged changes to the VM state.
+func (i *Instance) commit() error {
+	s := &i.stage
+	if len(s.patches) > 0 {
+		// patch a copy so that the image is left untouched on error
+		mem := append([]Cell(nil), i.Mem...)
+		for _, fn := range s.patches {
+			if err := fn(mem); err != nil {
+				return errors.Wrap(err, "image patch failed")
+			}
+		}
+		copy(i.Mem, mem)
+	}
+	if s.dataSize == 0 && i.data == nil {
+		s.dataSize = dataSize
+	}
+	if s.dataSize > 0 {
+		i.data = resizeStack(i.data, s.dataSize)
+	}
+	if s.addressSize == 0 && i.address == nil {
+		s.addressSize = addressSize
+	}
+	if s.addressSize > 0 {
+		i.address = resizeStack(i.address, s.addressSize)
+	}
+	for _, r := range s.inputs {
+		i.PushInput(r)
+	}
+	for _, reg := range s.registries {
+		reg.r.Add(i, reg.name)
+	}
 	return nil
 }
 
@@ -338,56 +633,125 @@ func (i *Instance) SetOptions(opts ...Option) error {
 // Options will be set by calling SetOptions.
 func New(mem []Cell, imageFile string, opts ...Option) (*Instance, error) {
 	i := &Instance{
-		PC:        0,
-		Mem:       mem,
-		Ports:     make([]Cell, portCount),
-		inH:       make(map[Cell]InHandler),
-		outH:      make(map[Cell]OutHandler),
-		waitH:     make(map[Cell]WaitHandler),
-		imageFile: imageFile,
-		files:     make(map[Cell]*os.File),
-		fid:       1,
-		memDump:   func(filename string, mem []Cell) error { return Save(filename, mem, 0) },
+		PC:     0,
+		Mem:    mem,
+		Ports:  make([]Cell, portCount),
+		files:  make(map[Cell]fs.File),
+		fid:    1,
+		bpPC:   -1,
+		wpPC:   -1,
+		waitPC: -1,
+		epoch:  time.Now(),
+		unread: -1,
+		config: config{
+			inH:       make(map[Cell]InHandler),
+			outH:      make(map[Cell]OutHandler),
+			waitH:     make(map[Cell]WaitHandler),
+			imageFile: imageFile,
+			memDump:   func(filename string, mem []Cell) error { return Save(filename, mem, 0) },
+			tickMask:  -1,
+			ctlMask:   ctlTicks - 1,
+			insLimit:  -1,
+		},
 	}
+	i.ctl.init()
 
 	// default Wait Handlers
-	for _, p := range []Cell{1, 2, 4, 5, 8} {
-		i.waitH[p] = (*Instance).Wait
+	for _, p := range []Cell{1, 2, 4, 5, 7, 8} {
+		i.bindWait(p, (*Instance).Wait)
 	}
 
 	if err := i.SetOptions(opts...); err != nil {
 		return nil, errors.Wrap(err, "SetOptions failed")
 	}
-	if i.data == nil {
-		i.SetOptions(DataSize(dataSize))
-	}
-	if i.address == nil {
-		i.SetOptions(AddressSize(addressSize))
-	}
 	return i, nil
 }
 
-// Data returns the data stack. Note that value changes will be reflected in the
-// instance's stack, but re-slicing will not affect it. To add/remove values on
-// the data stack, use the Push and Pop functions.
+// Data returns a copy of the data stack, bottom first. Changes to the returned
+// slice do not affect the instance's stack. To add/remove values on the data
+// stack, use the Push and Pop functions. Use StackAt to read individual values
+// without copying the whole stack.
 func (i *Instance) Data() []Cell {
-	if i.sp < 1 {
-		return nil
-	}
-	return append(i.data[2:i.sp+1], i.tos)
+	return stackSnapshot(i.data, i.sp, i.tos)
 }
 
-// Address returns the address stack. Note that value changes will be reflected
-// in the instance's stack, but re-slicing will not affect it. To add/remove
-// values on the address stack, use the Rpush and Rpop functions.
+// Address returns a copy of the address stack, bottom first. Changes to the
+// returned slice do not affect the instance's stack. To add/remove values on the
+// address stack, use the Rpush and Rpop functions.
 func (i *Instance) Address() []Cell {
-	if i.rsp < 1 {
+	return stackSnapshot(i.address, i.rsp, i.rtos)
+}
+
+// StackSnapshot returns copies of the data and address stacks, bottom first.
+func (i *Instance) StackSnapshot() (data, address []Cell) {
+	return i.Data(), i.Address()
+}
+
+// StackAt returns the n-th value from the top of the data stack, without
+// copying: StackAt(0) is the same as Tos and StackAt(1) the same as Nos. Like
+// Tos, it returns 0 if n is out of range.
+func (i *Instance) StackAt(n int) Cell {
+	switch {
+	case n < 0 || n >= i.sp:
+		return 0
+	case n == 0:
+		return i.tos
+	}
+	return i.data[i.sp-n+1]
+}
+
+// ImageFile returns the file name used to save the memory image, as set in
+// New.
+func (i *Instance) ImageFile() string {
+	return i.imageFile
+}
+
+// SaveImage saves the memory image to the given file using the dump function
+// set with SaveMemImage.
+func (i *Instance) SaveImage(filename string) error {
+	return i.memDump(filename, i.Mem)
+}
+
+// ReloadImage replaces the memory image with mem, for example to hot-swap a new
+// version of a program into a long running host process. Handlers, ports,
+// open files and the rest of the configuration are left untouched.
+//
+// If preserveStacks is true, the data and address stacks are left as is and
+// execution continues at the current PC in the new image. This only makes
+// sense if both images have a compatible layout. Otherwise, the stacks are
+// cleared and execution restarts at address 0.
+//
+// ReloadImage can be called from an I/O or opcode handler (execution continues
+// in the new image once the handler returns), while the VM is paused (see
+// Pause) or when Run is not executing, but not from a ticker function. It
+// returns a *LimitError if the new image exceeds the MaxMemCells limit.
+func (i *Instance) ReloadImage(mem []Cell, preserveStacks bool) error {
+	if err := i.checkMemLimit(len(mem)); err != nil {
+		return err
+	}
+	i.Mem = mem
+	i.bpPC, i.wpPC, i.waitPC = -1, -1, -1
+	i.atExit = nil
+	i.sched = nil
+	if preserveStacks {
 		return nil
 	}
-	return append(i.address[2:i.rsp+1], i.rtos)
+	i.sp, i.tos, i.rsp, i.rtos = 0, 0, 0, 0
+	c := &i.ctl
+	c.mu.Lock()
+	inHandler := c.running && !c.halted
+	c.mu.Unlock()
+	if inHandler {
+		// the PC is incremented when the handler returns
+		i.PC = -1
+	} else {
+		i.PC = 0
+	}
+	return nil
 }
 
-// InstructionCount returns the number of instructions executed so far.
+// InstructionCount returns the number of instructions executed so far. See
+// TimeInstructions for per opcode category counts and execution times.
 func (i *Instance) InstructionCount() int64 {
 	return i.insCount
 }
@@ -0,0 +1,73 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "time"
+
+// VSyncTicker returns a ticker function that synchronizes the VM with a frame
+// rate of fps frames per second, for example for canvas based games. Its return
+// values can be fed directly into Ticker.
+//
+// At each frame boundary, the ticker calls onFrame, if not nil, with the frame
+// number (starting at 1), typically to render the canvas, then posts a "frame
+// ready" event by sending the frame number to the given port with Notify,
+// unless port is 0 or the previous event has not been read yet. VM code can
+// then run its game loop at a stable frame rate by waiting for the event after
+// each frame: execute WAIT instructions until the port is not 0, then read the
+// frame number with IN.
+//
+// Frames are late by at most the time it takes for the VM to execute 1024
+// instructions. Should the VM fall behind by more than a frame, missed frames
+// are skipped.
+//
+// If clk is not nil, it is used to throttle the VM between frames so that a VM
+// waiting for the next frame does not eat up the CPU (see Clock.Ticker); the
+// clock frequency can still be controlled with its WaitHandler.
+func VSyncTicker(fps int, port Cell, clk *Clock, onFrame func(i *Instance, frame int64)) (ticker func(i *Instance), ticks int64) {
+	if fps <= 0 {
+		return nil, 0
+	}
+	period := time.Second / time.Duration(fps)
+	var (
+		next  time.Time
+		frame int64
+	)
+	return func(i *Instance) {
+		if clk != nil {
+			clk.tick(i)
+		}
+		now := i.now()
+		if next.IsZero() {
+			next = now.Add(period)
+			return
+		}
+		if now.Before(next) {
+			return
+		}
+		if next = next.Add(period); !now.Before(next) {
+			// more than a frame late, resync
+			next = now.Add(period)
+		}
+		frame++
+		if onFrame != nil {
+			onFrame(i, frame)
+		}
+		if port > 0 && int(port) < len(i.Ports) && i.port(port) == 0 {
+			i.Notify(port, Cell(frame))
+		}
+	}, clockTicks
+}
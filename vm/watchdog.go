@@ -0,0 +1,157 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StuckKind describes why a VM is deemed stuck by a watchdog.
+type StuckKind int
+
+// Stuck VM kinds.
+const (
+	// StuckBlocked means that no instruction has been executed during the
+	// watchdog window. The VM is typically blocked in a WAIT handler, like
+	// waiting for input.
+	StuckBlocked StuckKind = iota + 1
+	// StuckSpinning means that the VM executed instructions but no WAIT
+	// instruction during the watchdog window, like in an infinite loop.
+	StuckSpinning
+)
+
+func (k StuckKind) String() string {
+	switch k {
+	case StuckBlocked:
+		return "blocked"
+	case StuckSpinning:
+		return "spinning"
+	}
+	return "unknown"
+}
+
+// StuckError is reported by the watchdog set with the Watchdog option.
+type StuckError struct {
+	Kind   StuckKind
+	Window time.Duration
+	InWait bool // the VM was executing a WAIT instruction
+}
+
+func (e *StuckError) Error() string {
+	s := "vm stuck: "
+	if e.Kind == StuckBlocked {
+		s += "no progress"
+		if e.InWait {
+			s += " in WAIT"
+		}
+	} else {
+		s += "no I/O"
+	}
+	return s + " for " + e.Window.String()
+}
+
+// Watchdog sets up a watchdog that monitors the VM while Run is executing. If no
+// instruction is executed, or if no WAIT instruction is executed during the
+// given time window, the watchdog fires: it calls fn from its own goroutine
+// with a *StuckError describing the situation. fn will be called again for
+// each subsequent window during which the VM remains stuck.
+//
+// If fn is nil, the watchdog stops the VM and Run returns an error whose root
+// cause is the *StuckError. Note that a VM blocked in a WAIT handler only stops
+// once the handler returns.
+//
+// Paused VMs are not considered stuck. A window <= 0 disables the watchdog.
+func Watchdog(window time.Duration, fn func(i *Instance, err *StuckError)) Option {
+	return func(i *Instance) error {
+		i.wdWindow = window
+		i.wdFn = fn
+		return nil
+	}
+}
+
+// watchdog holds the state of a running watchdog.
+type watchdog struct {
+	ins    int64 // instruction count, accessed atomically
+	waits  int64 // WAIT instructions count, accessed atomically
+	inWait int32 // 1 while executing a WAIT, accessed atomically
+	done   chan struct{}
+	err    atomic.Value // *StuckError that stopped the VM
+}
+
+func (w *watchdog) enterWait() {
+	atomic.AddInt64(&w.waits, 1)
+	atomic.StoreInt32(&w.inWait, 1)
+}
+
+func (w *watchdog) leaveWait() {
+	atomic.StoreInt32(&w.inWait, 0)
+}
+
+// startWatchdog starts the watchdog goroutine.
+func (i *Instance) startWatchdog() *watchdog {
+	w := &watchdog{done: make(chan struct{})}
+	i.wd = w
+	go i.runWatchdog(w, i.wdWindow, i.wdFn)
+	return w
+}
+
+// stopWatchdog stops the watchdog goroutine. If the watchdog stopped the VM, it
+// replaces the ErrStopped error returned by Run with the watchdog error.
+func (i *Instance) stopWatchdog(w *watchdog, err error) error {
+	i.wd = nil
+	close(w.done)
+	if e, ok := w.err.Load().(*StuckError); ok && errors.Cause(err) == ErrStopped {
+		return errors.WithStack(e)
+	}
+	return err
+}
+
+func (i *Instance) runWatchdog(w *watchdog, window time.Duration, fn func(*Instance, *StuckError)) {
+	t := time.NewTicker(window)
+	defer t.Stop()
+	ins, waits := atomic.LoadInt64(&w.ins), atomic.LoadInt64(&w.waits)
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+		nIns, nWaits := atomic.LoadInt64(&w.ins), atomic.LoadInt64(&w.waits)
+		i.ctl.mu.Lock()
+		halted := i.ctl.halted
+		i.ctl.mu.Unlock()
+		if halted || nWaits != waits {
+			ins, waits = nIns, nWaits
+			continue
+		}
+		e := &StuckError{Kind: StuckSpinning, Window: window, InWait: atomic.LoadInt32(&w.inWait) != 0}
+		if nIns == ins {
+			e.Kind = StuckBlocked
+		}
+		ins = nIns
+		if fn != nil {
+			fn(i, e)
+			continue
+		}
+		w.err.Store(e)
+		i.Stop()
+		return
+	}
+}
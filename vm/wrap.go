@@ -0,0 +1,53 @@
+// This file is part of ngaro - https://github.com/db47h/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"github.com/pkg/errors"
+)
+
+// CellSize sets the width in bits of the cells as seen by running programs.
+// Supported values are 32 and CellBits.
+//
+// On 64 bits builds, CellSize(32) makes the arithmetic instructions (+, -, *,
+// /mod, <<, 1+ and 1-) wrap around exactly like they would on a 32 bits
+// build, and port 5 query -13 reports 32 bits cells. This allows running
+// programs that rely on 32 bits overflow semantics without a separate build.
+// The host is responsible for only feeding the VM values that fit in 32 bits
+// (memory image, Push, port values).
+func CellSize(bits int) Option {
+	return func(i *Instance) error {
+		if bits != 32 && bits != CellBits {
+			return errors.Errorf("%d bits cells not supported", bits)
+		}
+		i.wrap32 = bits != CellBits
+		return nil
+	}
+}
+
+// cellSize returns the width in bits of cells as seen by running programs.
+func (i *Instance) cellSize() Cell {
+	if i.wrap32 {
+		return 32
+	}
+	return CellBits
+}
+
+// wrap truncates v to 32 bits.
+func wrap(v Cell) Cell {
+	return Cell(int32(v))
+}